@@ -101,3 +101,15 @@ func ExecDb(ctx context.Context, db *sql.DB, query string, args ...interface{})
 
 	return result, nil
 }
+
+// Ping the database to check that it's still reachable.
+func PingDb(ctx context.Context, db *sql.DB) error {
+	logger := ctxlogger.GetLogger(ctx)
+	err := db.PingContext(ctx)
+	if err != nil {
+		logger.Error("Error pinging database: " + err.Error())
+		return err
+	}
+
+	return nil
+}
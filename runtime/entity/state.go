@@ -0,0 +1,37 @@
+package entity
+
+import "time"
+
+// ProvisioningState is the state of the entity as it's being created, updated or deleted.
+type ProvisioningState string
+
+const (
+	ProvisioningStateSucceeded ProvisioningState = "Succeeded"
+	ProvisioningStateFailed    ProvisioningState = "Failed"
+	ProvisioningStateCanceled  ProvisioningState = "Canceled"
+	ProvisioningStateCreating  ProvisioningState = "Creating"
+	ProvisioningStateUpdating  ProvisioningState = "Updating"
+	ProvisioningStateDeleting  ProvisioningState = "Deleting"
+)
+
+// Transitional states are the ones in which an operation is still modifying the entity.
+func (s ProvisioningState) IsTransitional() bool {
+	switch s {
+	case ProvisioningStateCreating, ProvisioningStateUpdating, ProvisioningStateDeleting:
+		return true
+	default:
+		return false
+	}
+}
+
+// VersionedEntity is an optional extension of the Entity. When the entity implements it, the
+// runtime guards against running operations on entities that are being deleted or that are
+// being modified by another operation.
+type VersionedEntity interface {
+	Entity
+	// ETag identifies the version of the entity, changing on every write.
+	GetETag() string
+	GetProvisioningState() ProvisioningState
+	GetLastModified() time.Time
+	IsSoftDeleted() bool
+}
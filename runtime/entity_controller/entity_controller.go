@@ -15,3 +15,23 @@ import (
 type EntityController interface {
 	GetEntity(context.Context, *operation.OperationRequest) (entity.Entity, *errors.AsyncError)
 }
+
+// RequestEntityFactoryFunc creates the entity using the whole OperationRequest, so it can rely on
+// the EntityType, EntityId or the Body of the request. It can be used instead of implementing a
+// full EntityController.
+type RequestEntityFactoryFunc func(context.Context, *operation.OperationRequest) (entity.Entity, error)
+
+var _ EntityController = RequestEntityFactoryFunc(nil)
+
+func (f RequestEntityFactoryFunc) GetEntity(ctx context.Context, req *operation.OperationRequest) (entity.Entity, *errors.AsyncError) {
+	e, err := f(ctx, req)
+	if err != nil {
+		return nil, &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Error creating the entity."},
+			Message:       err.Error(),
+			ErrorCode:     500,
+		}
+	}
+
+	return e, nil
+}
@@ -0,0 +1,17 @@
+package errors
+
+import (
+	"fmt"
+)
+
+// DeferError defers the message until another operation on the same entity completes, e.g. when
+// the entity hasn't recorded the operation yet because an earlier one is still running. If
+// BlockingOperationId is empty, any operation completing on the entity releases the message.
+type DeferError struct {
+	Message             string
+	BlockingOperationId string
+}
+
+func (e *DeferError) Error() string {
+	return fmt.Sprintf("DeferError: %s", e.Message)
+}
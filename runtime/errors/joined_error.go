@@ -0,0 +1,87 @@
+package errors
+
+import (
+	"fmt"
+	"strings"
+)
+
+// JoinedError preserves several errors, e.g. the error of an operation and the error of one of
+// its hooks. errors.Is and errors.As look into each one of them.
+type JoinedError struct {
+	Errors []error
+}
+
+func (e *JoinedError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("JoinedError: [%s]", strings.Join(messages, "; "))
+}
+
+func (e *JoinedError) Unwrap() []error {
+	return e.Errors
+}
+
+// Join returns an AsyncError holding both errors in a JoinedError, keeping the error code of the
+// first one and the longest RetryAfter. If one of them is nil, the other one is returned.
+func Join(first *AsyncError, second *AsyncError) *AsyncError {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+
+	retryAfter := first.RetryAfter
+	if second.RetryAfter > retryAfter {
+		retryAfter = second.RetryAfter
+	}
+	return &AsyncError{
+		OriginalError: &JoinedError{Errors: []error{first, second}},
+		Message:       first.Message + "; " + second.Message,
+		ErrorCode:     first.ErrorCode,
+		RetryAfter:    retryAfter,
+	}
+}
+
+// Classify returns the RetryError, NonRetryError or DeferError deciding how the error is handled,
+// looking through AsyncErrors and JoinedErrors. A NonRetryError wins over a RetryError, since
+// retrying won't fix it, and a RetryError wins over a DeferError, since nothing might release the
+// deferred message. Any other error is returned as is.
+func Classify(err error) error {
+	switch e := err.(type) {
+	case *NonRetryError, *RetryError, *DeferError:
+		return e
+	case *AsyncError:
+		if e.OriginalError == nil {
+			return e
+		}
+		return Classify(e.OriginalError)
+	case *JoinedError:
+		var retryErr, deferErr error
+		for _, joined := range e.Errors {
+			switch classified := Classify(joined).(type) {
+			case *NonRetryError:
+				return classified
+			case *RetryError:
+				if retryErr == nil {
+					retryErr = classified
+				}
+			case *DeferError:
+				if deferErr == nil {
+					deferErr = classified
+				}
+			}
+		}
+		if retryErr != nil {
+			return retryErr
+		}
+		if deferErr != nil {
+			return deferErr
+		}
+		return e
+	default:
+		return err
+	}
+}
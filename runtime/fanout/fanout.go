@@ -0,0 +1,376 @@
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/outbox"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/go-shuttle/v2"
+)
+
+const (
+	// Application property linking a child operation message with its parent operation.
+	ParentOperationIdProperty = "ParentOperationId"
+	// Application properties set on the continuation message with the aggregated results.
+	FailedChildrenCountProperty = "FailedChildrenCount"
+	FailedChildrenProperty      = "FailedChildren"
+)
+
+type ChildStatus string
+
+const (
+	ChildStatusPending   ChildStatus = "Pending"
+	ChildStatusSucceeded ChildStatus = "Succeeded"
+	ChildStatusFailed    ChildStatus = "Failed"
+)
+
+// ChildResult is the outcome of a child operation.
+type ChildResult struct {
+	OperationId string
+	Status      ChildStatus
+	Error       string
+}
+
+// Group keeps track of the children spawned by a parent operation.
+type Group struct {
+	ParentOperationId string
+	Children          map[string]*ChildResult
+	// Request sent once all the children reach a terminal state.
+	Continuation *operation.OperationRequest
+	// Set once all the children have been sent.
+	Spawned bool
+	// Set once the continuation has been sent.
+	Triggered bool
+}
+
+// Done returns true if all the children reached a terminal state.
+func (g *Group) Done() bool {
+	for _, child := range g.Children {
+		if child.Status == ChildStatusPending {
+			return false
+		}
+	}
+	return true
+}
+
+// Failures returns the results of the children that failed.
+func (g *Group) Failures() []*ChildResult {
+	failures := []*ChildResult{}
+	for _, child := range g.Children {
+		if child.Status == ChildStatusFailed {
+			failures = append(failures, child)
+		}
+	}
+	return failures
+}
+
+// Store keeps track of the groups of children, so the parent can be re-triggered once all of
+// them finish, regardless of which worker processes each child.
+type Store interface {
+	// CreateGroup creates the group unless the parent already has one. Returns the group of the
+	// parent and whether it was created.
+	CreateGroup(ctx context.Context, group *Group) (*Group, bool, error)
+	GetGroup(ctx context.Context, parentOperationId string) (*Group, error)
+	// CompleteChild records the terminal status of a child and returns the updated group.
+	CompleteChild(ctx context.Context, parentOperationId string, result *ChildResult) (*Group, error)
+	// MarkSpawned records that all the children of the group have been sent.
+	MarkSpawned(ctx context.Context, parentOperationId string) error
+	// MarkTriggered records that the continuation of the group has been sent.
+	MarkTriggered(ctx context.Context, parentOperationId string) error
+}
+
+type GroupNotFoundError struct {
+	ParentOperationId string
+}
+
+func (e *GroupNotFoundError) Error() string {
+	return fmt.Sprintf("No children found for parent operation %s.", e.ParentOperationId)
+}
+
+type ChildNotFoundError struct {
+	ParentOperationId string
+	OperationId       string
+}
+
+func (e *ChildNotFoundError) Error() string {
+	return fmt.Sprintf("Operation %s is not a child of operation %s.", e.OperationId, e.ParentOperationId)
+}
+
+var _ Store = &InMemoryStore{}
+
+// InMemoryStore keeps the groups in memory. Useful for testing or single instance workers.
+type InMemoryStore struct {
+	groups map[string]*Group
+	mu     sync.Mutex
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		groups: make(map[string]*Group),
+	}
+}
+
+func (s *InMemoryStore) CreateGroup(ctx context.Context, group *Group) (*Group, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.groups[group.ParentOperationId]; ok {
+		return copyGroup(existing), false, nil
+	}
+	s.groups[group.ParentOperationId] = copyGroup(group)
+	return copyGroup(group), true, nil
+}
+
+func (s *InMemoryStore) GetGroup(ctx context.Context, parentOperationId string) (*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[parentOperationId]
+	if !ok {
+		return nil, &GroupNotFoundError{ParentOperationId: parentOperationId}
+	}
+	return copyGroup(group), nil
+}
+
+func (s *InMemoryStore) CompleteChild(ctx context.Context, parentOperationId string, result *ChildResult) (*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[parentOperationId]
+	if !ok {
+		return nil, &GroupNotFoundError{ParentOperationId: parentOperationId}
+	}
+	if _, ok := group.Children[result.OperationId]; !ok {
+		return nil, &ChildNotFoundError{ParentOperationId: parentOperationId, OperationId: result.OperationId}
+	}
+
+	childResult := *result
+	group.Children[result.OperationId] = &childResult
+	return copyGroup(group), nil
+}
+
+func (s *InMemoryStore) MarkSpawned(ctx context.Context, parentOperationId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[parentOperationId]
+	if !ok {
+		return &GroupNotFoundError{ParentOperationId: parentOperationId}
+	}
+	group.Spawned = true
+	return nil
+}
+
+func (s *InMemoryStore) MarkTriggered(ctx context.Context, parentOperationId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[parentOperationId]
+	if !ok {
+		return &GroupNotFoundError{ParentOperationId: parentOperationId}
+	}
+	group.Triggered = true
+	return nil
+}
+
+func copyGroup(group *Group) *Group {
+	copied := *group
+	copied.Children = make(map[string]*ChildResult, len(group.Children))
+	for id, child := range group.Children {
+		childCopy := *child
+		copied.Children[id] = &childCopy
+	}
+	return &copied
+}
+
+// The Coordinator spawns the children of a parent operation and re-triggers the parent, or sends
+// a continuation operation, once all the children reach a terminal state. Continuations are sent
+// at least once, so the operations receiving them should guard against duplicates.
+type Coordinator struct {
+	Store      Store
+	Sender     sb.SenderInterface
+	Marshaller shuttle.Marshaller
+	// If set, the continuations are stored in the outbox before the group is marked as triggered,
+	// so the outbox dispatcher sends them if sending fails. Otherwise they are sent directly, and
+	// a continuation that can't be sent after the message of the last child was settled is lost.
+	Outbox *outbox.Outbox
+}
+
+func NewCoordinator(store Store, sender sb.SenderInterface, marshaller shuttle.Marshaller) *Coordinator {
+	if marshaller == nil {
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+	}
+
+	return &Coordinator{
+		Store:      store,
+		Sender:     sender,
+		Marshaller: marshaller,
+	}
+}
+
+// SpawnChildren enqueues the child operations linked to the parent. If no continuation is
+// provided, the parent request is sent again once all children finish. The children are spawned
+// once per parent: when the parent runs again, e.g. as its own continuation, the existing group is
+// kept and only the children that weren't sent by a failed attempt are sent.
+func (c *Coordinator) SpawnChildren(ctx context.Context, parent *operation.OperationRequest, children []*operation.OperationRequest, continuation *operation.OperationRequest) error {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if continuation == nil {
+		continuation = parent
+	}
+
+	group := &Group{
+		ParentOperationId: parent.OperationId,
+		Children:          make(map[string]*ChildResult, len(children)),
+		Continuation:      continuation,
+	}
+	for _, child := range children {
+		group.Children[child.OperationId] = &ChildResult{
+			OperationId: child.OperationId,
+			Status:      ChildStatusPending,
+		}
+	}
+
+	// The group is created before sending any child so that no completion is lost.
+	group, created, err := c.Store.CreateGroup(ctx, group)
+	if err != nil {
+		logger.Error("Coordinator: Error creating group: " + err.Error())
+		return err
+	}
+	if !created && group.Spawned {
+		logger.Info("Coordinator: Children of operation " + parent.OperationId + " already spawned.")
+		return nil
+	}
+
+	for _, child := range children {
+		// Children not tracked by the existing group, or already finished, aren't sent.
+		result, ok := group.Children[child.OperationId]
+		if !ok || result.Status != ChildStatusPending {
+			continue
+		}
+
+		message, err := c.Marshaller.Marshal(child)
+		if err != nil {
+			logger.Error("Coordinator: Error marshalling child operation: " + err.Error())
+			return err
+		}
+		message.ApplicationProperties = map[string]any{
+			ParentOperationIdProperty: parent.OperationId,
+		}
+
+		logger.Info("Coordinator: Sending child operation " + child.OperationId)
+		err = c.Sender.SendMessage(ctx, message)
+		if err != nil {
+			logger.Error("Coordinator: Error sending child operation: " + err.Error())
+			return err
+		}
+	}
+
+	return c.Store.MarkSpawned(ctx, parent.OperationId)
+}
+
+// CompleteChild records the terminal status of the child and, if it was the last child
+// pending, sends the continuation of the group.
+func (c *Coordinator) CompleteChild(ctx context.Context, parentOperationId string, result *ChildResult) error {
+	logger := ctxlogger.GetLogger(ctx)
+
+	group, err := c.Store.CompleteChild(ctx, parentOperationId, result)
+	if err != nil {
+		logger.Error("Coordinator: Error completing child: " + err.Error())
+		return err
+	}
+
+	if !group.Done() || group.Triggered {
+		return nil
+	}
+
+	logger.Info("Coordinator: All children of operation " + parentOperationId + " finished, sending continuation.")
+	message, err := c.Marshaller.Marshal(group.Continuation)
+	if err != nil {
+		logger.Error("Coordinator: Error marshalling continuation: " + err.Error())
+		return err
+	}
+
+	failures := group.Failures()
+	failedIds := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		failedIds = append(failedIds, failure.OperationId)
+	}
+	message.ApplicationProperties = map[string]any{
+		ParentOperationIdProperty:   parentOperationId,
+		FailedChildrenCountProperty: len(failures),
+		FailedChildrenProperty:      strings.Join(failedIds, ","),
+	}
+
+	if c.Outbox == nil {
+		err = c.Sender.SendMessage(ctx, message)
+		if err != nil {
+			logger.Error("Coordinator: Error sending continuation: " + err.Error())
+			return err
+		}
+
+		return c.Store.MarkTriggered(ctx, parentOperationId)
+	}
+
+	// The id of the entry is the same for every attempt, so the continuation is stored once.
+	id := parentOperationId + "-children-continuation"
+	message.MessageID = &id
+	entries := []*outbox.OutboxEntry{{
+		Id:                id,
+		SourceOperationId: parentOperationId,
+		Message:           message,
+		CreatedAt:         time.Now(),
+	}}
+	err = c.Outbox.Store.Add(ctx, entries)
+	if err != nil {
+		logger.Error("Coordinator: Error storing continuation: " + err.Error())
+		return err
+	}
+
+	err = c.Store.MarkTriggered(ctx, parentOperationId)
+	if err != nil {
+		return err
+	}
+
+	// The outbox dispatcher sends the continuation if it can't be sent now.
+	err = c.Outbox.Dispatch(ctx, entries)
+	if err != nil {
+		logger.Error("Coordinator: Error sending continuation, leaving it to the outbox: " + err.Error())
+	}
+	return nil
+}
+
+// AggregateError summarizes the failed children of a parent operation.
+type AggregateError struct {
+	ParentOperationId string
+	Failures          []*ChildResult
+}
+
+func (e *AggregateError) Error() string {
+	messages := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		messages = append(messages, failure.OperationId+": "+failure.Error)
+	}
+	return fmt.Sprintf("%d children of operation %s failed: %s", len(e.Failures), e.ParentOperationId, strings.Join(messages, "; "))
+}
+
+// GetAggregateError returns an AggregateError if any of the children of the parent failed, to be
+// used by the parent or the continuation to report the failures.
+func (c *Coordinator) GetAggregateError(ctx context.Context, parentOperationId string) (*AggregateError, error) {
+	group, err := c.Store.GetGroup(ctx, parentOperationId)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := group.Failures()
+	if len(failures) == 0 {
+		return nil, nil
+	}
+	return &AggregateError{ParentOperationId: parentOperationId, Failures: failures}, nil
+}
@@ -0,0 +1,204 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/outbox"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestFanout(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fanout Suite")
+}
+
+// Fails to send the messages until it's enabled.
+type toggleSender struct {
+	sb.SenderInterface
+	enabled bool
+}
+
+func (s *toggleSender) SendMessage(ctx context.Context, message *azservicebus.Message) error {
+	if !s.enabled {
+		return errors.New("send failed")
+	}
+	return s.SenderInterface.SendMessage(ctx, message)
+}
+
+var _ = Describe("Coordinator", func() {
+	var (
+		ctx         context.Context
+		client      *sb.FakeServiceBusClient
+		receiver    sb.ReceiverInterface
+		marshaller  shuttle.Marshaller
+		coordinator *Coordinator
+		parent      *operation.OperationRequest
+		children    []*operation.OperationRequest
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = sb.NewFakeServiceBusClient()
+		sender, _ := client.NewServiceBusSender(ctx, "operations", nil)
+		receiver, _ = client.NewServiceBusReceiver(ctx, "operations", nil)
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+		coordinator = NewCoordinator(NewInMemoryStore(), sender, marshaller)
+
+		parent = &operation.OperationRequest{OperationName: "UpgradeCluster", OperationId: "parent"}
+		children = []*operation.OperationRequest{
+			{OperationName: "UpgradeNodePool", OperationId: "child-1"},
+			{OperationName: "UpgradeNodePool", OperationId: "child-2"},
+		}
+	})
+
+	It("should send the children linked to the parent", func() {
+		err := coordinator.SpawnChildren(ctx, parent, children, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(2))
+		for i, message := range messages {
+			Expect(message.ApplicationProperties[ParentOperationIdProperty]).To(Equal("parent"))
+			var body operation.OperationRequest
+			Expect(marshaller.Unmarshal(message.Message(), &body)).To(Succeed())
+			Expect(body.OperationId).To(Equal(children[i].OperationId))
+		}
+	})
+
+	It("should re-trigger the parent once all children finish", func() {
+		Expect(coordinator.SpawnChildren(ctx, parent, children, nil)).To(Succeed())
+		_, _ = receiver.ReceiveMessage(ctx, 10, nil)
+
+		err := coordinator.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-1", Status: ChildStatusSucceeded})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).To(HaveOccurred())
+
+		err = coordinator.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-2", Status: ChildStatusFailed, Error: "boom"})
+		Expect(err).ToNot(HaveOccurred())
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		Expect(messages[0].ApplicationProperties[FailedChildrenCountProperty]).To(Equal(1))
+		Expect(messages[0].ApplicationProperties[FailedChildrenProperty]).To(Equal("child-2"))
+
+		var body operation.OperationRequest
+		Expect(marshaller.Unmarshal(messages[0].Message(), &body)).To(Succeed())
+		Expect(body.OperationId).To(Equal("parent"))
+
+		aggregateErr, err := coordinator.GetAggregateError(ctx, "parent")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aggregateErr.Failures).To(HaveLen(1))
+		Expect(aggregateErr.Error()).To(ContainSubstring("child-2: boom"))
+	})
+
+	It("should send the continuation only once", func() {
+		continuation := &operation.OperationRequest{OperationName: "ValidateCluster", OperationId: "continuation"}
+		Expect(coordinator.SpawnChildren(ctx, parent, children[:1], continuation)).To(Succeed())
+		_, _ = receiver.ReceiveMessage(ctx, 10, nil)
+
+		result := &ChildResult{OperationId: "child-1", Status: ChildStatusSucceeded}
+		Expect(coordinator.CompleteChild(ctx, "parent", result)).To(Succeed())
+		Expect(coordinator.CompleteChild(ctx, "parent", result)).To(Succeed())
+
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		var body operation.OperationRequest
+		Expect(marshaller.Unmarshal(messages[0].Message(), &body)).To(Succeed())
+		Expect(body.OperationId).To(Equal("continuation"))
+	})
+
+	It("should fail for unknown children", func() {
+		Expect(coordinator.SpawnChildren(ctx, parent, children, nil)).To(Succeed())
+		err := coordinator.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-3", Status: ChildStatusSucceeded})
+		var childErr *ChildNotFoundError
+		Expect(errors.As(err, &childErr)).To(BeTrue())
+
+		err = coordinator.CompleteChild(ctx, "other", &ChildResult{OperationId: "child-1", Status: ChildStatusSucceeded})
+		var groupErr *GroupNotFoundError
+		Expect(errors.As(err, &groupErr)).To(BeTrue())
+	})
+
+	It("should not respawn the children when the parent runs again", func() {
+		Expect(coordinator.SpawnChildren(ctx, parent, children, nil)).To(Succeed())
+		_, _ = receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(coordinator.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-1", Status: ChildStatusSucceeded})).To(Succeed())
+		Expect(coordinator.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-2", Status: ChildStatusSucceeded})).To(Succeed())
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+
+		// The continuation re-runs the parent, which spawns its children again.
+		Expect(coordinator.SpawnChildren(ctx, parent, children, nil)).To(Succeed())
+		_, err = receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).To(HaveOccurred())
+
+		group, err := coordinator.Store.GetGroup(ctx, "parent")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(group.Done()).To(BeTrue())
+		Expect(group.Triggered).To(BeTrue())
+	})
+
+	It("should send the pending children if a previous attempt failed", func() {
+		store := NewInMemoryStore()
+		_, created, err := store.CreateGroup(ctx, &Group{
+			ParentOperationId: "parent",
+			Children: map[string]*ChildResult{
+				"child-1": {OperationId: "child-1", Status: ChildStatusSucceeded},
+				"child-2": {OperationId: "child-2", Status: ChildStatusPending},
+			},
+			Continuation: parent,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(created).To(BeTrue())
+		coordinator.Store = store
+
+		Expect(coordinator.SpawnChildren(ctx, parent, children, nil)).To(Succeed())
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		var body operation.OperationRequest
+		Expect(marshaller.Unmarshal(messages[0].Message(), &body)).To(Succeed())
+		Expect(body.OperationId).To(Equal("child-2"))
+
+		group, err := store.GetGroup(ctx, "parent")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(group.Spawned).To(BeTrue())
+	})
+
+	It("should leave the continuation to the outbox if it can't be sent", func() {
+		sender, _ := client.NewServiceBusSender(ctx, "operations", nil)
+		outboxSender := &toggleSender{SenderInterface: sender}
+		coordinator.Outbox = outbox.NewOutbox(outbox.NewInMemoryStore(), outboxSender, marshaller)
+
+		Expect(coordinator.SpawnChildren(ctx, parent, children[:1], nil)).To(Succeed())
+		_, _ = receiver.ReceiveMessage(ctx, 10, nil)
+
+		Expect(coordinator.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-1", Status: ChildStatusSucceeded})).To(Succeed())
+		_, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).To(HaveOccurred())
+
+		group, err := coordinator.Store.GetGroup(ctx, "parent")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(group.Triggered).To(BeTrue())
+
+		outboxSender.enabled = true
+		Expect(coordinator.Outbox.DispatchPending(ctx, 0)).To(Succeed())
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		Expect(messages[0].ApplicationProperties[ParentOperationIdProperty]).To(Equal("parent"))
+		var body operation.OperationRequest
+		Expect(marshaller.Unmarshal(messages[0].Message(), &body)).To(Succeed())
+		Expect(body.OperationId).To(Equal("parent"))
+	})
+})
@@ -0,0 +1,192 @@
+package fanout
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/aks-async/database"
+	"github.com/Azure/aks-async/runtime/operation"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var _ Store = &SqlStore{}
+
+// SqlStore keeps the groups in two SQL Server tables with the following schema:
+//
+//	CREATE TABLE FanoutGroups (
+//		ParentOperationId NVARCHAR(255) NOT NULL PRIMARY KEY,
+//		Continuation NVARCHAR(MAX) NOT NULL,
+//		Spawned BIT NOT NULL,
+//		Triggered BIT NOT NULL
+//	)
+//
+//	CREATE TABLE FanoutChildren (
+//		ParentOperationId NVARCHAR(255) NOT NULL,
+//		OperationId NVARCHAR(255) NOT NULL,
+//		Status NVARCHAR(32) NOT NULL,
+//		Error NVARCHAR(MAX) NOT NULL,
+//		PRIMARY KEY (ParentOperationId, OperationId)
+//	)
+//
+// The continuations are stored as JSON. A group and its children are created in a single
+// transaction. The table names are not parametrized in the queries, so they must come from trusted
+// configuration.
+type SqlStore struct {
+	db            *sql.DB
+	groupsTable   string
+	childrenTable string
+}
+
+func NewSqlStore(db *sql.DB, groupsTable string, childrenTable string) *SqlStore {
+	return &SqlStore{
+		db:            db,
+		groupsTable:   groupsTable,
+		childrenTable: childrenTable,
+	}
+}
+
+func (s *SqlStore) CreateGroup(ctx context.Context, group *Group) (*Group, bool, error) {
+	continuation, err := protojson.Marshal(group.Continuation)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`MERGE %s WITH (HOLDLOCK) AS target
+USING (SELECT @p1 AS ParentOperationId) AS source
+ON target.ParentOperationId = source.ParentOperationId
+WHEN NOT MATCHED THEN INSERT (ParentOperationId, Continuation, Spawned, Triggered) VALUES (@p1, @p2, @p3, @p4);`, s.groupsTable)
+	result, err := tx.ExecContext(ctx, query, group.ParentOperationId, string(continuation), group.Spawned, group.Triggered)
+	if err != nil {
+		return nil, false, err
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The parent already has a group.
+	if created == 0 {
+		err = tx.Commit()
+		if err != nil {
+			return nil, false, err
+		}
+		existing, err := s.GetGroup(ctx, group.ParentOperationId)
+		return existing, false, err
+	}
+
+	query = fmt.Sprintf("INSERT INTO %s (ParentOperationId, OperationId, Status, Error) VALUES (@p1, @p2, @p3, @p4)", s.childrenTable)
+	for _, child := range group.Children {
+		_, err = tx.ExecContext(ctx, query, group.ParentOperationId, child.OperationId, string(child.Status), child.Error)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, false, err
+	}
+	return copyGroup(group), true, nil
+}
+
+func (s *SqlStore) GetGroup(ctx context.Context, parentOperationId string) (*Group, error) {
+	query := fmt.Sprintf("SELECT Continuation, Spawned, Triggered FROM %s WHERE ParentOperationId = @p1", s.groupsTable)
+	rows, err := database.QueryDb(ctx, s.db, query, parentOperationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, &GroupNotFoundError{ParentOperationId: parentOperationId}
+	}
+
+	group := &Group{
+		ParentOperationId: parentOperationId,
+		Children:          make(map[string]*ChildResult),
+		Continuation:      &operation.OperationRequest{},
+	}
+	var continuation string
+	err = rows.Scan(&continuation, &group.Spawned, &group.Triggered)
+	if err != nil {
+		return nil, err
+	}
+	err = protojson.Unmarshal([]byte(continuation), group.Continuation)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	query = fmt.Sprintf("SELECT OperationId, Status, Error FROM %s WHERE ParentOperationId = @p1", s.childrenTable)
+	rows, err = database.QueryDb(ctx, s.db, query, parentOperationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		child := &ChildResult{}
+		var status string
+		err = rows.Scan(&child.OperationId, &status, &child.Error)
+		if err != nil {
+			return nil, err
+		}
+		child.Status = ChildStatus(status)
+		group.Children[child.OperationId] = child
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+func (s *SqlStore) CompleteChild(ctx context.Context, parentOperationId string, result *ChildResult) (*Group, error) {
+	query := fmt.Sprintf("UPDATE %s SET Status = @p3, Error = @p4 WHERE ParentOperationId = @p1 AND OperationId = @p2", s.childrenTable)
+	_, err := database.ExecDb(ctx, s.db, query, parentOperationId, result.OperationId, string(result.Status), result.Error)
+
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		// Report whether the group or only the child is missing.
+		_, err = s.GetGroup(ctx, parentOperationId)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &ChildNotFoundError{ParentOperationId: parentOperationId, OperationId: result.OperationId}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetGroup(ctx, parentOperationId)
+}
+
+func (s *SqlStore) MarkSpawned(ctx context.Context, parentOperationId string) error {
+	return s.mark(ctx, parentOperationId, "Spawned")
+}
+
+func (s *SqlStore) MarkTriggered(ctx context.Context, parentOperationId string) error {
+	return s.mark(ctx, parentOperationId, "Triggered")
+}
+
+func (s *SqlStore) mark(ctx context.Context, parentOperationId string, column string) error {
+	query := fmt.Sprintf("UPDATE %s SET %s = 1 WHERE ParentOperationId = @p1", s.groupsTable, column)
+	_, err := database.ExecDb(ctx, s.db, query, parentOperationId)
+
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return &GroupNotFoundError{ParentOperationId: parentOperationId}
+	}
+	return err
+}
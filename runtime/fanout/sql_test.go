@@ -0,0 +1,143 @@
+package fanout
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var _ = Describe("SqlStore", func() {
+	var (
+		ctx          context.Context
+		db           *sql.DB
+		mock         sqlmock.Sqlmock
+		store        *SqlStore
+		group        *Group
+		continuation string
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		db, mock, err = sqlmock.New()
+		Expect(err).ToNot(HaveOccurred())
+		store = NewSqlStore(db, "FanoutGroups", "FanoutChildren")
+
+		group = &Group{
+			ParentOperationId: "parent",
+			Children: map[string]*ChildResult{
+				"child-1": {OperationId: "child-1", Status: ChildStatusPending},
+			},
+			Continuation: &operation.OperationRequest{OperationName: "UpgradeCluster", OperationId: "parent"},
+		}
+		marshalled, err := protojson.Marshal(group.Continuation)
+		Expect(err).ToNot(HaveOccurred())
+		continuation = string(marshalled)
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		db.Close()
+	})
+
+	expectGetGroup := func(status ChildStatus) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT Continuation, Spawned, Triggered FROM FanoutGroups WHERE ParentOperationId = @p1")).
+			WithArgs("parent").
+			WillReturnRows(sqlmock.NewRows([]string{"Continuation", "Spawned", "Triggered"}).AddRow(continuation, true, false))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT OperationId, Status, Error FROM FanoutChildren WHERE ParentOperationId = @p1")).
+			WithArgs("parent").
+			WillReturnRows(sqlmock.NewRows([]string{"OperationId", "Status", "Error"}).AddRow("child-1", string(status), ""))
+	}
+
+	It("should create the group and its children in a transaction", func() {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("MERGE FanoutGroups WITH (HOLDLOCK)")).
+			WithArgs("parent", continuation, false, false).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO FanoutChildren (ParentOperationId, OperationId, Status, Error)")).
+			WithArgs("parent", "child-1", string(ChildStatusPending), "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		created, ok, err := store.CreateGroup(ctx, group)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(created.Children).To(HaveKey("child-1"))
+	})
+
+	It("should return the existing group", func() {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("MERGE FanoutGroups WITH (HOLDLOCK)")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+		expectGetGroup(ChildStatusSucceeded)
+
+		existing, ok, err := store.CreateGroup(ctx, group)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeFalse())
+		Expect(existing.Spawned).To(BeTrue())
+		Expect(existing.Continuation.OperationName).To(Equal("UpgradeCluster"))
+		Expect(existing.Children["child-1"].Status).To(Equal(ChildStatusSucceeded))
+	})
+
+	It("should roll back the group if a child can't be created", func() {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("MERGE FanoutGroups WITH (HOLDLOCK)")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO FanoutChildren")).
+			WillReturnError(errors.New("insert failed"))
+		mock.ExpectRollback()
+
+		_, _, err := store.CreateGroup(ctx, group)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should complete the child and return the updated group", func() {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE FanoutChildren SET Status = @p3, Error = @p4 WHERE ParentOperationId = @p1 AND OperationId = @p2")).
+			WithArgs("parent", "child-1", string(ChildStatusSucceeded), "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectGetGroup(ChildStatusSucceeded)
+
+		updated, err := store.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-1", Status: ChildStatusSucceeded})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(updated.Done()).To(BeTrue())
+	})
+
+	It("should fail for unknown children and groups", func() {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE FanoutChildren")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		expectGetGroup(ChildStatusPending)
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE FanoutChildren")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT Continuation, Spawned, Triggered FROM FanoutGroups")).
+			WillReturnRows(sqlmock.NewRows([]string{"Continuation", "Spawned", "Triggered"}))
+
+		_, err := store.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-2", Status: ChildStatusSucceeded})
+		var childErr *ChildNotFoundError
+		Expect(errors.As(err, &childErr)).To(BeTrue())
+
+		_, err = store.CompleteChild(ctx, "parent", &ChildResult{OperationId: "child-1", Status: ChildStatusSucceeded})
+		var groupErr *GroupNotFoundError
+		Expect(errors.As(err, &groupErr)).To(BeTrue())
+	})
+
+	It("should mark the group as spawned and triggered", func() {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE FanoutGroups SET Spawned = 1 WHERE ParentOperationId = @p1")).
+			WithArgs("parent").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE FanoutGroups SET Triggered = 1 WHERE ParentOperationId = @p1")).
+			WithArgs("other").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		Expect(store.MarkSpawned(ctx, "parent")).To(Succeed())
+		var groupErr *GroupNotFoundError
+		Expect(errors.As(store.MarkTriggered(ctx, "other"), &groupErr)).To(BeTrue())
+	})
+})
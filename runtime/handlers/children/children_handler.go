@@ -0,0 +1,95 @@
+package children
+
+import (
+	"context"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/fanout"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+)
+
+// Handler that records the terminal state of child operations in the coordinator, which will
+// re-trigger the parent operation once all of its children have finished. Messages without a
+// parent operation are not modified.
+func NewChildCompletionHandler(coordinator *fanout.Coordinator, errHandler errorHandlers.ErrorHandlerFunc, marshaller shuttle.Marshaller) errorHandlers.ErrorHandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
+		logger := ctxlogger.GetLogger(ctx)
+
+		if marshaller == nil {
+			marshaller = &shuttle.DefaultProtoMarshaller{}
+		}
+
+		recorder := errorHandlers.NewSettlementRecorder(settler)
+		asyncErr := errHandler.Handle(ctx, recorder, message)
+
+		parentOperationId, ok := message.ApplicationProperties[fanout.ParentOperationIdProperty].(string)
+		if !ok || parentOperationId == "" {
+			return asyncErr
+		}
+
+		status, terminal := childStatus(recorder, asyncErr)
+		if !terminal {
+			// The child will be retried, so it hasn't reached a terminal state yet.
+			return asyncErr
+		}
+		result := &fanout.ChildResult{
+			Status: status,
+		}
+		if status == fanout.ChildStatusFailed && asyncErr != nil {
+			result.Error = asyncErr.Error()
+		}
+
+		var body operation.OperationRequest
+		err := marshaller.Unmarshal(message.Message(), &body)
+		if err != nil {
+			logger.Error("ChildCompletionHandler: Error unmarshalling message: " + err.Error())
+			return asyncErr
+		}
+		result.OperationId = body.OperationId
+
+		logger.Info("ChildCompletionHandler: Completing child " + body.OperationId + " of operation " + parentOperationId)
+		err = coordinator.CompleteChild(ctx, parentOperationId, result)
+		if err != nil {
+			errorMessage := "ChildCompletionHandler: Error completing child operation: " + err.Error()
+			logger.Error(errorMessage)
+			if asyncErr == nil {
+				return &errors.AsyncError{
+					OriginalError: err,
+					Message:       errorMessage,
+					ErrorCode:     500,
+				}
+			}
+		}
+
+		return asyncErr
+	}
+}
+
+// The settlement of the message decides whether the child reached a terminal state, since the
+// handlers can return an error after settling it, e.g. if the operation status update fails. If
+// the message wasn't settled, the result of the handlers is used instead.
+func childStatus(recorder *errorHandlers.SettlementRecorder, asyncErr *errors.AsyncError) (fanout.ChildStatus, bool) {
+	if action, settled := recorder.Settlement(); settled {
+		switch action {
+		case hooks.SettleActionComplete:
+			return fanout.ChildStatusSucceeded, true
+		case hooks.SettleActionDeadLetter:
+			return fanout.ChildStatusFailed, true
+		default:
+			return fanout.ChildStatusPending, false
+		}
+	}
+
+	if asyncErr == nil {
+		return fanout.ChildStatusSucceeded, true
+	}
+	if _, ok := errors.Classify(asyncErr.OriginalError).(*errors.NonRetryError); ok {
+		return fanout.ChildStatusFailed, true
+	}
+	return fanout.ChildStatusPending, false
+}
@@ -0,0 +1,131 @@
+package children
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/fanout"
+	"github.com/Azure/aks-async/runtime/operation"
+	sampleErrorHandler "github.com/Azure/aks-async/runtime/testutils/error_handler"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestChildCompletionHandler(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ChildCompletionHandler Suite")
+}
+
+var _ = Describe("ChildCompletionHandler", func() {
+	var (
+		ctx           context.Context
+		buf           bytes.Buffer
+		sampleSettler shuttle.MessageSettler
+		message       *azservicebus.ReceivedMessage
+		marshaller    shuttle.Marshaller
+		store         *fanout.InMemoryStore
+		coordinator   *fanout.Coordinator
+	)
+
+	BeforeEach(func() {
+		buf.Reset()
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		ctx = ctxlogger.WithLogger(context.TODO(), logger)
+
+		client := sb.NewFakeServiceBusClient()
+		sender, _ := client.NewServiceBusSender(ctx, "operations", nil)
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+		store = fanout.NewInMemoryStore()
+		coordinator = fanout.NewCoordinator(store, sender, marshaller)
+
+		parent := &operation.OperationRequest{OperationName: "UpgradeCluster", OperationId: "parent"}
+		child := &operation.OperationRequest{OperationName: "UpgradeNodePool", OperationId: "child"}
+		Expect(coordinator.SpawnChildren(ctx, parent, []*operation.OperationRequest{child}, nil)).To(Succeed())
+
+		sampleSettler = &settler.SampleMessageSettler{}
+		marshalledMessage, err := marshaller.Marshal(child)
+		Expect(err).ToNot(HaveOccurred())
+		marshalledMessage.ApplicationProperties = map[string]any{fanout.ParentOperationIdProperty: "parent"}
+		message = convert.ConvertToReceivedMessage(marshalledMessage)
+	})
+
+	It("should complete the child when it succeeds", func() {
+		handler := NewChildCompletionHandler(coordinator, sampleErrorHandler.SampleErrorHandler(nil), marshaller)
+		err := handler(ctx, sampleSettler, message)
+		Expect(err).To(BeNil())
+
+		group, getErr := store.GetGroup(ctx, "parent")
+		Expect(getErr).ToNot(HaveOccurred())
+		Expect(group.Children["child"].Status).To(Equal(fanout.ChildStatusSucceeded))
+		Expect(group.Triggered).To(BeTrue())
+	})
+
+	It("should complete the child as failed after a NonRetryError", func() {
+		handler := NewChildCompletionHandler(coordinator, sampleErrorHandler.SampleErrorHandler(&asyncErrors.NonRetryError{Message: "boom"}), marshaller)
+		err := handler(ctx, sampleSettler, message)
+		Expect(err).ToNot(BeNil())
+
+		group, getErr := store.GetGroup(ctx, "parent")
+		Expect(getErr).ToNot(HaveOccurred())
+		Expect(group.Children["child"].Status).To(Equal(fanout.ChildStatusFailed))
+	})
+
+	It("should not complete the child after a RetryError", func() {
+		handler := NewChildCompletionHandler(coordinator, sampleErrorHandler.SampleErrorHandler(&asyncErrors.RetryError{Message: "retry"}), marshaller)
+		err := handler(ctx, sampleSettler, message)
+		Expect(err).ToNot(BeNil())
+
+		group, getErr := store.GetGroup(ctx, "parent")
+		Expect(getErr).ToNot(HaveOccurred())
+		Expect(group.Children["child"].Status).To(Equal(fanout.ChildStatusPending))
+	})
+
+	It("should ignore messages without a parent", func() {
+		message.ApplicationProperties = nil
+		handler := NewChildCompletionHandler(coordinator, sampleErrorHandler.SampleErrorHandler(nil), marshaller)
+		err := handler(ctx, sampleSettler, message)
+		Expect(err).To(BeNil())
+
+		group, getErr := store.GetGroup(ctx, "parent")
+		Expect(getErr).ToNot(HaveOccurred())
+		Expect(group.Children["child"].Status).To(Equal(fanout.ChildStatusPending))
+	})
+
+	It("should complete the child when the message is completed but the handler fails afterwards", func() {
+		inner := func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			Expect(settler.CompleteMessage(ctx, message, nil)).To(Succeed())
+			return &asyncErrors.AsyncError{OriginalError: errors.New("operation container unavailable"), ErrorCode: 500}
+		}
+		handler := NewChildCompletionHandler(coordinator, inner, marshaller)
+		err := handler(ctx, sampleSettler, message)
+		Expect(err).ToNot(BeNil())
+
+		group, getErr := store.GetGroup(ctx, "parent")
+		Expect(getErr).ToNot(HaveOccurred())
+		Expect(group.Children["child"].Status).To(Equal(fanout.ChildStatusSucceeded))
+		Expect(group.Triggered).To(BeTrue())
+	})
+
+	It("should not complete the child when the message is abandoned", func() {
+		inner := func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			Expect(settler.AbandonMessage(ctx, message, nil)).To(Succeed())
+			return nil
+		}
+		handler := NewChildCompletionHandler(coordinator, inner, marshaller)
+		Expect(handler(ctx, sampleSettler, message)).To(BeNil())
+
+		group, getErr := store.GetGroup(ctx, "parent")
+		Expect(getErr).ToNot(HaveOccurred())
+		Expect(group.Children["child"].Status).To(Equal(fanout.ChildStatusPending))
+	})
+})
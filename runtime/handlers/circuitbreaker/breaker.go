@@ -0,0 +1,271 @@
+package circuitbreaker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State of the circuit of an operation type.
+type State string
+
+const (
+	// Operations run normally while the failures are counted.
+	StateClosed State = "Closed"
+	// Operations are rejected until the cool-down ends.
+	StateOpen State = "Open"
+	// A limited number of probe operations run to decide whether to close the circuit again.
+	StateHalfOpen State = "HalfOpen"
+)
+
+const (
+	DefaultMinRequests    = 10
+	DefaultFailureRatio   = 0.5
+	DefaultWindow         = time.Minute
+	DefaultCoolDown       = 30 * time.Second
+	DefaultHalfOpenProbes = 1
+)
+
+// Settings of the circuits. Zero values are replaced by the defaults.
+type Settings struct {
+	// Minimum number of results in the window before the circuit can open.
+	MinRequests int
+	// Ratio of failures in the window that opens the circuit.
+	FailureRatio float64
+	// The results are counted over this window while the circuit is closed.
+	Window time.Duration
+	// Time the circuit stays open before probing.
+	CoolDown time.Duration
+	// Number of operations allowed to run at the same time while half-open. The circuit closes
+	// once they all succeed.
+	HalfOpenProbes int
+}
+
+// Observer is notified every time a circuit changes state.
+type Observer interface {
+	OnStateChange(ctx context.Context, operationName string, from State, to State)
+}
+
+type ObserverFunc func(ctx context.Context, operationName string, from State, to State)
+
+func (f ObserverFunc) OnStateChange(ctx context.Context, operationName string, from State, to State) {
+	f(ctx, operationName, from, to)
+}
+
+// MetricsRecorder records the activity of the circuits, e.g. as prometheus counters and gauges.
+type MetricsRecorder interface {
+	RecordResult(operationName string, success bool)
+	RecordRejected(operationName string)
+	RecordState(operationName string, state State)
+}
+
+type circuit struct {
+	state       State
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+// Breaker keeps a circuit per operation name.
+type Breaker struct {
+	Settings  Settings
+	Observers []Observer
+	Metrics   MetricsRecorder
+
+	circuits map[string]*circuit
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+func NewBreaker(settings *Settings) *Breaker {
+	b := &Breaker{
+		circuits: make(map[string]*circuit),
+		now:      time.Now,
+	}
+	if settings != nil {
+		b.Settings = *settings
+	}
+	if b.Settings.MinRequests <= 0 {
+		b.Settings.MinRequests = DefaultMinRequests
+	}
+	if b.Settings.FailureRatio <= 0 {
+		b.Settings.FailureRatio = DefaultFailureRatio
+	}
+	if b.Settings.Window <= 0 {
+		b.Settings.Window = DefaultWindow
+	}
+	if b.Settings.CoolDown <= 0 {
+		b.Settings.CoolDown = DefaultCoolDown
+	}
+	if b.Settings.HalfOpenProbes <= 0 {
+		b.Settings.HalfOpenProbes = DefaultHalfOpenProbes
+	}
+	return b
+}
+
+// Returns whether the operation can run, and if not, how long until the circuit is probed again.
+// Every allowed operation must be followed by a call to Record.
+func (b *Breaker) Allow(ctx context.Context, operationName string) (bool, time.Duration) {
+	allowed, retryAfter, change := b.allow(operationName)
+
+	b.notify(ctx, operationName, change)
+	if !allowed && b.Metrics != nil {
+		b.Metrics.RecordRejected(operationName)
+	}
+	return allowed, retryAfter
+}
+
+func (b *Breaker) allow(operationName string) (bool, time.Duration, *stateChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	c := b.getCircuit(operationName, now)
+
+	var change *stateChange
+	if c.state == StateOpen {
+		remaining := c.openedAt.Add(b.Settings.CoolDown).Sub(now)
+		if remaining > 0 {
+			return false, remaining, nil
+		}
+		change = b.setState(c, StateHalfOpen, now)
+	}
+
+	if c.state == StateHalfOpen {
+		if c.probes+c.successes >= b.Settings.HalfOpenProbes {
+			return false, b.Settings.CoolDown, change
+		}
+		c.probes++
+	}
+
+	return true, 0, change
+}
+
+// Records the result of an operation allowed to run.
+func (b *Breaker) Record(ctx context.Context, operationName string, success bool) {
+	change := b.record(operationName, success)
+
+	if b.Metrics != nil {
+		b.Metrics.RecordResult(operationName, success)
+	}
+	b.notify(ctx, operationName, change)
+}
+
+func (b *Breaker) record(operationName string, success bool) *stateChange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	c := b.getCircuit(operationName, now)
+
+	switch c.state {
+	case StateHalfOpen:
+		if c.probes > 0 {
+			c.probes--
+		}
+		if !success {
+			return b.setState(c, StateOpen, now)
+		}
+		c.successes++
+		if c.successes >= b.Settings.HalfOpenProbes {
+			return b.setState(c, StateClosed, now)
+		}
+	case StateClosed:
+		c.requests++
+		if !success {
+			c.failures++
+		}
+		if c.requests >= b.Settings.MinRequests && float64(c.failures)/float64(c.requests) >= b.Settings.FailureRatio {
+			return b.setState(c, StateOpen, now)
+		}
+	}
+	return nil
+}
+
+// Returns the state of the circuit of the operation.
+func (b *Breaker) State(operationName string) State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[operationName]
+	if !ok {
+		return StateClosed
+	}
+	return c.state
+}
+
+// Returns the names of the operations whose circuit isn't closed, sorted.
+func (b *Breaker) OpenCircuits() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := []string{}
+	for name, c := range b.circuits {
+		if c.state != StateClosed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Must be called while holding the lock.
+func (b *Breaker) getCircuit(operationName string, now time.Time) *circuit {
+	if b.circuits == nil {
+		b.circuits = make(map[string]*circuit)
+	}
+
+	c, ok := b.circuits[operationName]
+	if !ok {
+		c = &circuit{state: StateClosed, windowStart: now}
+		b.circuits[operationName] = c
+	}
+
+	if c.state == StateClosed && now.Sub(c.windowStart) >= b.Settings.Window {
+		c.windowStart = now
+		c.requests = 0
+		c.failures = 0
+	}
+	return c
+}
+
+type stateChange struct {
+	from State
+	to   State
+}
+
+// Must be called while holding the lock. The change is notified once the lock is released, so
+// the observers can call the breaker.
+func (b *Breaker) setState(c *circuit, state State, now time.Time) *stateChange {
+	from := c.state
+	c.state = state
+	c.probes = 0
+	c.successes = 0
+	switch state {
+	case StateOpen:
+		c.openedAt = now
+	case StateClosed:
+		c.windowStart = now
+		c.requests = 0
+		c.failures = 0
+	}
+	return &stateChange{from: from, to: state}
+}
+
+// Must be called without holding the lock.
+func (b *Breaker) notify(ctx context.Context, operationName string, change *stateChange) {
+	if change == nil {
+		return
+	}
+
+	if b.Metrics != nil {
+		b.Metrics.RecordState(operationName, change.to)
+	}
+	for _, observer := range b.Observers {
+		observer.OnStateChange(ctx, operationName, change.from, change.to)
+	}
+}
@@ -0,0 +1,85 @@
+package circuitbreaker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+// Handler that rejects the operations whose circuit is open. Rejected messages are rescheduled
+// using the sender, so they aren't redelivered before the circuit may close. Without a sender the
+// circuit is never opened. Operations failing with a NonRetryError or deferred are counted as
+// successes, since they failed because of the request and not because of a dependency. Since it
+// settles the rejected messages itself, it must be placed outside of the error handlers, and calls
+// the settlement hooks itself.
+func NewCircuitBreakerHandler(breaker *Breaker, errHandler errorHandlers.ErrorHandlerFunc, marshaller shuttle.Marshaller, sender sb.SenderInterface, settlementHooks []hooks.SettlementHooks) errorHandlers.ErrorHandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
+		logger := ctxlogger.GetLogger(ctx)
+
+		if sender == nil {
+			logger.Error("CircuitBreakerHandler: No sender received, the circuit isn't checked.")
+			return errHandler.Handle(ctx, settler, message)
+		}
+
+		if marshaller == nil {
+			marshaller = &shuttle.DefaultProtoMarshaller{}
+		}
+
+		var body operation.OperationRequest
+		err := marshaller.Unmarshal(message.Message(), &body)
+		if err != nil {
+			logger.Error("CircuitBreakerHandler: Error unmarshalling message: " + err.Error())
+			return errHandler.Handle(ctx, settler, message)
+		}
+
+		allowed, retryAfter := breaker.Allow(ctx, body.OperationName)
+		if allowed {
+			// Count a panic as a failure, so a half-open circuit isn't left waiting for its probe.
+			success := false
+			defer func() {
+				breaker.Record(ctx, body.OperationName, success)
+			}()
+
+			asyncErr := errHandler.Handle(ctx, settler, message)
+			success = asyncErr == nil
+			if asyncErr != nil {
+				switch errors.Classify(asyncErr.OriginalError).(type) {
+				case *errors.NonRetryError, *errors.DeferError:
+					success = true
+				}
+			}
+			return asyncErr
+		}
+
+		errorMessage := fmt.Sprintf("CircuitBreakerHandler: Circuit of %s is open, retrying operation %s in %s.", body.OperationName, body.OperationId, retryAfter)
+		logger.Info(errorMessage)
+
+		asyncErr := &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Circuit open."},
+			Message:       errorMessage,
+			ErrorCode:     503,
+			RetryAfter:    retryAfter,
+		}
+
+		err = errorHandlers.RescheduleMessageWithHooks(ctx, settler, sender, message, retryAfter, asyncErr, settlementHooks)
+		if err != nil {
+			logger.Error("CircuitBreakerHandler: Error rescheduling rejected message: " + err.Error())
+			return &errors.AsyncError{
+				OriginalError: err,
+				Message:       err.Error(),
+				ErrorCode:     500,
+			}
+		}
+
+		return asyncErr
+	}
+}
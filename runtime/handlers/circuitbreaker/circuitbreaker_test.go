@@ -0,0 +1,225 @@
+package circuitbreaker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+	sampleErrorHandler "github.com/Azure/aks-async/runtime/testutils/error_handler"
+	sampleHooks "github.com/Azure/aks-async/runtime/testutils/hooks"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CircuitBreaker Suite")
+}
+
+// Records the state changes and metrics of the breaker.
+type recorder struct {
+	transitions []string
+	results     int
+	rejected    int
+}
+
+func (r *recorder) OnStateChange(ctx context.Context, operationName string, from State, to State) {
+	r.transitions = append(r.transitions, operationName+":"+string(from)+"->"+string(to))
+}
+
+func (r *recorder) RecordResult(operationName string, success bool) { r.results++ }
+func (r *recorder) RecordRejected(operationName string)             { r.rejected++ }
+func (r *recorder) RecordState(operationName string, state State)   {}
+
+var _ = Describe("Breaker", func() {
+	var (
+		ctx      context.Context
+		now      time.Time
+		breaker  *Breaker
+		observer *recorder
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now = time.Now()
+		observer = &recorder{}
+		breaker = NewBreaker(&Settings{MinRequests: 4, FailureRatio: 0.5, CoolDown: 10 * time.Second})
+		breaker.now = func() time.Time { return now }
+		breaker.Observers = []Observer{observer}
+		breaker.Metrics = observer
+	})
+
+	fail := func(name string, times int) {
+		for i := 0; i < times; i++ {
+			allowed, _ := breaker.Allow(ctx, name)
+			Expect(allowed).To(BeTrue())
+			breaker.Record(ctx, name, false)
+		}
+	}
+
+	It("should open once the failure ratio is reached", func() {
+		fail("Upgrade", 3)
+		Expect(breaker.State("Upgrade")).To(Equal(StateClosed))
+		fail("Upgrade", 1)
+		Expect(breaker.State("Upgrade")).To(Equal(StateOpen))
+
+		allowed, retryAfter := breaker.Allow(ctx, "Upgrade")
+		Expect(allowed).To(BeFalse())
+		Expect(retryAfter).To(Equal(10 * time.Second))
+		Expect(observer.rejected).To(Equal(1))
+
+		// Other operations aren't affected.
+		allowed, _ = breaker.Allow(ctx, "Create")
+		Expect(allowed).To(BeTrue())
+		Expect(breaker.OpenCircuits()).To(Equal([]string{"Upgrade"}))
+	})
+
+	It("should reset the counts every window", func() {
+		fail("Upgrade", 3)
+		now = now.Add(DefaultWindow)
+		fail("Upgrade", 3)
+		Expect(breaker.State("Upgrade")).To(Equal(StateClosed))
+	})
+
+	It("should close after a successful probe", func() {
+		fail("Upgrade", 4)
+		now = now.Add(10 * time.Second)
+
+		allowed, _ := breaker.Allow(ctx, "Upgrade")
+		Expect(allowed).To(BeTrue())
+		Expect(breaker.State("Upgrade")).To(Equal(StateHalfOpen))
+
+		// Only one probe runs at a time.
+		allowed, _ = breaker.Allow(ctx, "Upgrade")
+		Expect(allowed).To(BeFalse())
+
+		breaker.Record(ctx, "Upgrade", true)
+		Expect(breaker.State("Upgrade")).To(Equal(StateClosed))
+		Expect(observer.transitions).To(Equal([]string{
+			"Upgrade:Closed->Open",
+			"Upgrade:Open->HalfOpen",
+			"Upgrade:HalfOpen->Closed",
+		}))
+	})
+
+	It("should open again after a failed probe", func() {
+		fail("Upgrade", 4)
+		now = now.Add(10 * time.Second)
+		fail("Upgrade", 1)
+		Expect(breaker.State("Upgrade")).To(Equal(StateOpen))
+
+		allowed, retryAfter := breaker.Allow(ctx, "Upgrade")
+		Expect(allowed).To(BeFalse())
+		Expect(retryAfter).To(Equal(10 * time.Second))
+	})
+
+	It("should let the observers call the breaker", func() {
+		states := []State{}
+		breaker.Observers = append(breaker.Observers, ObserverFunc(func(ctx context.Context, operationName string, from State, to State) {
+			states = append(states, breaker.State(operationName))
+			Expect(breaker.OpenCircuits()).ToNot(BeNil())
+		}))
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			fail("Upgrade", 4)
+			now = now.Add(10 * time.Second)
+			allowed, _ := breaker.Allow(ctx, "Upgrade")
+			Expect(allowed).To(BeTrue())
+		}()
+		Eventually(done).Should(BeClosed())
+		Expect(states).To(Equal([]State{StateOpen, StateHalfOpen}))
+	})
+})
+
+var _ = Describe("CircuitBreakerHandler", func() {
+	var (
+		ctx           context.Context
+		buf           bytes.Buffer
+		sampleSettler shuttle.MessageSettler
+		message       *azservicebus.ReceivedMessage
+		marshaller    shuttle.Marshaller
+		breaker       *Breaker
+		handler       errorHandlers.ErrorHandlerFunc
+		sender        sb.SenderInterface
+		receiver      sb.ReceiverInterface
+	)
+
+	BeforeEach(func() {
+		buf.Reset()
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		ctx = ctxlogger.WithLogger(context.TODO(), logger)
+		sampleSettler = &settler.SampleMessageSettler{}
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+
+		req := &operation.OperationRequest{OperationName: "Upgrade", OperationId: "0", EntityType: "Cluster", EntityId: "1"}
+		marshalledMessage, err := marshaller.Marshal(req)
+		Expect(err).ToNot(HaveOccurred())
+		message = convert.ConvertToReceivedMessage(marshalledMessage)
+
+		breaker = NewBreaker(&Settings{MinRequests: 1})
+		now := time.Now()
+		breaker.now = func() time.Time { return now }
+
+		client := sb.NewFakeServiceBusClient()
+		sender, _ = client.NewServiceBusSender(ctx, "operations", nil)
+		receiver, _ = client.NewServiceBusReceiver(ctx, "operations", nil)
+	})
+
+	It("should not count NonRetryErrors as failures", func() {
+		handler = NewCircuitBreakerHandler(breaker, sampleErrorHandler.SampleErrorHandler(&asyncErrors.NonRetryError{Message: "bad request"}), marshaller, sender, nil)
+		Expect(handler(ctx, sampleSettler, message)).ToNot(BeNil())
+		Expect(breaker.State("Upgrade")).To(Equal(StateClosed))
+	})
+
+	It("should not check the circuit without a sender", func() {
+		handler = NewCircuitBreakerHandler(breaker, sampleErrorHandler.SampleErrorHandler(&asyncErrors.RetryError{Message: "dependency down"}), marshaller, nil, nil)
+		Expect(handler(ctx, sampleSettler, message)).ToNot(BeNil())
+		Expect(breaker.State("Upgrade")).To(Equal(StateClosed))
+		Expect(buf.String()).To(ContainSubstring("No sender received"))
+	})
+
+	It("should reschedule the messages while the circuit is open", func() {
+		settlementHooks := &sampleHooks.SampleSettlementHooks{}
+		handler = NewCircuitBreakerHandler(breaker, sampleErrorHandler.SampleErrorHandler(&asyncErrors.RetryError{Message: "dependency down"}), marshaller, sender, []hooks.SettlementHooks{settlementHooks})
+		Expect(handler(ctx, sampleSettler, message)).ToNot(BeNil())
+		Expect(breaker.State("Upgrade")).To(Equal(StateOpen))
+
+		asyncErr := handler(ctx, sampleSettler, message)
+		Expect(asyncErr).ToNot(BeNil())
+		Expect(asyncErr.ErrorCode).To(Equal(503))
+		Expect(asyncErr.RetryAfter).To(Equal(DefaultCoolDown))
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		Expect(*messages[0].ScheduledEnqueueTime).To(BeTemporally(">", time.Now()))
+		Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Complete", "AfterSettle:Complete", "OnRetryScheduled"}))
+	})
+
+	It("should count a panic as a failure", func() {
+		panicHandler := func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			panic("boom")
+		}
+		handler = NewCircuitBreakerHandler(breaker, panicHandler, marshaller, sender, nil)
+		Expect(func() { handler(ctx, sampleSettler, message) }).To(Panic())
+		Expect(breaker.State("Upgrade")).To(Equal(StateOpen))
+	})
+})
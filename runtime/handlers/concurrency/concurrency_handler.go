@@ -0,0 +1,57 @@
+package concurrency
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/handlers/lockrenewal"
+)
+
+// Handler that waits for the controller to allow the operation to run, and reports its latency
+// and result. Operations failing with a NonRetryError or deferred aren't counted as failures,
+// since they failed because of the request. The processor must allow at least the maximum of the
+// controller, and the handler must run inside the lock renewal so the waiting messages keep
+// their lock. The wait isn't counted towards the maximum lock duration. If the context is done
+// while waiting, a RetryError is returned so the error handlers abandon the message.
+func NewConcurrencyHandler(controller *Controller, errHandler errorHandlers.ErrorHandlerFunc) errorHandlers.ErrorHandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
+		logger := ctxlogger.GetLogger(ctx)
+
+		// The wait isn't counted towards the maximum lock duration of the operation.
+		err := lockrenewal.ExcludeFromMaxDuration(ctx, func() error {
+			return controller.Acquire(ctx)
+		})
+		if err != nil {
+			errorMessage := "ConcurrencyHandler: Stopped waiting to run the operation: " + err.Error()
+			logger.Info(errorMessage)
+			// The error handlers abandon the message.
+			return &errors.AsyncError{
+				OriginalError: &errors.RetryError{Message: err.Error()},
+				Message:       errorMessage,
+				ErrorCode:     503,
+			}
+		}
+
+		start := time.Now()
+		failed := true
+		defer func() {
+			controller.Release(time.Since(start), failed)
+		}()
+
+		asyncErr := errHandler.Handle(ctx, settler, message)
+		failed = asyncErr != nil
+		if asyncErr != nil {
+			switch errors.Classify(asyncErr.OriginalError).(type) {
+			case *errors.NonRetryError, *errors.DeferError:
+				failed = false
+			}
+		}
+		return asyncErr
+	}
+}
@@ -0,0 +1,177 @@
+package concurrency
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/handlers/lockrenewal"
+	"github.com/Azure/aks-async/runtime/matcher"
+	sampleErrorHandler "github.com/Azure/aks-async/runtime/testutils/error_handler"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestConcurrency(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Concurrency Suite")
+}
+
+var _ = Describe("Controller", func() {
+	var (
+		ctx        context.Context
+		controller *Controller
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		controller = NewController(&Settings{Min: 1, Max: 4, Initial: 2, TargetLatency: time.Second})
+	})
+
+	run := func(count int, latency time.Duration, failed bool) {
+		for i := 0; i < count; i++ {
+			Expect(controller.Acquire(ctx)).To(Succeed())
+			controller.Release(latency, failed)
+		}
+	}
+
+	It("should increase the limit while saturated", func() {
+		Expect(controller.Acquire(ctx)).To(Succeed())
+		Expect(controller.Acquire(ctx)).To(Succeed())
+		controller.Adjust(ctx)
+		Expect(controller.Limit()).To(Equal(3))
+
+		// Not saturated anymore.
+		controller.Release(time.Millisecond, false)
+		controller.Release(time.Millisecond, false)
+		controller.Adjust(ctx)
+		Expect(controller.Limit()).To(Equal(3))
+	})
+
+	It("should only increase the limit if there is a backlog", func() {
+		depth := int64(0)
+		controller.Settings.QueueDepth = func(ctx context.Context) (int64, error) { return depth, nil }
+		Expect(controller.Acquire(ctx)).To(Succeed())
+		Expect(controller.Acquire(ctx)).To(Succeed())
+		controller.Adjust(ctx)
+		Expect(controller.Limit()).To(Equal(2))
+
+		depth = 10
+		controller.Adjust(ctx)
+		Expect(controller.Limit()).To(Equal(3))
+		Expect(controller.Stats().QueueDepth).To(Equal(int64(10)))
+	})
+
+	It("should decrease the limit on errors", func() {
+		controller = NewController(&Settings{Min: 1, Max: 8, Initial: 8})
+		run(4, time.Millisecond, true)
+		controller.Adjust(ctx)
+		Expect(controller.Limit()).To(Equal(4))
+		Expect(controller.Stats().LastReason).To(ContainSubstring("error rate"))
+	})
+
+	It("should decrease the limit on high latency down to the minimum", func() {
+		for i := 0; i < 3; i++ {
+			run(1, 2*time.Second, false)
+			controller.Adjust(ctx)
+		}
+		Expect(controller.Limit()).To(Equal(1))
+	})
+
+	It("should wait for a slot", func() {
+		controller.SetOverride(1)
+		Expect(controller.Acquire(ctx)).To(Succeed())
+
+		acquired := make(chan error, 1)
+		go func() {
+			acquired <- controller.Acquire(ctx)
+		}()
+		Consistently(acquired, 50*time.Millisecond).ShouldNot(Receive())
+
+		controller.Release(time.Millisecond, false)
+		Eventually(acquired).Should(Receive(BeNil()))
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		Expect(controller.Acquire(timeoutCtx)).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("should apply the override within the bounds", func() {
+		controller.SetOverride(10)
+		Expect(controller.Limit()).To(Equal(4))
+		controller.SetOverride(0)
+		Expect(controller.Limit()).To(Equal(2))
+	})
+
+	It("should set the processor concurrency to the maximum", func() {
+		options := &shuttle.ProcessorOptions{MaxConcurrency: 1, StartMaxAttempt: 3}
+		Expect(controller.ProcessorOptions(options)).To(Equal(&shuttle.ProcessorOptions{MaxConcurrency: 4, StartMaxAttempt: 3}))
+		Expect(options.MaxConcurrency).To(Equal(1))
+	})
+})
+
+var _ = Describe("ConcurrencyHandler", func() {
+	var (
+		ctx        context.Context
+		buf        bytes.Buffer
+		controller *Controller
+		message    *azservicebus.ReceivedMessage
+	)
+
+	BeforeEach(func() {
+		buf.Reset()
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		ctx = ctxlogger.WithLogger(context.TODO(), logger)
+		controller = NewController(&Settings{Min: 1, Max: 1})
+		message = &azservicebus.ReceivedMessage{}
+	})
+
+	It("should count retryable errors as failures", func() {
+		handler := NewConcurrencyHandler(controller, sampleErrorHandler.SampleErrorHandler(&asyncErrors.RetryError{Message: "retry"}))
+		Expect(handler(ctx, &settler.SampleMessageSettler{}, message)).ToNot(BeNil())
+		handler = NewConcurrencyHandler(controller, sampleErrorHandler.SampleErrorHandler(&asyncErrors.NonRetryError{Message: "bad request"}))
+		Expect(handler(ctx, &settler.SampleMessageSettler{}, message)).ToNot(BeNil())
+
+		controller.Adjust(ctx)
+		stats := controller.Stats()
+		Expect(stats.Completed).To(Equal(2))
+		Expect(stats.Failed).To(Equal(1))
+		Expect(stats.InFlight).To(Equal(0))
+	})
+
+	It("should return a RetryError if the context is done while waiting", func() {
+		Expect(controller.Acquire(ctx)).To(Succeed())
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		handler := NewConcurrencyHandler(controller, sampleErrorHandler.SampleErrorHandler(nil))
+		recorder := errorHandlers.NewSettlementRecorder(&settler.SampleMessageSettler{})
+		asyncErr := handler(cancelledCtx, recorder, message)
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+
+		// The error handlers settle the message.
+		_, settled := recorder.Settlement()
+		Expect(settled).To(BeFalse())
+	})
+
+	It("should not count the wait towards the maximum lock duration", func() {
+		Expect(controller.Acquire(ctx)).To(Succeed())
+		go func() {
+			time.Sleep(80 * time.Millisecond)
+			controller.Release(time.Millisecond, false)
+		}()
+
+		handler := lockrenewal.NewLockRenewalHandler(nil, &matcher.LockRenewalPolicy{Interval: time.Hour, MaxDuration: 40 * time.Millisecond}, NewConcurrencyHandler(controller, sampleErrorHandler.SampleErrorHandler(nil)), nil)
+		Expect(handler(ctx, &settler.SampleMessageSettler{}, message)).To(BeNil())
+	})
+})
@@ -0,0 +1,268 @@
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/go-shuttle/v2"
+)
+
+const (
+	DefaultAdjustInterval = 10 * time.Second
+	DefaultMaxErrorRate   = 0.2
+	DefaultDecreaseFactor = 0.5
+)
+
+// Returns the number of messages waiting in the queue, e.g. from the service bus admin client.
+type QueueDepthFunc func(ctx context.Context) (int64, error)
+
+type Settings struct {
+	// Bounds of the concurrency limit. Min defaults to 1 and Max to Min.
+	Min int
+	Max int
+	// Limit before the first adjustment. Defaults to Min.
+	Initial int
+	// Time between adjustments.
+	AdjustInterval time.Duration
+	// The limit decreases if the average latency of the operations goes over it. Not checked if not set.
+	TargetLatency time.Duration
+	// The limit decreases if the ratio of operations failing with a retryable error goes over it.
+	MaxErrorRate float64
+	// Factor applied to the limit when decreasing it.
+	DecreaseFactor float64
+	// If set, the limit only increases while there are more messages waiting than the limit.
+	QueueDepth QueueDepthFunc
+}
+
+// Stats of the last adjustment window.
+type Stats struct {
+	Limit       int
+	Override    int
+	InFlight    int
+	Completed   int
+	Failed      int
+	AvgLatency  time.Duration
+	QueueDepth  int64
+	Saturated   bool
+	LastAdjust  time.Time
+	LastReason  string
+	Adjustments int
+}
+
+// Controller adapts the number of operations handled at the same time with AIMD: the limit
+// increases by one every interval while the handlers are saturated, healthy and there is a
+// backlog, and decreases by DecreaseFactor when the latency or the error rate are too high.
+type Controller struct {
+	Settings Settings
+
+	limit     int
+	override  int
+	inFlight  int
+	saturated bool
+	completed int
+	failed    int
+	latency   time.Duration
+	// Closed and replaced every time a slot frees up or the limit changes.
+	changed chan struct{}
+	stats   Stats
+	mu      sync.Mutex
+}
+
+func NewController(settings *Settings) *Controller {
+	c := &Controller{
+		changed: make(chan struct{}),
+	}
+	if settings != nil {
+		c.Settings = *settings
+	}
+	if c.Settings.Min <= 0 {
+		c.Settings.Min = 1
+	}
+	if c.Settings.Max < c.Settings.Min {
+		c.Settings.Max = c.Settings.Min
+	}
+	if c.Settings.AdjustInterval <= 0 {
+		c.Settings.AdjustInterval = DefaultAdjustInterval
+	}
+	if c.Settings.MaxErrorRate <= 0 {
+		c.Settings.MaxErrorRate = DefaultMaxErrorRate
+	}
+	if c.Settings.DecreaseFactor <= 0 || c.Settings.DecreaseFactor >= 1 {
+		c.Settings.DecreaseFactor = DefaultDecreaseFactor
+	}
+	c.limit = c.clamp(c.Settings.Initial)
+	return c
+}
+
+// Returns the options of a processor able to run up to Max handlers, based on the given options.
+func (c *Controller) ProcessorOptions(options *shuttle.ProcessorOptions) *shuttle.ProcessorOptions {
+	result := shuttle.ProcessorOptions{StartMaxAttempt: 5}
+	if options != nil {
+		result = *options
+	}
+	result.MaxConcurrency = c.Settings.Max
+	return &result
+}
+
+// Returns the current limit, or the override if one is set.
+func (c *Controller) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.effectiveLimit()
+}
+
+// Fixes the limit until the override is cleared with 0. The override is clamped to the bounds.
+func (c *Controller) SetOverride(limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if limit <= 0 {
+		c.override = 0
+	} else {
+		c.override = c.clamp(limit)
+	}
+	c.notify()
+}
+
+// Returns the stats of the last adjustment.
+func (c *Controller) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Limit = c.limit
+	stats.Override = c.override
+	stats.InFlight = c.inFlight
+	return stats
+}
+
+// Waits until an operation can be handled. Every successful Acquire must be followed by Release.
+func (c *Controller) Acquire(ctx context.Context) error {
+	c.mu.Lock()
+	for c.inFlight >= c.effectiveLimit() {
+		c.saturated = true
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	c.inFlight++
+	if c.inFlight >= c.effectiveLimit() {
+		c.saturated = true
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Records the result of an operation and frees its slot.
+func (c *Controller) Release(latency time.Duration, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	c.completed++
+	c.latency += latency
+	if failed {
+		c.failed++
+	}
+	c.notify()
+}
+
+// Adjusts the limit every interval until the context is canceled.
+func (c *Controller) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Settings.AdjustInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Adjust(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Adjusts the limit based on the operations completed since the last adjustment.
+func (c *Controller) Adjust(ctx context.Context) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	var queueDepth int64 = -1
+	if c.Settings.QueueDepth != nil {
+		depth, err := c.Settings.QueueDepth(ctx)
+		if err != nil {
+			logger.Error("ConcurrencyController: Error getting the queue depth: " + err.Error())
+		} else {
+			queueDepth = depth
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var avgLatency time.Duration
+	var errorRate float64
+	if c.completed > 0 {
+		avgLatency = c.latency / time.Duration(c.completed)
+		errorRate = float64(c.failed) / float64(c.completed)
+	}
+
+	previous := c.limit
+	reason := ""
+	switch {
+	case errorRate > c.Settings.MaxErrorRate:
+		c.limit = c.clamp(int(math.Floor(float64(c.limit) * c.Settings.DecreaseFactor)))
+		reason = fmt.Sprintf("error rate %.2f", errorRate)
+	case c.Settings.TargetLatency > 0 && avgLatency > c.Settings.TargetLatency:
+		c.limit = c.clamp(int(math.Floor(float64(c.limit) * c.Settings.DecreaseFactor)))
+		reason = "latency " + avgLatency.String()
+	case c.saturated && (c.Settings.QueueDepth == nil || queueDepth > int64(c.limit)):
+		c.limit = c.clamp(c.limit + 1)
+		reason = "saturated"
+	}
+
+	c.stats = Stats{
+		Completed:   c.completed,
+		Failed:      c.failed,
+		AvgLatency:  avgLatency,
+		QueueDepth:  queueDepth,
+		Saturated:   c.saturated,
+		LastAdjust:  time.Now(),
+		LastReason:  c.stats.LastReason,
+		Adjustments: c.stats.Adjustments,
+	}
+	if c.limit != previous {
+		c.stats.LastReason = reason
+		c.stats.Adjustments++
+		logger.Info(fmt.Sprintf("ConcurrencyController: Limit changed from %d to %d because of %s.", previous, c.limit, reason))
+		c.notify()
+	}
+
+	c.completed = 0
+	c.failed = 0
+	c.latency = 0
+	c.saturated = c.inFlight >= c.effectiveLimit()
+}
+
+// Must be called while holding the lock.
+func (c *Controller) effectiveLimit() int {
+	if c.override > 0 {
+		return c.override
+	}
+	return c.limit
+}
+
+func (c *Controller) clamp(limit int) int {
+	return min(max(limit, c.Settings.Min), c.Settings.Max)
+}
+
+// Must be called while holding the lock.
+func (c *Controller) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
@@ -2,21 +2,63 @@ package handlers
 
 import (
 	"log/slog"
-	"time"
 
 	oc "github.com/Azure/OperationContainer/api/v1"
 	ec "github.com/Azure/aks-async/runtime/entity_controller"
+	"github.com/Azure/aks-async/runtime/fanout"
+	"github.com/Azure/aks-async/runtime/handlers/children"
+	"github.com/Azure/aks-async/runtime/handlers/circuitbreaker"
+	"github.com/Azure/aks-async/runtime/handlers/concurrency"
+	"github.com/Azure/aks-async/runtime/handlers/deferral"
 	"github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/handlers/lockrenewal"
 	"github.com/Azure/aks-async/runtime/handlers/log"
 	"github.com/Azure/aks-async/runtime/handlers/operation"
 	och "github.com/Azure/aks-async/runtime/handlers/operation_container"
 	"github.com/Azure/aks-async/runtime/handlers/qos"
+	"github.com/Azure/aks-async/runtime/handlers/ratelimit"
 	"github.com/Azure/aks-async/runtime/hooks"
 	"github.com/Azure/aks-async/runtime/matcher"
 	sb "github.com/Azure/aks-async/servicebus"
 	"github.com/Azure/go-shuttle/v2"
 )
 
+// DefaultHandlerOptions holds the optional features of the default handler chain.
+type DefaultHandlerOptions struct {
+	// Options passed down to the operation handler.
+	OperationHandlerOptions *operation.OperationHandlerOptions
+	// If set, the terminal state of child operations is recorded in the coordinator so the
+	// parent operation is re-triggered once all of its children finish.
+	ChildCoordinator *fanout.Coordinator
+	// Hooks called once the message is settled and the operation reaches its final status. The
+	// operation hooks implementing hooks.SettlementHooks are also called.
+	SettlementHooks []hooks.SettlementHooks
+	// If set, the operations throttled by the limiter are rescheduled using RescheduleSender
+	// before reaching the operation handler. Requires RescheduleSender.
+	RateLimiter *ratelimit.Limiter
+	// Lock renewal policy of the operations without one registered in the matcher. The lock is
+	// renewed every 10 seconds by default.
+	LockRenewalPolicy *matcher.LockRenewalPolicy
+	// If set, limits the number of operations handled at the same time. The processor must allow
+	// the maximum of the controller, see Controller.ProcessorOptions, and Controller.Run must be
+	// running to adjust the limit.
+	ConcurrencyController *concurrency.Controller
+	// If set, the operations whose circuit is open are rescheduled using RescheduleSender before
+	// reaching the operation handler. Requires RescheduleSender.
+	CircuitBreaker *circuitbreaker.Breaker
+	// If set, the messages of a DeferError are deferred and tracked in the store, and received
+	// again once the operation blocking them completes. They are requeued using RescheduleSender,
+	// which is required. If not set, they are abandoned like a RetryError. A deferral.Sweeper
+	// should run to release the messages whose release was missed.
+	DeferralStore deferral.Store
+	// Receiver of the deferred messages. Defaults to the azservicebus.Receiver of the
+	// serviceBusReceiver.
+	DeferredReceiver deferral.DeferredReceiver
+	// Sender used to reschedule throttled, rejected or released messages, typically to the queue
+	// being processed.
+	RescheduleSender sb.SenderInterface
+}
+
 func DefaultHandlers(
 	serviceBusReceiver sb.ReceiverInterface,
 	matcher *matcher.Matcher,
@@ -26,45 +68,142 @@ func DefaultHandlers(
 	hooks []hooks.BaseOperationHooksInterface,
 	marshaller shuttle.Marshaller,
 ) shuttle.HandlerFunc {
+	return DefaultHandlersWithOptions(serviceBusReceiver, matcher, operationContainer, entityController, logger, hooks, marshaller, nil)
+}
 
-	// Lock renewal settings
-	lockRenewalInterval := 10 * time.Second
-	lockRenewalOptions := &shuttle.LockRenewalOptions{Interval: &lockRenewalInterval}
+// Same as DefaultHandlers, but allows enabling the optional features of the handlers.
+func DefaultHandlersWithOptions(
+	serviceBusReceiver sb.ReceiverInterface,
+	matcher *matcher.Matcher,
+	operationContainer oc.OperationContainerClient,
+	entityController ec.EntityController,
+	logger *slog.Logger,
+	hooks []hooks.BaseOperationHooksInterface,
+	marshaller shuttle.Marshaller,
+	options *DefaultHandlerOptions,
+) shuttle.HandlerFunc {
 
 	if marshaller == nil {
 		marshaller = &shuttle.DefaultProtoMarshaller{}
 	}
 
+	if options == nil {
+		options = &DefaultHandlerOptions{}
+	}
+
+	settlementHooks := getSettlementHooks(hooks, options.SettlementHooks)
+
+	operationHandler := operation.NewOperationHandlerWithOptions(matcher, hooks, entityController, marshaller, options.OperationHandlerOptions)
+
+	if options.ConcurrencyController != nil {
+		operationHandler = concurrency.NewConcurrencyHandler(options.ConcurrencyController, operationHandler)
+	}
+
+	// The lock is renewed while the operation runs, so the error handlers can settle the message
+	// and update the operation if the lock is lost or held for too long. The time waiting for the
+	// concurrency controller isn't counted towards the maximum duration.
+	operationHandler = lockrenewal.NewLockRenewalHandler(matcher, options.LockRenewalPolicy, operationHandler, marshaller)
+
 	var errorHandler errors.ErrorHandlerFunc
 	if operationContainer != nil {
-		errorHandler = och.NewOperationContainerHandler(
-			errors.NewErrorReturnHandler(
-				operation.NewOperationHandler(matcher, hooks, entityController, marshaller),
+		// The OnTerminal hooks are called once the final status of the operation is set.
+		errorHandler = och.NewOperationContainerHandlerWithHooks(
+			errors.NewErrorReturnHandlerWithHooks(
+				operationHandler,
 				nil,
+				marshaller,
+				settlementHooks,
 			),
 			operationContainer,
 			marshaller,
+			settlementHooks,
 		)
 	} else {
-		errorHandler = errors.NewErrorReturnHandler(
-			operation.NewOperationHandler(matcher, hooks, entityController, marshaller),
+		errorHandler = errors.NewErrorReturnHandlerWithHooks(
+			operationHandler,
 			nil,
+			marshaller,
+			settlementHooks,
 		)
 	}
 
+	if options.ChildCoordinator != nil {
+		errorHandler = children.NewChildCompletionHandler(options.ChildCoordinator, errorHandler, marshaller)
+	}
+
+	if options.DeferralStore != nil {
+		if options.RescheduleSender != nil {
+			receiver := getDeferredReceiver(serviceBusReceiver, options.DeferredReceiver, logger)
+			if receiver != nil {
+				errorHandler = deferral.NewDeferralHandler(options.DeferralStore, receiver, errorHandler, marshaller, options.RescheduleSender)
+			}
+		} else {
+			getLogger(logger).Error("DefaultHandlers: No RescheduleSender for the deferred messages, deferral is disabled.")
+		}
+	}
+
+	if options.CircuitBreaker != nil {
+		if options.RescheduleSender != nil {
+			errorHandler = circuitbreaker.NewCircuitBreakerHandler(options.CircuitBreaker, errorHandler, marshaller, options.RescheduleSender, settlementHooks)
+		} else {
+			getLogger(logger).Error("DefaultHandlers: No RescheduleSender for the rejected messages, the circuit breaker is disabled.")
+		}
+	}
+
+	// Throttled messages aren't counted by the circuit breaker.
+	if options.RateLimiter != nil {
+		if options.RescheduleSender != nil {
+			errorHandler = ratelimit.NewRateLimitHandler(options.RateLimiter, errorHandler, marshaller, options.RescheduleSender, settlementHooks)
+		} else {
+			getLogger(logger).Error("DefaultHandlers: No RescheduleSender for the throttled messages, rate limiting is disabled.")
+		}
+	}
+
 	// Combine handlers into a single default handler
 	return shuttle.NewPanicHandler(
 		nil,
-		shuttle.NewRenewLockHandler(
-			lockRenewalOptions,
-			log.NewLogHandler(
+		log.NewLogHandler(
+			logger,
+			qos.NewQosErrorHandler(
 				logger,
-				qos.NewQosErrorHandler(
-					logger,
-					errorHandler,
-				),
-				marshaller,
+				errorHandler,
 			),
+			marshaller,
 		),
 	)
 }
+
+func getSettlementHooks(hookList []hooks.BaseOperationHooksInterface, settlementHooks []hooks.SettlementHooks) []hooks.SettlementHooks {
+	return append(append([]hooks.SettlementHooks{}, settlementHooks...), hooks.GetSettlementHooks(hookList)...)
+}
+
+// Without a receiver the deferred messages couldn't be released, so deferral is disabled and the
+// messages of a DeferError are abandoned instead.
+func getDeferredReceiver(serviceBusReceiver sb.ReceiverInterface, receiver deferral.DeferredReceiver, logger *slog.Logger) deferral.DeferredReceiver {
+	if receiver != nil {
+		return receiver
+	}
+	logger = getLogger(logger)
+	if serviceBusReceiver == nil {
+		logger.Error("DefaultHandlers: No receiver for the deferred messages, deferral is disabled.")
+		return nil
+	}
+
+	azReceiver, err := serviceBusReceiver.GetAzureReceiver()
+	if err != nil {
+		logger.Error("DefaultHandlers: Error getting the receiver of the deferred messages, deferral is disabled: " + err.Error())
+		return nil
+	}
+	if azReceiver == nil {
+		logger.Error("DefaultHandlers: No receiver for the deferred messages, deferral is disabled.")
+		return nil
+	}
+	return azReceiver
+}
+
+func getLogger(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
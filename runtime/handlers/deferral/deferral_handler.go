@@ -0,0 +1,162 @@
+package deferral
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/lock"
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+// DeferredReceiver receives deferred messages by sequence number and settles them, like
+// azservicebus.Receiver.
+type DeferredReceiver interface {
+	shuttle.MessageSettler
+	ReceiveDeferredMessages(ctx context.Context, sequenceNumbers []int64, options *azservicebus.ReceiveDeferredMessagesOptions) ([]*azservicebus.ReceivedMessage, error)
+}
+
+// Handler that defers the messages of a DeferError, recording them so they're received again once
+// the operation blocking them completes, successfully or not. The released messages are received
+// with the receiver, which must be the receiver of the queue being processed, and sent back to the
+// queue using the sender, so they go through the whole handler chain again. Without a sender the
+// messages aren't deferred, and the error handlers abandon them like a RetryError.
+func NewDeferralHandler(store Store, receiver DeferredReceiver, errHandler errorHandlers.ErrorHandlerFunc, marshaller shuttle.Marshaller, sender sb.SenderInterface) errorHandlers.ErrorHandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
+		logger := ctxlogger.GetLogger(ctx)
+
+		if sender == nil {
+			logger.Error("DeferralHandler: No sender received, the messages aren't deferred.")
+			return errHandler.Handle(ctx, settler, message)
+		}
+
+		if marshaller == nil {
+			marshaller = &shuttle.DefaultProtoMarshaller{}
+		}
+
+		// Without an entity the message can't be released, so the error handlers abandon it
+		// instead of deferring it.
+		var body operation.OperationRequest
+		err := marshaller.Unmarshal(message.Message(), &body)
+		if err != nil {
+			logger.Error("DeferralHandler: Error unmarshalling message: " + err.Error())
+			return errHandler.Handle(ctx, settler, message)
+		}
+		entityKey := lock.EntityKey(&body)
+		if entityKey == "" {
+			return errHandler.Handle(ctx, settler, message)
+		}
+
+		deferCtx := errorHandlers.WithDeferFunc(ctx, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage, deferErr *errors.DeferError) error {
+			return deferMessage(ctx, store, settler, message, &body, entityKey, deferErr)
+		})
+		asyncErr := errHandler.Handle(deferCtx, settler, message)
+
+		if asyncErr != nil {
+			switch errors.Classify(asyncErr.OriginalError).(type) {
+			case *errors.NonRetryError:
+				// The operation failed for good, so it no longer blocks the deferred messages.
+			default:
+				// The operation was deferred or will be retried, so it's still blocking the
+				// deferred messages.
+				return asyncErr
+			}
+		}
+
+		entries, err := store.Release(ctx, entityKey, body.OperationId)
+		if err != nil {
+			logger.Error("DeferralHandler: Error releasing deferred messages: " + err.Error())
+			return asyncErr
+		}
+		if len(entries) > 0 {
+			releaseMessages(ctx, store, receiver, sender, entries)
+		}
+
+		return asyncErr
+	}
+}
+
+// Records the message before deferring it, so it's never deferred without being tracked. If it
+// can't be deferred, the entry is removed since the message will be redelivered.
+func deferMessage(ctx context.Context, store Store, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage, body *operation.OperationRequest, entityKey string, deferErr *errors.DeferError) error {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if message.SequenceNumber == nil {
+		return stderrors.New("Deferred message of operation " + body.OperationId + " has no sequence number.")
+	}
+
+	err := store.Add(ctx, &DeferredEntry{
+		EntityKey:           entityKey,
+		OperationId:         body.OperationId,
+		BlockingOperationId: deferErr.BlockingOperationId,
+		SequenceNumber:      *message.SequenceNumber,
+		DeferredAt:          time.Now(),
+	})
+	if err != nil {
+		logger.Error("DeferralHandler: Error recording deferred message: " + err.Error())
+		return err
+	}
+
+	err = settler.DeferMessage(ctx, message, nil)
+	if err != nil {
+		removeErr := store.Remove(ctx, entityKey, *message.SequenceNumber)
+		if removeErr != nil {
+			logger.Error("DeferralHandler: Error removing deferred message: " + removeErr.Error())
+		}
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("DeferralHandler: Deferred operation %s with sequence number %d.", body.OperationId, *message.SequenceNumber))
+	return nil
+}
+
+// Receives the released messages and requeues them. The entries of the messages that can't be
+// received or requeued are added back, since the messages stay deferred and nothing else would
+// release them.
+func releaseMessages(ctx context.Context, store Store, receiver DeferredReceiver, sender sb.SenderInterface, entries []*DeferredEntry) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	restore := func(entry *DeferredEntry) {
+		err := store.Add(ctx, entry)
+		if err != nil {
+			logger.Error("DeferralHandler: Error restoring deferred message: " + err.Error())
+		}
+	}
+
+	sequenceNumbers := make([]int64, 0, len(entries))
+	entriesBySequenceNumber := make(map[int64]*DeferredEntry, len(entries))
+	for _, entry := range entries {
+		sequenceNumbers = append(sequenceNumbers, entry.SequenceNumber)
+		entriesBySequenceNumber[entry.SequenceNumber] = entry
+	}
+
+	messages, err := receiver.ReceiveDeferredMessages(ctx, sequenceNumbers, nil)
+	if err != nil {
+		logger.Error("DeferralHandler: Error receiving deferred messages: " + err.Error())
+		for _, entry := range entries {
+			restore(entry)
+		}
+		return
+	}
+
+	logger.Info(fmt.Sprintf("DeferralHandler: Releasing %d deferred messages.", len(messages)))
+	for _, deferred := range messages {
+		err = errorHandlers.RescheduleMessage(ctx, receiver, sender, deferred, 0)
+		if err != nil {
+			logger.Error("DeferralHandler: Error requeueing deferred message: " + err.Error())
+			if deferred.SequenceNumber != nil {
+				if entry, ok := entriesBySequenceNumber[*deferred.SequenceNumber]; ok {
+					restore(entry)
+				}
+			}
+		}
+	}
+}
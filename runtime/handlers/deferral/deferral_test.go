@@ -0,0 +1,354 @@
+package deferral
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDeferral(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Deferral Suite")
+}
+
+// Settler keeping the deferred messages so they can be received by sequence number.
+type deferringSettler struct {
+	settler.SampleMessageSettler
+	deferred   map[int64]*azservicebus.ReceivedMessage
+	completed  int
+	receiveErr error
+	onDefer    func(message *azservicebus.ReceivedMessage) error
+}
+
+func (s *deferringSettler) DeferMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions) error {
+	if s.onDefer != nil {
+		if err := s.onDefer(message); err != nil {
+			return err
+		}
+	}
+	s.deferred[*message.SequenceNumber] = message
+	return nil
+}
+
+func (s *deferringSettler) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	s.completed++
+	return nil
+}
+
+func (s *deferringSettler) ReceiveDeferredMessages(ctx context.Context, sequenceNumbers []int64, options *azservicebus.ReceiveDeferredMessagesOptions) ([]*azservicebus.ReceivedMessage, error) {
+	if s.receiveErr != nil {
+		return nil, s.receiveErr
+	}
+	messages := []*azservicebus.ReceivedMessage{}
+	for _, sequenceNumber := range sequenceNumbers {
+		if message, ok := s.deferred[sequenceNumber]; ok {
+			messages = append(messages, message)
+			delete(s.deferred, sequenceNumber)
+		}
+	}
+	return messages, nil
+}
+
+var _ = Describe("InMemoryStore", func() {
+	var (
+		ctx   context.Context
+		store *InMemoryStore
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = NewInMemoryStore()
+		Expect(store.Add(ctx, &DeferredEntry{EntityKey: "Cluster/1", OperationId: "2", BlockingOperationId: "1", SequenceNumber: 2})).To(Succeed())
+		Expect(store.Add(ctx, &DeferredEntry{EntityKey: "Cluster/1", OperationId: "3", SequenceNumber: 3})).To(Succeed())
+		Expect(store.Add(ctx, &DeferredEntry{EntityKey: "Cluster/1", OperationId: "3", SequenceNumber: 3})).To(Succeed())
+		Expect(store.Add(ctx, &DeferredEntry{EntityKey: "Cluster/2", OperationId: "4", SequenceNumber: 4})).To(Succeed())
+	})
+
+	It("should release the entries blocked by the operation", func() {
+		released, err := store.Release(ctx, "Cluster/1", "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(HaveLen(1))
+		Expect(released[0].OperationId).To(Equal("3"))
+
+		released, err = store.Release(ctx, "Cluster/1", "1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(HaveLen(1))
+		Expect(released[0].OperationId).To(Equal("2"))
+
+		released, err = store.Release(ctx, "Cluster/1", "1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(BeEmpty())
+	})
+})
+
+var _ = Describe("InMemoryStore expiration", func() {
+	It("should release the entries deferred before the given time", func() {
+		ctx := context.Background()
+		store := NewInMemoryStore()
+		now := time.Now()
+		Expect(store.Add(ctx, &DeferredEntry{EntityKey: "Cluster/1", OperationId: "2", SequenceNumber: 2, DeferredAt: now.Add(-time.Hour)})).To(Succeed())
+		Expect(store.Add(ctx, &DeferredEntry{EntityKey: "Cluster/1", OperationId: "3", SequenceNumber: 3, DeferredAt: now})).To(Succeed())
+		Expect(store.Add(ctx, &DeferredEntry{EntityKey: "Cluster/2", OperationId: "4", SequenceNumber: 4, DeferredAt: now.Add(-time.Hour)})).To(Succeed())
+
+		released, err := store.ReleaseExpired(ctx, now.Add(-time.Minute))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(HaveLen(2))
+
+		released, err = store.Release(ctx, "Cluster/1", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(HaveLen(1))
+		Expect(released[0].OperationId).To(Equal("3"))
+	})
+})
+
+// Sender failing every send.
+type failingSender struct {
+	sb.SenderInterface
+}
+
+func (s *failingSender) SendMessage(ctx context.Context, message *azservicebus.Message) error {
+	return errors.New("unavailable")
+}
+
+var _ = Describe("DeferralHandler", func() {
+	var (
+		ctx           context.Context
+		buf           bytes.Buffer
+		store         *InMemoryStore
+		receiver      *deferringSettler
+		marshaller    shuttle.Marshaller
+		handled       []string
+		blockedResult map[string]error
+		inner         errorHandlers.ErrorHandlerFunc
+		sender        sb.SenderInterface
+		queue         sb.ReceiverInterface
+	)
+
+	BeforeEach(func() {
+		buf.Reset()
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		ctx = ctxlogger.WithLogger(context.TODO(), logger)
+		store = NewInMemoryStore()
+		receiver = &deferringSettler{deferred: map[int64]*azservicebus.ReceivedMessage{}}
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+		handled = []string{}
+		blockedResult = map[string]error{}
+
+		client := sb.NewFakeServiceBusClient()
+		sender, _ = client.NewServiceBusSender(ctx, "operations", nil)
+		queue, _ = client.NewServiceBusReceiver(ctx, "operations", nil)
+
+		// Returns the result of the operation the first time it's handled.
+		inner = errorHandlers.NewErrorReturnHandler(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			var body operation.OperationRequest
+			Expect(marshaller.Unmarshal(message.Message(), &body)).To(Succeed())
+			handled = append(handled, body.OperationId)
+
+			err, ok := blockedResult[body.OperationId]
+			if !ok {
+				return nil
+			}
+			delete(blockedResult, body.OperationId)
+			return &asyncErrors.AsyncError{OriginalError: err}
+		}, nil)
+	})
+
+	newMessage := func(operationId string, sequenceNumber int64) *azservicebus.ReceivedMessage {
+		marshalledMessage, err := marshaller.Marshal(&operation.OperationRequest{OperationName: "Upgrade", OperationId: operationId, EntityType: "Cluster", EntityId: "1"})
+		Expect(err).ToNot(HaveOccurred())
+		message := convert.ConvertToReceivedMessage(marshalledMessage)
+		message.SequenceNumber = &sequenceNumber
+		return message
+	}
+
+	It("should requeue the deferred message once the blocking operation completes", func() {
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked", BlockingOperationId: "1"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, sender)
+
+		asyncErr := handler(ctx, receiver, newMessage("2", 2))
+		var deferErr *asyncErrors.DeferError
+		Expect(errors.As(asyncErr, &deferErr)).To(BeTrue())
+		Expect(receiver.deferred).To(HaveKey(int64(2)))
+
+		Expect(handler(ctx, receiver, newMessage("1", 1))).To(BeNil())
+		Expect(handled).To(Equal([]string{"2", "1"}))
+		Expect(receiver.deferred).To(BeEmpty())
+		Expect(receiver.completed).To(Equal(1))
+		messages, err := queue.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+	})
+
+	It("should not release the deferred messages while the blocking operation is retried", func() {
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+		blockedResult["1"] = &asyncErrors.RetryError{Message: "retry"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, sender)
+
+		handler(ctx, receiver, newMessage("2", 2))
+		handler(ctx, receiver, newMessage("1", 1))
+		Expect(handled).To(Equal([]string{"2", "1"}))
+		Expect(receiver.deferred).To(HaveLen(1))
+	})
+
+	It("should not defer the messages without a sender", func() {
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, nil)
+
+		handler(ctx, receiver, newMessage("2", 2))
+		Expect(receiver.deferred).To(BeEmpty())
+		Expect(buf.String()).To(ContainSubstring("No sender received"))
+		Expect(buf.String()).To(ContainSubstring("Deferral not configured"))
+	})
+
+	It("should restore the entry if the released message can't be requeued", func() {
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, &failingSender{})
+		handler(ctx, receiver, newMessage("2", 2))
+		handler(ctx, receiver, newMessage("1", 1))
+
+		released, err := store.Release(ctx, "Cluster/1", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(HaveLen(1))
+		Expect(released[0].SequenceNumber).To(Equal(int64(2)))
+	})
+
+	It("should keep the entries if the deferred messages can't be received", func() {
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, sender)
+		handler(ctx, receiver, newMessage("2", 2))
+
+		receiver.receiveErr = errors.New("unavailable")
+		handler(ctx, receiver, newMessage("1", 1))
+
+		released, err := store.Release(ctx, "Cluster/1", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(HaveLen(1))
+	})
+
+	It("should record the message before deferring it", func() {
+		receiver.onDefer = func(message *azservicebus.ReceivedMessage) error {
+			released, err := store.Release(ctx, "Cluster/1", "1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(released).To(HaveLen(1))
+			Expect(store.Add(ctx, released[0])).To(Succeed())
+			return nil
+		}
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked", BlockingOperationId: "1"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, sender)
+		handler(ctx, receiver, newMessage("2", 2))
+		Expect(receiver.deferred).To(HaveKey(int64(2)))
+	})
+
+	It("should remove the entry if the message can't be deferred", func() {
+		receiver.onDefer = func(message *azservicebus.ReceivedMessage) error {
+			return errors.New("lock lost")
+		}
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, sender)
+
+		asyncErr := handler(ctx, receiver, newMessage("2", 2))
+		Expect(asyncErr).ToNot(BeNil())
+		Expect(asyncErr.ErrorCode).To(Equal(500))
+		released, err := store.Release(ctx, "Cluster/1", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(BeEmpty())
+	})
+
+	It("should abandon the message if it has no entity", func() {
+		marshalledMessage, err := marshaller.Marshal(&operation.OperationRequest{OperationName: "Upgrade", OperationId: "2"})
+		Expect(err).ToNot(HaveOccurred())
+		message := convert.ConvertToReceivedMessage(marshalledMessage)
+
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, sender)
+		handler(ctx, receiver, message)
+		Expect(receiver.deferred).To(BeEmpty())
+		Expect(buf.String()).To(ContainSubstring("Deferral not configured"))
+	})
+
+	It("should release the messages when the settler is wrapped", func() {
+		wrapped := &struct{ shuttle.MessageSettler }{MessageSettler: receiver}
+		blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+		handler := NewDeferralHandler(store, receiver, inner, marshaller, sender)
+
+		handler(ctx, wrapped, newMessage("2", 2))
+		Expect(receiver.deferred).To(HaveKey(int64(2)))
+		handler(ctx, wrapped, newMessage("1", 1))
+		Expect(handled).To(Equal([]string{"2", "1"}))
+		Expect(receiver.deferred).To(BeEmpty())
+		Expect(receiver.completed).To(Equal(1))
+	})
+
+	Context("Sweeper", func() {
+		It("should requeue the message missed when the blocking operation completes before it's recorded", func() {
+			var handler errorHandlers.ErrorHandlerFunc
+			inner = errorHandlers.NewErrorReturnHandler(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+				var body operation.OperationRequest
+				Expect(marshaller.Unmarshal(message.Message(), &body)).To(Succeed())
+				handled = append(handled, body.OperationId)
+				if body.OperationId != "2" {
+					return nil
+				}
+
+				// The blocking operation completes after the guard of operation 2 and before
+				// its message is recorded, so there's nothing to release yet.
+				Expect(handler(ctx, receiver, newMessage("1", 1))).To(BeNil())
+				return &asyncErrors.AsyncError{OriginalError: &asyncErrors.DeferError{Message: "blocked", BlockingOperationId: "1"}}
+			}, nil)
+			handler = NewDeferralHandler(store, receiver, inner, marshaller, sender)
+
+			handler(ctx, receiver, newMessage("2", 2))
+			Expect(handled).To(Equal([]string{"2", "1"}))
+			Expect(receiver.deferred).To(HaveKey(int64(2)))
+
+			sweeper := NewSweeper(store, receiver, sender, time.Hour)
+			released, err := sweeper.Sweep(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(released).To(Equal(0))
+			Expect(receiver.deferred).To(HaveKey(int64(2)))
+
+			sweeper = NewSweeper(store, receiver, sender, 0)
+			released, err = sweeper.Sweep(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(released).To(Equal(1))
+			Expect(receiver.deferred).To(BeEmpty())
+			Expect(receiver.completed).To(Equal(1))
+			messages, err := queue.ReceiveMessage(ctx, 10, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+		})
+
+		It("should keep the entries if the deferred messages can't be received", func() {
+			blockedResult["2"] = &asyncErrors.DeferError{Message: "blocked"}
+			NewDeferralHandler(store, receiver, inner, marshaller, sender)(ctx, receiver, newMessage("2", 2))
+
+			receiver.receiveErr = errors.New("unavailable")
+			_, err := NewSweeper(store, receiver, sender, 0).Sweep(ctx)
+			Expect(err).ToNot(HaveOccurred())
+
+			released, err := store.Release(ctx, "Cluster/1", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(released).To(HaveLen(1))
+		})
+
+		It("should fail without a sender", func() {
+			_, err := NewSweeper(store, receiver, nil, 0).Sweep(ctx)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,217 @@
+package deferral
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/aks-async/database"
+)
+
+// DeferredEntry is a message deferred until another operation on its entity completes.
+type DeferredEntry struct {
+	EntityKey   string
+	OperationId string
+	// If empty, any operation completing on the entity releases the message.
+	BlockingOperationId string
+	SequenceNumber      int64
+	DeferredAt          time.Time
+}
+
+// Store keeps track of the deferred messages of each entity.
+type Store interface {
+	Add(ctx context.Context, entry *DeferredEntry) error
+	// Removes the entry of the message, if any.
+	Remove(ctx context.Context, entityKey string, sequenceNumber int64) error
+	// Removes and returns the entries of the entity released by the completion of the operation.
+	Release(ctx context.Context, entityKey string, operationId string) ([]*DeferredEntry, error)
+	// Removes and returns the entries deferred before the given time, of any entity.
+	ReleaseExpired(ctx context.Context, deferredBefore time.Time) ([]*DeferredEntry, error)
+}
+
+var _ Store = &InMemoryStore{}
+
+// InMemoryStore keeps the entries in memory. Useful for testing or single instance workers.
+type InMemoryStore struct {
+	entries map[string][]*DeferredEntry
+	mu      sync.Mutex
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		entries: make(map[string][]*DeferredEntry),
+	}
+}
+
+func (s *InMemoryStore) Add(ctx context.Context, entry *DeferredEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The same message can be deferred more than once if its release fails.
+	for _, existing := range s.entries[entry.EntityKey] {
+		if existing.SequenceNumber == entry.SequenceNumber {
+			return nil
+		}
+	}
+	s.entries[entry.EntityKey] = append(s.entries[entry.EntityKey], entry)
+	return nil
+}
+
+func (s *InMemoryStore) Remove(ctx context.Context, entityKey string, sequenceNumber int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remaining := []*DeferredEntry{}
+	for _, entry := range s.entries[entityKey] {
+		if entry.SequenceNumber != sequenceNumber {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(s.entries, entityKey)
+	} else {
+		s.entries[entityKey] = remaining
+	}
+	return nil
+}
+
+func (s *InMemoryStore) Release(ctx context.Context, entityKey string, operationId string) ([]*DeferredEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	released := []*DeferredEntry{}
+	remaining := []*DeferredEntry{}
+	for _, entry := range s.entries[entityKey] {
+		if entry.BlockingOperationId == "" || entry.BlockingOperationId == operationId {
+			released = append(released, entry)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(s.entries, entityKey)
+	} else {
+		s.entries[entityKey] = remaining
+	}
+	return released, nil
+}
+
+func (s *InMemoryStore) ReleaseExpired(ctx context.Context, deferredBefore time.Time) ([]*DeferredEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	released := []*DeferredEntry{}
+	for entityKey, entries := range s.entries {
+		remaining := []*DeferredEntry{}
+		for _, entry := range entries {
+			if entry.DeferredAt.Before(deferredBefore) {
+				released = append(released, entry)
+			} else {
+				remaining = append(remaining, entry)
+			}
+		}
+
+		if len(remaining) == 0 {
+			delete(s.entries, entityKey)
+		} else {
+			s.entries[entityKey] = remaining
+		}
+	}
+	return released, nil
+}
+
+var _ Store = &SqlStore{}
+
+// SqlStore keeps the entries in a SQL Server table with the following schema:
+//
+//	CREATE TABLE DeferredMessages (
+//		EntityKey NVARCHAR(255) NOT NULL,
+//		SequenceNumber BIGINT NOT NULL,
+//		OperationId NVARCHAR(255) NOT NULL,
+//		BlockingOperationId NVARCHAR(255) NOT NULL,
+//		DeferredAt DATETIME2 NOT NULL,
+//		PRIMARY KEY (EntityKey, SequenceNumber)
+//	)
+//
+// The table name is not parametrized in the queries, so it must come from trusted configuration.
+type SqlStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewSqlStore(db *sql.DB, table string) *SqlStore {
+	return &SqlStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func (s *SqlStore) Add(ctx context.Context, entry *DeferredEntry) error {
+	query := fmt.Sprintf(`MERGE %s WITH (HOLDLOCK) AS target
+USING (SELECT @p1 AS EntityKey, @p2 AS SequenceNumber) AS source
+ON target.EntityKey = source.EntityKey AND target.SequenceNumber = source.SequenceNumber
+WHEN NOT MATCHED THEN INSERT (EntityKey, SequenceNumber, OperationId, BlockingOperationId, DeferredAt) VALUES (@p1, @p2, @p3, @p4, @p5);`, s.table)
+	_, err := database.ExecDb(ctx, s.db, query, entry.EntityKey, entry.SequenceNumber, entry.OperationId, entry.BlockingOperationId, entry.DeferredAt)
+
+	// The entry already exists.
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return nil
+	}
+	return err
+}
+
+func (s *SqlStore) Remove(ctx context.Context, entityKey string, sequenceNumber int64) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE EntityKey = @p1 AND SequenceNumber = @p2", s.table)
+	_, err := database.ExecDb(ctx, s.db, query, entityKey, sequenceNumber)
+
+	// The entry doesn't exist.
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return nil
+	}
+	return err
+}
+
+func (s *SqlStore) Release(ctx context.Context, entityKey string, operationId string) ([]*DeferredEntry, error) {
+	query := fmt.Sprintf(`DELETE FROM %s
+OUTPUT DELETED.EntityKey, DELETED.SequenceNumber, DELETED.OperationId, DELETED.BlockingOperationId, DELETED.DeferredAt
+WHERE EntityKey = @p1 AND (BlockingOperationId = '' OR BlockingOperationId = @p2)`, s.table)
+	return s.deleteEntries(ctx, query, entityKey, operationId)
+}
+
+func (s *SqlStore) ReleaseExpired(ctx context.Context, deferredBefore time.Time) ([]*DeferredEntry, error) {
+	query := fmt.Sprintf(`DELETE FROM %s
+OUTPUT DELETED.EntityKey, DELETED.SequenceNumber, DELETED.OperationId, DELETED.BlockingOperationId, DELETED.DeferredAt
+WHERE DeferredAt < @p1`, s.table)
+	return s.deleteEntries(ctx, query, deferredBefore)
+}
+
+// Runs the DELETE query and returns the deleted entries.
+func (s *SqlStore) deleteEntries(ctx context.Context, query string, args ...interface{}) ([]*DeferredEntry, error) {
+	rows, err := database.QueryDb(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	released := []*DeferredEntry{}
+	for rows.Next() {
+		entry := &DeferredEntry{}
+		err = rows.Scan(&entry.EntityKey, &entry.SequenceNumber, &entry.OperationId, &entry.BlockingOperationId, &entry.DeferredAt)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return released, nil
+}
@@ -0,0 +1,72 @@
+package deferral
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+// Sweeper releases the messages deferred for longer than the TTL, in case their release was missed,
+// e.g. the blocking operation completed between the guard and the recording of the message, or
+// the worker stopped while releasing it. The released messages are requeued using the sender, so
+// they go through the handlers again and are deferred again if they're still blocked.
+type Sweeper struct {
+	store    Store
+	receiver DeferredReceiver
+	sender   sb.SenderInterface
+	ttl      time.Duration
+}
+
+func NewSweeper(store Store, receiver DeferredReceiver, sender sb.SenderInterface, ttl time.Duration) *Sweeper {
+	return &Sweeper{
+		store:    store,
+		receiver: receiver,
+		sender:   sender,
+		ttl:      ttl,
+	}
+}
+
+// Sweeps the store every interval until the context is canceled.
+func (s *Sweeper) Run(ctx context.Context, interval time.Duration) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := s.Sweep(ctx)
+			if err != nil {
+				logger.Error("DeferralSweeper: Error sweeping deferred messages: " + err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Requeues the messages deferred for longer than the TTL. Returns the number of entries released.
+func (s *Sweeper) Sweep(ctx context.Context) (int, error) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if s.sender == nil {
+		return 0, errors.New("No sender received.")
+	}
+
+	entries, err := s.store.ReleaseExpired(ctx, time.Now().Add(-s.ttl))
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	logger.Info(fmt.Sprintf("DeferralSweeper: Releasing %d expired deferred messages.", len(entries)))
+	releaseMessages(ctx, s.store, s.receiver, s.sender, entries)
+	return len(entries), nil
+}
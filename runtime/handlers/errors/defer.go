@@ -0,0 +1,27 @@
+package errors
+
+import (
+	"context"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+)
+
+// DeferFunc defers the message of an operation that returned a DeferError. It must keep track of
+// the message so it's received again once the blocking operation completes.
+type DeferFunc func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage, deferErr *errors.DeferError) error
+
+type deferFuncKey struct{}
+
+// Returns a context where the error handlers defer the messages of a DeferError using the
+// function. Without one, a deferred message would never be received again, so the error handlers
+// abandon it like a RetryError.
+func WithDeferFunc(ctx context.Context, deferFunc DeferFunc) context.Context {
+	return context.WithValue(ctx, deferFuncKey{}, deferFunc)
+}
+
+func getDeferFunc(ctx context.Context) DeferFunc {
+	deferFunc, _ := ctx.Value(deferFuncKey{}).(DeferFunc)
+	return deferFunc
+}
@@ -3,7 +3,9 @@ package errors
 import (
 	"context"
 
+	oc "github.com/Azure/OperationContainer/api/v1"
 	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
 	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
 	"github.com/Azure/go-shuttle/v2"
@@ -22,24 +24,50 @@ func (f ErrorHandlerFunc) Handle(ctx context.Context, settler shuttle.MessageSet
 
 // An error handler that continues the normal shuttle.HandlerFunc handler chain.
 func NewErrorHandler(errHandler ErrorHandlerFunc, next shuttle.HandlerFunc) shuttle.HandlerFunc {
+	return NewErrorHandlerWithHooks(errHandler, next, nil, nil)
+}
+
+// Same as NewErrorHandler, calling the settlement hooks when the message is settled. The OnTerminal
+// hooks are called once the message is completed or dead-lettered, using the marshaller to read
+// the operation id.
+func NewErrorHandlerWithHooks(errHandler ErrorHandlerFunc, next shuttle.HandlerFunc, marshaller shuttle.Marshaller, settlementHooks []hooks.SettlementHooks) shuttle.HandlerFunc {
 	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
-		err := errHandler.Handle(ctx, settler, message)
-		if err != nil {
+		settler = newHookedSettler(settler, settlementHooks)
+		recorder := NewSettlementRecorder(settler)
+		err := errHandler.Handle(ctx, recorder, message)
+		if err == nil {
+			if action, ok := recorder.Settlement(); ok && action == hooks.SettleActionComplete {
+				onTerminal(ctx, settlementHooks, marshaller, message, oc.Status_SUCCEEDED, nil)
+			}
+		} else {
 			logger := ctxlogger.GetLogger(ctx)
 			logger.Error("ErrorHandler: Handling error: " + err.Error())
 
-			switch err.OriginalError.(type) {
+			switch classified := errors.Classify(err.OriginalError).(type) {
 			case *errors.NonRetryError:
 				logger.Info("ErrorHandler: Handling NonRetryError.")
 				actionErr := nonRetryOperationError(ctx, settler, message)
 				if actionErr != nil {
 					logger.Error("ErrorHandler: " + actionErr.Error())
+				} else {
+					onDeadLetter(ctx, settlementHooks, message, err)
+					onTerminal(ctx, settlementHooks, marshaller, message, oc.Status_FAILED, err)
 				}
 			case *errors.RetryError:
 				logger.Info("ErrorHandler: Handling RetryError.")
 				actionErr := retryOperationError(ctx, settler, message)
 				if actionErr != nil {
 					logger.Error("ErrorHandler: " + actionErr.Error())
+				} else {
+					onRetryScheduled(ctx, settlementHooks, message, err)
+				}
+			case *errors.DeferError:
+				logger.Info("ErrorHandler: Handling DeferError.")
+				deferred, actionErr := deferOperationError(ctx, settler, message, classified)
+				if actionErr != nil {
+					logger.Error("ErrorHandler: " + actionErr.Error())
+				} else if !deferred {
+					onRetryScheduled(ctx, settlementHooks, message, err)
 				}
 			default:
 				logger.Info("ErrorHandler: Error not recognized: " + err.Error())
@@ -54,13 +82,26 @@ func NewErrorHandler(errHandler ErrorHandlerFunc, next shuttle.HandlerFunc) shut
 
 // An error handler that provides the error to the parent handler for logging.
 func NewErrorReturnHandler(errHandler ErrorHandlerFunc, next shuttle.HandlerFunc) ErrorHandlerFunc {
+	return NewErrorReturnHandlerWithHooks(errHandler, next, nil, nil)
+}
+
+// Same as NewErrorReturnHandler, calling the settlement hooks when the message is settled. The
+// OnTerminal hooks are called once the message is completed or dead-lettered, using the marshaller
+// to read the operation id.
+func NewErrorReturnHandlerWithHooks(errHandler ErrorHandlerFunc, next shuttle.HandlerFunc, marshaller shuttle.Marshaller, settlementHooks []hooks.SettlementHooks) ErrorHandlerFunc {
 	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
-		err := errHandler.Handle(ctx, settler, message)
-		if err != nil {
+		settler = newHookedSettler(settler, settlementHooks)
+		recorder := NewSettlementRecorder(settler)
+		err := errHandler.Handle(ctx, recorder, message)
+		if err == nil {
+			if action, ok := recorder.Settlement(); ok && action == hooks.SettleActionComplete {
+				onTerminal(ctx, settlementHooks, marshaller, message, oc.Status_SUCCEEDED, nil)
+			}
+		} else {
 			logger := ctxlogger.GetLogger(ctx)
 			logger.Error("ErrorReturnHandler: Handling error: " + err.Error())
 
-			switch err.OriginalError.(type) {
+			switch classified := errors.Classify(err.OriginalError).(type) {
 			case *errors.NonRetryError:
 				logger.Info("ErrorReturnHandler: Handling NonRetryError.")
 				actionErr := nonRetryOperationError(ctx, settler, message)
@@ -72,6 +113,8 @@ func NewErrorReturnHandler(errHandler ErrorHandlerFunc, next shuttle.HandlerFunc
 						ErrorCode:     500,
 					}
 				}
+				onDeadLetter(ctx, settlementHooks, message, err)
+				onTerminal(ctx, settlementHooks, marshaller, message, oc.Status_FAILED, err)
 			case *errors.RetryError:
 				logger.Info("ErrorReturnHandler: Handling RetryError.")
 				actionErr := retryOperationError(ctx, settler, message)
@@ -83,6 +126,21 @@ func NewErrorReturnHandler(errHandler ErrorHandlerFunc, next shuttle.HandlerFunc
 						ErrorCode:     500,
 					}
 				}
+				onRetryScheduled(ctx, settlementHooks, message, err)
+			case *errors.DeferError:
+				logger.Info("ErrorReturnHandler: Handling DeferError.")
+				deferred, actionErr := deferOperationError(ctx, settler, message, classified)
+				if actionErr != nil {
+					logger.Error("ErrorReturnHandler: " + actionErr.Error())
+					return &errors.AsyncError{
+						OriginalError: actionErr,
+						Message:       actionErr.Error(),
+						ErrorCode:     500,
+					}
+				}
+				if !deferred {
+					onRetryScheduled(ctx, settlementHooks, message, err)
+				}
 			default:
 				logger.Info("ErrorReturnHandler: Error not recognized: " + err.Error())
 			}
@@ -113,7 +171,9 @@ func retryOperationError(ctx context.Context, settler shuttle.MessageSettler, me
 	logger := ctxlogger.GetLogger(ctx)
 	logger.Info("Abandoning message for retry.")
 
-	err := settler.AbandonMessage(ctx, message, nil)
+	// The operation may have failed because the context is done, the message is still abandoned
+	// so it's retried without waiting for the lock to expire.
+	err := settler.AbandonMessage(context.WithoutCancel(ctx), message, nil)
 	if err != nil {
 		logger.Error("Error abandoning message: " + err.Error())
 		return err
@@ -121,3 +181,24 @@ func retryOperationError(ctx context.Context, settler shuttle.MessageSettler, me
 
 	return nil
 }
+
+// Defers the message using the DeferFunc of the context. Without one, nothing would receive the
+// message again, so it's abandoned for retry instead. Returns whether the message was deferred.
+func deferOperationError(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage, deferErr *errors.DeferError) (bool, error) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	deferFunc := getDeferFunc(ctx)
+	if deferFunc == nil {
+		logger.Info("Deferral not configured.")
+		return false, retryOperationError(ctx, settler, message)
+	}
+
+	logger.Info("Deferring message.")
+	err := deferFunc(ctx, settler, message, deferErr)
+	if err != nil {
+		logger.Error("Error deferring message: " + err.Error())
+		return false, err
+	}
+
+	return true, nil
+}
@@ -10,8 +10,10 @@ import (
 	"testing"
 
 	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
 	"github.com/Azure/aks-async/runtime/operation"
 	sampleHandler "github.com/Azure/aks-async/runtime/testutils/handler"
+	sampleHooks "github.com/Azure/aks-async/runtime/testutils/hooks"
 	"github.com/Azure/aks-async/runtime/testutils/settler"
 	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
 	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
@@ -21,6 +23,15 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// Fails to settle the messages if the context is done.
+type contextSettler struct {
+	settler.SampleMessageSettler
+}
+
+func (s *contextSettler) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	return ctx.Err()
+}
+
 func TestErrorHandler(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "ErrorHandler Suite")
@@ -169,6 +180,18 @@ var _ = Describe("ErrorHandler", func() {
 				Expect(strings.Count(buf.String(), "ErrorReturnHandler: Handling RetryError")).To(Equal(1))
 				Expect(err).ToNot(BeNil())
 			})
+
+			It("should abandon the message if the context is done", func() {
+				cancelledCtx, cancel := context.WithCancel(ctx)
+				cancel()
+				testErrorMessage = &asyncErrors.RetryError{
+					Message: "RetryError",
+				}
+				errHandler = NewErrorReturnHandler(SampleErrorHandler(testErrorMessage), nil)
+				err := errHandler(cancelledCtx, &contextSettler{}, message)
+				Expect(err).ToNot(BeNil())
+				Expect(buf.String()).ToNot(ContainSubstring("Error abandoning message"))
+			})
 		})
 
 		Context("NonRetryError", func() {
@@ -197,6 +220,42 @@ var _ = Describe("ErrorHandler", func() {
 			})
 		})
 
+		It("should defer the message on a DeferError", func() {
+			var deferred *asyncErrors.DeferError
+			ctx = WithDeferFunc(ctx, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage, deferErr *asyncErrors.DeferError) error {
+				deferred = deferErr
+				return settler.DeferMessage(ctx, message, nil)
+			})
+			testErrorMessage = &asyncErrors.DeferError{Message: "DeferError"}
+			errHandler = NewErrorReturnHandler(SampleErrorHandler(testErrorMessage), sampleHandler.SampleHandler())
+			err := errHandler(ctx, sampleSettler, message)
+			Expect(strings.Count(buf.String(), "ErrorReturnHandler: Handling DeferError")).To(Equal(1))
+			Expect(deferred).To(Equal(testErrorMessage))
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should abandon the message on a DeferError if deferral isn't configured", func() {
+			testErrorMessage = &asyncErrors.DeferError{Message: "DeferError"}
+			errHandler = NewErrorReturnHandler(SampleErrorHandler(testErrorMessage), sampleHandler.SampleHandler())
+			err := errHandler(ctx, sampleSettler, message)
+			Expect(strings.Count(buf.String(), "Deferral not configured")).To(Equal(1))
+			Expect(strings.Count(buf.String(), "Abandoning message for retry")).To(Equal(1))
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should return the error if deferring fails", func() {
+			ctx = WithDeferFunc(ctx, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage, deferErr *asyncErrors.DeferError) error {
+				return settler.DeferMessage(ctx, message, nil)
+			})
+			failureContentType := "failure_test"
+			message.ContentType = &failureContentType
+			testErrorMessage = &asyncErrors.DeferError{Message: "DeferError"}
+			errHandler = NewErrorReturnHandler(SampleErrorHandler(testErrorMessage), sampleHandler.SampleHandler())
+			err := errHandler(ctx, sampleSettler, message)
+			Expect(strings.Count(buf.String(), "ErrorReturnHandler: ")).To(Equal(3))
+			Expect(err.ErrorCode).To(Equal(500))
+		})
+
 		It("should handle default case", func() {
 			testErrorMessage = errors.New("Random error")
 			errHandler = NewErrorReturnHandler(SampleErrorHandler(testErrorMessage), sampleHandler.SampleHandler())
@@ -206,6 +265,79 @@ var _ = Describe("ErrorHandler", func() {
 			Expect(err).ToNot(BeNil())
 		})
 	})
+
+	Context("Settlement hooks", func() {
+		var (
+			settlementHooks *sampleHooks.SampleSettlementHooks
+		)
+
+		BeforeEach(func() {
+			settlementHooks = &sampleHooks.SampleSettlementHooks{}
+		})
+
+		It("should call the hooks when the message is completed down the chain", func() {
+			completeHandler := func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+				_ = settler.CompleteMessage(ctx, message, nil)
+				return nil
+			}
+			errHandler := NewErrorReturnHandlerWithHooks(completeHandler, nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			Expect(errHandler(ctx, sampleSettler, message)).To(BeNil())
+			Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Complete", "AfterSettle:Complete", "OnTerminal:SUCCEEDED"}))
+		})
+
+		It("should call the hooks when a retry is scheduled", func() {
+			testErrorMessage = &asyncErrors.RetryError{Message: "RetryError"}
+			handler := NewErrorHandlerWithHooks(SampleErrorHandler(testErrorMessage), nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			handler(ctx, sampleSettler, message)
+			Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Abandon", "AfterSettle:Abandon", "OnRetryScheduled"}))
+		})
+
+		It("should call the hooks when the message is dead-lettered", func() {
+			testErrorMessage = &asyncErrors.NonRetryError{Message: "NonRetryError"}
+			errHandler := NewErrorReturnHandlerWithHooks(SampleErrorHandler(testErrorMessage), nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			Expect(errHandler(ctx, sampleSettler, message)).ToNot(BeNil())
+			Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:DeadLetter", "AfterSettle:DeadLetter", "OnDeadLetter", "OnTerminal:FAILED"}))
+		})
+
+		It("should call the hooks when the message is deferred", func() {
+			ctx = WithDeferFunc(ctx, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage, deferErr *asyncErrors.DeferError) error {
+				return settler.DeferMessage(ctx, message, nil)
+			})
+			testErrorMessage = &asyncErrors.DeferError{Message: "DeferError"}
+			handler := NewErrorHandlerWithHooks(SampleErrorHandler(testErrorMessage), nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			handler(ctx, sampleSettler, message)
+			Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Defer", "AfterSettle:Defer"}))
+		})
+
+		It("should call the retry hooks when a DeferError is abandoned", func() {
+			testErrorMessage = &asyncErrors.DeferError{Message: "DeferError"}
+			handler := NewErrorHandlerWithHooks(SampleErrorHandler(testErrorMessage), nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			handler(ctx, sampleSettler, message)
+			Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Abandon", "AfterSettle:Abandon", "OnRetryScheduled"}))
+		})
+
+		It("should call OnTerminal when the message is dead-lettered by the error handler", func() {
+			testErrorMessage = &asyncErrors.NonRetryError{Message: "NonRetryError"}
+			handler := NewErrorHandlerWithHooks(SampleErrorHandler(testErrorMessage), nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			handler(ctx, sampleSettler, message)
+			Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:DeadLetter", "AfterSettle:DeadLetter", "OnDeadLetter", "OnTerminal:FAILED"}))
+		})
+
+		It("should not call OnTerminal if the message isn't settled", func() {
+			errHandler := NewErrorReturnHandlerWithHooks(SampleErrorHandler(nil), nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			Expect(errHandler(ctx, sampleSettler, message)).To(BeNil())
+			Expect(settlementHooks.Calls).To(BeEmpty())
+		})
+
+		It("should not call OnDeadLetter if settling fails", func() {
+			failureContentType := "failure_test"
+			message.ContentType = &failureContentType
+			testErrorMessage = &asyncErrors.NonRetryError{Message: "NonRetryError"}
+			errHandler := NewErrorReturnHandlerWithHooks(SampleErrorHandler(testErrorMessage), nil, marshaller, []hooks.SettlementHooks{settlementHooks})
+			Expect(errHandler(ctx, sampleSettler, message)).ToNot(BeNil())
+			Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:DeadLetter", "AfterSettle:DeadLetter:error"}))
+		})
+	})
 })
 
 // Need to re-create this here because importing it from testutils would cause an import cycle error.
@@ -0,0 +1,73 @@
+package errors
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+// Reschedules the message instead of abandoning it: a copy is sent to be enqueued after the delay
+// and the original message is completed. Unlike abandoning, the message isn't redelivered right away
+// and its delivery count isn't increased.
+func RescheduleMessage(ctx context.Context, settler shuttle.MessageSettler, sender sb.SenderInterface, message *azservicebus.ReceivedMessage, delay time.Duration) error {
+	logger := ctxlogger.GetLogger(ctx)
+	logger.Info("Rescheduling message in " + delay.String())
+
+	err := sender.SendMessage(ctx, NewScheduledMessage(message, time.Now().Add(delay)))
+	if err != nil {
+		logger.Error("Error sending rescheduled message: " + err.Error())
+		return err
+	}
+
+	err = settler.CompleteMessage(ctx, message, nil)
+	if err != nil {
+		logger.Error("Error completing rescheduled message: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Same as RescheduleMessage, calling the settlement hooks when the message is completed and the
+// OnRetryScheduled hooks once it's rescheduled. Used by the handlers settling messages outside of
+// the error handlers.
+func RescheduleMessageWithHooks(ctx context.Context, settler shuttle.MessageSettler, sender sb.SenderInterface, message *azservicebus.ReceivedMessage, delay time.Duration, asyncErr *errors.AsyncError, settlementHooks []hooks.SettlementHooks) error {
+	err := RescheduleMessage(ctx, newHookedSettler(settler, settlementHooks), sender, message, delay)
+	if err != nil {
+		return err
+	}
+
+	onRetryScheduled(ctx, settlementHooks, message, asyncErr)
+	return nil
+}
+
+// Creates a copy of the received message to be enqueued at the given time. The MessageID is not
+// copied so the copy isn't dropped by duplicate detection.
+func NewScheduledMessage(message *azservicebus.ReceivedMessage, enqueueTime time.Time) *azservicebus.Message {
+	properties := make(map[string]any, len(message.ApplicationProperties))
+	for k, v := range message.ApplicationProperties {
+		properties[k] = v
+	}
+
+	return &azservicebus.Message{
+		Body:                  message.Body,
+		ApplicationProperties: properties,
+		ContentType:           message.ContentType,
+		CorrelationID:         message.CorrelationID,
+		PartitionKey:          message.PartitionKey,
+		ReplyTo:               message.ReplyTo,
+		ReplyToSessionID:      message.ReplyToSessionID,
+		SessionID:             message.SessionID,
+		Subject:               message.Subject,
+		TimeToLive:            message.TimeToLive,
+		To:                    message.To,
+		ScheduledEnqueueTime:  &enqueueTime,
+	}
+}
@@ -0,0 +1,162 @@
+package errors
+
+import (
+	"context"
+	"sync"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+var _ shuttle.MessageSettler = &hookedSettler{}
+
+// hookedSettler calls the BeforeSettle and AfterSettle hooks around every settlement, including
+// the ones done by the handlers further down the chain.
+type hookedSettler struct {
+	shuttle.MessageSettler
+	hooks []hooks.SettlementHooks
+}
+
+func newHookedSettler(settler shuttle.MessageSettler, settlementHooks []hooks.SettlementHooks) shuttle.MessageSettler {
+	if len(settlementHooks) == 0 {
+		return settler
+	}
+	return &hookedSettler{MessageSettler: settler, hooks: settlementHooks}
+}
+
+func (s *hookedSettler) settle(ctx context.Context, message *azservicebus.ReceivedMessage, action hooks.SettleAction, settle func() error) error {
+	for _, hook := range s.hooks {
+		hook.BeforeSettle(ctx, message, action)
+	}
+	err := settle()
+	for _, hook := range s.hooks {
+		hook.AfterSettle(ctx, message, action, err)
+	}
+	return err
+}
+
+func (s *hookedSettler) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	return s.settle(ctx, message, hooks.SettleActionComplete, func() error {
+		return s.MessageSettler.CompleteMessage(ctx, message, options)
+	})
+}
+
+func (s *hookedSettler) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	return s.settle(ctx, message, hooks.SettleActionAbandon, func() error {
+		return s.MessageSettler.AbandonMessage(ctx, message, options)
+	})
+}
+
+func (s *hookedSettler) DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error {
+	return s.settle(ctx, message, hooks.SettleActionDeadLetter, func() error {
+		return s.MessageSettler.DeadLetterMessage(ctx, message, options)
+	})
+}
+
+func (s *hookedSettler) DeferMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions) error {
+	return s.settle(ctx, message, hooks.SettleActionDefer, func() error {
+		return s.MessageSettler.DeferMessage(ctx, message, options)
+	})
+}
+
+var _ shuttle.MessageSettler = &SettlementRecorder{}
+
+// SettlementRecorder records the settlement of the message by the handlers further down the chain,
+// so the outcome of the message is known even if a later step, like updating the operation
+// status, fails.
+type SettlementRecorder struct {
+	shuttle.MessageSettler
+	action hooks.SettleAction
+	mu     sync.Mutex
+}
+
+func NewSettlementRecorder(settler shuttle.MessageSettler) *SettlementRecorder {
+	return &SettlementRecorder{MessageSettler: settler}
+}
+
+// Returns the action that settled the message, if it was settled successfully.
+func (r *SettlementRecorder) Settlement() (hooks.SettleAction, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.action, r.action != ""
+}
+
+func (r *SettlementRecorder) record(action hooks.SettleAction, err error) error {
+	if err == nil {
+		r.mu.Lock()
+		r.action = action
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *SettlementRecorder) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	return r.record(hooks.SettleActionComplete, r.MessageSettler.CompleteMessage(ctx, message, options))
+}
+
+func (r *SettlementRecorder) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	return r.record(hooks.SettleActionAbandon, r.MessageSettler.AbandonMessage(ctx, message, options))
+}
+
+func (r *SettlementRecorder) DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error {
+	return r.record(hooks.SettleActionDeadLetter, r.MessageSettler.DeadLetterMessage(ctx, message, options))
+}
+
+func (r *SettlementRecorder) DeferMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions) error {
+	return r.record(hooks.SettleActionDefer, r.MessageSettler.DeferMessage(ctx, message, options))
+}
+
+func onRetryScheduled(ctx context.Context, settlementHooks []hooks.SettlementHooks, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError) {
+	for _, hook := range settlementHooks {
+		hook.OnRetryScheduled(ctx, message, asyncErr)
+	}
+}
+
+func onDeadLetter(ctx context.Context, settlementHooks []hooks.SettlementHooks, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError) {
+	for _, hook := range settlementHooks {
+		hook.OnDeadLetter(ctx, message, asyncErr)
+	}
+}
+
+type terminalHooksKey struct{}
+
+// Returns a context where the error handlers don't call the OnTerminal hooks, used by the handlers
+// around them that call the hooks once the final status of the operation is set.
+func WithoutTerminalHooks(ctx context.Context) context.Context {
+	return context.WithValue(ctx, terminalHooksKey{}, true)
+}
+
+func terminalHooksDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(terminalHooksKey{}).(bool)
+	return disabled
+}
+
+// Calls the OnTerminal hooks with the id of the operation of the message. The message was completed
+// or dead-lettered, so the operation won't run again whether or not an OperationContainer is used.
+func onTerminal(ctx context.Context, settlementHooks []hooks.SettlementHooks, marshaller shuttle.Marshaller, message *azservicebus.ReceivedMessage, status oc.Status, asyncErr *errors.AsyncError) {
+	if len(settlementHooks) == 0 || terminalHooksDisabled(ctx) {
+		return
+	}
+
+	if marshaller == nil {
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+	}
+
+	var body operation.OperationRequest
+	err := marshaller.Unmarshal(message.Message(), &body)
+	if err != nil {
+		ctxlogger.GetLogger(ctx).Error("Unable to unmarshal message for the terminal hooks: " + err.Error())
+		return
+	}
+
+	ctx = hooks.WithTerminalRequest(ctx, &body)
+	for _, hook := range settlementHooks {
+		hook.OnTerminal(ctx, body.OperationId, status, asyncErr)
+	}
+}
@@ -0,0 +1,167 @@
+package lockrenewal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/matcher"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+const DefaultInterval = 10 * time.Second
+
+// Cause of the cancellation of the operation when the message lock couldn't be renewed.
+type LockRenewalError struct {
+	Err error
+}
+
+func (e *LockRenewalError) Error() string {
+	return fmt.Sprintf("Error renewing the message lock: %s", e.Err.Error())
+}
+
+func (e *LockRenewalError) Unwrap() error {
+	return e.Err
+}
+
+// Cause of the cancellation of the operation when it held the message for too long.
+type MaxLockDurationError struct {
+	OperationName string
+	MaxDuration   time.Duration
+}
+
+func (e *MaxLockDurationError) Error() string {
+	return fmt.Sprintf("Operation %s held the message lock for more than %s.", e.OperationName, e.MaxDuration)
+}
+
+// Handler that renews the message lock while the operation runs, using the lock renewal policy
+// registered in the matcher for the operation, or the default policy otherwise. If the lock
+// can't be renewed or the operation runs for longer than the maximum duration of the policy,
+// the context of the operation is cancelled and the handler returns a RetryError or a
+// NonRetryError respectively, so the error handlers around it settle the message and update
+// the operation accordingly. The time excluded with ExcludeFromMaxDuration isn't counted towards
+// the maximum duration. Once the message is settled the lock isn't renewed anymore, and the
+// cancellation cause only replaces the error of the operation if the operation failed.
+func NewLockRenewalHandler(operationMatcher *matcher.Matcher, defaultPolicy *matcher.LockRenewalPolicy, errHandler errorHandlers.ErrorHandlerFunc, marshaller shuttle.Marshaller) errorHandlers.ErrorHandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
+		logger := ctxlogger.GetLogger(ctx)
+
+		if marshaller == nil {
+			marshaller = &shuttle.DefaultProtoMarshaller{}
+		}
+
+		policy := matcher.LockRenewalPolicy{}
+		if defaultPolicy != nil {
+			policy = *defaultPolicy
+		}
+
+		// An invalid message still has its lock renewed, the operation handler reports the error.
+		var body operation.OperationRequest
+		err := marshaller.Unmarshal(message.Message(), &body)
+		if err == nil && operationMatcher != nil {
+			if operationPolicy, ok := operationMatcher.GetLockRenewalPolicy(ctx, body.OperationName); ok {
+				policy = operationPolicy
+			}
+		}
+		if policy.Interval <= 0 {
+			policy.Interval = DefaultInterval
+		}
+
+		renewCtx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		clock := newMaxDurationClock(policy.MaxDuration)
+		defer clock.stop()
+		renewCtx = context.WithValue(renewCtx, maxDurationClockKey{}, clock)
+
+		signal := newSettlementSignal(settler)
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			renewLock(renewCtx, cancel, done, signal, message, &body, policy, clock)
+		}()
+
+		asyncErr := errHandler.Handle(renewCtx, signal, message)
+		close(done)
+		<-stopped
+
+		// The operation succeeded, even if the lock was lost afterwards.
+		if asyncErr == nil {
+			return nil
+		}
+
+		cause := context.Cause(renewCtx)
+		switch cause := cause.(type) {
+		case *LockRenewalError:
+			if asyncErr != nil {
+				logger.Error("LockRenewalHandler: Operation failed after losing the message lock: " + asyncErr.Error())
+			}
+			return &errors.AsyncError{
+				OriginalError: &errors.RetryError{Message: cause.Error()},
+				Message:       "LockRenewalHandler: " + cause.Error(),
+				ErrorCode:     500,
+			}
+		case *MaxLockDurationError:
+			if asyncErr != nil {
+				logger.Error("LockRenewalHandler: Operation failed after exceeding the maximum lock duration: " + asyncErr.Error())
+			}
+			return &errors.AsyncError{
+				OriginalError: &errors.NonRetryError{Message: cause.Error()},
+				Message:       "LockRenewalHandler: " + cause.Error(),
+				ErrorCode:     408,
+			}
+		}
+
+		return asyncErr
+	}
+}
+
+// Renews the lock every interval until done is closed or the message is settled, cancelling the
+// context with the reason if the lock can't be renewed or the maximum duration is reached.
+func renewLock(ctx context.Context, cancel context.CancelCauseFunc, done <-chan struct{}, signal *settlementSignal, message *azservicebus.ReceivedMessage, body *operation.OperationRequest, policy matcher.LockRenewalPolicy, clock *maxDurationClock) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-clock.expiredC():
+			if signal.isSettled() {
+				return
+			}
+			err := &MaxLockDurationError{OperationName: body.OperationName, MaxDuration: policy.MaxDuration}
+			logger.Error("LockRenewalHandler: " + err.Error())
+			cancel(err)
+			return
+		case <-ticker.C:
+			settled, err := signal.renew(ctx, message)
+			if settled {
+				return
+			}
+			if err != nil {
+				// The operation may have finished while renewing.
+				select {
+				case <-done:
+					return
+				default:
+				}
+				renewalErr := &LockRenewalError{Err: err}
+				logger.Error("LockRenewalHandler: " + renewalErr.Error())
+				cancel(renewalErr)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package lockrenewal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/matcher"
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLockRenewal(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "LockRenewal Suite")
+}
+
+// Counts the lock renewals, failing once it reaches failAfter if set.
+type renewalSettler struct {
+	settler.SampleMessageSettler
+	renewals  atomic.Int32
+	failAfter int32
+}
+
+func (s *renewalSettler) RenewMessageLock(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.RenewMessageLockOptions) error {
+	if s.renewals.Add(1) == s.failAfter {
+		return errors.New("lock lost")
+	}
+	return nil
+}
+
+var _ = Describe("LockRenewalHandler", func() {
+	var (
+		ctx              context.Context
+		buf              bytes.Buffer
+		message          *azservicebus.ReceivedMessage
+		operationMatcher *matcher.Matcher
+		renewals         *renewalSettler
+	)
+
+	BeforeEach(func() {
+		buf.Reset()
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		ctx = ctxlogger.WithLogger(context.TODO(), logger)
+
+		marshalledMessage, err := (&shuttle.DefaultProtoMarshaller{}).Marshal(&operation.OperationRequest{OperationName: "Upgrade", OperationId: "0"})
+		Expect(err).ToNot(HaveOccurred())
+		message = convert.ConvertToReceivedMessage(marshalledMessage)
+
+		operationMatcher = matcher.NewMatcher()
+		renewals = &renewalSettler{}
+	})
+
+	// Runs until the context is cancelled or the duration expires.
+	waitingHandler := func(duration time.Duration) func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+		return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			select {
+			case <-time.After(duration):
+				return nil
+			case <-ctx.Done():
+				return &asyncErrors.AsyncError{OriginalError: ctx.Err(), Message: ctx.Err().Error()}
+			}
+		}
+	}
+
+	It("should renew the lock using the policy of the operation", func() {
+		Expect(operationMatcher.RegisterLockRenewalPolicy(ctx, "Upgrade", matcher.LockRenewalPolicy{Interval: 10 * time.Millisecond})).To(Succeed())
+		handler := NewLockRenewalHandler(operationMatcher, &matcher.LockRenewalPolicy{Interval: time.Hour}, waitingHandler(55*time.Millisecond), nil)
+
+		Expect(handler(ctx, renewals, message)).To(BeNil())
+		Expect(renewals.renewals.Load()).To(BeNumerically(">=", 3))
+	})
+
+	It("should use the default policy", func() {
+		handler := NewLockRenewalHandler(operationMatcher, &matcher.LockRenewalPolicy{Interval: time.Hour}, waitingHandler(20*time.Millisecond), nil)
+		Expect(handler(ctx, renewals, message)).To(BeNil())
+		Expect(renewals.renewals.Load()).To(BeEquivalentTo(0))
+	})
+
+	It("should cancel the operation if the lock can't be renewed", func() {
+		renewals.failAfter = 2
+		handler := NewLockRenewalHandler(operationMatcher, &matcher.LockRenewalPolicy{Interval: 10 * time.Millisecond}, waitingHandler(time.Minute), nil)
+
+		asyncErr := handler(ctx, renewals, message)
+		Expect(asyncErr).ToNot(BeNil())
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+		Expect(asyncErr.Message).To(ContainSubstring("lock lost"))
+	})
+
+	It("should cancel the operation once it exceeds the maximum duration", func() {
+		Expect(operationMatcher.RegisterLockRenewalPolicy(ctx, "Upgrade", matcher.LockRenewalPolicy{Interval: 10 * time.Millisecond, MaxDuration: 30 * time.Millisecond})).To(Succeed())
+		handler := NewLockRenewalHandler(operationMatcher, nil, waitingHandler(time.Minute), nil)
+
+		asyncErr := handler(ctx, renewals, message)
+		Expect(asyncErr).ToNot(BeNil())
+		var nonRetryErr *asyncErrors.NonRetryError
+		Expect(errors.As(asyncErr, &nonRetryErr)).To(BeTrue())
+		Expect(asyncErr.ErrorCode).To(Equal(408))
+	})
+
+	It("should not count the excluded time towards the maximum duration", func() {
+		policy := &matcher.LockRenewalPolicy{Interval: 10 * time.Millisecond, MaxDuration: 40 * time.Millisecond}
+		handler := NewLockRenewalHandler(operationMatcher, policy, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			Expect(ExcludeFromMaxDuration(ctx, func() error {
+				time.Sleep(80 * time.Millisecond)
+				return nil
+			})).To(Succeed())
+			return waitingHandler(10*time.Millisecond)(ctx, settler, message)
+		}, nil)
+
+		Expect(handler(ctx, renewals, message)).To(BeNil())
+		Expect(renewals.renewals.Load()).To(BeNumerically(">=", 5))
+	})
+
+	It("should keep counting the time after the excluded one", func() {
+		policy := &matcher.LockRenewalPolicy{Interval: 10 * time.Millisecond, MaxDuration: 40 * time.Millisecond}
+		handler := NewLockRenewalHandler(operationMatcher, policy, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			Expect(ExcludeFromMaxDuration(ctx, func() error {
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			})).To(Succeed())
+			return waitingHandler(time.Minute)(ctx, settler, message)
+		}, nil)
+
+		asyncErr := handler(ctx, renewals, message)
+		Expect(asyncErr).ToNot(BeNil())
+		Expect(asyncErr.ErrorCode).To(Equal(408))
+	})
+
+	It("should return the error of the operation", func() {
+		operationErr := &asyncErrors.AsyncError{OriginalError: &asyncErrors.RetryError{Message: "retry"}}
+		handler := NewLockRenewalHandler(operationMatcher, nil, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			return operationErr
+		}, nil)
+		Expect(handler(ctx, renewals, message)).To(Equal(operationErr))
+	})
+
+	It("should stop renewing the lock once the message is settled", func() {
+		renewals.failAfter = 1
+		handler := NewLockRenewalHandler(operationMatcher, &matcher.LockRenewalPolicy{Interval: 10 * time.Millisecond}, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			Expect(settler.CompleteMessage(ctx, message, nil)).To(Succeed())
+			return waitingHandler(40*time.Millisecond)(ctx, settler, message)
+		}, nil)
+
+		Expect(handler(ctx, renewals, message)).To(BeNil())
+		Expect(renewals.renewals.Load()).To(BeEquivalentTo(0))
+	})
+
+	It("should not cancel the operation after the message is settled and the maximum duration is reached", func() {
+		policy := &matcher.LockRenewalPolicy{Interval: time.Hour, MaxDuration: 20 * time.Millisecond}
+		handler := NewLockRenewalHandler(operationMatcher, policy, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			Expect(settler.CompleteMessage(ctx, message, nil)).To(Succeed())
+			return waitingHandler(50*time.Millisecond)(ctx, settler, message)
+		}, nil)
+
+		Expect(handler(ctx, renewals, message)).To(BeNil())
+	})
+
+	It("should return nil if the operation succeeded after losing the lock", func() {
+		renewals.failAfter = 1
+		handler := NewLockRenewalHandler(operationMatcher, &matcher.LockRenewalPolicy{Interval: 10 * time.Millisecond}, func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		}, nil)
+
+		Expect(handler(ctx, renewals, message)).To(BeNil())
+	})
+})
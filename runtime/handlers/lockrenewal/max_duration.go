@@ -0,0 +1,94 @@
+package lockrenewal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type maxDurationClockKey struct{}
+
+// Runs fn without counting its duration towards the maximum lock duration of the lock renewal
+// handler around the context, e.g. while waiting for a concurrency slot before running the
+// operation. The lock is still renewed in the meantime.
+func ExcludeFromMaxDuration(ctx context.Context, fn func() error) error {
+	clock, ok := ctx.Value(maxDurationClockKey{}).(*maxDurationClock)
+	if !ok {
+		return fn()
+	}
+
+	clock.pause()
+	defer clock.resume()
+	return fn()
+}
+
+// maxDurationClock expires once the operation held the lock for the maximum duration, not
+// counting the time it was paused.
+type maxDurationClock struct {
+	timer     *time.Timer
+	deadline  time.Time
+	remaining time.Duration
+	paused    int
+	expired   bool
+	mu        sync.Mutex
+}
+
+// Returns a clock that never expires if the maximum duration isn't set.
+func newMaxDurationClock(maxDuration time.Duration) *maxDurationClock {
+	clock := &maxDurationClock{}
+	if maxDuration > 0 {
+		clock.timer = time.NewTimer(maxDuration)
+		clock.deadline = time.Now().Add(maxDuration)
+	}
+	return clock
+}
+
+func (c *maxDurationClock) expiredC() <-chan time.Time {
+	if c.timer == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+func (c *maxDurationClock) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer == nil || c.expired {
+		return
+	}
+	c.paused++
+	if c.paused > 1 {
+		return
+	}
+	if !c.timer.Stop() {
+		// The clock expired before being paused.
+		c.expired = true
+		return
+	}
+	c.remaining = time.Until(c.deadline)
+}
+
+func (c *maxDurationClock) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer == nil || c.expired {
+		return
+	}
+	c.paused--
+	if c.paused > 0 {
+		return
+	}
+	c.deadline = time.Now().Add(c.remaining)
+	c.timer.Reset(c.remaining)
+}
+
+func (c *maxDurationClock) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
@@ -0,0 +1,68 @@
+package lockrenewal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+)
+
+// Settler that records when the message is settled, so the lock stops being renewed and the
+// work done by the handlers after settling the message isn't cancelled. The settlement and the
+// renewals are serialized, so a renewal never fails because it raced the settlement.
+type settlementSignal struct {
+	shuttle.MessageSettler
+	mu      sync.Mutex
+	settled bool
+}
+
+var _ shuttle.MessageSettler = &settlementSignal{}
+
+func newSettlementSignal(settler shuttle.MessageSettler) *settlementSignal {
+	return &settlementSignal{MessageSettler: settler}
+}
+
+func (s *settlementSignal) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	return s.settle(func() error { return s.MessageSettler.AbandonMessage(ctx, message, options) })
+}
+
+func (s *settlementSignal) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	return s.settle(func() error { return s.MessageSettler.CompleteMessage(ctx, message, options) })
+}
+
+func (s *settlementSignal) DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error {
+	return s.settle(func() error { return s.MessageSettler.DeadLetterMessage(ctx, message, options) })
+}
+
+func (s *settlementSignal) DeferMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions) error {
+	return s.settle(func() error { return s.MessageSettler.DeferMessage(ctx, message, options) })
+}
+
+func (s *settlementSignal) settle(settle func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := settle()
+	if err == nil {
+		s.settled = true
+	}
+	return err
+}
+
+// Renews the lock unless the message was already settled, reporting whether it was.
+func (s *settlementSignal) renew(ctx context.Context, message *azservicebus.ReceivedMessage) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.settled {
+		return true, nil
+	}
+	return false, s.MessageSettler.RenewMessageLock(ctx, message, nil)
+}
+
+func (s *settlementSignal) isSettled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settled
+}
@@ -2,6 +2,7 @@ package operation
 
 import (
 	"context"
+	stderrors "errors"
 	"time"
 
 	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
@@ -13,11 +14,77 @@ import (
 	"github.com/Azure/aks-async/runtime/errors"
 	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
 	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/lock"
 	"github.com/Azure/aks-async/runtime/matcher"
 	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/outbox"
+	"github.com/Azure/aks-async/runtime/progress"
+	"github.com/Azure/aks-async/runtime/result"
+	"github.com/Azure/aks-async/runtime/statemachine"
 )
 
+// OperationHandlerOptions are the optional features of the operation handler.
+type OperationHandlerOptions struct {
+	// ResultPublisher saves the result of the operations implementing operation.ResultOperation
+	// before the message is completed. The reply is sent once the message is completed, through the
+	// Outbox if it has a ServiceBusClient. The operations that fail for good get a failure reply.
+	ResultPublisher *result.Publisher
+	// ProgressSink persists the progress reported by the operations through the
+	// progress.ProgressReporter injected in the context of Run.
+	ProgressSink progress.Sink
+	// Minimum time between two persisted progress reports. Defaults to progress.DefaultMinInterval.
+	ProgressInterval time.Duration
+	// CheckpointStore persists the last completed step of the operations that run using
+	// operation.RunSteps, so they can resume after a redelivery. The checkpoint is deleted once the
+	// operation succeeds and its message is completed.
+	CheckpointStore operation.CheckpointStore
+	// StepHooks are called before and after each step. The operation hooks that implement
+	// operation.StepHooks are also called.
+	StepHooks []operation.StepHooks
+	// Outbox enqueues the continuations of the operations implementing operation.ContinuationOperation.
+	// They are stored before the message is completed and sent right after. With a ServiceBusClient,
+	// it also stores the replies of the ResultPublisher.
+	Outbox *outbox.Outbox
+	// Disables the built-in guards for entities implementing entity.VersionedEntity.
+	// See operation.GuardEntityState.
+	DisableEntityGuards bool
+	// StateMachine validates and writes the provisioning state of the entity for the operations
+	// implementing statemachine.StatefulOperation.
+	StateMachine *statemachine.StateMachine
+	// Locker grants the operation an exclusive lease over its entity while it runs, for entities
+	// that can't rely on GuardConcurrency. Operations are retried while the lease is contended.
+	Locker lock.Locker
+	// Duration of the entity lease. Defaults to lock.DefaultTTL.
+	LockTTL time.Duration
+	// Interval between renewals of the entity lease. Defaults to lock.DefaultRenewInterval.
+	LockRenewInterval time.Duration
+	// Decides which error is returned when both the operation and an After* hook fail. Defaults to
+	// hooks.ErrorPolicyJoined.
+	HookErrorPolicy hooks.ErrorPolicy
+}
+
 func NewOperationHandler(matcher *matcher.Matcher, hooks []hooks.BaseOperationHooksInterface, entityController ec.EntityController, marshaller shuttle.Marshaller) errorHandlers.ErrorHandlerFunc {
+	return NewOperationHandlerWithOptions(matcher, hooks, entityController, marshaller, nil)
+}
+
+// Same as NewOperationHandler, but allows enabling the optional features of the handler.
+func NewOperationHandlerWithOptions(matcher *matcher.Matcher, hooks []hooks.BaseOperationHooksInterface, entityController ec.EntityController, marshaller shuttle.Marshaller, options *OperationHandlerOptions) errorHandlers.ErrorHandlerFunc {
+	if options == nil {
+		options = &OperationHandlerOptions{}
+	}
+
+	progressInterval := options.ProgressInterval
+	if progressInterval <= 0 {
+		progressInterval = progress.DefaultMinInterval
+	}
+
+	stepHooks := append([]operation.StepHooks{}, options.StepHooks...)
+	for _, hook := range hooks {
+		if stepHook, ok := hook.(operation.StepHooks); ok {
+			stepHooks = append(stepHooks, stepHook)
+		}
+	}
+
 	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
 		logger := ctxlogger.GetLogger(ctx)
 
@@ -40,7 +107,7 @@ func NewOperationHandler(matcher *matcher.Matcher, hooks []hooks.BaseOperationHo
 		}
 
 		// 2. Match it with the correct type of operation
-		operation, err := matcher.CreateHookedInstance(ctx, body.OperationName, hooks)
+		hookedOperation, err := matcher.CreateHookedInstanceForVersion(ctx, body.OperationName, body.ApiVersion, hooks)
 		if err != nil {
 			errorMessage := "Operation type doesn't exist in the matcher: " + err.Error()
 			logger.Error(errorMessage)
@@ -52,38 +119,105 @@ func NewOperationHandler(matcher *matcher.Matcher, hooks []hooks.BaseOperationHo
 			}
 		}
 
+		hookedOperation.ErrorPolicy = options.HookErrorPolicy
+
 		// 3. Init the operation with the information we have.
-		_, asyncErr := operation.InitOperation(ctx, &body)
+		_, asyncErr := hookedOperation.InitOperation(ctx, &body)
 		if asyncErr != nil {
 			logger.Error("Something went wrong initializing the operation.")
 			return asyncErr
 		}
 
+		// 4. Lock the entity before reading it, so the entity isn't changed by another operation
+		// until this one finishes. The lease is released once the message is settled.
+		lockCtx, releaseLock, asyncErr := acquireEntityLock(ctx, options, &body)
+		if asyncErr != nil {
+			logger.Error("Error acquiring the entity lock: " + asyncErr.Error())
+			return asyncErr
+		}
+		defer releaseLock()
+
+		// 5. Get the entity.
 		//TODO(mheberling): Remove this after usage is adopted in Guardrails
+		// Without an EntityController, fall back to the entity factory registered in the matcher.
 		var e entity.Entity
-		if entityController != nil {
-			e, asyncErr = entityController.GetEntity(ctx, &body)
+		getEntity := entityController
+		if getEntity == nil {
+			if factory, ok := matcher.GetEntityFactory(ctx, body.OperationName); ok {
+				getEntity = factory
+			}
+		}
+		if getEntity != nil {
+			e, asyncErr = getEntity.GetEntity(ctx, &body)
 			if asyncErr != nil {
 				logger.Error("Something went wrong getting the entity.")
 				return asyncErr
 			}
 		}
 
-		// 4. Guard against concurrency.
-		asyncErr = operation.GuardConcurrency(ctx, e)
+		// 6. Guard against concurrency.
+		if !options.DisableEntityGuards {
+			hookedOperation.EntityGuard = func(ctx context.Context, e entity.Entity) *errors.AsyncError {
+				return operation.GuardEntityState(ctx, &body, e)
+			}
+		}
+		asyncErr = hookedOperation.GuardConcurrency(ctx, e)
 		if asyncErr != nil {
 			logger.Error("Error calling GuardConcurrency: " + asyncErr.Error())
 			return asyncErr
 		}
 
-		// 5. Call run on the operation
-		asyncErr = operation.Run(ctx)
+		// 7. Call run on the operation
+		runCtx := newRunContext(lockCtx, options, &body, progressInterval, stepHooks)
+		if options.StateMachine != nil {
+			asyncErr = options.StateMachine.Run(runCtx, &body, hookedOperation.OperationInstance, e, hookedOperation.Run)
+		} else {
+			asyncErr = hookedOperation.Run(runCtx)
+		}
 		if asyncErr != nil {
 			logger.Error("Something went wrong running the operation: " + asyncErr.Error())
+			// The operation failed for good, it won't resume from its checkpoint.
+			if _, ok := errors.Classify(asyncErr.OriginalError).(*errors.NonRetryError); ok {
+				deleteCheckpoint(ctx, options, &body)
+				sendFailureReply(ctx, options, message, &body, asyncErr)
+			}
 			return asyncErr
 		}
 
-		// 6. Settle the message
+		// 8. Save the result of the operation. The reply is only sent once the message is completed.
+		var reply *azservicebus.Message
+		if options.ResultPublisher != nil {
+			reply, asyncErr = saveResult(ctx, options.ResultPublisher, message, hookedOperation.OperationInstance)
+			if asyncErr != nil {
+				logger.Error("Something went wrong saving the operation result: " + asyncErr.Error())
+				return asyncErr
+			}
+		}
+
+		// 9. Store the continuations of the operation
+		var entries []*outbox.OutboxEntry
+		if options.Outbox != nil {
+			entries, asyncErr = enqueueContinuations(ctx, options.Outbox, message, &body, hookedOperation.OperationInstance)
+			if asyncErr != nil {
+				logger.Error("Something went wrong enqueueing the continuations: " + asyncErr.Error())
+				return asyncErr
+			}
+		}
+		if reply != nil && canQueueReplies(options) {
+			replyEntry, err := enqueueReply(ctx, options.Outbox, message, &body, reply)
+			if err != nil {
+				logger.Error("Something went wrong enqueueing the reply: " + err.Error())
+				return &errors.AsyncError{
+					OriginalError: &errors.RetryError{Message: "Error enqueueing reply."},
+					Message:       err.Error(),
+					ErrorCode:     500,
+				}
+			}
+			entries = append(entries, replyEntry)
+			reply = nil
+		}
+
+		// 10. Settle the message
 		err = settleMessage(ctx, settler, message, nil)
 		if err != nil {
 			logger.Error("Settling message: " + err.Error())
@@ -94,6 +228,24 @@ func NewOperationHandler(matcher *matcher.Matcher, hooks []hooks.BaseOperationHo
 			}
 		}
 
+		// 11. The operation won't run again, so its checkpoint is no longer needed.
+		deleteCheckpoint(ctx, options, &body)
+
+		// 12. Send the continuations and the reply. If it fails, the outbox dispatcher will send them
+		// later. Without an outbox, a reply that can't be sent is lost.
+		if len(entries) > 0 {
+			err = options.Outbox.Dispatch(ctx, entries)
+			if err != nil {
+				logger.Error("Error sending the continuations, leaving them in the outbox: " + err.Error())
+			}
+		}
+		if reply != nil {
+			err = options.ResultPublisher.Reply(ctx, message, reply)
+			if err != nil {
+				logger.Error("Error sending the reply: " + err.Error())
+			}
+		}
+
 		logger.Info("Operation run successfully!")
 		return nil
 	}
@@ -111,3 +263,196 @@ func settleMessage(ctx context.Context, settler shuttle.MessageSettler, message
 
 	return nil
 }
+
+// Deletes the checkpoint of an operation that won't run again. Failing to delete it is only logged,
+// since the operation already finished.
+func deleteCheckpoint(ctx context.Context, options *OperationHandlerOptions, body *operation.OperationRequest) {
+	if options.CheckpointStore == nil {
+		return
+	}
+
+	err := options.CheckpointStore.DeleteCheckpoint(ctx, body.OperationId)
+	if err != nil {
+		logger := ctxlogger.GetLogger(ctx)
+		logger.Error("Error deleting the checkpoint of the operation: " + err.Error())
+	}
+}
+
+// Injects the progress reporter and step runner into the context passed to Run.
+func newRunContext(ctx context.Context, options *OperationHandlerOptions, body *operation.OperationRequest, progressInterval time.Duration, stepHooks []operation.StepHooks) context.Context {
+	if options.ProgressSink != nil {
+		ctx = progress.WithProgressReporter(ctx, progress.NewProgressReporter(options.ProgressSink, body, progressInterval))
+	}
+	if options.CheckpointStore != nil || len(stepHooks) > 0 {
+		ctx = operation.WithStepRunner(ctx, &operation.StepRunner{Store: options.CheckpointStore, Hooks: stepHooks, CombineErrors: options.HookErrorPolicy.Combine})
+	}
+	return ctx
+}
+
+// Acquires the lease over the entity of the request and keeps renewing it. If the lease is lost,
+// the returned context is cancelled. The returned function stops the renewal and releases the lease.
+func acquireEntityLock(ctx context.Context, options *OperationHandlerOptions, body *operation.OperationRequest) (context.Context, func(), *errors.AsyncError) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	key := lock.EntityKey(body)
+	if options.Locker == nil || key == "" {
+		return ctx, func() {}, nil
+	}
+
+	ttl := options.LockTTL
+	if ttl <= 0 {
+		ttl = lock.DefaultTTL
+	}
+	renewInterval := options.LockRenewInterval
+	if renewInterval <= 0 {
+		renewInterval = lock.DefaultRenewInterval
+	}
+
+	lease, err := options.Locker.Acquire(ctx, key, body.OperationId, ttl)
+	if err != nil {
+		var contendedErr *lock.LockContendedError
+		if stderrors.As(err, &contendedErr) {
+			return nil, nil, &errors.AsyncError{
+				OriginalError: &errors.RetryError{Message: "Entity lock is held by another operation."},
+				Message:       err.Error(),
+				ErrorCode:     409,
+				RetryAfter:    contendedErr.RetryAfter,
+			}
+		}
+		return nil, nil, &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Error acquiring entity lock."},
+			Message:       err.Error(),
+			ErrorCode:     500,
+		}
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	stop := lock.KeepAlive(ctx, options.Locker, lease, ttl, renewInterval, func(err error) {
+		cancel(err)
+	})
+
+	return lockCtx, func() {
+		stop()
+		cancel(nil)
+		err := options.Locker.Release(context.WithoutCancel(ctx), lease)
+		if err != nil {
+			logger.Error("Error releasing the entity lock: " + err.Error())
+		}
+	}, nil
+}
+
+// Saves the result of the operation and returns its reply, or nil if the caller didn't ask for one.
+// Wrapper since the operation package is shadowed inside the handler.
+func saveResult(ctx context.Context, publisher *result.Publisher, message *azservicebus.ReceivedMessage, op operation.ApiOperation) (*azservicebus.Message, *errors.AsyncError) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	resultOperation, ok := op.(operation.ResultOperation)
+	if !ok {
+		return nil, nil
+	}
+
+	res, asyncErr := resultOperation.GetResult(ctx)
+	if asyncErr != nil {
+		return nil, asyncErr
+	}
+	if res == nil {
+		logger.Info("Operation returned no result.")
+		return nil, nil
+	}
+
+	if res.OperationId == "" && op.GetOperationRequest() != nil {
+		res.OperationId = op.GetOperationRequest().OperationId
+	}
+
+	err := publisher.SaveResult(ctx, res)
+	if err != nil {
+		return nil, &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Error saving operation result."},
+			Message:       err.Error(),
+			ErrorCode:     500,
+		}
+	}
+
+	if message.ReplyTo == nil || *message.ReplyTo == "" {
+		return nil, nil
+	}
+	return result.NewReplyMessage(message, res), nil
+}
+
+// Sends a failure reply for an operation that won't run again. Failing to send it is only logged,
+// since the operation already failed.
+func sendFailureReply(ctx context.Context, options *OperationHandlerOptions, message *azservicebus.ReceivedMessage, body *operation.OperationRequest, asyncErr *errors.AsyncError) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if options.ResultPublisher == nil || message.ReplyTo == nil || *message.ReplyTo == "" {
+		return
+	}
+
+	reply := result.NewFailureReplyMessage(message, body.OperationId, asyncErr.Error())
+	if !canQueueReplies(options) {
+		err := options.ResultPublisher.Reply(ctx, message, reply)
+		if err != nil {
+			logger.Error("Error sending the failure reply: " + err.Error())
+		}
+		return
+	}
+
+	entry, err := enqueueReply(ctx, options.Outbox, message, body, reply)
+	if err != nil {
+		logger.Error("Error enqueueing the failure reply: " + err.Error())
+		return
+	}
+	err = options.Outbox.Dispatch(ctx, []*outbox.OutboxEntry{entry})
+	if err != nil {
+		logger.Error("Error sending the failure reply, leaving it in the outbox: " + err.Error())
+	}
+}
+
+// The replies go to the ReplyTo queue of each message, so the outbox needs a client to send them.
+func canQueueReplies(options *OperationHandlerOptions) bool {
+	return options.Outbox != nil && options.Outbox.ServiceBusClient != nil
+}
+
+func enqueueReply(ctx context.Context, ob *outbox.Outbox, message *azservicebus.ReceivedMessage, body *operation.OperationRequest, reply *azservicebus.Message) (*outbox.OutboxEntry, error) {
+	id := body.OperationId + "-reply"
+	reply.MessageID = &id
+	entry := &outbox.OutboxEntry{
+		Id:                id,
+		SourceOperationId: body.OperationId,
+		Message:           reply,
+		CreatedAt:         time.Now(),
+		Queue:             *message.ReplyTo,
+	}
+
+	err := ob.Store.Add(ctx, []*outbox.OutboxEntry{entry})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func enqueueContinuations(ctx context.Context, ob *outbox.Outbox, message *azservicebus.ReceivedMessage, body *operation.OperationRequest, op operation.ApiOperation) ([]*outbox.OutboxEntry, *errors.AsyncError) {
+	continuationOperation, ok := op.(operation.ContinuationOperation)
+	if !ok {
+		return nil, nil
+	}
+
+	continuations, asyncErr := continuationOperation.GetContinuations(ctx)
+	if asyncErr != nil {
+		return nil, asyncErr
+	}
+	if len(continuations) == 0 {
+		return nil, nil
+	}
+
+	entries, err := ob.Enqueue(ctx, message, body, continuations)
+	if err != nil {
+		return nil, &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Error enqueueing continuations."},
+			Message:       err.Error(),
+			ErrorCode:     500,
+		}
+	}
+
+	return entries, nil
+}
@@ -7,16 +7,23 @@ import (
 	"errors"
 	"log/slog"
 	"testing"
+	"time"
 
 	"github.com/Azure/aks-async/mocks"
 	"github.com/Azure/aks-async/runtime/entity"
 	asyncError "github.com/Azure/aks-async/runtime/errors"
 	handlerErrors "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/lock"
 	"github.com/Azure/aks-async/runtime/matcher"
 	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/operation/checkpoint"
+	"github.com/Azure/aks-async/runtime/outbox"
+	"github.com/Azure/aks-async/runtime/progress"
+	"github.com/Azure/aks-async/runtime/result"
 	sampleOperation "github.com/Azure/aks-async/runtime/testutils/operation"
 	"github.com/Azure/aks-async/runtime/testutils/settler"
 	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	sb "github.com/Azure/aks-async/servicebus"
 	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
 	"github.com/Azure/go-shuttle/v2"
@@ -123,6 +130,39 @@ var _ = Describe("OperationHandler", func() {
 			Expect(err.Message).To(ContainSubstring("Operation type doesn't exist in the matcher:"))
 		})
 
+		It("should match the operation using the api version", func() {
+			operationMatcher = matcher.NewMatcher()
+			operationMatcher.RegisterVersion(ctx, operationName, "v0.0.1", sampleOp)
+			operationHandler = NewOperationHandler(operationMatcher, nil, mockEntityController, marshaller)
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).To(BeNil())
+		})
+
+		It("should use the entity factory of the matcher without an entity controller", func() {
+			var received *operation.OperationRequest
+			operationMatcher.RegisterEntityFactory(ctx, operationName, func(ctx context.Context, req *operation.OperationRequest) (entity.Entity, error) {
+				received = req
+				return mocks.NewMockEntity(ctrl), nil
+			})
+			operationHandler = NewOperationHandler(operationMatcher, nil, nil, marshaller)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).To(BeNil())
+			Expect(received.EntityType).To(Equal("Cluster"))
+			Expect(received.EntityId).To(Equal("1"))
+		})
+
+		It("should retry if the entity factory of the matcher fails", func() {
+			operationMatcher.RegisterEntityFactory(ctx, operationName, func(ctx context.Context, req *operation.OperationRequest) (entity.Entity, error) {
+				return nil, errors.New("database unavailable")
+			})
+			operationHandler = NewOperationHandler(operationMatcher, nil, nil, marshaller)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).ToNot(BeNil())
+			var retryErr *asyncError.RetryError
+			Expect(errors.As(err, &retryErr)).To(BeTrue())
+		})
+
 		It("should throw an error while InitOperation", func() {
 			req := &operation.OperationRequest{
 				OperationId:   "1",
@@ -179,4 +219,308 @@ var _ = Describe("OperationHandler", func() {
 			Expect(err).ToNot(BeNil())
 		})
 	})
+
+	Context("result publishing", func() {
+		var (
+			resultStore *result.InMemoryStore
+			client      *sb.FakeServiceBusClient
+			replies     sb.ReceiverInterface
+		)
+
+		BeforeEach(func() {
+			resultStore = result.NewInMemoryStore()
+			client = sb.NewFakeServiceBusClient()
+			replies, _ = client.NewServiceBusReceiver(ctx, "replies", nil)
+			replyTo := "replies"
+			message.ReplyTo = &replyTo
+
+			operationMatcher = matcher.NewMatcher()
+			operationMatcher.Register(ctx, operationName, &sampleOperation.SampleResultOperation{})
+			options := &OperationHandlerOptions{
+				ResultPublisher: result.NewPublisher(resultStore, client),
+			}
+			operationHandler = NewOperationHandlerWithOptions(operationMatcher, nil, mockEntityController, marshaller, options)
+		})
+
+		setOperationId := func(operationId string) {
+			req := &operation.OperationRequest{
+				OperationId:   operationId,
+				OperationName: operationName,
+			}
+			marshalledOperation, err := marshaller.Marshal(req)
+			Expect(err).To(BeNil())
+			message.Body = marshalledOperation.Body
+		}
+
+		It("should store the result of the operation", func() {
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).To(BeNil())
+
+			res, getErr := resultStore.GetResult(ctx, "0")
+			Expect(getErr).ToNot(HaveOccurred())
+			Expect(res.Body).To(Equal([]byte("result")))
+		})
+
+		It("should not store a result if the operation failed", func() {
+			req := &operation.OperationRequest{
+				OperationId:   "3",
+				OperationName: operationName,
+			}
+			marshalledOperation, err := marshaller.Marshal(req)
+			Expect(err).To(BeNil())
+			message.Body = marshalledOperation.Body
+
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			asyncErr := operationHandler(ctx, sampleSettler, message)
+			Expect(asyncErr).ToNot(BeNil())
+
+			_, getErr := resultStore.GetResult(ctx, "3")
+			Expect(getErr).To(HaveOccurred())
+		})
+
+		It("should send the reply after completing the message", func() {
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).To(BeNil())
+
+			messages, receiveErr := replies.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Body).To(Equal([]byte("result")))
+			Expect(messages[0].ApplicationProperties[result.StatusProperty]).To(Equal(result.StatusSucceeded))
+		})
+
+		It("should not send the reply if settling fails", func() {
+			failureContentType := "failure_test"
+			message.ContentType = &failureContentType
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).ToNot(BeNil())
+
+			_, receiveErr := replies.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).To(HaveOccurred())
+		})
+
+		It("should send a failure reply if the operation fails for good", func() {
+			setOperationId("4")
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).ToNot(BeNil())
+
+			messages, receiveErr := replies.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].ApplicationProperties[result.OperationIdProperty]).To(Equal("4"))
+			Expect(messages[0].ApplicationProperties[result.StatusProperty]).To(Equal(result.StatusFailed))
+		})
+
+		It("should not send a failure reply if the operation is retried", func() {
+			setOperationId("3")
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).ToNot(BeNil())
+
+			_, receiveErr := replies.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).To(HaveOccurred())
+		})
+
+		It("should store the reply in the outbox until the message is completed", func() {
+			outboxStore := outbox.NewInMemoryStore()
+			ob := outbox.NewOutbox(outboxStore, nil, marshaller)
+			ob.ServiceBusClient = client
+			options := &OperationHandlerOptions{
+				ResultPublisher: result.NewPublisher(resultStore, client),
+				Outbox:          ob,
+			}
+			operationHandler = NewOperationHandlerWithOptions(operationMatcher, nil, mockEntityController, marshaller, options)
+
+			failureContentType := "failure_test"
+			message.ContentType = &failureContentType
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).ToNot(BeNil())
+
+			_, receiveErr := replies.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).To(HaveOccurred())
+			pending, pendingErr := outboxStore.Pending(ctx, 0)
+			Expect(pendingErr).ToNot(HaveOccurred())
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].Queue).To(Equal("replies"))
+
+			Expect(ob.DispatchPending(ctx, 0)).To(Succeed())
+			messages, receiveErr := replies.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+		})
+	})
+
+	Context("progress reporting", func() {
+		It("should persist the progress reported by the operation", func() {
+			saved := []*progress.Progress{}
+			operationMatcher = matcher.NewMatcher()
+			operationMatcher.Register(ctx, operationName, &sampleOperation.SampleProgressOperation{})
+			options := &OperationHandlerOptions{
+				ProgressSink: progress.SinkFunc(func(ctx context.Context, p *progress.Progress) error {
+					saved = append(saved, p)
+					return nil
+				}),
+			}
+			operationHandler = NewOperationHandlerWithOptions(operationMatcher, nil, mockEntityController, marshaller, options)
+
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).To(BeNil())
+
+			// The 50% report is persisted and the 100% report bypasses the throttling.
+			Expect(saved).To(HaveLen(2))
+			Expect(saved[0].OperationId).To(Equal("0"))
+			Expect(saved[1].PercentComplete).To(Equal(100))
+		})
+	})
+
+	Context("checkpoints", func() {
+		var (
+			store *checkpoint.InMemoryStore
+		)
+
+		BeforeEach(func() {
+			store = checkpoint.NewInMemoryStore()
+			Expect(store.SaveCheckpoint(ctx, "0", "step")).To(Succeed())
+			options := &OperationHandlerOptions{
+				CheckpointStore: store,
+			}
+			operationHandler = NewOperationHandlerWithOptions(operationMatcher, nil, mockEntityController, marshaller, options)
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+		})
+
+		It("should delete the checkpoint once the operation succeeds", func() {
+			Expect(operationHandler(ctx, sampleSettler, message)).To(BeNil())
+			step, err := store.GetCheckpoint(ctx, "0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(step).To(BeEmpty())
+		})
+
+		It("should delete the checkpoint once the operation fails for good", func() {
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			for _, operationId := range []string{"3", "4"} {
+				Expect(store.SaveCheckpoint(ctx, operationId, "step")).To(Succeed())
+				marshalledOperation, err := marshaller.Marshal(&operation.OperationRequest{OperationId: operationId, OperationName: operationName})
+				Expect(err).ToNot(HaveOccurred())
+				message.Body = marshalledOperation.Body
+				Expect(operationHandler(ctx, sampleSettler, message)).ToNot(BeNil())
+			}
+
+			// The operation failing with a RetryError resumes from its checkpoint.
+			step, err := store.GetCheckpoint(ctx, "3")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(step).To(Equal("step"))
+			step, err = store.GetCheckpoint(ctx, "4")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(step).To(BeEmpty())
+		})
+
+		It("should keep the checkpoint if settling fails", func() {
+			failureContentType := "failure_test"
+			message.ContentType = &failureContentType
+			Expect(operationHandler(ctx, sampleSettler, message)).ToNot(BeNil())
+			step, err := store.GetCheckpoint(ctx, "0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(step).To(Equal("step"))
+		})
+	})
+
+	Context("entity lock", func() {
+		var (
+			locker *lock.InMemoryLocker
+		)
+
+		BeforeEach(func() {
+			locker = lock.NewInMemoryLocker()
+			options := &OperationHandlerOptions{
+				Locker: locker,
+			}
+			operationHandler = NewOperationHandlerWithOptions(operationMatcher, nil, mockEntityController, marshaller, options)
+		})
+
+		It("should release the lock once the message is settled", func() {
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).To(BeNil())
+
+			_, lockErr := locker.Acquire(ctx, "Cluster/1", "other", time.Minute)
+			Expect(lockErr).ToNot(HaveOccurred())
+		})
+
+		It("should hold the lock while reading the entity", func() {
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, req *operation.OperationRequest) (entity.Entity, *asyncError.AsyncError) {
+				_, lockErr := locker.Acquire(ctx, "Cluster/1", "other", time.Minute)
+				Expect(lockErr).To(HaveOccurred())
+				return nil, nil
+			})
+			Expect(operationHandler(ctx, sampleSettler, message)).To(BeNil())
+		})
+
+		It("should retry while another operation holds the lock", func() {
+			_, lockErr := locker.Acquire(ctx, "Cluster/1", "other", time.Minute)
+			Expect(lockErr).ToNot(HaveOccurred())
+
+			// The entity isn't read without the lock.
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).ToNot(BeNil())
+			var retryErr *asyncError.RetryError
+			Expect(errors.As(err, &retryErr)).To(BeTrue())
+			Expect(err.RetryAfter).To(BeNumerically(">", 0))
+		})
+	})
+
+	Context("continuations", func() {
+		var (
+			outboxStore *outbox.InMemoryStore
+			receiver    sb.ReceiverInterface
+		)
+
+		BeforeEach(func() {
+			client := sb.NewFakeServiceBusClient()
+			sender, _ := client.NewServiceBusSender(ctx, "operations", nil)
+			receiver, _ = client.NewServiceBusReceiver(ctx, "operations", nil)
+			outboxStore = outbox.NewInMemoryStore()
+
+			operationMatcher = matcher.NewMatcher()
+			operationMatcher.Register(ctx, operationName, &sampleOperation.SampleContinuationOperation{})
+			options := &OperationHandlerOptions{
+				Outbox: outbox.NewOutbox(outboxStore, sender, marshaller),
+			}
+			operationHandler = NewOperationHandlerWithOptions(operationMatcher, nil, mockEntityController, marshaller, options)
+		})
+
+		It("should send the continuations after completing the message", func() {
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).To(BeNil())
+
+			messages, receiveErr := receiver.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+
+			var body operation.OperationRequest
+			Expect(marshaller.Unmarshal(messages[0].Message(), &body)).To(Succeed())
+			Expect(body.OperationId).To(Equal("0-next"))
+			Expect(body.EntityId).To(Equal("1"))
+		})
+
+		It("should keep the continuations in the outbox if settling fails", func() {
+			failureContentType := "failure_test"
+			message.ContentType = &failureContentType
+			mockEntityController.EXPECT().GetEntity(gomock.Any(), gomock.Any()).Return(nil, nil)
+			err := operationHandler(ctx, sampleSettler, message)
+			Expect(err).ToNot(BeNil())
+
+			_, receiveErr := receiver.ReceiveMessage(ctx, 10, nil)
+			Expect(receiveErr).To(HaveOccurred())
+			pending, pendingErr := outboxStore.Pending(ctx, 0)
+			Expect(pendingErr).ToNot(HaveOccurred())
+			Expect(pending).To(HaveLen(1))
+		})
+	})
 })
@@ -6,6 +6,7 @@ import (
 	oc "github.com/Azure/OperationContainer/api/v1"
 	"github.com/Azure/aks-async/runtime/errors"
 	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
 	"github.com/Azure/aks-async/runtime/operation"
 	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
 	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
@@ -14,6 +15,12 @@ import (
 
 // Handler for when the user uses the OperationContainer.
 func NewOperationContainerHandler(errHandler errorHandlers.ErrorHandlerFunc, operationContainer oc.OperationContainerClient, marshaller shuttle.Marshaller) errorHandlers.ErrorHandlerFunc {
+	return NewOperationContainerHandlerWithHooks(errHandler, operationContainer, marshaller, nil)
+}
+
+// Same as NewOperationContainerHandler, calling the OnTerminal settlement hooks once the operation
+// is set as Succeeded or Failed instead of the error handlers it wraps.
+func NewOperationContainerHandlerWithHooks(errHandler errorHandlers.ErrorHandlerFunc, operationContainer oc.OperationContainerClient, marshaller shuttle.Marshaller, settlementHooks []hooks.SettlementHooks) errorHandlers.ErrorHandlerFunc {
 	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
 		logger := ctxlogger.GetLogger(ctx)
 
@@ -42,11 +49,15 @@ func NewOperationContainerHandler(errHandler errorHandlers.ErrorHandlerFunc, ope
 				ErrorCode:     500,
 			}
 		}
-		asyncErr := errHandler.Handle(ctx, settler, message)
+		handleCtx := ctx
+		if len(settlementHooks) > 0 {
+			handleCtx = errorHandlers.WithoutTerminalHooks(ctx)
+		}
+		asyncErr := errHandler.Handle(handleCtx, settler, message)
 
 		if asyncErr != nil {
 			logger.Info("OperationContainerHandler: Handling error: " + asyncErr.Error())
-			switch asyncErr.OriginalError.(type) {
+			switch errors.Classify(asyncErr.OriginalError).(type) {
 			case *errors.NonRetryError:
 				// Fail the operation
 				logger.Info("OperationContainerHandler: Setting operation as Failed.")
@@ -64,7 +75,8 @@ func NewOperationContainerHandler(errHandler errorHandlers.ErrorHandlerFunc, ope
 						ErrorCode:     500,
 					}
 				}
-			case *errors.RetryError:
+				onTerminal(ctx, settlementHooks, &body, oc.Status_FAILED, asyncErr)
+			case *errors.RetryError, *errors.DeferError:
 				// Set the operation as Pending
 				logger.Info("OperationContainerHandler: Setting operation as Pending.")
 				updateOperationStatusRequest = &oc.UpdateOperationStatusRequest{
@@ -108,8 +120,16 @@ func NewOperationContainerHandler(errHandler errorHandlers.ErrorHandlerFunc, ope
 					ErrorCode:     500,
 				}
 			}
+			onTerminal(ctx, settlementHooks, &body, oc.Status_SUCCEEDED, nil)
 		}
 
 		return nil
 	}
 }
+
+func onTerminal(ctx context.Context, settlementHooks []hooks.SettlementHooks, body *operation.OperationRequest, status oc.Status, asyncErr *errors.AsyncError) {
+	ctx = hooks.WithTerminalRequest(ctx, body)
+	for _, hook := range settlementHooks {
+		hook.OnTerminal(ctx, body.OperationId, status, asyncErr)
+	}
+}
@@ -11,8 +11,10 @@ import (
 	ocMock "github.com/Azure/OperationContainer/api/v1/mock"
 	asyncErrors "github.com/Azure/aks-async/runtime/errors"
 	handlerErrors "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
 	"github.com/Azure/aks-async/runtime/operation"
 	sampleErrorHandler "github.com/Azure/aks-async/runtime/testutils/error_handler"
+	sampleHooks "github.com/Azure/aks-async/runtime/testutils/hooks"
 	"github.com/Azure/aks-async/runtime/testutils/settler"
 	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
 	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
@@ -148,6 +150,23 @@ var _ = Describe("OperationContainerHandler", func() {
 				})
 			})
 
+			Context("DeferError", func() {
+				It("should set a deferred operation as Pending", func() {
+					deferError := &asyncErrors.DeferError{
+						Message: "DeferError!",
+					}
+					operationContainerHandler = NewOperationContainerHandler(sampleErrorHandler.SampleErrorHandler(deferError), operationContainerClient, marshaller)
+
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, gomock.Any()).Return(nil, nil)
+
+					updateOperationStatusRequest.Status = oc.Status_PENDING
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, updateOperationStatusRequest).Return(nil, nil)
+					err := operationContainerHandler(ctx, sampleSettler, message)
+					Expect(err).ToNot(BeNil())
+					Expect(errors.Is(err, deferError)).To(BeTrue())
+				})
+			})
+
 			Context("RetryError", func() {
 				It("should handle a RetryError", func() {
 					retryError := &asyncErrors.RetryError{
@@ -182,6 +201,65 @@ var _ = Describe("OperationContainerHandler", func() {
 				})
 			})
 
+			Context("Settlement hooks", func() {
+				It("should call OnTerminal once the operation is set as Failed", func() {
+					settlementHooks := &sampleHooks.SampleSettlementHooks{}
+					nonRetryError := &asyncErrors.NonRetryError{Message: "NonRetryError!"}
+					operationContainerHandler = NewOperationContainerHandlerWithHooks(sampleErrorHandler.SampleErrorHandler(nonRetryError), operationContainerClient, marshaller, []hooks.SettlementHooks{settlementHooks})
+
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, gomock.Any()).Return(nil, nil).Times(2)
+					err := operationContainerHandler(ctx, sampleSettler, message)
+					Expect(err).ToNot(BeNil())
+					Expect(settlementHooks.Calls).To(Equal([]string{"OnTerminal:FAILED"}))
+				})
+
+				It("should call OnTerminal once the operation is set as Succeeded", func() {
+					settlementHooks := &sampleHooks.SampleSettlementHooks{}
+					operationContainerHandler = NewOperationContainerHandlerWithHooks(sampleErrorHandler.SampleErrorHandler(nil), operationContainerClient, marshaller, []hooks.SettlementHooks{settlementHooks})
+
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, gomock.Any()).Return(nil, nil).Times(2)
+					err := operationContainerHandler(ctx, sampleSettler, message)
+					Expect(err).To(BeNil())
+					Expect(settlementHooks.Calls).To(Equal([]string{"OnTerminal:SUCCEEDED"}))
+				})
+
+				It("should not call OnTerminal if the final status can't be set", func() {
+					settlementHooks := &sampleHooks.SampleSettlementHooks{}
+					operationContainerHandler = NewOperationContainerHandlerWithHooks(sampleErrorHandler.SampleErrorHandler(nil), operationContainerClient, marshaller, []hooks.SettlementHooks{settlementHooks})
+
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, gomock.Any()).Return(nil, nil)
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, gomock.Any()).Return(nil, errors.New("Random error"))
+					err := operationContainerHandler(ctx, sampleSettler, message)
+					Expect(err).ToNot(BeNil())
+					Expect(settlementHooks.Calls).To(BeEmpty())
+				})
+
+				It("should not call OnTerminal while the operation is retried", func() {
+					settlementHooks := &sampleHooks.SampleSettlementHooks{}
+					retryError := &asyncErrors.RetryError{Message: "RetryError!"}
+					operationContainerHandler = NewOperationContainerHandlerWithHooks(sampleErrorHandler.SampleErrorHandler(retryError), operationContainerClient, marshaller, []hooks.SettlementHooks{settlementHooks})
+
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, gomock.Any()).Return(nil, nil).Times(2)
+					_ = operationContainerHandler(ctx, sampleSettler, message)
+					Expect(settlementHooks.Calls).To(BeEmpty())
+				})
+
+				It("should call OnTerminal once when wrapping the error handlers with hooks", func() {
+					settlementHooks := &sampleHooks.SampleSettlementHooks{}
+					hookList := []hooks.SettlementHooks{settlementHooks}
+					completingHandler := func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *asyncErrors.AsyncError {
+						Expect(settler.CompleteMessage(ctx, message, nil)).To(Succeed())
+						return nil
+					}
+					errorHandler := handlerErrors.NewErrorReturnHandlerWithHooks(completingHandler, nil, marshaller, hookList)
+					operationContainerHandler = NewOperationContainerHandlerWithHooks(errorHandler, operationContainerClient, marshaller, hookList)
+
+					operationContainerClient.EXPECT().UpdateOperationStatus(ctx, gomock.Any()).Return(nil, nil).Times(2)
+					Expect(operationContainerHandler(ctx, sampleSettler, message)).To(BeNil())
+					Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Complete", "AfterSettle:Complete", "OnTerminal:SUCCEEDED"}))
+				})
+			})
+
 			Context("default", func() {
 				It("should handle a default", func() {
 					defaultError := errors.New("default error")
@@ -0,0 +1,206 @@
+package ratelimit
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+// How often the buckets that are full again are removed.
+const pruneInterval = time.Minute
+
+// Limit of a token bucket. The bucket holds up to Burst tokens and is refilled at Rate tokens
+// per second. A Rate of 0 or less disables the limit. A Burst of 0 or less defaults to Rate
+// rounded up, and at least 1, since a bucket that can't hold a token never allows a request.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) withDefaults() Limit {
+	if l.Burst <= 0 && l.Rate > 0 {
+		l.Burst = int(math.Max(1, math.Ceil(l.Rate)))
+	}
+	return l
+}
+
+// KeyFunc returns the key of the bucket the request is counted against. Requests with an empty
+// key are not limited by the rule.
+type KeyFunc func(req *operation.OperationRequest) string
+
+func ByOperationName(req *operation.OperationRequest) string {
+	return req.GetOperationName()
+}
+
+func ByEntity(req *operation.OperationRequest) string {
+	if req.GetEntityId() == "" {
+		return ""
+	}
+	return req.GetEntityType() + "/" + req.GetEntityId()
+}
+
+func ByOperationNameAndEntity(req *operation.OperationRequest) string {
+	entityKey := ByEntity(req)
+	if entityKey == "" {
+		return ""
+	}
+	return req.GetOperationName() + ":" + entityKey
+}
+
+// Rule limits the requests sharing the same key.
+type Rule struct {
+	Name  string
+	Key   KeyFunc
+	Limit Limit
+	// Limits for specific keys, e.g. a lower limit for a single operation name.
+	Overrides map[string]Limit
+}
+
+func (r *Rule) limitFor(key string) Limit {
+	if limit, ok := r.Overrides[key]; ok {
+		return limit.withDefaults()
+	}
+	return r.Limit.withDefaults()
+}
+
+// BucketState is the current state of a bucket, for debugging.
+type BucketState struct {
+	Rule   string
+	Key    string
+	Tokens float64
+	Limit  Limit
+}
+
+type bucket struct {
+	rule   string
+	key    string
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.last = now
+	}
+}
+
+// Time until the bucket has a token.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// Limiter applies token bucket rules to the requests. A request is only allowed if every rule
+// allows it, and only then are the tokens taken.
+type Limiter struct {
+	Rules []Rule
+
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	mu        sync.Mutex
+	now       func() time.Time
+}
+
+func NewLimiter(rules ...Rule) *Limiter {
+	return &Limiter{
+		Rules:   rules,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Returns whether the request is allowed, and if not, how long to wait before retrying it.
+func (l *Limiter) Allow(req *operation.OperationRequest) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	matched := []*bucket{}
+	var retryAfter time.Duration
+	for i := range l.Rules {
+		rule := &l.Rules[i]
+		key := rule.Key(req)
+		limit := rule.limitFor(key)
+		if key == "" || limit.Rate <= 0 {
+			continue
+		}
+
+		b := l.getBucket(rule.Name, key, limit, now)
+		if wait := b.wait(); wait > retryAfter {
+			retryAfter = wait
+		}
+		matched = append(matched, b)
+	}
+
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+
+	for _, b := range matched {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// Must be called while holding the lock.
+func (l *Limiter) getBucket(rule string, key string, limit Limit, now time.Time) *bucket {
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+
+	id := rule + "|" + key
+	b, ok := l.buckets[id]
+	if !ok || b.limit != limit {
+		b = &bucket{rule: rule, key: key, limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[id] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// Removes the buckets that are full again, since they are the same as a new bucket.
+// Must be called while holding the lock.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+
+	for id, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// Returns the state of the buckets in use, sorted by rule and key.
+func (l *Limiter) State() []BucketState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	states := make([]BucketState, 0, len(l.buckets))
+	for _, b := range l.buckets {
+		b.refill(now)
+		states = append(states, BucketState{Rule: b.rule, Key: b.key, Tokens: b.tokens, Limit: b.limit})
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Rule != states[j].Rule {
+			return states[i].Rule < states[j].Rule
+		}
+		return states[i].Key < states[j].Key
+	})
+	return states
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+// Handler that only calls the next handler if the limiter allows the operation. Throttled messages
+// are rescheduled using the sender, so the worker is never blocked and the message isn't
+// redelivered before the limiter allows it. Without a sender the operations aren't throttled.
+// Since it settles the throttled messages itself, it must be placed outside of the error handlers,
+// and calls the settlement hooks itself.
+func NewRateLimitHandler(limiter *Limiter, errHandler errorHandlers.ErrorHandlerFunc, marshaller shuttle.Marshaller, sender sb.SenderInterface, settlementHooks []hooks.SettlementHooks) errorHandlers.ErrorHandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) *errors.AsyncError {
+		logger := ctxlogger.GetLogger(ctx)
+
+		if sender == nil {
+			logger.Error("RateLimitHandler: No sender received, the operation isn't throttled.")
+			return errHandler.Handle(ctx, settler, message)
+		}
+
+		if marshaller == nil {
+			marshaller = &shuttle.DefaultProtoMarshaller{}
+		}
+
+		var body operation.OperationRequest
+		err := marshaller.Unmarshal(message.Message(), &body)
+		if err != nil {
+			// Let the next handlers deal with the invalid message.
+			logger.Error("RateLimitHandler: Error unmarshalling message: " + err.Error())
+			return errHandler.Handle(ctx, settler, message)
+		}
+
+		allowed, retryAfter := limiter.Allow(&body)
+		if allowed {
+			return errHandler.Handle(ctx, settler, message)
+		}
+
+		errorMessage := fmt.Sprintf("RateLimitHandler: Operation %s throttled, retrying in %s.", body.OperationId, retryAfter)
+		logger.Info(errorMessage)
+
+		asyncErr := &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Operation throttled."},
+			Message:       errorMessage,
+			ErrorCode:     429,
+			RetryAfter:    retryAfter,
+		}
+
+		err = errorHandlers.RescheduleMessageWithHooks(ctx, settler, sender, message, retryAfter, asyncErr, settlementHooks)
+		if err != nil {
+			logger.Error("RateLimitHandler: Error rescheduling throttled message: " + err.Error())
+			return &errors.AsyncError{
+				OriginalError: err,
+				Message:       err.Error(),
+				ErrorCode:     500,
+			}
+		}
+
+		return asyncErr
+	}
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	errorHandlers "github.com/Azure/aks-async/runtime/handlers/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+	sampleErrorHandler "github.com/Azure/aks-async/runtime/testutils/error_handler"
+	sampleHooks "github.com/Azure/aks-async/runtime/testutils/hooks"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRateLimit(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "RateLimit Suite")
+}
+
+var _ = Describe("Limiter", func() {
+	var (
+		now     time.Time
+		limiter *Limiter
+		upgrade *operation.OperationRequest
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		limiter = NewLimiter(
+			Rule{Name: "operation", Key: ByOperationName, Limit: Limit{Rate: 1, Burst: 2}},
+			Rule{Name: "entity", Key: ByEntity, Limit: Limit{Rate: 0.5, Burst: 1}},
+		)
+		limiter.now = func() time.Time { return now }
+		upgrade = &operation.OperationRequest{OperationName: "Upgrade", EntityType: "Cluster", EntityId: "1"}
+	})
+
+	It("should throttle once the burst is used", func() {
+		allowed, _ := limiter.Allow(&operation.OperationRequest{OperationName: "Upgrade"})
+		Expect(allowed).To(BeTrue())
+		allowed, _ = limiter.Allow(&operation.OperationRequest{OperationName: "Upgrade"})
+		Expect(allowed).To(BeTrue())
+
+		allowed, retryAfter := limiter.Allow(&operation.OperationRequest{OperationName: "Upgrade"})
+		Expect(allowed).To(BeFalse())
+		Expect(retryAfter).To(Equal(time.Second))
+
+		now = now.Add(time.Second)
+		allowed, _ = limiter.Allow(&operation.OperationRequest{OperationName: "Upgrade"})
+		Expect(allowed).To(BeTrue())
+	})
+
+	It("should require every rule to allow the request", func() {
+		allowed, _ := limiter.Allow(upgrade)
+		Expect(allowed).To(BeTrue())
+
+		allowed, retryAfter := limiter.Allow(upgrade)
+		Expect(allowed).To(BeFalse())
+		Expect(retryAfter).To(Equal(2 * time.Second))
+
+		// The operation bucket wasn't consumed by the throttled request.
+		Expect(limiter.State()).To(ContainElement(BucketState{Rule: "operation", Key: "Upgrade", Tokens: 1, Limit: Limit{Rate: 1, Burst: 2}}))
+	})
+
+	It("should apply the overrides", func() {
+		limiter.Rules[0].Overrides = map[string]Limit{"Create": {Rate: 0}}
+		for i := 0; i < 5; i++ {
+			allowed, _ := limiter.Allow(&operation.OperationRequest{OperationName: "Create"})
+			Expect(allowed).To(BeTrue())
+		}
+	})
+
+	It("should default the burst to the rate", func() {
+		limiter.Rules = []Rule{
+			{Name: "operation", Key: ByOperationName, Limit: Limit{Rate: 2.5}},
+			{Name: "entity", Key: ByEntity, Limit: Limit{Rate: 0.5}},
+		}
+		for i := 0; i < 3; i++ {
+			allowed, _ := limiter.Allow(&operation.OperationRequest{OperationName: "Upgrade"})
+			Expect(allowed).To(BeTrue())
+		}
+		allowed, _ := limiter.Allow(&operation.OperationRequest{OperationName: "Upgrade"})
+		Expect(allowed).To(BeFalse())
+
+		// A rate below 1 still allows a request.
+		allowed, _ = limiter.Allow(&operation.OperationRequest{EntityType: "Cluster", EntityId: "1"})
+		Expect(allowed).To(BeTrue())
+		Expect(limiter.State()).To(ContainElement(BucketState{Rule: "entity", Key: "Cluster/1", Tokens: 0, Limit: Limit{Rate: 0.5, Burst: 1}}))
+	})
+
+	It("should prune the buckets that are full", func() {
+		limiter.Allow(upgrade)
+		Expect(limiter.State()).To(HaveLen(2))
+
+		now = now.Add(pruneInterval)
+		limiter.Allow(&operation.OperationRequest{})
+		Expect(limiter.State()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("RateLimitHandler", func() {
+	var (
+		ctx           context.Context
+		buf           bytes.Buffer
+		sampleSettler shuttle.MessageSettler
+		message       *azservicebus.ReceivedMessage
+		marshaller    shuttle.Marshaller
+		limiter       *Limiter
+		handler       errorHandlers.ErrorHandlerFunc
+		sender        sb.SenderInterface
+		receiver      sb.ReceiverInterface
+	)
+
+	BeforeEach(func() {
+		buf.Reset()
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		ctx = ctxlogger.WithLogger(context.TODO(), logger)
+		sampleSettler = &settler.SampleMessageSettler{}
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+
+		req := &operation.OperationRequest{OperationName: "Upgrade", OperationId: "0", EntityType: "Cluster", EntityId: "1"}
+		marshalledMessage, err := marshaller.Marshal(req)
+		Expect(err).ToNot(HaveOccurred())
+		message = convert.ConvertToReceivedMessage(marshalledMessage)
+
+		limiter = NewLimiter(Rule{Name: "operation", Key: ByOperationName, Limit: Limit{Rate: 1, Burst: 1}})
+
+		client := sb.NewFakeServiceBusClient()
+		sender, _ = client.NewServiceBusSender(ctx, "operations", nil)
+		receiver, _ = client.NewServiceBusReceiver(ctx, "operations", nil)
+	})
+
+	It("should not throttle the messages without a sender", func() {
+		handler = NewRateLimitHandler(limiter, sampleErrorHandler.SampleErrorHandler(nil), marshaller, nil, nil)
+		Expect(handler(ctx, sampleSettler, message)).To(BeNil())
+		Expect(handler(ctx, sampleSettler, message)).To(BeNil())
+		Expect(buf.String()).To(ContainSubstring("No sender received"))
+	})
+
+	It("should reschedule the throttled messages", func() {
+		settlementHooks := &sampleHooks.SampleSettlementHooks{}
+		handler = NewRateLimitHandler(limiter, sampleErrorHandler.SampleErrorHandler(nil), marshaller, sender, []hooks.SettlementHooks{settlementHooks})
+
+		Expect(handler(ctx, sampleSettler, message)).To(BeNil())
+		asyncErr := handler(ctx, sampleSettler, message)
+		Expect(asyncErr).ToNot(BeNil())
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+		Expect(asyncErr.RetryAfter).To(BeNumerically(">", 0))
+
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		Expect(messages[0].Body).To(Equal(message.Body))
+		Expect(*messages[0].ScheduledEnqueueTime).To(BeTemporally(">", time.Now()))
+		Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Complete", "AfterSettle:Complete", "OnRetryScheduled"}))
+	})
+
+	It("should return the settling error", func() {
+		settlementHooks := &sampleHooks.SampleSettlementHooks{}
+		handler = NewRateLimitHandler(limiter, sampleErrorHandler.SampleErrorHandler(nil), marshaller, sender, []hooks.SettlementHooks{settlementHooks})
+		Expect(handler(ctx, sampleSettler, message)).To(BeNil())
+
+		failureContentType := "failure_test"
+		message.ContentType = &failureContentType
+		asyncErr := handler(ctx, sampleSettler, message)
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeFalse())
+		Expect(settlementHooks.Calls).To(Equal([]string{"BeforeSettle:Complete", "AfterSettle:Complete:error"}))
+	})
+})
@@ -0,0 +1,76 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Azure/aks-async/database"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+// Operation id used to reach the operation container. It's not expected to exist.
+const ProbeOperationId = "health-probe"
+
+// Check of a dependency the processor needs to be ready.
+type Check interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type checkFunc struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func (c *checkFunc) Name() string {
+	return c.name
+}
+
+func (c *checkFunc) Check(ctx context.Context) error {
+	return c.check(ctx)
+}
+
+// Creates a check from a function.
+func NewCheck(name string, check func(ctx context.Context) error) Check {
+	return &checkFunc{name: name, check: check}
+}
+
+// Checks that the service bus is reachable by peeking a message, which doesn't lock it.
+func ReceiverCheck(receiver sb.ReceiverInterface) Check {
+	return NewCheck("servicebus", func(ctx context.Context) error {
+		azReceiver, err := receiver.GetAzureReceiver()
+		if err != nil {
+			return err
+		}
+		if azReceiver == nil {
+			return errors.New("No Receiver was found.")
+		}
+		_, err = azReceiver.PeekMessages(ctx, 1, nil)
+		return err
+	})
+}
+
+// Checks that the database is reachable.
+func DatabaseCheck(db *sql.DB) Check {
+	return NewCheck("database", func(ctx context.Context) error {
+		return database.PingDb(ctx, db)
+	})
+}
+
+// Checks that the operation container is reachable. Any answer from the service, including not
+// finding the probe operation, means it's reachable.
+func OperationContainerCheck(client oc.OperationContainerClient) Check {
+	return NewCheck("operationcontainer", func(ctx context.Context) error {
+		_, err := client.GetOperationStatus(ctx, &oc.GetOperationStatusRequest{OperationId: ProbeOperationId})
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.Unauthenticated, codes.PermissionDenied, codes.Unknown, codes.Internal:
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,200 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ocMock "github.com/Azure/OperationContainer/api/v1/mock"
+	"github.com/Azure/aks-async/runtime/matcher"
+	"github.com/Azure/aks-async/runtime/processor"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealth(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Health Suite")
+}
+
+// Receiver failing every receive of the processors.
+type failingReceiver struct {
+	sb.ReceiverInterface
+	*settler.SampleMessageSettler
+}
+
+func (r *failingReceiver) ReceiveMessages(ctx context.Context, maxMessages int, options *azservicebus.ReceiveMessagesOptions) ([]*azservicebus.ReceivedMessage, error) {
+	return nil, errors.New("Connection lost.")
+}
+
+var _ = Describe("Monitor", func() {
+	var (
+		ctx     context.Context
+		now     time.Time
+		monitor *Monitor
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now = time.Now()
+		monitor = NewMonitor()
+		monitor.now = func() time.Time { return now }
+		monitor.started = now
+	})
+
+	It("should not be alive after too many receive errors", func() {
+		receiver, _ := sb.NewFakeServiceBusClient().NewServiceBusReceiver(ctx, "operations", nil)
+		receiver = monitor.WrapReceiver(receiver)
+		for i := 0; i < DefaultMaxConsecutiveErrors-1; i++ {
+			_, _ = receiver.ReceiveMessage(ctx, 1, nil)
+		}
+		Expect(monitor.Liveness().Live).To(BeTrue())
+
+		_, _ = receiver.ReceiveMessage(ctx, 1, nil)
+		status := monitor.Liveness()
+		Expect(status.Live).To(BeFalse())
+		Expect(status.ConsecutiveErrors).To(Equal(DefaultMaxConsecutiveErrors))
+		Expect(status.LastError).To(Equal("No messages available."))
+
+		monitor.RecordReceive(nil)
+		Expect(monitor.Liveness().Live).To(BeTrue())
+	})
+
+	It("should record the receive errors of the processor", func() {
+		receiver := monitor.WrapReceiver(&failingReceiver{SampleMessageSettler: &settler.SampleMessageSettler{}})
+		handler := monitor.WrapHandler(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {})
+		p, err := processor.CreateProcessor(receiver, matcher.NewMatcher(), nil, nil, nil, handler, &shuttle.ProcessorOptions{MaxConcurrency: 1, StartMaxAttempt: 1}, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(p.Start(ctx)).To(HaveOccurred())
+		status := monitor.Liveness()
+		Expect(status.ConsecutiveErrors).To(Equal(1))
+		Expect(status.LastError).To(Equal("Connection lost."))
+		Expect(status.LastReceive).To(BeNil())
+	})
+
+	It("should not record the handled messages as receives", func() {
+		handler := monitor.WrapHandler(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {})
+		handler(ctx, &settler.SampleMessageSettler{}, &azservicebus.ReceivedMessage{})
+		Expect(monitor.Liveness().LastReceive).To(BeNil())
+	})
+
+	It("should not be alive if no message was received for too long", func() {
+		monitor.StallTimeout = time.Minute
+		now = now.Add(2 * time.Minute)
+		Expect(monitor.Liveness().Live).To(BeFalse())
+
+		monitor.RecordReceive(nil)
+		Expect(monitor.Liveness().Live).To(BeTrue())
+	})
+
+	It("should track the messages being handled", func() {
+		monitor.MaxHandlerDuration = time.Minute
+		release := make(chan struct{})
+		started := make(chan struct{})
+		handler := monitor.WrapHandler(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+			close(started)
+			<-release
+		})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler(ctx, &settler.SampleMessageSettler{}, &azservicebus.ReceivedMessage{})
+		}()
+
+		<-started
+		Expect(monitor.InFlight()).To(Equal(1))
+		Expect(monitor.Liveness().Live).To(BeTrue())
+
+		monitor.mu.Lock()
+		now = now.Add(2 * time.Minute)
+		monitor.mu.Unlock()
+		Expect(monitor.Liveness().Live).To(BeFalse())
+
+		close(release)
+		<-done
+		Expect(monitor.InFlight()).To(Equal(0))
+		Expect(monitor.Liveness().Live).To(BeTrue())
+	})
+})
+
+var _ = Describe("Handler", func() {
+	var (
+		ctx     context.Context
+		ctrl    *gomock.Controller
+		mux     *http.ServeMux
+		monitor *Monitor
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		ctrl = gomock.NewController(GinkgoT())
+		mux = http.NewServeMux()
+		monitor = NewMonitor()
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	It("should report the liveness", func() {
+		NewHandler(monitor).Register(mux)
+		Expect(get(LivenessPath).Code).To(Equal(http.StatusOK))
+
+		monitor.MaxConsecutiveErrors = 1
+		monitor.RecordReceive(errors.New("unreachable"))
+		response := get(LivenessPath)
+		Expect(response.Code).To(Equal(http.StatusServiceUnavailable))
+
+		var status LivenessStatus
+		Expect(json.Unmarshal(response.Body.Bytes(), &status)).To(Succeed())
+		Expect(status.LastError).To(Equal("unreachable"))
+	})
+
+	It("should report the readiness checks", func() {
+		NewHandler(monitor,
+			NewCheck("ok", func(ctx context.Context) error { return nil }),
+			NewCheck("down", func(ctx context.Context) error { return errors.New("down") }),
+		).Register(mux)
+
+		response := get(ReadinessPath)
+		Expect(response.Code).To(Equal(http.StatusServiceUnavailable))
+
+		var status ReadinessStatus
+		Expect(json.Unmarshal(response.Body.Bytes(), &status)).To(Succeed())
+		Expect(status.Checks).To(Equal(map[string]string{"ok": "ok", "down": "down"}))
+	})
+
+	It("should check the operation container", func() {
+		client := ocMock.NewMockOperationContainerClient(ctrl)
+		check := OperationContainerCheck(client)
+
+		client.EXPECT().GetOperationStatus(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.NotFound, "not found"))
+		Expect(check.Check(ctx)).To(Succeed())
+
+		client.EXPECT().GetOperationStatus(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Unavailable, "unavailable"))
+		Expect(check.Check(ctx)).ToNot(Succeed())
+	})
+
+	It("should fail the receiver check without an azure receiver", func() {
+		receiver, _ := sb.NewFakeServiceBusClient().NewServiceBusReceiver(ctx, "operations", nil)
+		Expect(ReceiverCheck(receiver).Check(ctx)).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,109 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	LivenessPath        = "/healthz"
+	ReadinessPath       = "/readyz"
+	DefaultCheckTimeout = 5 * time.Second
+)
+
+// ReadinessStatus reports the result of every readiness check.
+type ReadinessStatus struct {
+	Ready    bool              `json:"ready"`
+	Checks   map[string]string `json:"checks"`
+	InFlight int               `json:"inFlight"`
+}
+
+// Handler serves the liveness and readiness of a processor.
+type Handler struct {
+	Monitor *Monitor
+	Checks  []Check
+	// Time given to all the readiness checks to finish.
+	CheckTimeout time.Duration
+}
+
+func NewHandler(monitor *Monitor, checks ...Check) *Handler {
+	return &Handler{
+		Monitor:      monitor,
+		Checks:       checks,
+		CheckTimeout: DefaultCheckTimeout,
+	}
+}
+
+// Registers the liveness and readiness endpoints in the mux.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(LivenessPath, h.Liveness)
+	mux.HandleFunc(ReadinessPath, h.Readiness)
+}
+
+// Responds 200 if the processor is alive, or 503 otherwise.
+func (h *Handler) Liveness(w http.ResponseWriter, r *http.Request) {
+	status := &LivenessStatus{Live: true}
+	if h.Monitor != nil {
+		status = h.Monitor.Liveness()
+	}
+	writeStatus(w, status.Live, status)
+}
+
+// Responds 200 if all the checks succeed, or 503 otherwise.
+func (h *Handler) Readiness(w http.ResponseWriter, r *http.Request) {
+	status := h.Ready(r.Context())
+	writeStatus(w, status.Ready, status)
+}
+
+// Runs all the checks concurrently.
+func (h *Handler) Ready(ctx context.Context) *ReadinessStatus {
+	timeout := h.CheckTimeout
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	status := &ReadinessStatus{
+		Ready:  true,
+		Checks: make(map[string]string, len(h.Checks)),
+	}
+	if h.Monitor != nil {
+		status.InFlight = h.Monitor.InFlight()
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, check := range h.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := check.Check(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				status.Ready = false
+				status.Checks[check.Name()] = err.Error()
+				return
+			}
+			status.Checks[check.Name()] = "ok"
+		}()
+	}
+	wg.Wait()
+
+	return status
+}
+
+func writeStatus(w http.ResponseWriter, ok bool, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
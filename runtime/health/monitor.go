@@ -0,0 +1,254 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+const DefaultMaxConsecutiveErrors = 5
+
+// Monitor tracks the activity of a processor to tell whether it's alive.
+type Monitor struct {
+	// The processor isn't alive after this many receive errors in a row.
+	MaxConsecutiveErrors int
+	// If set, the processor isn't alive if no receive succeeded for this long. Only useful with
+	// receivers that return once no message is available.
+	StallTimeout time.Duration
+	// If set, the processor isn't alive if a message is being handled for longer than this.
+	MaxHandlerDuration time.Duration
+
+	started           time.Time
+	lastReceive       time.Time
+	lastError         error
+	lastErrorTime     time.Time
+	consecutiveErrors int
+	inFlight          map[uint64]time.Time
+	nextId            uint64
+	mu                sync.Mutex
+	now               func() time.Time
+}
+
+// LivenessStatus reports the activity of the processor.
+type LivenessStatus struct {
+	Live              bool       `json:"live"`
+	Reason            string     `json:"reason,omitempty"`
+	LastReceive       *time.Time `json:"lastReceive,omitempty"`
+	LastError         string     `json:"lastError,omitempty"`
+	LastErrorTime     *time.Time `json:"lastErrorTime,omitempty"`
+	ConsecutiveErrors int        `json:"consecutiveErrors"`
+	InFlight          int        `json:"inFlight"`
+	OldestInFlight    string     `json:"oldestInFlight,omitempty"`
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{
+		MaxConsecutiveErrors: DefaultMaxConsecutiveErrors,
+		started:              time.Now(),
+		inFlight:             make(map[uint64]time.Time),
+		now:                  time.Now,
+	}
+}
+
+// Records the result of receiving messages.
+func (m *Monitor) RecordReceive(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if err != nil {
+		m.lastError = err
+		m.lastErrorTime = now
+		m.consecutiveErrors++
+		return
+	}
+	m.lastReceive = now
+	m.consecutiveErrors = 0
+}
+
+// Returns the number of messages being handled.
+func (m *Monitor) InFlight() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.inFlight)
+}
+
+// Wraps the handler to track the messages being handled.
+func (m *Monitor) WrapHandler(handler shuttle.HandlerFunc) shuttle.HandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+		m.mu.Lock()
+		id := m.nextId
+		m.nextId++
+		m.inFlight[id] = m.now()
+		m.mu.Unlock()
+
+		defer func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			delete(m.inFlight, id)
+		}()
+
+		handler(ctx, settler, message)
+	}
+}
+
+// Wraps the receiver to record the result of every receive. The returned receiver also
+// implements shuttle.Receiver, so the processors created with it, like CreateProcessor, receive
+// through it instead of the azure receiver.
+func (m *Monitor) WrapReceiver(receiver sb.ReceiverInterface) sb.ReceiverInterface {
+	return &monitoredReceiver{
+		ReceiverInterface: receiver,
+		monitor:           m,
+	}
+}
+
+// Returns whether the processor is alive and why not.
+func (m *Monitor) Liveness() *LivenessStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	status := &LivenessStatus{
+		Live:              true,
+		ConsecutiveErrors: m.consecutiveErrors,
+		InFlight:          len(m.inFlight),
+	}
+	if !m.lastReceive.IsZero() {
+		lastReceive := m.lastReceive
+		status.LastReceive = &lastReceive
+	}
+	if m.lastError != nil {
+		lastErrorTime := m.lastErrorTime
+		status.LastError = m.lastError.Error()
+		status.LastErrorTime = &lastErrorTime
+	}
+
+	var oldest time.Duration
+	for _, startedAt := range m.inFlight {
+		if d := now.Sub(startedAt); d > oldest {
+			oldest = d
+		}
+	}
+	if len(m.inFlight) > 0 {
+		status.OldestInFlight = oldest.String()
+	}
+
+	switch {
+	case m.MaxConsecutiveErrors > 0 && m.consecutiveErrors >= m.MaxConsecutiveErrors:
+		status.Live = false
+		status.Reason = fmt.Sprintf("%d consecutive receive errors.", m.consecutiveErrors)
+	case m.MaxHandlerDuration > 0 && oldest > m.MaxHandlerDuration:
+		status.Live = false
+		status.Reason = fmt.Sprintf("A message is being handled for %s.", oldest)
+	case m.StallTimeout > 0 && now.Sub(m.lastActivity()) > m.StallTimeout:
+		status.Live = false
+		status.Reason = fmt.Sprintf("No message received for %s.", now.Sub(m.lastActivity()))
+	}
+
+	return status
+}
+
+// Must be called while holding the lock.
+func (m *Monitor) lastActivity() time.Time {
+	if m.lastReceive.After(m.started) {
+		return m.lastReceive
+	}
+	return m.started
+}
+
+var _ sb.ReceiverInterface = &monitoredReceiver{}
+var _ shuttle.Receiver = &monitoredReceiver{}
+
+type monitoredReceiver struct {
+	sb.ReceiverInterface
+	monitor *Monitor
+}
+
+func (r *monitoredReceiver) ReceiveMessage(ctx context.Context, maxMessages int, options *azservicebus.ReceiveMessagesOptions) ([]*azservicebus.ReceivedMessage, error) {
+	messages, err := r.ReceiverInterface.ReceiveMessage(ctx, maxMessages, options)
+	r.record(ctx, err)
+	return messages, err
+}
+
+func (r *monitoredReceiver) ReceiveMessages(ctx context.Context, maxMessages int, options *azservicebus.ReceiveMessagesOptions) ([]*azservicebus.ReceivedMessage, error) {
+	receiver, err := r.receiver()
+	if err != nil {
+		r.record(ctx, err)
+		return nil, err
+	}
+
+	messages, err := receiver.ReceiveMessages(ctx, maxMessages, options)
+	r.record(ctx, err)
+	return messages, err
+}
+
+func (r *monitoredReceiver) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	receiver, err := r.receiver()
+	if err != nil {
+		return err
+	}
+	return receiver.AbandonMessage(ctx, message, options)
+}
+
+func (r *monitoredReceiver) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	receiver, err := r.receiver()
+	if err != nil {
+		return err
+	}
+	return receiver.CompleteMessage(ctx, message, options)
+}
+
+func (r *monitoredReceiver) DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error {
+	receiver, err := r.receiver()
+	if err != nil {
+		return err
+	}
+	return receiver.DeadLetterMessage(ctx, message, options)
+}
+
+func (r *monitoredReceiver) DeferMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions) error {
+	receiver, err := r.receiver()
+	if err != nil {
+		return err
+	}
+	return receiver.DeferMessage(ctx, message, options)
+}
+
+func (r *monitoredReceiver) RenewMessageLock(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.RenewMessageLockOptions) error {
+	receiver, err := r.receiver()
+	if err != nil {
+		return err
+	}
+	return receiver.RenewMessageLock(ctx, message, options)
+}
+
+// Returns the receiver used by the processors: the wrapped receiver if it implements
+// shuttle.Receiver, or its azure receiver otherwise.
+func (r *monitoredReceiver) receiver() (shuttle.Receiver, error) {
+	if receiver, ok := r.ReceiverInterface.(shuttle.Receiver); ok {
+		return receiver, nil
+	}
+
+	azReceiver, err := r.ReceiverInterface.GetAzureReceiver()
+	if err != nil {
+		return nil, err
+	}
+	if azReceiver == nil {
+		return nil, errors.New("No azure receiver received.")
+	}
+	return azReceiver, nil
+}
+
+func (r *monitoredReceiver) record(ctx context.Context, err error) {
+	// Stopping the processor isn't a receive error.
+	if ctx.Err() == nil {
+		r.monitor.RecordReceive(err)
+	}
+}
@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+
+	"github.com/Azure/aks-async/runtime/entity"
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+// Phase is the step of the operation being audited.
+type Phase string
+
+const (
+	PhaseInitStart  Phase = "InitStart"
+	PhaseInitEnd    Phase = "InitEnd"
+	PhaseGuardStart Phase = "GuardStart"
+	PhaseGuardEnd   Phase = "GuardEnd"
+	PhaseRunStart   Phase = "RunStart"
+	PhaseRunEnd     Phase = "RunEnd"
+)
+
+// Record is a single entry of the audit trail. The error fields are only set on the End phases
+// of a failed step.
+type Record struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Phase         Phase     `json:"phase"`
+	OperationId   string    `json:"operationId"`
+	OperationName string    `json:"operationName"`
+	ApiVersion    string    `json:"apiVersion,omitempty"`
+	EntityType    string    `json:"entityType,omitempty"`
+	EntityId      string    `json:"entityId,omitempty"`
+	HttpMethod    string    `json:"httpMethod,omitempty"`
+	ErrorCode     int       `json:"errorCode,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Sink persists the audit records.
+type Sink interface {
+	RecordAudit(ctx context.Context, record *Record) error
+}
+
+type SinkFunc func(ctx context.Context, record *Record) error
+
+func (f SinkFunc) RecordAudit(ctx context.Context, record *Record) error {
+	return f(ctx, record)
+}
+
+var _ hooks.BaseOperationHooksInterface = &AuditHook{}
+
+// AuditHook records every phase of the operations to the Sink. By default a failure to record
+// is only logged, so auditing never fails an operation.
+type AuditHook struct {
+	Sink Sink
+	// If set, failing to record returns a RetryError instead.
+	FailOnSinkError bool
+
+	now func() time.Time
+}
+
+func NewAuditHook(sink Sink) *AuditHook {
+	return &AuditHook{
+		Sink: sink,
+		now:  time.Now,
+	}
+}
+
+func (h *AuditHook) BeforeInitOperation(ctx context.Context, req *operation.OperationRequest) *errors.AsyncError {
+	return h.record(ctx, PhaseInitStart, req, nil)
+}
+
+func (h *AuditHook) AfterInitOperation(ctx context.Context, op operation.ApiOperation, req *operation.OperationRequest, asyncError *errors.AsyncError) *errors.AsyncError {
+	return h.record(ctx, PhaseInitEnd, req, asyncError)
+}
+
+func (h *AuditHook) BeforeGuardConcurrency(ctx context.Context, op operation.ApiOperation, e entity.Entity) *errors.AsyncError {
+	return h.record(ctx, PhaseGuardStart, op.GetOperationRequest(), nil)
+}
+
+func (h *AuditHook) AfterGuardConcurrency(ctx context.Context, op operation.ApiOperation, asyncError *errors.AsyncError) *errors.AsyncError {
+	return h.record(ctx, PhaseGuardEnd, op.GetOperationRequest(), asyncError)
+}
+
+func (h *AuditHook) BeforeRun(ctx context.Context, op operation.ApiOperation) *errors.AsyncError {
+	return h.record(ctx, PhaseRunStart, op.GetOperationRequest(), nil)
+}
+
+func (h *AuditHook) AfterRun(ctx context.Context, op operation.ApiOperation, asyncError *errors.AsyncError) *errors.AsyncError {
+	return h.record(ctx, PhaseRunEnd, op.GetOperationRequest(), asyncError)
+}
+
+func (h *AuditHook) record(ctx context.Context, phase Phase, req *operation.OperationRequest, asyncErr *errors.AsyncError) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	now := h.now
+	if now == nil {
+		now = time.Now
+	}
+
+	record := &Record{
+		Timestamp:     now().UTC(),
+		Phase:         phase,
+		OperationId:   req.GetOperationId(),
+		OperationName: req.GetOperationName(),
+		ApiVersion:    req.GetApiVersion(),
+		EntityType:    req.GetEntityType(),
+		EntityId:      req.GetEntityId(),
+		HttpMethod:    req.GetHttpMethod(),
+	}
+	if asyncErr != nil {
+		record.ErrorCode = asyncErr.ErrorCode
+		record.Error = asyncErr.Error()
+	}
+
+	err := h.Sink.RecordAudit(ctx, record)
+	if err != nil {
+		logger.Error("AuditHook: Error recording " + string(phase) + ": " + err.Error())
+		if h.FailOnSinkError {
+			return &errors.AsyncError{
+				OriginalError: &errors.RetryError{Message: "Error recording audit."},
+				Message:       err.Error(),
+				ErrorCode:     500,
+			}
+		}
+	}
+
+	return nil
+}
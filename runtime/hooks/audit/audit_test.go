@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/operation"
+	sampleOperation "github.com/Azure/aks-async/runtime/testutils/operation"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestAudit(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Audit Suite")
+}
+
+var _ = Describe("AuditHook", func() {
+	var (
+		ctx        context.Context
+		records    []*Record
+		auditHook  *AuditHook
+		hOperation *hooks.HookedApiOperation
+		req        *operation.OperationRequest
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		records = []*Record{}
+		auditHook = NewAuditHook(SinkFunc(func(ctx context.Context, record *Record) error {
+			records = append(records, record)
+			return nil
+		}))
+		auditHook.now = func() time.Time { return time.Unix(0, 0) }
+		hOperation = &hooks.HookedApiOperation{
+			OperationInstance: &sampleOperation.SampleOperation{},
+			OperationHooks:    []hooks.BaseOperationHooksInterface{auditHook},
+		}
+		req = &operation.OperationRequest{
+			OperationName: "DeleteCluster",
+			OperationId:   "0",
+			EntityType:    "Cluster",
+			EntityId:      "1",
+			HttpMethod:    "DELETE",
+		}
+	})
+
+	phases := func() []Phase {
+		result := []Phase{}
+		for _, record := range records {
+			result = append(result, record.Phase)
+		}
+		return result
+	}
+
+	It("should record every phase of the operation", func() {
+		_, _ = hOperation.InitOperation(ctx, req)
+		_ = hOperation.GuardConcurrency(ctx, nil)
+		_ = hOperation.Run(ctx)
+
+		Expect(phases()).To(Equal([]Phase{PhaseInitStart, PhaseInitEnd, PhaseGuardStart, PhaseGuardEnd, PhaseRunStart, PhaseRunEnd}))
+		Expect(records[5].OperationName).To(Equal("DeleteCluster"))
+		Expect(records[5].EntityId).To(Equal("1"))
+		Expect(records[5].Timestamp).To(Equal(time.Unix(0, 0).UTC()))
+		Expect(records[5].Error).To(BeEmpty())
+	})
+
+	It("should record the error of the failed phase", func() {
+		req.OperationId = "3"
+		_, _ = hOperation.InitOperation(ctx, req)
+		asyncErr := hOperation.Run(ctx)
+		Expect(asyncErr).ToNot(BeNil())
+
+		last := records[len(records)-1]
+		Expect(last.Phase).To(Equal(PhaseRunEnd))
+		Expect(last.Error).To(ContainSubstring("Incorrect OperationId"))
+	})
+
+	It("should only fail the operation on sink errors if configured", func() {
+		auditHook.Sink = SinkFunc(func(ctx context.Context, record *Record) error {
+			return errors.New("sink unavailable")
+		})
+		_, asyncErr := hOperation.InitOperation(ctx, req)
+		Expect(asyncErr).To(BeNil())
+
+		auditHook.FailOnSinkError = true
+		_, asyncErr = hOperation.InitOperation(ctx, req)
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+	})
+})
+
+var _ = Describe("JSONLinesSink", func() {
+	It("should append one JSON record per line to the file", func() {
+		ctx := context.Background()
+		path := filepath.Join(GinkgoT().TempDir(), "audit.jsonl")
+
+		sink, err := NewFileSink(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sink.RecordAudit(ctx, &Record{Phase: PhaseRunStart, OperationId: "0"})).To(Succeed())
+		Expect(sink.RecordAudit(ctx, &Record{Phase: PhaseRunEnd, OperationId: "0", ErrorCode: 500, Error: "failed"})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		file, err := os.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+
+		lines := []Record{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record Record
+			Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+			lines = append(lines, record)
+		}
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[1].Phase).To(Equal(PhaseRunEnd))
+		Expect(lines[1].ErrorCode).To(Equal(500))
+	})
+})
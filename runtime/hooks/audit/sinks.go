@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Azure/aks-async/database"
+)
+
+var _ Sink = &SqlSink{}
+
+// SqlSink inserts the audit records in a SQL Server table with the following schema:
+//
+//	CREATE TABLE OperationAudit (
+//		Id BIGINT IDENTITY(1,1) PRIMARY KEY,
+//		Timestamp DATETIME2 NOT NULL,
+//		Phase NVARCHAR(32) NOT NULL,
+//		OperationId NVARCHAR(255) NOT NULL,
+//		OperationName NVARCHAR(255) NOT NULL,
+//		ApiVersion NVARCHAR(64) NULL,
+//		EntityType NVARCHAR(255) NULL,
+//		EntityId NVARCHAR(255) NULL,
+//		HttpMethod NVARCHAR(16) NULL,
+//		ErrorCode INT NULL,
+//		Error NVARCHAR(MAX) NULL
+//	)
+//
+// The table name is not parametrized in the queries, so it must come from trusted configuration.
+type SqlSink struct {
+	db    *sql.DB
+	table string
+}
+
+func NewSqlSink(db *sql.DB, table string) *SqlSink {
+	return &SqlSink{
+		db:    db,
+		table: table,
+	}
+}
+
+func (s *SqlSink) RecordAudit(ctx context.Context, record *Record) error {
+	query := fmt.Sprintf(`INSERT INTO %s (Timestamp, Phase, OperationId, OperationName, ApiVersion, EntityType, EntityId, HttpMethod, ErrorCode, Error)
+VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9, @p10)`, s.table)
+	_, err := database.ExecDb(ctx, s.db, query,
+		record.Timestamp,
+		string(record.Phase),
+		record.OperationId,
+		record.OperationName,
+		record.ApiVersion,
+		record.EntityType,
+		record.EntityId,
+		record.HttpMethod,
+		record.ErrorCode,
+		record.Error,
+	)
+	return err
+}
+
+var _ Sink = &JSONLinesSink{}
+
+// JSONLinesSink writes each audit record as a JSON object on its own line.
+type JSONLinesSink struct {
+	writer io.Writer
+	closer io.Closer
+	mu     sync.Mutex
+}
+
+func NewJSONLinesSink(writer io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{
+		writer: writer,
+	}
+}
+
+// Creates a JSONLinesSink appending to the file, creating it if needed.
+func NewFileSink(path string) (*JSONLinesSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONLinesSink{
+		writer: file,
+		closer: file,
+	}, nil
+}
+
+func (s *JSONLinesSink) RecordAudit(ctx context.Context, record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A single write per record, so lines aren't interleaved between processes appending to the same file.
+	_, err = s.writer.Write(line)
+	return err
+}
+
+// Closes the file of the sink, if it was created with NewFileSink.
+func (s *JSONLinesSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
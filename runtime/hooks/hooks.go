@@ -2,6 +2,8 @@ package hooks
 
 import (
 	"context"
+	"fmt"
+	"runtime/debug"
 
 	"github.com/Azure/aks-async/runtime/entity"
 	"github.com/Azure/aks-async/runtime/errors"
@@ -22,9 +24,27 @@ type BaseOperationHooksInterface interface {
 	AfterRun(ctx context.Context, op operation.ApiOperation, asyncError *errors.AsyncError) *errors.AsyncError
 }
 
+// ErrorPolicy decides which error is returned when both the operation and an After* hook fail.
+type ErrorPolicy int
+
+const (
+	// Both errors are returned in an errors.JoinedError, so neither is lost and the most severe
+	// one decides how the message is settled.
+	ErrorPolicyJoined ErrorPolicy = iota
+	// The error of the hook is returned.
+	ErrorPolicyHookWins
+	// The error of the operation is returned and the error of the hook is only logged.
+	ErrorPolicyOperationWins
+)
+
 type HookedApiOperation struct {
 	OperationInstance operation.ApiOperation
 	OperationHooks    []BaseOperationHooksInterface
+	// Defaults to ErrorPolicyJoined.
+	ErrorPolicy ErrorPolicy
+	// If set, runs before the GuardConcurrency of the operation, between the GuardConcurrency
+	// hooks. The operation isn't guarded if it fails.
+	EntityGuard func(ctx context.Context, e entity.Entity) *errors.AsyncError
 }
 
 // HookedApiOperation implements the methods of the BaseOperationHooksInterface to allow the user to
@@ -53,7 +73,7 @@ func (h *HookedApiOperation) InitOperation(ctx context.Context, opReq *operation
 	logger := ctxlogger.GetLogger(ctx)
 	logger.Info("Running BeforeInit hooks.")
 	for _, hook := range h.OperationHooks {
-		herr := hook.BeforeInitOperation(ctx, opReq)
+		herr := callHook(ctx, "BeforeInit", func() *errors.AsyncError { return hook.BeforeInitOperation(ctx, opReq) })
 		if herr != nil {
 			logger.Error("Something went wrong running a BeforeInit hook: " + herr.Error())
 			return nil, herr
@@ -65,10 +85,10 @@ func (h *HookedApiOperation) InitOperation(ctx context.Context, opReq *operation
 
 	logger.Info("Running AfterInit hooks.")
 	for _, hook := range h.OperationHooks {
-		herr := hook.AfterInitOperation(ctx, h.OperationInstance, opReq, err)
+		herr := callHook(ctx, "AfterInit", func() *errors.AsyncError { return hook.AfterInitOperation(ctx, h.OperationInstance, opReq, err) })
 		if herr != nil {
 			logger.Error("Something went wrong running a AfterInit hook: " + herr.Error())
-			return nil, herr
+			return nil, h.combineErrors(ctx, err, herr)
 		}
 	}
 
@@ -79,22 +99,29 @@ func (h *HookedApiOperation) GuardConcurrency(ctx context.Context, e entity.Enti
 	logger := ctxlogger.GetLogger(ctx)
 	logger.Info("Running BeforeGuardConcurrency hooks.")
 	for _, hook := range h.OperationHooks {
-		herr := hook.BeforeGuardConcurrency(ctx, h.OperationInstance, e)
+		herr := callHook(ctx, "BeforeGuardConcurrency", func() *errors.AsyncError { return hook.BeforeGuardConcurrency(ctx, h.OperationInstance, e) })
 		if herr != nil {
 			logger.Error("Something went wrong running a BeforeGuardConcurrency hook: " + herr.Error())
 			return herr
 		}
 	}
 
-	logger.Info("Running operation guard concurrency.")
-	asyncError := h.OperationInstance.GuardConcurrency(ctx, e)
+	var asyncError *errors.AsyncError
+	if h.EntityGuard != nil {
+		logger.Info("Running entity guard.")
+		asyncError = h.EntityGuard(ctx, e)
+	}
+	if asyncError == nil {
+		logger.Info("Running operation guard concurrency.")
+		asyncError = h.OperationInstance.GuardConcurrency(ctx, e)
+	}
 
 	logger.Info("Running AfterGuardConcurrency hooks.")
 	for _, hook := range h.OperationHooks {
-		herr := hook.AfterGuardConcurrency(ctx, h.OperationInstance, asyncError)
+		herr := callHook(ctx, "AfterGuardConcurrency", func() *errors.AsyncError { return hook.AfterGuardConcurrency(ctx, h.OperationInstance, asyncError) })
 		if herr != nil {
 			logger.Error("Something went wrong running a AfterGuardConcurrency hook: " + herr.Error())
-			return herr
+			return h.combineErrors(ctx, asyncError, herr)
 		}
 	}
 
@@ -105,7 +132,7 @@ func (h *HookedApiOperation) Run(ctx context.Context) *errors.AsyncError {
 	logger := ctxlogger.GetLogger(ctx)
 	logger.Info("Running BeforeRun hooks.")
 	for _, hook := range h.OperationHooks {
-		herr := hook.BeforeRun(ctx, h.OperationInstance)
+		herr := callHook(ctx, "BeforeRun", func() *errors.AsyncError { return hook.BeforeRun(ctx, h.OperationInstance) })
 		if herr != nil {
 			logger.Error("Something went wrong running a BeforeRun hook: " + herr.Error())
 			return herr
@@ -117,12 +144,55 @@ func (h *HookedApiOperation) Run(ctx context.Context) *errors.AsyncError {
 
 	logger.Info("Running AfterRun hooks.")
 	for _, hook := range h.OperationHooks {
-		herr := hook.AfterRun(ctx, h.OperationInstance, err)
+		herr := callHook(ctx, "AfterRun", func() *errors.AsyncError { return hook.AfterRun(ctx, h.OperationInstance, err) })
 		if herr != nil {
 			logger.Error("Something went wrong running a AfterRun hook: " + herr.Error())
-			return herr
+			return h.combineErrors(ctx, err, herr)
 		}
 	}
 
 	return err
 }
+
+// Calls the hook, converting a panic into a NonRetryError since running the hook again would
+// panic again.
+func callHook(ctx context.Context, name string, hook func() *errors.AsyncError) (asyncErr *errors.AsyncError) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger := ctxlogger.GetLogger(ctx)
+			errorMessage := fmt.Sprintf("Panic in %s hook: %v", name, r)
+			logger.Error(errorMessage + "\n" + string(debug.Stack()))
+			asyncErr = &errors.AsyncError{
+				OriginalError: &errors.NonRetryError{Message: errorMessage},
+				Message:       errorMessage,
+				ErrorCode:     500,
+			}
+		}
+	}()
+
+	return hook()
+}
+
+// Combines the error of the operation with the error of an After* hook following the ErrorPolicy.
+func (h *HookedApiOperation) combineErrors(ctx context.Context, operationErr *errors.AsyncError, hookErr *errors.AsyncError) *errors.AsyncError {
+	return h.ErrorPolicy.Combine(ctx, operationErr, hookErr)
+}
+
+// Combine returns the error of the operation, the error of the hook, or both following the policy.
+// The error of the hook is returned if the operation didn't fail.
+func (p ErrorPolicy) Combine(ctx context.Context, operationErr *errors.AsyncError, hookErr *errors.AsyncError) *errors.AsyncError {
+	if operationErr == nil {
+		return hookErr
+	}
+
+	switch p {
+	case ErrorPolicyHookWins:
+		return hookErr
+	case ErrorPolicyOperationWins:
+		logger := ctxlogger.GetLogger(ctx)
+		logger.Info("Ignoring the hook error, returning the operation error: " + operationErr.Error())
+		return operationErr
+	default:
+		return errors.Join(operationErr, hookErr)
+	}
+}
@@ -2,11 +2,17 @@ package hooks
 
 import (
 	"context"
+	stderrors "errors"
 	"testing"
 
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/aks-async/runtime/entity"
 	"github.com/Azure/aks-async/runtime/errors"
 	"github.com/Azure/aks-async/runtime/operation"
 	sampleOperation "github.com/Azure/aks-async/runtime/testutils/operation"
+	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -80,4 +86,262 @@ var _ = Describe("Hooks", func() {
 			Fail("Something went wrong casting the operation to LongRunningOperation type.")
 		}
 	})
+
+	It("should run the entity guard between the GuardConcurrency hooks", func() {
+		guardErr := &errors.AsyncError{OriginalError: &errors.NonRetryError{Message: "Entity was modified."}}
+		guardHooks := &guardRecordingHooks{}
+		hOperation.OperationHooks = []BaseOperationHooksInterface{guardHooks}
+		hOperation.EntityGuard = func(ctx context.Context, e entity.Entity) *errors.AsyncError {
+			guardHooks.ran = append(guardHooks.ran, "EntityGuard")
+			return guardErr
+		}
+
+		Expect(hOperation.GuardConcurrency(ctx, nil)).To(Equal(guardErr))
+		Expect(guardHooks.ran).To(Equal([]string{"BeforeGuardConcurrency", "EntityGuard", "AfterGuardConcurrency"}))
+		Expect(guardHooks.afterErr).To(Equal(guardErr))
+	})
+})
+
+// Records the GuardConcurrency hooks.
+type guardRecordingHooks struct {
+	HookedApiOperation
+	ran      []string
+	afterErr *errors.AsyncError
+}
+
+func (h *guardRecordingHooks) BeforeGuardConcurrency(ctx context.Context, op operation.ApiOperation, e entity.Entity) *errors.AsyncError {
+	h.ran = append(h.ran, "BeforeGuardConcurrency")
+	return nil
+}
+
+func (h *guardRecordingHooks) AfterGuardConcurrency(ctx context.Context, op operation.ApiOperation, asyncErr *errors.AsyncError) *errors.AsyncError {
+	h.ran = append(h.ran, "AfterGuardConcurrency")
+	h.afterErr = asyncErr
+	return nil
+}
+
+// Records the hooks that ran.
+type recordingHooks struct {
+	HookedApiOperation
+	name string
+	ran  *[]string
+}
+
+func (h *recordingHooks) BeforeRun(ctx context.Context, op operation.ApiOperation) *errors.AsyncError {
+	*h.ran = append(*h.ran, h.name)
+	return nil
+}
+
+// Records the settlement and step hooks called.
+type recordingSettlementHooks struct {
+	BaseSettlementHooks
+	recordingHooks
+}
+
+func (h *recordingSettlementHooks) OnDeadLetter(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError) {
+	*h.ran = append(*h.ran, h.name+":OnDeadLetter")
+}
+
+func (h *recordingSettlementHooks) OnTerminal(ctx context.Context, operationId string, status oc.Status, asyncErr *errors.AsyncError) {
+	*h.ran = append(*h.ran, h.name+":OnTerminal")
+}
+
+func (h *recordingSettlementHooks) BeforeStep(ctx context.Context, op operation.ApiOperation, step string) *errors.AsyncError {
+	*h.ran = append(*h.ran, h.name+":BeforeStep")
+	return nil
+}
+
+func (h *recordingSettlementHooks) AfterStep(ctx context.Context, op operation.ApiOperation, step string, asyncError *errors.AsyncError) *errors.AsyncError {
+	return asyncError
+}
+
+var _ = Describe("ScopedHook", func() {
+	var (
+		ctx       context.Context
+		opRequest *operation.OperationRequest
+		ran       []string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		opRequest = &operation.OperationRequest{
+			OperationName: "DeleteCluster",
+			ApiVersion:    "v1.0.0",
+			OperationId:   "0",
+			EntityType:    "Cluster",
+		}
+		ran = []string{}
+	})
+
+	run := func(hookList ...BaseOperationHooksInterface) {
+		hOperation := &HookedApiOperation{
+			OperationInstance: &sampleOperation.SampleOperation{},
+			OperationHooks:    SortByPriority(hookList),
+		}
+		_, err := hOperation.InitOperation(ctx, opRequest)
+		Expect(err).To(BeNil())
+		_ = hOperation.Run(ctx)
+	}
+
+	It("should only run the hooks matching the scope", func() {
+		run(
+			NewScopedHook(&recordingHooks{name: "delete", ran: &ran}, Scope{OperationNames: []string{"DeleteCluster"}}, 0),
+			NewScopedHook(&recordingHooks{name: "create", ran: &ran}, Scope{OperationNames: []string{"CreateCluster"}}, 0),
+			NewScopedHook(&recordingHooks{name: "nodepool", ran: &ran}, Scope{EntityTypes: []string{"NodePool"}}, 0),
+			NewScopedHook(&recordingHooks{name: "v1", ran: &ran}, Scope{EntityTypes: []string{"Cluster"}, ApiVersions: []string{"v1.0.0"}}, 0),
+			&recordingHooks{name: "all", ran: &ran},
+		)
+		Expect(ran).To(Equal([]string{"delete", "v1", "all"}))
+	})
+
+	It("should run the hooks by priority", func() {
+		run(
+			&recordingHooks{name: "default", ran: &ran},
+			NewScopedHook(&recordingHooks{name: "low", ran: &ran}, Scope{}, -1),
+			NewScopedHook(&recordingHooks{name: "high", ran: &ran}, Scope{}, 10),
+			NewScopedHook(&recordingHooks{name: "default2", ran: &ran}, Scope{}, 0),
+		)
+		Expect(ran).To(Equal([]string{"high", "default", "default2", "low"}))
+	})
+
+	It("should forward the settlement and step hooks matching the scope", func() {
+		marshalledMessage, err := (&shuttle.DefaultProtoMarshaller{}).Marshal(opRequest)
+		Expect(err).To(BeNil())
+		message := convert.ConvertToReceivedMessage(marshalledMessage)
+
+		hookList := []BaseOperationHooksInterface{
+			NewScopedHook(&recordingSettlementHooks{recordingHooks: recordingHooks{name: "delete", ran: &ran}}, Scope{OperationNames: []string{"DeleteCluster"}}, 0),
+			NewScopedHook(&recordingSettlementHooks{recordingHooks: recordingHooks{name: "create", ran: &ran}}, Scope{OperationNames: []string{"CreateCluster"}}, 0),
+			NewScopedHook(&recordingHooks{name: "operation", ran: &ran}, Scope{}, 0),
+		}
+
+		for _, hook := range GetSettlementHooks(hookList) {
+			hook.OnDeadLetter(ctx, message, nil)
+			hook.OnTerminal(WithTerminalRequest(ctx, opRequest), opRequest.OperationId, oc.Status_FAILED, nil)
+		}
+		op := &sampleOperation.SampleOperation{}
+		_, initErr := op.InitOperation(ctx, opRequest)
+		Expect(initErr).To(BeNil())
+		for _, hook := range hookList {
+			if stepHook, ok := hook.(operation.StepHooks); ok {
+				Expect(stepHook.BeforeStep(ctx, op, "step")).To(BeNil())
+			}
+		}
+		Expect(ran).To(Equal([]string{"delete:OnDeadLetter", "delete:OnTerminal", "delete:BeforeStep"}))
+	})
+
+	It("should only call the scoped OnTerminal hooks with the request in the context", func() {
+		hook := NewScopedHook(&recordingSettlementHooks{recordingHooks: recordingHooks{name: "delete", ran: &ran}}, Scope{OperationNames: []string{"DeleteCluster"}}, 0)
+		hook.OnTerminal(ctx, opRequest.OperationId, oc.Status_SUCCEEDED, nil)
+		Expect(ran).To(BeEmpty())
+
+		hook.OnTerminal(WithTerminalRequest(ctx, opRequest), opRequest.OperationId, oc.Status_SUCCEEDED, nil)
+		Expect(ran).To(Equal([]string{"delete:OnTerminal"}))
+	})
+})
+
+// Hooks failing after the operation ran.
+type failingHooks struct {
+	HookedApiOperation
+	panicValue any
+	hookErr    *errors.AsyncError
+}
+
+func (h *failingHooks) AfterRun(ctx context.Context, op operation.ApiOperation, err *errors.AsyncError) *errors.AsyncError {
+	if h.panicValue != nil {
+		panic(h.panicValue)
+	}
+	return h.hookErr
+}
+
+var _ = Describe("Hook errors", func() {
+	var (
+		ctx        context.Context
+		hook       *failingHooks
+		hOperation *HookedApiOperation
+		hookErr    *errors.AsyncError
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		hookErr = &errors.AsyncError{OriginalError: &errors.RetryError{Message: "hook"}, Message: "hook"}
+		hook = &failingHooks{hookErr: hookErr}
+		hOperation = &HookedApiOperation{
+			OperationInstance: &sampleOperation.SampleOperation{},
+			OperationHooks:    []BaseOperationHooksInterface{hook},
+		}
+	})
+
+	// The sample operation fails to run with OperationId 3.
+	initOperation := func(operationId string) {
+		_, err := hOperation.InitOperation(ctx, &operation.OperationRequest{OperationId: operationId})
+		Expect(err).To(BeNil())
+	}
+
+	It("should convert a hook panic into a NonRetryError", func() {
+		initOperation("0")
+		hook.panicValue = "boom"
+		asyncErr := hOperation.Run(ctx)
+		Expect(asyncErr).ToNot(BeNil())
+		var nonRetryErr *errors.NonRetryError
+		Expect(stderrors.As(asyncErr, &nonRetryErr)).To(BeTrue())
+		Expect(asyncErr.Message).To(ContainSubstring("boom"))
+	})
+
+	It("should join both errors by default", func() {
+		initOperation("3")
+		asyncErr := hOperation.Run(ctx)
+
+		var joinedErr *errors.JoinedError
+		Expect(stderrors.As(asyncErr, &joinedErr)).To(BeTrue())
+		Expect(joinedErr.Errors).To(HaveLen(2))
+	})
+
+	It("should return the hook error if the hook wins", func() {
+		initOperation("3")
+		hOperation.ErrorPolicy = ErrorPolicyHookWins
+		Expect(hOperation.Run(ctx)).To(Equal(hookErr))
+	})
+
+	It("should return the operation error if the operation wins", func() {
+		initOperation("3")
+		hOperation.ErrorPolicy = ErrorPolicyOperationWins
+		asyncErr := hOperation.Run(ctx)
+		Expect(asyncErr).ToNot(Equal(hookErr))
+		Expect(asyncErr.Error()).To(ContainSubstring("Incorrect OperationId"))
+	})
+
+	It("should return the hook error if the operation succeeded", func() {
+		initOperation("0")
+		hOperation.ErrorPolicy = ErrorPolicyOperationWins
+		Expect(hOperation.Run(ctx)).To(Equal(hookErr))
+	})
+
+	It("should join both errors", func() {
+		initOperation("3")
+		hOperation.ErrorPolicy = ErrorPolicyJoined
+		asyncErr := hOperation.Run(ctx)
+
+		var joinedErr *errors.JoinedError
+		Expect(stderrors.As(asyncErr, &joinedErr)).To(BeTrue())
+		Expect(joinedErr.Errors).To(HaveLen(2))
+		Expect(stderrors.Is(asyncErr, hookErr)).To(BeTrue())
+		Expect(errors.Classify(asyncErr)).To(Equal(hookErr.OriginalError))
+	})
+
+	It("should classify joined errors", func() {
+		nonRetryErr := &errors.NonRetryError{Message: "operation"}
+		joined := &errors.JoinedError{Errors: []error{
+			hookErr,
+			&errors.AsyncError{OriginalError: nonRetryErr},
+		}}
+		Expect(errors.Classify(joined)).To(Equal(nonRetryErr))
+
+		deferErr := &errors.DeferError{Message: "blocked"}
+		Expect(errors.Classify(&errors.JoinedError{Errors: []error{deferErr, hookErr}})).To(Equal(hookErr.OriginalError))
+		Expect(errors.Classify(&errors.JoinedError{Errors: []error{deferErr, stderrors.New("unknown")}})).To(Equal(deferErr))
+
+		unknown := stderrors.New("unknown")
+		Expect(errors.Classify(&errors.AsyncError{OriginalError: unknown})).To(Equal(unknown))
+	})
 })
@@ -0,0 +1,208 @@
+package hooks
+
+import (
+	"context"
+	"slices"
+	"sort"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/entity"
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+// Scope restricts the operations a hook runs for. Empty fields match every operation.
+type Scope struct {
+	OperationNames []string
+	EntityTypes    []string
+	ApiVersions    []string
+}
+
+func (s Scope) Matches(req *operation.OperationRequest) bool {
+	if req == nil {
+		return len(s.OperationNames) == 0 && len(s.EntityTypes) == 0 && len(s.ApiVersions) == 0
+	}
+
+	return matches(s.OperationNames, req.GetOperationName()) &&
+		matches(s.EntityTypes, req.GetEntityType()) &&
+		matches(s.ApiVersions, req.GetApiVersion())
+}
+
+func matches(allowed []string, value string) bool {
+	return len(allowed) == 0 || slices.Contains(allowed, value)
+}
+
+// PrioritizedHook can be implemented by hooks to control the order in which they run.
+type PrioritizedHook interface {
+	GetPriority() int
+}
+
+var _ BaseOperationHooksInterface = &ScopedHook{}
+var _ PrioritizedHook = &ScopedHook{}
+var _ SettlementHooks = &ScopedHook{}
+var _ operation.StepHooks = &ScopedHook{}
+
+// ScopedHook only runs the wrapped hook for the operations matching the Scope. If the wrapped hook
+// implements SettlementHooks or operation.StepHooks, those are forwarded with the same filter.
+// Ex:
+//
+//	hooks.NewScopedHook(auditHook, hooks.Scope{OperationNames: []string{"DeleteCluster"}}, 10)
+type ScopedHook struct {
+	Hook  BaseOperationHooksInterface
+	Scope Scope
+	// Hooks with a higher priority run first.
+	Priority int
+	// Used to read the operation of the messages passed to the settlement hooks. Defaults to the
+	// proto marshaller.
+	Marshaller shuttle.Marshaller
+}
+
+func NewScopedHook(hook BaseOperationHooksInterface, scope Scope, priority int) *ScopedHook {
+	return &ScopedHook{
+		Hook:     hook,
+		Scope:    scope,
+		Priority: priority,
+	}
+}
+
+func (h *ScopedHook) GetPriority() int {
+	return h.Priority
+}
+
+func (h *ScopedHook) matchesOperation(op operation.ApiOperation) bool {
+	if op == nil {
+		return h.Scope.Matches(nil)
+	}
+	return h.Scope.Matches(op.GetOperationRequest())
+}
+
+func (h *ScopedHook) BeforeInitOperation(ctx context.Context, req *operation.OperationRequest) *errors.AsyncError {
+	if !h.Scope.Matches(req) {
+		return nil
+	}
+	return h.Hook.BeforeInitOperation(ctx, req)
+}
+
+func (h *ScopedHook) AfterInitOperation(ctx context.Context, op operation.ApiOperation, req *operation.OperationRequest, asyncError *errors.AsyncError) *errors.AsyncError {
+	if !h.Scope.Matches(req) {
+		return nil
+	}
+	return h.Hook.AfterInitOperation(ctx, op, req, asyncError)
+}
+
+func (h *ScopedHook) BeforeGuardConcurrency(ctx context.Context, op operation.ApiOperation, e entity.Entity) *errors.AsyncError {
+	if !h.matchesOperation(op) {
+		return nil
+	}
+	return h.Hook.BeforeGuardConcurrency(ctx, op, e)
+}
+
+func (h *ScopedHook) AfterGuardConcurrency(ctx context.Context, op operation.ApiOperation, asyncError *errors.AsyncError) *errors.AsyncError {
+	if !h.matchesOperation(op) {
+		return nil
+	}
+	return h.Hook.AfterGuardConcurrency(ctx, op, asyncError)
+}
+
+func (h *ScopedHook) BeforeRun(ctx context.Context, op operation.ApiOperation) *errors.AsyncError {
+	if !h.matchesOperation(op) {
+		return nil
+	}
+	return h.Hook.BeforeRun(ctx, op)
+}
+
+func (h *ScopedHook) AfterRun(ctx context.Context, op operation.ApiOperation, asyncError *errors.AsyncError) *errors.AsyncError {
+	if !h.matchesOperation(op) {
+		return nil
+	}
+	return h.Hook.AfterRun(ctx, op, asyncError)
+}
+
+func (h *ScopedHook) BeforeStep(ctx context.Context, op operation.ApiOperation, step string) *errors.AsyncError {
+	stepHook, ok := h.Hook.(operation.StepHooks)
+	if !ok || !h.matchesOperation(op) {
+		return nil
+	}
+	return stepHook.BeforeStep(ctx, op, step)
+}
+
+func (h *ScopedHook) AfterStep(ctx context.Context, op operation.ApiOperation, step string, asyncError *errors.AsyncError) *errors.AsyncError {
+	stepHook, ok := h.Hook.(operation.StepHooks)
+	if !ok || !h.matchesOperation(op) {
+		return nil
+	}
+	return stepHook.AfterStep(ctx, op, step, asyncError)
+}
+
+// Returns the settlement hooks of the wrapped hook if the operation of the message matches the
+// scope. Messages that can't be unmarshalled only match an empty scope.
+func (h *ScopedHook) settlementHook(message *azservicebus.ReceivedMessage) (SettlementHooks, bool) {
+	settlementHook, ok := h.Hook.(SettlementHooks)
+	if !ok {
+		return nil, false
+	}
+
+	marshaller := h.Marshaller
+	if marshaller == nil {
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+	}
+
+	var req operation.OperationRequest
+	if message == nil || marshaller.Unmarshal(message.Message(), &req) != nil {
+		return settlementHook, h.Scope.Matches(nil)
+	}
+	return settlementHook, h.Scope.Matches(&req)
+}
+
+func (h *ScopedHook) BeforeSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action SettleAction) {
+	if settlementHook, ok := h.settlementHook(message); ok {
+		settlementHook.BeforeSettle(ctx, message, action)
+	}
+}
+
+func (h *ScopedHook) AfterSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action SettleAction, err error) {
+	if settlementHook, ok := h.settlementHook(message); ok {
+		settlementHook.AfterSettle(ctx, message, action, err)
+	}
+}
+
+func (h *ScopedHook) OnRetryScheduled(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError) {
+	if settlementHook, ok := h.settlementHook(message); ok {
+		settlementHook.OnRetryScheduled(ctx, message, asyncErr)
+	}
+}
+
+func (h *ScopedHook) OnDeadLetter(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError) {
+	if settlementHook, ok := h.settlementHook(message); ok {
+		settlementHook.OnDeadLetter(ctx, message, asyncErr)
+	}
+}
+
+// The scope is matched against the request of the context, see WithTerminalRequest.
+func (h *ScopedHook) OnTerminal(ctx context.Context, operationId string, status oc.Status, asyncErr *errors.AsyncError) {
+	settlementHook, ok := h.Hook.(SettlementHooks)
+	if !ok || !h.Scope.Matches(getTerminalRequest(ctx)) {
+		return
+	}
+	settlementHook.OnTerminal(ctx, operationId, status, asyncErr)
+}
+
+// Returns a copy of the hooks sorted from the highest to the lowest priority. Hooks that don't
+// implement PrioritizedHook have a priority of 0, and hooks with the same priority keep their order.
+func SortByPriority(hookList []BaseOperationHooksInterface) []BaseOperationHooksInterface {
+	sorted := slices.Clone(hookList)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return priority(sorted[i]) > priority(sorted[j])
+	})
+	return sorted
+}
+
+func priority(hook BaseOperationHooksInterface) int {
+	if prioritizedHook, ok := hook.(PrioritizedHook); ok {
+		return prioritizedHook.GetPriority()
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package hooks
+
+import (
+	"context"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+// SettleAction is the action taken to settle a message.
+type SettleAction string
+
+const (
+	SettleActionComplete   SettleAction = "Complete"
+	SettleActionAbandon    SettleAction = "Abandon"
+	SettleActionDeadLetter SettleAction = "DeadLetter"
+	SettleActionDefer      SettleAction = "Defer"
+)
+
+// SettlementHooks are called once the outcome of the message is decided. Unlike the operation
+// hooks they can't change the outcome, they are meant to emit events reliably.
+type SettlementHooks interface {
+	BeforeSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action SettleAction)
+	// err is the error returned while settling the message, if any.
+	AfterSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action SettleAction, err error)
+	// Called once the message has been abandoned to be retried.
+	OnRetryScheduled(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError)
+	// Called once the message has been dead-lettered because of an error that won't be retried.
+	OnDeadLetter(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError)
+	// Called once the message has been completed or dead-lettered, so the operation won't run again.
+	// status is Succeeded or Failed. With an OperationContainer, it's called once the final status
+	// of the operation is set.
+	OnTerminal(ctx context.Context, operationId string, status oc.Status, asyncErr *errors.AsyncError)
+}
+
+var _ SettlementHooks = &BaseSettlementHooks{}
+
+// BaseSettlementHooks implements all the SettlementHooks, so it can be embedded to implement
+// only the hooks needed.
+type BaseSettlementHooks struct{}
+
+func (h *BaseSettlementHooks) BeforeSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action SettleAction) {
+}
+func (h *BaseSettlementHooks) AfterSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action SettleAction, err error) {
+}
+func (h *BaseSettlementHooks) OnRetryScheduled(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError) {
+}
+func (h *BaseSettlementHooks) OnDeadLetter(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *errors.AsyncError) {
+}
+func (h *BaseSettlementHooks) OnTerminal(ctx context.Context, operationId string, status oc.Status, asyncErr *errors.AsyncError) {
+}
+
+type terminalRequestKey struct{}
+
+// Returns a context holding the request of the operation passed to the OnTerminal hooks, so they
+// can tell which operation ended beyond its id.
+func WithTerminalRequest(ctx context.Context, req *operation.OperationRequest) context.Context {
+	return context.WithValue(ctx, terminalRequestKey{}, req)
+}
+
+func getTerminalRequest(ctx context.Context) *operation.OperationRequest {
+	req, _ := ctx.Value(terminalRequestKey{}).(*operation.OperationRequest)
+	return req
+}
+
+// Returns the hooks of the list implementing SettlementHooks.
+func GetSettlementHooks(hookList []BaseOperationHooksInterface) []SettlementHooks {
+	settlementHooks := []SettlementHooks{}
+	for _, hook := range hookList {
+		if settlementHook, ok := hook.(SettlementHooks); ok {
+			settlementHooks = append(settlementHooks, settlementHook)
+		}
+	}
+	return settlementHooks
+}
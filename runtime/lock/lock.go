@@ -0,0 +1,161 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+const (
+	// Default duration of a lease.
+	DefaultTTL = 60 * time.Second
+	// Default interval between lease renewals, matching the renewal of the message lock.
+	DefaultRenewInterval = 10 * time.Second
+)
+
+// Lease is the lock held by an owner, typically an operation, over a key.
+type Lease struct {
+	Key       string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// Locker grants exclusive leases over keys. Acquiring a lease already held by the same owner
+// succeeds, so a redelivered operation can take back its own lease.
+type Locker interface {
+	// Returns a LockContendedError if another owner holds an unexpired lease on the key.
+	Acquire(ctx context.Context, key string, owner string, ttl time.Duration) (*Lease, error)
+	// Extends the lease. Returns a LeaseLostError if the lease has been taken by another owner.
+	Renew(ctx context.Context, lease *Lease, ttl time.Duration) error
+	Release(ctx context.Context, lease *Lease) error
+}
+
+type LockContendedError struct {
+	Key   string
+	Owner string
+	// Time until the current lease expires.
+	RetryAfter time.Duration
+}
+
+func (e *LockContendedError) Error() string {
+	return fmt.Sprintf("The lock %s is held by %s for %s.", e.Key, e.Owner, e.RetryAfter)
+}
+
+type LeaseLostError struct {
+	Key   string
+	Owner string
+}
+
+func (e *LeaseLostError) Error() string {
+	return fmt.Sprintf("The lease of %s on lock %s has been lost.", e.Owner, e.Key)
+}
+
+// Returns the key locking the entity of the request, or an empty string if the request has no entity.
+func EntityKey(req *operation.OperationRequest) string {
+	if req.GetEntityId() == "" {
+		return ""
+	}
+	return req.GetEntityType() + "/" + req.GetEntityId()
+}
+
+// Renews the lease every interval until the returned stop function is called. If a renewal fails,
+// onLost is called and the renewal stops.
+func KeepAlive(ctx context.Context, locker Locker, lease *Lease, ttl time.Duration, interval time.Duration, onLost func(error)) (stop func()) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := locker.Renew(ctx, lease, ttl)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Error("KeepAlive: Error renewing lease on " + lease.Key + ": " + err.Error())
+					if onLost != nil {
+						onLost(err)
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+var _ Locker = &InMemoryLocker{}
+
+// InMemoryLocker keeps the leases in memory. Useful for testing or single instance workers.
+type InMemoryLocker struct {
+	leases map[string]*Lease
+	mu     sync.Mutex
+	now    func() time.Time
+}
+
+func NewInMemoryLocker() *InMemoryLocker {
+	return &InMemoryLocker{
+		leases: make(map[string]*Lease),
+		now:    time.Now,
+	}
+}
+
+func (l *InMemoryLocker) Acquire(ctx context.Context, key string, owner string, ttl time.Duration) (*Lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if current, ok := l.leases[key]; ok && current.Owner != owner && current.ExpiresAt.After(now) {
+		return nil, &LockContendedError{
+			Key:        key,
+			Owner:      current.Owner,
+			RetryAfter: current.ExpiresAt.Sub(now),
+		}
+	}
+
+	lease := &Lease{Key: key, Owner: owner, ExpiresAt: now.Add(ttl)}
+	l.leases[key] = lease
+	return &Lease{Key: key, Owner: owner, ExpiresAt: lease.ExpiresAt}, nil
+}
+
+func (l *InMemoryLocker) Renew(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current, ok := l.leases[lease.Key]
+	if !ok || current.Owner != lease.Owner {
+		return &LeaseLostError{Key: lease.Key, Owner: lease.Owner}
+	}
+
+	current.ExpiresAt = l.now().Add(ttl)
+	lease.ExpiresAt = current.ExpiresAt
+	return nil
+}
+
+func (l *InMemoryLocker) Release(ctx context.Context, lease *Lease) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if current, ok := l.leases[lease.Key]; ok && current.Owner == lease.Owner {
+		delete(l.leases, lease.Key)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLock(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Lock Suite")
+}
+
+var _ = Describe("InMemoryLocker", func() {
+	var (
+		ctx    context.Context
+		locker *InMemoryLocker
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now = time.Now()
+		locker = NewInMemoryLocker()
+		locker.now = func() time.Time { return now }
+	})
+
+	It("should grant a lease to a single owner", func() {
+		lease, err := locker.Acquire(ctx, "Cluster/1", "op1", time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(lease.Owner).To(Equal("op1"))
+
+		_, err = locker.Acquire(ctx, "Cluster/1", "op2", time.Minute)
+		var contendedErr *LockContendedError
+		Expect(errors.As(err, &contendedErr)).To(BeTrue())
+		Expect(contendedErr.Owner).To(Equal("op1"))
+		Expect(contendedErr.RetryAfter).To(Equal(time.Minute))
+
+		_, err = locker.Acquire(ctx, "Cluster/2", "op2", time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should let the owner take back its lease", func() {
+		_, err := locker.Acquire(ctx, "Cluster/1", "op1", time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = locker.Acquire(ctx, "Cluster/1", "op1", time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should grant the lease once released or expired", func() {
+		lease, _ := locker.Acquire(ctx, "Cluster/1", "op1", time.Minute)
+		Expect(locker.Release(ctx, lease)).To(Succeed())
+		lease, err := locker.Acquire(ctx, "Cluster/1", "op2", time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+
+		now = now.Add(2 * time.Minute)
+		_, err = locker.Acquire(ctx, "Cluster/1", "op3", time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+
+		var lostErr *LeaseLostError
+		Expect(errors.As(locker.Renew(ctx, lease, time.Minute), &lostErr)).To(BeTrue())
+	})
+
+	It("should keep the lease alive until stopped", func() {
+		lease, _ := locker.Acquire(ctx, "Cluster/1", "op1", time.Minute)
+		stop := KeepAlive(ctx, locker, lease, time.Hour, time.Millisecond, nil)
+		Eventually(func() time.Time {
+			locker.mu.Lock()
+			defer locker.mu.Unlock()
+			return locker.leases["Cluster/1"].ExpiresAt
+		}).Should(Equal(now.Add(time.Hour)))
+		stop()
+	})
+
+	It("should report a lost lease", func() {
+		lease := &Lease{Key: "Cluster/1", Owner: "op1"}
+		lost := make(chan error, 1)
+		stop := KeepAlive(ctx, locker, lease, time.Minute, time.Millisecond, func(err error) {
+			lost <- err
+		})
+		defer stop()
+
+		var err error
+		Eventually(lost).Should(Receive(&err))
+		var lostErr *LeaseLostError
+		Expect(errors.As(err, &lostErr)).To(BeTrue())
+	})
+
+	It("should build the entity key", func() {
+		Expect(EntityKey(&operation.OperationRequest{EntityType: "Cluster", EntityId: "1"})).To(Equal("Cluster/1"))
+		Expect(EntityKey(&operation.OperationRequest{EntityType: "Cluster"})).To(BeEmpty())
+	})
+})
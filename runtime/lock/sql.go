@@ -0,0 +1,106 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/aks-async/database"
+)
+
+var _ Locker = &SqlLocker{}
+
+// SqlLocker keeps the leases in a SQL Server table with the following schema:
+//
+//	CREATE TABLE Leases (
+//		LockKey NVARCHAR(255) NOT NULL PRIMARY KEY,
+//		Owner NVARCHAR(255) NOT NULL,
+//		ExpiresAt DATETIME2 NOT NULL
+//	)
+//
+// Expirations are computed with the clock of the database, so the workers don't need synchronized
+// clocks. The table name is not parametrized in the queries, so it must come from trusted configuration.
+type SqlLocker struct {
+	db    *sql.DB
+	table string
+}
+
+func NewSqlLocker(db *sql.DB, table string) *SqlLocker {
+	return &SqlLocker{
+		db:    db,
+		table: table,
+	}
+}
+
+func (l *SqlLocker) Acquire(ctx context.Context, key string, owner string, ttl time.Duration) (*Lease, error) {
+	query := fmt.Sprintf(`MERGE %s WITH (HOLDLOCK) AS target
+USING (SELECT @p1 AS LockKey) AS source
+ON target.LockKey = source.LockKey
+WHEN MATCHED AND (target.Owner = @p2 OR target.ExpiresAt < SYSUTCDATETIME()) THEN UPDATE SET Owner = @p2, ExpiresAt = DATEADD(millisecond, @p3, SYSUTCDATETIME())
+WHEN NOT MATCHED THEN INSERT (LockKey, Owner, ExpiresAt) VALUES (@p1, @p2, DATEADD(millisecond, @p3, SYSUTCDATETIME()));`, l.table)
+	_, err := database.ExecDb(ctx, l.db, query, key, owner, ttl.Milliseconds())
+
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return nil, l.contendedError(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Lease{Key: key, Owner: owner, ExpiresAt: time.Now().Add(ttl)}, nil
+}
+
+func (l *SqlLocker) contendedError(ctx context.Context, key string) error {
+	query := fmt.Sprintf("SELECT Owner, DATEDIFF(millisecond, SYSUTCDATETIME(), ExpiresAt) FROM %s WHERE LockKey = @p1", l.table)
+	rows, err := database.QueryDb(ctx, l.db, query, key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	contendedErr := &LockContendedError{Key: key}
+	if rows.Next() {
+		var remaining int64
+		err = rows.Scan(&contendedErr.Owner, &remaining)
+		if err != nil {
+			return err
+		}
+		contendedErr.RetryAfter = time.Duration(remaining) * time.Millisecond
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return contendedErr
+}
+
+func (l *SqlLocker) Renew(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	query := fmt.Sprintf("UPDATE %s SET ExpiresAt = DATEADD(millisecond, @p3, SYSUTCDATETIME()) WHERE LockKey = @p1 AND Owner = @p2", l.table)
+	_, err := database.ExecDb(ctx, l.db, query, lease.Key, lease.Owner, ttl.Milliseconds())
+
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return &LeaseLostError{Key: lease.Key, Owner: lease.Owner}
+	}
+	if err != nil {
+		return err
+	}
+
+	lease.ExpiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+func (l *SqlLocker) Release(ctx context.Context, lease *Lease) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE LockKey = @p1 AND Owner = @p2", l.table)
+	_, err := database.ExecDb(ctx, l.db, query, lease.Key, lease.Owner)
+
+	// Releasing a lease that already expired and was taken, or deleted, is not an error.
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return nil
+	}
+	return err
+}
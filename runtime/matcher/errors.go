@@ -2,6 +2,7 @@ package matcher
 
 import (
 	"fmt"
+	"strings"
 )
 
 type OperationKeyLookupError struct {
@@ -32,3 +33,66 @@ type EntityCreationError struct{}
 func (e *EntityCreationError) Error() string {
 	return fmt.Sprintf("Entity is nil after creation.")
 }
+
+type OperationVersionLookupError struct {
+	Key               string
+	ApiVersion        string
+	AvailableVersions []string
+}
+
+func (e *OperationVersionLookupError) Error() string {
+	return fmt.Sprintf("No version of operation %s matches api version %s. Available versions: [%s].", e.Key, e.ApiVersion, strings.Join(e.AvailableVersions, ", "))
+}
+
+type InvalidOperationTypeError struct {
+	Key  string
+	Type string
+}
+
+func (e *InvalidOperationTypeError) Error() string {
+	return fmt.Sprintf("The operation %s must be a pointer to a struct, got %s.", e.Key, e.Type)
+}
+
+type NilFactoryError struct {
+	Key string
+}
+
+func (e *NilFactoryError) Error() string {
+	return fmt.Sprintf("The factory of operation %s is nil.", e.Key)
+}
+
+type OperationCreationError struct {
+	Key string
+	Err error
+}
+
+func (e *OperationCreationError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("The factory of operation %s returned a nil operation.", e.Key)
+	}
+	return fmt.Sprintf("The factory of operation %s failed: %s", e.Key, e.Err.Error())
+}
+
+func (e *OperationCreationError) Unwrap() error {
+	return e.Err
+}
+
+type DuplicateRegistrationError struct {
+	Key        string
+	ApiVersion string
+}
+
+func (e *DuplicateRegistrationError) Error() string {
+	if e.ApiVersion == "" {
+		return fmt.Sprintf("The key %s is already registered.", e.Key)
+	}
+	return fmt.Sprintf("The key %s is already registered for api version %s.", e.Key, e.ApiVersion)
+}
+
+type FrozenMatcherError struct {
+	Key string
+}
+
+func (e *FrozenMatcherError) Error() string {
+	return fmt.Sprintf("The matcher is frozen, unable to change the registration of %s.", e.Key)
+}
@@ -0,0 +1,39 @@
+package matcher
+
+import (
+	"context"
+	"time"
+)
+
+// LockRenewalPolicy defines how the message lock of an operation is renewed while it runs.
+type LockRenewalPolicy struct {
+	// Time between renewals of the message lock. Must be shorter than the lock duration of the queue.
+	Interval time.Duration
+	// If set, the operation is cancelled once it has held the message for this long.
+	MaxDuration time.Duration
+}
+
+// Registers the lock renewal policy of the operation. Operations without a policy use the one
+// configured in the handlers.
+func (m *Matcher) RegisterLockRenewalPolicy(ctx context.Context, key string, policy LockRenewalPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.lockRenewalPolicies[key]
+	err := m.checkRegistration(key, "", exists)
+	if err != nil {
+		return err
+	}
+
+	m.lockRenewalPolicies[key] = policy
+	return nil
+}
+
+// Retrieves the lock renewal policy registered with RegisterLockRenewalPolicy.
+func (m *Matcher) GetLockRenewalPolicy(ctx context.Context, key string) (LockRenewalPolicy, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	policy, exists := m.lockRenewalPolicies[key]
+	return policy, exists
+}
@@ -2,9 +2,13 @@ package matcher
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/Azure/aks-async/runtime/entity"
+	ec "github.com/Azure/aks-async/runtime/entity_controller"
 	"github.com/Azure/aks-async/runtime/hooks"
 	"github.com/Azure/aks-async/runtime/operation"
 )
@@ -14,48 +18,449 @@ import (
 // but we utilize the name in that struct to create an instance of the right operation
 // type (e.g. LongRunning) and Run with the correct logic. The matcher can also be used
 // to create the Entity based on the name of the operation by using a stored EntityFactoryFunc.
+// Operations can also be registered for a specific api version, so that multiple versions of the
+// same operation can run side by side during rollouts.
+// The matcher is safe for concurrent use, so operations can be registered while the processor runs
+// unless the matcher has been frozen.
 type Matcher struct {
-	Types          map[string]reflect.Type
+	// Types registered through Register.
+	//
+	// Deprecated: use Get or List instead. The map is kept for compatibility and is still read by
+	// the matcher, but it isn't safe to access while operations are being registered.
+	Types map[string]reflect.Type
+	// Entity creators registered through RegisterEntity.
+	//
+	// Deprecated: use CreateEntityInstance or List instead. The map is kept for compatibility and
+	// is still read by the matcher, but it isn't safe to access while operations are being
+	// registered.
 	EntityCreators map[string]entity.EntityFactoryFunc
+	// Rules applied in order to resolve the version of an operation.
+	FallbackRules []FallbackRule
+	// If set, the processor freezes the matcher when it's created.
+	FreezeOnStart bool
+
+	versionedTypes map[string]map[string]reflect.Type
+	// Every registration ends up as a factory, which is what is used to create the instances.
+	factories           map[string]OperationFactory
+	versionedFactories  map[string]map[string]OperationFactory
+	entityFactories     map[string]ec.RequestEntityFactoryFunc
+	lockRenewalPolicies map[string]LockRenewalPolicy
+	frozen              bool
+	mu                  sync.RWMutex
+}
+
+// OperationFactory creates a new instance of an operation. Unlike registering a type, a factory
+// can inject shared clients and configuration into every instance it creates.
+type OperationFactory func(ctx context.Context) (operation.ApiOperation, error)
+
+// Registration describes everything registered under an operation name.
+type Registration struct {
+	Name string
+	// Whether the operation has a registration that isn't tied to an api version.
+	Default bool
+	// Registered api versions, sorted from oldest to newest.
+	Versions         []string
+	HasEntityCreator bool
 }
 
 func NewMatcher() *Matcher {
 	return &Matcher{
-		Types:          make(map[string]reflect.Type),
-		EntityCreators: make(map[string]entity.EntityFactoryFunc),
+		FallbackRules:       DefaultFallbackRules,
+		Types:               make(map[string]reflect.Type),
+		EntityCreators:      make(map[string]entity.EntityFactoryFunc),
+		versionedTypes:      make(map[string]map[string]reflect.Type),
+		factories:           make(map[string]OperationFactory),
+		versionedFactories:  make(map[string]map[string]OperationFactory),
+		entityFactories:     make(map[string]ec.RequestEntityFactoryFunc),
+		lockRenewalPolicies: make(map[string]LockRenewalPolicy),
 	}
 }
 
-// Set adds a key-value pair to the map
-// Ex: matcher.Register("LongRunning", &LongRunning{})
-func (m *Matcher) Register(ctx context.Context, key string, value operation.ApiOperation) {
-	m.Types[key] = reflect.TypeOf(value).Elem()
+// Set adds a key-value pair to the map. The value must be a pointer to a struct, and only its
+// type is stored: every instance is created as a zero value. Registering a key twice returns a
+// DuplicateRegistrationError instead of overwriting the previous operation; use RegisterFactory
+// for operations that need dependencies.
+// Ex: matcher.Register(ctx, "LongRunning", &LongRunning{})
+func (m *Matcher) Register(ctx context.Context, key string, value operation.ApiOperation) error {
+	t, err := operationType(key, value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.defaultFactory(key)
+	err = m.checkRegistration(key, "", exists)
+	if err != nil {
+		return err
+	}
+
+	m.Types[key] = t
+	m.factories[key] = typeFactory(t)
+	return nil
+}
+
+// Adds the operation for a specific api version.
+// Ex: matcher.RegisterVersion("LongRunning", "v1.0.0", &LongRunningV1{})
+func (m *Matcher) RegisterVersion(ctx context.Context, key string, apiVersion string, value operation.ApiOperation) error {
+	t, err := operationType(key, value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err = m.checkRegistration(key, apiVersion, m.versionedFactories[key][apiVersion] != nil)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := m.versionedTypes[key]; !ok {
+		m.versionedTypes[key] = make(map[string]reflect.Type)
+	}
+	m.versionedTypes[key][apiVersion] = t
+	m.registerVersionedFactory(key, apiVersion, typeFactory(t))
+	return nil
+}
+
+// Adds a factory that will be used to create the instances of the operation.
+// Ex:
+//
+//	matcher.RegisterFactory(ctx, "LongRunning", func(ctx context.Context) (operation.ApiOperation, error) {
+//		return &LongRunning{client: sharedClient}, nil
+//	})
+func (m *Matcher) RegisterFactory(ctx context.Context, key string, factory OperationFactory) error {
+	if factory == nil {
+		return &NilFactoryError{Key: key}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.defaultFactory(key)
+	err := m.checkRegistration(key, "", exists)
+	if err != nil {
+		return err
+	}
+
+	m.factories[key] = factory
+	return nil
+}
+
+// Adds a factory for a specific api version.
+func (m *Matcher) RegisterFactoryVersion(ctx context.Context, key string, apiVersion string, factory OperationFactory) error {
+	if factory == nil {
+		return &NilFactoryError{Key: key}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.checkRegistration(key, apiVersion, m.versionedFactories[key][apiVersion] != nil)
+	if err != nil {
+		return err
+	}
+
+	m.registerVersionedFactory(key, apiVersion, factory)
+	return nil
+}
+
+func (m *Matcher) registerVersionedFactory(key string, apiVersion string, factory OperationFactory) {
+	if _, ok := m.versionedFactories[key]; !ok {
+		m.versionedFactories[key] = make(map[string]OperationFactory)
+	}
+	m.versionedFactories[key][apiVersion] = factory
+}
+
+// Must be called while holding the lock.
+func (m *Matcher) checkRegistration(key string, apiVersion string, exists bool) error {
+	if m.frozen {
+		return &FrozenMatcherError{Key: key}
+	}
+	if exists {
+		return &DuplicateRegistrationError{Key: key, ApiVersion: apiVersion}
+	}
+	return nil
 }
 
 // Set adds a key-value pair to the map
 // Ex: matcher.RegisterEntity("LongRunning", longRunningOperation.CreateLroEntityFunc)
-func (m *Matcher) RegisterEntity(ctx context.Context, key string, value entity.EntityFactoryFunc) {
+func (m *Matcher) RegisterEntity(ctx context.Context, key string, value entity.EntityFactoryFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.checkRegistration(key, "", m.EntityCreators[key] != nil)
+	if err != nil {
+		return err
+	}
+
 	m.EntityCreators[key] = value
+	return nil
+}
+
+// Adds an entity factory that receives the whole OperationRequest. The operation handler uses it
+// to get the entity when no EntityController is provided.
+// Ex:
+//
+//	matcher.RegisterEntityFactory(ctx, "LongRunning", func(ctx context.Context, req *operation.OperationRequest) (entity.Entity, error) {
+//		return db.GetCluster(ctx, req.EntityId)
+//	})
+func (m *Matcher) RegisterEntityFactory(ctx context.Context, key string, factory ec.RequestEntityFactoryFunc) error {
+	if factory == nil {
+		return &NilFactoryError{Key: key}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.checkRegistration(key, "", m.entityFactories[key] != nil)
+	if err != nil {
+		return err
+	}
+
+	m.entityFactories[key] = factory
+	return nil
+}
+
+// Retrieves the entity factory registered with RegisterEntityFactory.
+func (m *Matcher) GetEntityFactory(ctx context.Context, key string) (ec.RequestEntityFactoryFunc, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	factory, exists := m.entityFactories[key]
+	return factory, exists
+}
+
+// Removes the operation, all its versions, its entity creators and its lock renewal policy.
+func (m *Matcher) Unregister(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.frozen {
+		return &FrozenMatcherError{Key: key}
+	}
+
+	_, hasDefault := m.defaultFactory(key)
+	_, hasVersions := m.versionedFactories[key]
+	_, hasEntity := m.EntityCreators[key]
+	_, hasEntityFactory := m.entityFactories[key]
+	_, hasLockRenewalPolicy := m.lockRenewalPolicies[key]
+	if !hasDefault && !hasVersions && !hasEntity && !hasEntityFactory && !hasLockRenewalPolicy {
+		return &OperationKeyLookupError{Key: key}
+	}
+
+	delete(m.Types, key)
+	delete(m.versionedTypes, key)
+	delete(m.factories, key)
+	delete(m.versionedFactories, key)
+	delete(m.EntityCreators, key)
+	delete(m.entityFactories, key)
+	delete(m.lockRenewalPolicies, key)
+	return nil
+}
+
+// Returns everything registered in the matcher, sorted by name.
+func (m *Matcher) List(ctx context.Context) []Registration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := map[string]struct{}{}
+	for name := range m.factories {
+		names[name] = struct{}{}
+	}
+	for name := range m.Types {
+		names[name] = struct{}{}
+	}
+	for name := range m.versionedFactories {
+		names[name] = struct{}{}
+	}
+	for name := range m.EntityCreators {
+		names[name] = struct{}{}
+	}
+	for name := range m.entityFactories {
+		names[name] = struct{}{}
+	}
+
+	registrations := make([]Registration, 0, len(names))
+	for name := range names {
+		_, hasDefault := m.defaultFactory(name)
+		_, hasEntity := m.EntityCreators[name]
+		_, hasEntityFactory := m.entityFactories[name]
+		registrations = append(registrations, Registration{
+			Name:             name,
+			Default:          hasDefault,
+			Versions:         sortedVersions(m.versionedFactories[name]),
+			HasEntityCreator: hasEntity || hasEntityFactory,
+		})
+	}
+
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].Name < registrations[j].Name
+	})
+	return registrations
+}
+
+// After freezing the matcher, any registration or removal fails with a FrozenMatcherError.
+func (m *Matcher) Freeze() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.frozen = true
+}
+
+func (m *Matcher) IsFrozen() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.frozen
 }
 
 // Get retrieves a type from the map by its key.
 func (m *Matcher) Get(ctx context.Context, key string) (reflect.Type, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	value, exists := m.Types[key]
 	return value, exists
 }
 
+// Retrieves the type of the operation for the api version, applying the FallbackRules. Operations
+// registered through a factory have no type to retrieve.
+func (m *Matcher) GetVersion(ctx context.Context, key string, apiVersion string) (reflect.Type, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	version, err := m.resolve(key, apiVersion)
+	if err != nil {
+		return nil, false
+	}
+
+	var t reflect.Type
+	var exists bool
+	if version == "" {
+		t, exists = m.Types[key]
+	} else {
+		t, exists = m.versionedTypes[key][version]
+	}
+	return t, exists
+}
+
+// Returns the api versions registered for the operation, sorted from oldest to newest.
+func (m *Matcher) GetVersions(ctx context.Context, key string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return sortedVersions(m.versionedFactories[key])
+}
+
+// Returns the registered version matching the api version, or an empty string if the default
+// registration should be used. Must be called while holding the lock.
+func (m *Matcher) resolve(key string, apiVersion string) (string, error) {
+	rules := m.FallbackRules
+	if rules == nil {
+		rules = DefaultFallbackRules
+	}
+
+	versions := m.versionedFactories[key]
+	for _, rule := range rules {
+		switch rule {
+		case FallbackExact:
+			if _, ok := versions[apiVersion]; ok && apiVersion != "" {
+				return apiVersion, nil
+			}
+		case FallbackLatestCompatible:
+			if v, ok := latestCompatible(apiVersion, sortedVersions(versions)); ok {
+				return v, nil
+			}
+		case FallbackDefault:
+			if _, ok := m.defaultFactory(key); ok {
+				return "", nil
+			}
+		}
+	}
+
+	if len(versions) == 0 {
+		return "", &OperationKeyLookupError{Key: key}
+	}
+	return "", &OperationVersionLookupError{
+		Key:               key,
+		ApiVersion:        apiVersion,
+		AvailableVersions: sortedVersions(versions),
+	}
+}
+
 // This will create an empty instance of the type, with which you can then call op.Init()
-// and initialize any info you need.
+// and initialize any info you need. If the operation was registered with a factory, the
+// factory is used to create the instance instead.
 func (m *Matcher) CreateOperationInstance(ctx context.Context, key string) (operation.ApiOperation, error) {
-	t, exists := m.Types[key]
+	m.mu.RLock()
+	factory, exists := m.defaultFactory(key)
+	m.mu.RUnlock()
 	if !exists {
 		return nil, &OperationKeyLookupError{Key: key}
 	}
 
-	instance := reflect.New(t).Interface().(operation.ApiOperation)
+	return createInstance(ctx, key, factory)
+}
+
+// Same as CreateOperationInstance, but resolving the operation using the api version.
+func (m *Matcher) CreateOperationInstanceForVersion(ctx context.Context, key string, apiVersion string) (operation.ApiOperation, error) {
+	m.mu.RLock()
+	version, err := m.resolve(key, apiVersion)
+	factory, _ := m.defaultFactory(key)
+	if version != "" {
+		factory = m.versionedFactories[key][version]
+	}
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The factory is called without holding the lock, since it may take a while.
+	return createInstance(ctx, key, factory)
+}
+
+func createInstance(ctx context.Context, key string, factory OperationFactory) (operation.ApiOperation, error) {
+	instance, err := factory(ctx)
+	if err != nil {
+		return nil, &OperationCreationError{Key: key, Err: err}
+	}
+	if instance == nil {
+		return nil, &OperationCreationError{Key: key}
+	}
 	return instance, nil
 }
 
+// Validates that the operation is a pointer to a struct, and returns the type of the struct.
+func operationType(key string, value operation.ApiOperation) (reflect.Type, error) {
+	t := reflect.TypeOf(value)
+	if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return nil, &InvalidOperationTypeError{Key: key, Type: fmt.Sprint(t)}
+	}
+	return t.Elem(), nil
+}
+
+// Returns the factory of the operation registered without a version. Types added directly to the
+// deprecated Types map have no factory, so one is created for them. Must be called while holding
+// the lock.
+func (m *Matcher) defaultFactory(key string) (OperationFactory, bool) {
+	if factory, ok := m.factories[key]; ok {
+		return factory, true
+	}
+	if t, ok := m.Types[key]; ok {
+		return typeFactory(t), true
+	}
+	return nil, false
+}
+
+func typeFactory(t reflect.Type) OperationFactory {
+	return func(ctx context.Context) (operation.ApiOperation, error) {
+		return reflect.New(t).Interface().(operation.ApiOperation), nil
+	}
+}
+
 // This will create an Entity using the EntityFactoryFunc with the lastOperationId by matching
 // with the key passed in.
 func (m *Matcher) CreateEntityInstance(ctx context.Context, key string, lastOperationId string) (entity.Entity, error) {
@@ -64,9 +469,13 @@ func (m *Matcher) CreateEntityInstance(ctx context.Context, key string, lastOper
 		return nil, &EmptyOperationId{}
 	}
 
+	m.mu.RLock()
+	f, ok := m.EntityCreators[key]
+	m.mu.RUnlock()
+
 	var entity entity.Entity
 	var err error
-	if f, ok := m.EntityCreators[key]; ok {
+	if ok {
 		entity, err = f(lastOperationId)
 		if err != nil {
 			return nil, err
@@ -89,14 +498,28 @@ func (m *Matcher) CreateHookedInstance(ctx context.Context, key string, hookList
 		return nil, err
 	}
 
+	return newHookedInstance(operationInstance, hookList), nil
+}
+
+// Creates an instance of the operation for the api version with hooks enabled.
+func (m *Matcher) CreateHookedInstanceForVersion(ctx context.Context, key string, apiVersion string, hookList []hooks.BaseOperationHooksInterface) (*hooks.HookedApiOperation, error) {
+	operationInstance, err := m.CreateOperationInstanceForVersion(ctx, key, apiVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHookedInstance(operationInstance, hookList), nil
+}
+
+func newHookedInstance(operationInstance operation.ApiOperation, hookList []hooks.BaseOperationHooksInterface) *hooks.HookedApiOperation {
 	if hookList == nil {
 		hookList = []hooks.BaseOperationHooksInterface{}
 	}
 
 	hOperation := &hooks.HookedApiOperation{
 		OperationInstance: operationInstance,
-		OperationHooks:    hookList,
+		OperationHooks:    hooks.SortByPriority(hookList),
 	}
 
-	return hOperation, nil
+	return hOperation
 }
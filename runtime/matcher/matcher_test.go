@@ -3,8 +3,11 @@ package matcher
 import (
 	"context"
 	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Azure/aks-async/runtime/entity"
 	"github.com/Azure/aks-async/runtime/operation"
@@ -83,6 +86,230 @@ var _ = Describe("Matcher", func() {
 		})
 	})
 
+	Describe("Versioned operations", func() {
+		var (
+			v1Op *sampleOperation.SampleOperation
+			v2Op *sampleOperation.SampleResultOperation
+		)
+
+		BeforeEach(func() {
+			v1Op = &sampleOperation.SampleOperation{}
+			v2Op = &sampleOperation.SampleResultOperation{}
+			matcher.RegisterVersion(ctx, operationName, "v1.0.0", v1Op)
+			matcher.RegisterVersion(ctx, operationName, "v1.2.0", v2Op)
+		})
+
+		It("should match the exact version", func() {
+			retrieved, exists := matcher.GetVersion(ctx, operationName, "v1.0.0")
+			Expect(exists).To(BeTrue())
+			Expect(retrieved).To(Equal(sampleOperationType))
+		})
+
+		It("should fall back to the latest compatible version", func() {
+			retrieved, exists := matcher.GetVersion(ctx, operationName, "v1.5.0")
+			Expect(exists).To(BeTrue())
+			Expect(retrieved).To(Equal(reflect.TypeOf(v2Op).Elem()))
+
+			retrieved, exists = matcher.GetVersion(ctx, operationName, "v1.1.0")
+			Expect(exists).To(BeTrue())
+			Expect(retrieved).To(Equal(sampleOperationType))
+		})
+
+		It("should use the latest version if no api version is requested", func() {
+			instance, err := matcher.CreateOperationInstanceForVersion(ctx, operationName, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reflect.TypeOf(instance).Elem()).To(Equal(reflect.TypeOf(v2Op).Elem()))
+		})
+
+		It("should fall back to the default registration", func() {
+			matcher.Register(ctx, operationName, sampleOp)
+			retrieved, exists := matcher.GetVersion(ctx, operationName, "v2.0.0")
+			Expect(exists).To(BeTrue())
+			Expect(retrieved).To(Equal(sampleOperationType))
+		})
+
+		It("should list the available versions when no version matches", func() {
+			instance, err := matcher.CreateOperationInstanceForVersion(ctx, operationName, "v2.0.0")
+			Expect(instance).To(BeNil())
+			var versionErr *OperationVersionLookupError
+			Expect(errors.As(err, &versionErr)).To(BeTrue())
+			Expect(versionErr.AvailableVersions).To(Equal([]string{"v1.0.0", "v1.2.0"}))
+			Expect(err.Error()).To(ContainSubstring("v1.0.0, v1.2.0"))
+		})
+
+		It("should only match exact versions if configured", func() {
+			matcher.FallbackRules = []FallbackRule{FallbackExact}
+			_, exists := matcher.GetVersion(ctx, operationName, "v1.5.0")
+			Expect(exists).To(BeFalse())
+		})
+
+		It("should fail if the operation isn't registered", func() {
+			hOp, err := matcher.CreateHookedInstanceForVersion(ctx, "Unregistered", "v1.0.0", nil)
+			Expect(hOp).To(BeNil())
+			var opKeyErr *OperationKeyLookupError
+			Expect(errors.As(err, &opKeyErr)).To(BeTrue())
+		})
+
+		It("should compare versions", func() {
+			Expect(compareVersions("v1.10.0", "v1.9.0")).To(BeNumerically(">", 0))
+			Expect(compareVersions("2024-01-01", "2024-01-01-preview")).To(BeNumerically(">", 0))
+			Expect(compareVersions("v1.0.0", "1.0.0")).To(Equal(0))
+			Expect(matcher.GetVersions(ctx, operationName)).To(Equal([]string{"v1.0.0", "v1.2.0"}))
+		})
+	})
+
+	Describe("Operation factories", func() {
+		It("should create the instances using the factory", func() {
+			opReq := &operation.OperationRequest{OperationId: "injected"}
+			err := matcher.RegisterFactory(ctx, operationName, func(ctx context.Context) (operation.ApiOperation, error) {
+				op := &sampleOperation.SampleOperation{}
+				_, _ = op.InitOperation(ctx, opReq)
+				return op, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			instance, err := matcher.CreateOperationInstance(ctx, operationName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance.GetOperationRequest()).To(Equal(opReq))
+		})
+
+		It("should use the versioned factory", func() {
+			err := matcher.RegisterFactoryVersion(ctx, operationName, "v1.0.0", func(ctx context.Context) (operation.ApiOperation, error) {
+				return &sampleOperation.SampleResultOperation{}, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			instance, err := matcher.CreateOperationInstanceForVersion(ctx, operationName, "v1.0.0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(instance).To(BeAssignableToTypeOf(&sampleOperation.SampleResultOperation{}))
+		})
+
+		It("should fail if the factory fails", func() {
+			factoryErr := errors.New("no client")
+			_ = matcher.RegisterFactory(ctx, operationName, func(ctx context.Context) (operation.ApiOperation, error) {
+				return nil, factoryErr
+			})
+
+			instance, err := matcher.CreateOperationInstance(ctx, operationName)
+			Expect(instance).To(BeNil())
+			var creationErr *OperationCreationError
+			Expect(errors.As(err, &creationErr)).To(BeTrue())
+			Expect(errors.Is(err, factoryErr)).To(BeTrue())
+		})
+
+		It("should fail if the factory returns a nil operation", func() {
+			_ = matcher.RegisterFactory(ctx, operationName, func(ctx context.Context) (operation.ApiOperation, error) {
+				return nil, nil
+			})
+
+			_, err := matcher.CreateOperationInstance(ctx, operationName)
+			var creationErr *OperationCreationError
+			Expect(errors.As(err, &creationErr)).To(BeTrue())
+		})
+
+		It("should reject a nil factory", func() {
+			err := matcher.RegisterFactory(ctx, operationName, nil)
+			var nilErr *NilFactoryError
+			Expect(errors.As(err, &nilErr)).To(BeTrue())
+		})
+
+		It("should reject operations that aren't a pointer to a struct", func() {
+			var nilOp *sampleOperation.SampleOperation
+			Expect(matcher.Register(ctx, operationName, nilOp)).To(Succeed())
+
+			err := matcher.Register(ctx, operationName, nil)
+			var typeErr *InvalidOperationTypeError
+			Expect(errors.As(err, &typeErr)).To(BeTrue())
+
+			err = matcher.RegisterVersion(ctx, operationName, "v1.0.0", nil)
+			Expect(errors.As(err, &typeErr)).To(BeTrue())
+			Expect(matcher.GetVersions(ctx, operationName)).To(BeEmpty())
+		})
+	})
+
+	Describe("Registration management", func() {
+		It("should reject duplicate registrations", func() {
+			Expect(matcher.Register(ctx, operationName, sampleOp)).To(Succeed())
+			Expect(matcher.RegisterVersion(ctx, operationName, "v1.0.0", sampleOp)).To(Succeed())
+
+			var dupErr *DuplicateRegistrationError
+			err := matcher.Register(ctx, operationName, sampleOp)
+			Expect(errors.As(err, &dupErr)).To(BeTrue())
+			err = matcher.RegisterFactoryVersion(ctx, operationName, "v1.0.0", func(ctx context.Context) (operation.ApiOperation, error) {
+				return sampleOp, nil
+			})
+			Expect(errors.As(err, &dupErr)).To(BeTrue())
+			Expect(dupErr.ApiVersion).To(Equal("v1.0.0"))
+		})
+
+		It("should list and unregister the operations", func() {
+			Expect(matcher.Register(ctx, operationName, sampleOp)).To(Succeed())
+			Expect(matcher.RegisterVersion(ctx, operationName, "v1.0.0", sampleOp)).To(Succeed())
+			Expect(matcher.RegisterEntity(ctx, "Other", func(string) (entity.Entity, error) { return nil, nil })).To(Succeed())
+
+			Expect(matcher.List(ctx)).To(Equal([]Registration{
+				{Name: operationName, Default: true, Versions: []string{"v1.0.0"}},
+				{Name: "Other", Versions: []string{}, HasEntityCreator: true},
+			}))
+
+			Expect(matcher.Unregister(ctx, operationName)).To(Succeed())
+			_, err := matcher.CreateOperationInstanceForVersion(ctx, operationName, "v1.0.0")
+			Expect(err).To(HaveOccurred())
+			Expect(matcher.List(ctx)).To(HaveLen(1))
+
+			var opKeyErr *OperationKeyLookupError
+			Expect(errors.As(matcher.Unregister(ctx, operationName), &opKeyErr)).To(BeTrue())
+		})
+
+		It("should reject changes once frozen", func() {
+			Expect(matcher.Register(ctx, operationName, sampleOp)).To(Succeed())
+			matcher.Freeze()
+			Expect(matcher.IsFrozen()).To(BeTrue())
+
+			var frozenErr *FrozenMatcherError
+			Expect(errors.As(matcher.Register(ctx, "Other", sampleOp), &frozenErr)).To(BeTrue())
+			Expect(errors.As(matcher.Unregister(ctx, operationName), &frozenErr)).To(BeTrue())
+
+			_, err := matcher.CreateOperationInstance(ctx, operationName)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should allow registering while creating instances", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					_ = matcher.Register(ctx, fmt.Sprintf("Operation%d", i), sampleOp)
+				}(i)
+				go func() {
+					defer wg.Done()
+					_, _ = matcher.CreateOperationInstanceForVersion(ctx, operationName, "")
+				}()
+			}
+			wg.Wait()
+			Expect(matcher.List(ctx)).To(HaveLen(10))
+		})
+
+		It("should register the lock renewal policies", func() {
+			policy := LockRenewalPolicy{Interval: time.Second, MaxDuration: time.Minute}
+			Expect(matcher.RegisterLockRenewalPolicy(ctx, operationName, policy)).To(Succeed())
+
+			registered, ok := matcher.GetLockRenewalPolicy(ctx, operationName)
+			Expect(ok).To(BeTrue())
+			Expect(registered).To(Equal(policy))
+			_, ok = matcher.GetLockRenewalPolicy(ctx, "Other")
+			Expect(ok).To(BeFalse())
+
+			var duplicateErr *DuplicateRegistrationError
+			Expect(errors.As(matcher.RegisterLockRenewalPolicy(ctx, operationName, policy), &duplicateErr)).To(BeTrue())
+
+			Expect(matcher.Unregister(ctx, operationName)).To(Succeed())
+			_, ok = matcher.GetLockRenewalPolicy(ctx, operationName)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
 	Describe("Register and Create Entity", func() {
 		It("should register and retrieve the entity creator", func() {
 			entityKey := "TestEntity"
@@ -99,6 +326,23 @@ var _ = Describe("Matcher", func() {
 			Expect(entityInstance.GetLatestOperationID()).To(Equal(lastOperationId))
 		})
 
+		It("should register the entity factory using the operation request", func() {
+			err := matcher.RegisterEntityFactory(ctx, operationName, func(ctx context.Context, req *operation.OperationRequest) (entity.Entity, error) {
+				return &TestEntity{latestOperationId: req.EntityId}, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			factory, exists := matcher.GetEntityFactory(ctx, operationName)
+			Expect(exists).To(BeTrue())
+			entityInstance, asyncErr := factory.GetEntity(ctx, &operation.OperationRequest{EntityId: "cluster"})
+			Expect(asyncErr).To(BeNil())
+			Expect(entityInstance.GetLatestOperationID()).To(Equal("cluster"))
+			Expect(matcher.List(ctx)[0].HasEntityCreator).To(BeTrue())
+
+			var nilErr *NilFactoryError
+			Expect(errors.As(matcher.RegisterEntityFactory(ctx, "Other", nil), &nilErr)).To(BeTrue())
+		})
+
 		It("should fail if no lastOperationId provided", func() {
 			entityKey := "TestEntity"
 			Expect(matcher.EntityCreators).NotTo(HaveKey(entityKey))
@@ -158,6 +402,28 @@ var _ = Describe("Matcher", func() {
 			Expect(errors.As(err, &opKeyErr)).To(BeTrue())
 		})
 	})
+
+	Describe("Deprecated fields", func() {
+		It("should use the types and entity creators added directly to the maps", func() {
+			matcher.Types[operationName] = sampleOperationType
+			matcher.EntityCreators[operationName] = func(lastOperationId string) (entity.Entity, error) {
+				return &TestEntity{latestOperationId: lastOperationId}, nil
+			}
+
+			op, err := matcher.CreateOperationInstanceForVersion(ctx, operationName, "v1.0.0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reflect.TypeOf(op).Elem()).To(Equal(sampleOperationType))
+			e, err := matcher.CreateEntityInstance(ctx, operationName, "1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.GetLatestOperationID()).To(Equal("1"))
+
+			registrations := matcher.List(ctx)
+			Expect(registrations).To(HaveLen(1))
+			Expect(registrations[0].Default).To(BeTrue())
+			Expect(registrations[0].HasEntityCreator).To(BeTrue())
+			Expect(matcher.Register(ctx, operationName, sampleOp)).ToNot(Succeed())
+		})
+	})
 })
 
 // Example implementatin of entity.
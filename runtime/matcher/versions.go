@@ -0,0 +1,139 @@
+package matcher
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FallbackRule defines how the matcher resolves the version of an operation.
+type FallbackRule int
+
+const (
+	// Use the operation registered with exactly the same api version.
+	FallbackExact FallbackRule = iota
+	// Use the latest operation registered with the same major version that isn't newer than the
+	// requested version. If no api version was requested, the latest registered version is used.
+	FallbackLatestCompatible
+	// Use the operation registered without a version through Register.
+	FallbackDefault
+)
+
+// The rules used by a new matcher: exact, then latest compatible, then default.
+var DefaultFallbackRules = []FallbackRule{FallbackExact, FallbackLatestCompatible, FallbackDefault}
+
+// Versions are split on "." and "-" after removing the "v" prefix (e.g. "v1.2.3" or
+// "2024-01-01-preview"). The leading numeric components are the release, compared as numbers with
+// missing components treated as 0, so "v1.2" is the same as "v1.2.0". The components after them
+// are a pre-release suffix: a version with a suffix is older than the same release without it. The
+// first component is considered the major version.
+type version []string
+
+func parseVersion(v string) version {
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "v"), "V")
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == '.' || r == '-'
+	})
+}
+
+func (v version) major() string {
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+// Splits the version into its release numbers and its suffix.
+func (v version) split() ([]int, []string) {
+	release := []int{}
+	for i, component := range v {
+		n, err := strconv.Atoi(component)
+		if err != nil {
+			return release, v[i:]
+		}
+		release = append(release, n)
+	}
+	return release, nil
+}
+
+func compareVersions(a, b string) int {
+	releaseA, suffixA := parseVersion(a).split()
+	releaseB, suffixB := parseVersion(b).split()
+
+	for i := 0; i < max(len(releaseA), len(releaseB)); i++ {
+		if c := cmp.Compare(releaseComponent(releaseA, i), releaseComponent(releaseB, i)); c != 0 {
+			return c
+		}
+	}
+
+	// A version without a suffix (e.g. "-preview") is newer than the same release with it.
+	switch {
+	case len(suffixA) == 0 && len(suffixB) == 0:
+		return 0
+	case len(suffixA) == 0:
+		return 1
+	case len(suffixB) == 0:
+		return -1
+	}
+	return compareSuffixes(suffixA, suffixB)
+}
+
+func releaseComponent(release []int, i int) int {
+	if i < len(release) {
+		return release[i]
+	}
+	return 0
+}
+
+// Numeric components are compared as numbers and the rest as strings. If one suffix is a prefix of
+// the other, the longer one is newer, e.g. "preview.2" is newer than "preview".
+func compareSuffixes(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		na, errA := strconv.Atoi(a[i])
+		nb, errB := strconv.Atoi(b[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				return cmp.Compare(na, nb)
+			}
+		case errA == nil:
+			// Numbers sort before strings.
+			return -1
+		case errB == nil:
+			return 1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// Returns the latest version compatible with the requested one.
+func latestCompatible(requested string, available []string) (string, bool) {
+	var latest string
+	found := false
+	for _, candidate := range available {
+		if requested != "" {
+			if parseVersion(candidate).major() != parseVersion(requested).major() || compareVersions(candidate, requested) > 0 {
+				continue
+			}
+		}
+		if !found || compareVersions(candidate, latest) > 0 {
+			latest = candidate
+			found = true
+		}
+	}
+	return latest, found
+}
+
+func sortedVersions[T any](versions map[string]T) []string {
+	keys := make([]string, 0, len(versions))
+	for v := range versions {
+		keys = append(keys, v)
+	}
+	slices.SortFunc(keys, compareVersions)
+	return keys
+}
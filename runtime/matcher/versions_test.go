@@ -0,0 +1,25 @@
+package matcher
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("compareVersions",
+	func(a, b string, expected int) {
+		Expect(compareVersions(a, b)).To(Equal(expected))
+		Expect(compareVersions(b, a)).To(Equal(-expected))
+	},
+	Entry("equal versions", "v1.2.3", "v1.2.3", 0),
+	Entry("prefix is ignored", "v1.0.0", "1.0.0", 0),
+	Entry("numeric components compared as numbers", "v1.10.0", "v1.9.0", 1),
+	Entry("missing components are 0", "v1.2", "v1.2.0", 0),
+	Entry("shorter version is older", "v1.2", "v1.2.3", -1),
+	Entry("major only is older than minor", "v1", "v1.1", -1),
+	Entry("release is newer than preview", "2024-01-01", "2024-01-01-preview", 1),
+	Entry("preview of a newer release", "2024-02-01-preview", "2024-01-01", 1),
+	Entry("preview with missing components", "v1.2-preview", "v1.2.0", -1),
+	Entry("suffixes compared as strings", "v1.0.0-beta", "v1.0.0-alpha", 1),
+	Entry("longer suffix is newer", "v1.0.0-preview.2", "v1.0.0-preview", 1),
+	Entry("suffix numbers compared as numbers", "v1.0.0-rc.10", "v1.0.0-rc.9", 1),
+)
@@ -13,7 +13,9 @@ type ApiOperation interface {
 	// Can simply return itself after initializing all the required values.
 	InitOperation(context.Context, *OperationRequest) (ApiOperation, *errors.AsyncError)
 	// GuardConcurrency ensures that this operation is the latest operation that should be
-	// running to modify the Entity. If it fails, it should return the AsyncError.
+	// running to modify the Entity. If it fails, it should return the AsyncError. If the
+	// Entity hasn't recorded the operation yet, a DeferError defers the message until the
+	// operation blocking it completes, or retries it if no deferral store is configured.
 	GuardConcurrency(context.Context, entity.Entity) *errors.AsyncError
 	// Run will simply run the operation logic required.
 	Run(context.Context) *errors.AsyncError
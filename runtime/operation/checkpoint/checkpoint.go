@@ -0,0 +1,114 @@
+package checkpoint
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/aks-async/database"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+var _ operation.CheckpointStore = &InMemoryStore{}
+
+// InMemoryStore keeps the checkpoints in memory. Useful for testing, since the checkpoints won't
+// survive a restart of the worker.
+type InMemoryStore struct {
+	checkpoints map[string]string
+	mu          sync.RWMutex
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		checkpoints: make(map[string]string),
+	}
+}
+
+func (s *InMemoryStore) GetCheckpoint(ctx context.Context, operationId string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.checkpoints[operationId], nil
+}
+
+func (s *InMemoryStore) SaveCheckpoint(ctx context.Context, operationId string, step string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[operationId] = step
+	return nil
+}
+
+func (s *InMemoryStore) DeleteCheckpoint(ctx context.Context, operationId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.checkpoints, operationId)
+	return nil
+}
+
+var _ operation.CheckpointStore = &SqlStore{}
+
+// SqlStore keeps the checkpoints in a SQL Server table with the following schema:
+//
+//	CREATE TABLE OperationCheckpoints (
+//		OperationId NVARCHAR(255) NOT NULL PRIMARY KEY,
+//		Step NVARCHAR(255) NOT NULL,
+//		UpdatedAt DATETIME2 NOT NULL
+//	)
+//
+// The table name is not parametrized in the queries, so it must come from trusted configuration.
+type SqlStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewSqlStore(db *sql.DB, table string) *SqlStore {
+	return &SqlStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func (s *SqlStore) GetCheckpoint(ctx context.Context, operationId string) (string, error) {
+	query := fmt.Sprintf("SELECT Step FROM %s WHERE OperationId = @p1", s.table)
+	rows, err := database.QueryDb(ctx, s.db, query, operationId)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var step string
+	if rows.Next() {
+		err = rows.Scan(&step)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return step, rows.Err()
+}
+
+func (s *SqlStore) SaveCheckpoint(ctx context.Context, operationId string, step string) error {
+	query := fmt.Sprintf(`MERGE %s AS target
+USING (SELECT @p1 AS OperationId, @p2 AS Step) AS source
+ON target.OperationId = source.OperationId
+WHEN MATCHED THEN UPDATE SET Step = source.Step, UpdatedAt = SYSUTCDATETIME()
+WHEN NOT MATCHED THEN INSERT (OperationId, Step, UpdatedAt) VALUES (source.OperationId, source.Step, SYSUTCDATETIME());`, s.table)
+	_, err := database.ExecDb(ctx, s.db, query, operationId, step)
+	return err
+}
+
+func (s *SqlStore) DeleteCheckpoint(ctx context.Context, operationId string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE OperationId = @p1", s.table)
+	_, err := database.ExecDb(ctx, s.db, query, operationId)
+
+	// Deleting a checkpoint that doesn't exist is not an error.
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return nil
+	}
+	return err
+}
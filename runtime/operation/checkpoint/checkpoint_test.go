@@ -0,0 +1,116 @@
+package checkpoint
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCheckpoint(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Checkpoint Suite")
+}
+
+var _ = Describe("InMemoryStore", func() {
+	var (
+		ctx   context.Context
+		store *InMemoryStore
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = NewInMemoryStore()
+	})
+
+	It("should return an empty checkpoint if there is none", func() {
+		step, err := store.GetCheckpoint(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step).To(BeEmpty())
+	})
+
+	It("should keep the last checkpoint of each operation", func() {
+		Expect(store.SaveCheckpoint(ctx, "0", "first")).To(Succeed())
+		Expect(store.SaveCheckpoint(ctx, "0", "second")).To(Succeed())
+		Expect(store.SaveCheckpoint(ctx, "1", "first")).To(Succeed())
+
+		step, err := store.GetCheckpoint(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step).To(Equal("second"))
+		step, err = store.GetCheckpoint(ctx, "1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step).To(Equal("first"))
+	})
+
+	It("should delete the checkpoint", func() {
+		Expect(store.SaveCheckpoint(ctx, "0", "first")).To(Succeed())
+		Expect(store.DeleteCheckpoint(ctx, "0")).To(Succeed())
+		Expect(store.DeleteCheckpoint(ctx, "0")).To(Succeed())
+
+		step, err := store.GetCheckpoint(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step).To(BeEmpty())
+	})
+})
+
+var _ = Describe("SqlStore", func() {
+	var (
+		ctx   context.Context
+		db    *sql.DB
+		mock  sqlmock.Sqlmock
+		store *SqlStore
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		db, mock, err = sqlmock.New()
+		Expect(err).ToNot(HaveOccurred())
+		store = NewSqlStore(db, "OperationCheckpoints")
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		db.Close()
+	})
+
+	It("should return the checkpoint of the operation", func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT Step FROM OperationCheckpoints WHERE OperationId = @p1")).
+			WithArgs("0").
+			WillReturnRows(sqlmock.NewRows([]string{"Step"}).AddRow("first"))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT Step FROM OperationCheckpoints")).
+			WithArgs("1").
+			WillReturnRows(sqlmock.NewRows([]string{"Step"}))
+
+		step, err := store.GetCheckpoint(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step).To(Equal("first"))
+		step, err = store.GetCheckpoint(ctx, "1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step).To(BeEmpty())
+	})
+
+	It("should save the checkpoint", func() {
+		mock.ExpectExec(regexp.QuoteMeta("MERGE OperationCheckpoints AS target")).
+			WithArgs("0", "first").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		Expect(store.SaveCheckpoint(ctx, "0", "first")).To(Succeed())
+	})
+
+	It("should delete the checkpoint, even if there is none", func() {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM OperationCheckpoints WHERE OperationId = @p1")).
+			WithArgs("0").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM OperationCheckpoints")).
+			WithArgs("0").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		Expect(store.DeleteCheckpoint(ctx, "0")).To(Succeed())
+		Expect(store.DeleteCheckpoint(ctx, "0")).To(Succeed())
+	})
+})
@@ -0,0 +1,15 @@
+package operation
+
+import (
+	"context"
+
+	"github.com/Azure/aks-async/runtime/errors"
+)
+
+// ContinuationOperation is an optional interface for operations that are part of a pipeline
+// (e.g. create, then configure, then validate). GetContinuations is called after Run has
+// succeeded, and the returned requests are enqueued by the runtime together with the completion
+// of the current message, instead of the operation having to send them at the end of Run.
+type ContinuationOperation interface {
+	GetContinuations(context.Context) ([]*OperationRequest, *errors.AsyncError)
+}
@@ -0,0 +1,62 @@
+package operation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/entity"
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+)
+
+// How long to wait before retrying an operation whose entity is in a transitional state.
+const DefaultTransitionalRetryAfter = 30 * time.Second
+
+// IsDeleteOperation returns true if the request deletes the entity.
+func IsDeleteOperation(req *OperationRequest) bool {
+	return strings.EqualFold(req.GetHttpMethod(), http.MethodDelete)
+}
+
+// GuardEntityState runs the built-in guards for entities implementing entity.VersionedEntity:
+//   - Operations other than delete can't run on deleted or deleting entities.
+//   - Operations are retried while another operation keeps the entity in a transitional state.
+//
+// Entities that don't implement the interface are not checked.
+func GuardEntityState(ctx context.Context, req *OperationRequest, e entity.Entity) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	versionedEntity, ok := e.(entity.VersionedEntity)
+	if !ok {
+		return nil
+	}
+
+	isDelete := IsDeleteOperation(req)
+	state := versionedEntity.GetProvisioningState()
+
+	if !isDelete && (versionedEntity.IsSoftDeleted() || state == entity.ProvisioningStateDeleting) {
+		errorMessage := fmt.Sprintf("Operation %s can't run on a deleted entity. ProvisioningState: %s", req.GetOperationId(), state)
+		logger.Error("GuardEntityState: " + errorMessage)
+		return &errors.AsyncError{
+			OriginalError: &errors.NonRetryError{Message: "Entity is deleted."},
+			Message:       errorMessage,
+			ErrorCode:     http.StatusConflict,
+		}
+	}
+
+	// The transitional state could have been set by this same operation before being redelivered.
+	if state.IsTransitional() && versionedEntity.GetLatestOperationID() != req.GetOperationId() && !(isDelete && state == entity.ProvisioningStateDeleting) {
+		errorMessage := fmt.Sprintf("Entity is in transitional state %s by operation %s.", state, versionedEntity.GetLatestOperationID())
+		logger.Info("GuardEntityState: " + errorMessage)
+		return &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Entity is in a transitional state."},
+			Message:       errorMessage,
+			ErrorCode:     http.StatusConflict,
+			RetryAfter:    DefaultTransitionalRetryAfter,
+		}
+	}
+
+	return nil
+}
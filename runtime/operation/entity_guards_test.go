@@ -0,0 +1,93 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/entity"
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GuardEntityState", func() {
+	var (
+		ctx context.Context
+		req *OperationRequest
+		e   *testVersionedEntity
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		req = &OperationRequest{OperationId: "1", HttpMethod: "PUT"}
+		e = &testVersionedEntity{latestOperationId: "0", state: entity.ProvisioningStateSucceeded}
+	})
+
+	It("should allow operations on entities in a terminal state", func() {
+		Expect(GuardEntityState(ctx, req, e)).To(BeNil())
+	})
+
+	It("should ignore entities that don't implement VersionedEntity", func() {
+		Expect(GuardEntityState(ctx, req, nil)).To(BeNil())
+	})
+
+	It("should not run non-delete operations on deleting entities", func() {
+		e.state = entity.ProvisioningStateDeleting
+		asyncErr := GuardEntityState(ctx, req, e)
+		Expect(asyncErr).ToNot(BeNil())
+		var nonRetryErr *asyncErrors.NonRetryError
+		Expect(errors.As(asyncErr, &nonRetryErr)).To(BeTrue())
+
+		e.state = entity.ProvisioningStateSucceeded
+		e.softDeleted = true
+		Expect(GuardEntityState(ctx, req, e)).ToNot(BeNil())
+	})
+
+	It("should allow deleting a deleting entity", func() {
+		req.HttpMethod = "delete"
+		e.state = entity.ProvisioningStateDeleting
+		Expect(GuardEntityState(ctx, req, e)).To(BeNil())
+	})
+
+	It("should retry while the entity is in a transitional state", func() {
+		e.state = entity.ProvisioningStateUpdating
+		asyncErr := GuardEntityState(ctx, req, e)
+		Expect(asyncErr).ToNot(BeNil())
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+		Expect(asyncErr.RetryAfter).To(Equal(DefaultTransitionalRetryAfter))
+	})
+
+	It("should allow the operation that set the transitional state", func() {
+		e.state = entity.ProvisioningStateUpdating
+		e.latestOperationId = "1"
+		Expect(GuardEntityState(ctx, req, e)).To(BeNil())
+	})
+})
+
+type testVersionedEntity struct {
+	latestOperationId string
+	state             entity.ProvisioningState
+	softDeleted       bool
+}
+
+func (e *testVersionedEntity) GetLatestOperationID() string {
+	return e.latestOperationId
+}
+
+func (e *testVersionedEntity) GetETag() string {
+	return "etag"
+}
+
+func (e *testVersionedEntity) GetProvisioningState() entity.ProvisioningState {
+	return e.state
+}
+
+func (e *testVersionedEntity) GetLastModified() time.Time {
+	return time.Time{}
+}
+
+func (e *testVersionedEntity) IsSoftDeleted() bool {
+	return e.softDeleted
+}
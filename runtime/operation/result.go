@@ -0,0 +1,24 @@
+package operation
+
+import (
+	"context"
+
+	"github.com/Azure/aks-async/runtime/errors"
+)
+
+// OperationResult is the output payload produced by an operation once it has run successfully.
+type OperationResult struct {
+	// OperationId of the operation that produced the result.
+	OperationId string
+	// Body holds the raw result payload.
+	Body []byte
+	// ContentType describes the encoding of the Body (e.g. "application/json").
+	ContentType string
+}
+
+// ResultOperation is an optional interface an ApiOperation can implement in order to publish
+// an output payload. GetResult is only called after Run has succeeded, and the returned result
+// will be persisted and/or sent back to the caller by the runtime.
+type ResultOperation interface {
+	GetResult(context.Context) (*OperationResult, *errors.AsyncError)
+}
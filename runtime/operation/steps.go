@@ -0,0 +1,200 @@
+package operation
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+)
+
+// Step is a named unit of work of a multi-step operation.
+type Step struct {
+	Name string
+	Run  func(context.Context) *errors.AsyncError
+}
+
+// StepOperation is an optional interface for operations made of ordered named steps. The operation
+// can simply implement Run by calling RunSteps, and the runtime will persist the last completed
+// step so a redelivered message resumes from the next step instead of starting from the beginning.
+// Ex:
+//
+//	func (op *CreateCluster) Run(ctx context.Context) *errors.AsyncError {
+//		return operation.RunSteps(ctx, op)
+//	}
+type StepOperation interface {
+	ApiOperation
+	GetSteps(context.Context) []Step
+}
+
+// CheckpointStore persists the name of the last completed step of each operation.
+type CheckpointStore interface {
+	// GetCheckpoint returns the name of the last completed step, or an empty string if there is none.
+	GetCheckpoint(ctx context.Context, operationId string) (string, error)
+	SaveCheckpoint(ctx context.Context, operationId string, step string) error
+	DeleteCheckpoint(ctx context.Context, operationId string) error
+}
+
+// StepHooks are called before and after running each step of a StepOperation. Any hook passed to
+// the operation handler that also implements this interface will be called by RunSteps.
+type StepHooks interface {
+	BeforeStep(ctx context.Context, op ApiOperation, step string) *errors.AsyncError
+	AfterStep(ctx context.Context, op ApiOperation, step string, asyncError *errors.AsyncError) *errors.AsyncError
+}
+
+// StepRunner holds the store and hooks used by RunSteps. It's injected in the context of Run by
+// the operation handler.
+type StepRunner struct {
+	Store CheckpointStore
+	Hooks []StepHooks
+	// Combines the error of a step with the error of an AfterStep hook. Defaults to errors.Join.
+	CombineErrors func(ctx context.Context, stepErr *errors.AsyncError, hookErr *errors.AsyncError) *errors.AsyncError
+}
+
+type UnknownCheckpointError struct {
+	OperationId string
+	Step        string
+}
+
+func (e *UnknownCheckpointError) Error() string {
+	return fmt.Sprintf("The checkpoint %s of operation %s doesn't match any step.", e.Step, e.OperationId)
+}
+
+type stepRunnerKey struct{}
+
+// WithStepRunner returns a copy of the context holding the step runner.
+func WithStepRunner(ctx context.Context, runner *StepRunner) context.Context {
+	return context.WithValue(ctx, stepRunnerKey{}, runner)
+}
+
+// GetStepRunner returns the step runner stored in the context. If there is none, a runner without
+// a store is returned, which will run all the steps every time.
+func GetStepRunner(ctx context.Context) *StepRunner {
+	if runner, ok := ctx.Value(stepRunnerKey{}).(*StepRunner); ok && runner != nil {
+		return runner
+	}
+	return &StepRunner{}
+}
+
+// RunSteps runs the steps of the operation using the StepRunner in the context.
+func RunSteps(ctx context.Context, op StepOperation) *errors.AsyncError {
+	return GetStepRunner(ctx).Run(ctx, op)
+}
+
+// Run resumes the operation from the step after the last checkpoint, saving a new checkpoint
+// after each step completes successfully.
+func (r *StepRunner) Run(ctx context.Context, op StepOperation) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	var operationId string
+	if req := op.GetOperationRequest(); req != nil {
+		operationId = req.OperationId
+	}
+
+	steps := op.GetSteps(ctx)
+	start := 0
+	if r.Store != nil {
+		checkpoint, err := r.Store.GetCheckpoint(ctx, operationId)
+		if err != nil {
+			logger.Error("StepRunner: Error getting checkpoint: " + err.Error())
+			return &errors.AsyncError{
+				OriginalError: &errors.RetryError{Message: "Error getting checkpoint."},
+				Message:       err.Error(),
+				ErrorCode:     500,
+			}
+		}
+
+		if checkpoint != "" {
+			index := stepIndex(steps, checkpoint)
+			if index < 0 {
+				unknownErr := &UnknownCheckpointError{OperationId: operationId, Step: checkpoint}
+				logger.Error("StepRunner: " + unknownErr.Error())
+				return &errors.AsyncError{
+					OriginalError: &errors.NonRetryError{Message: unknownErr.Error()},
+					Message:       unknownErr.Error(),
+					ErrorCode:     500,
+				}
+			}
+			logger.Info("StepRunner: Resuming operation after step " + checkpoint)
+			start = index + 1
+		}
+	}
+
+	for _, step := range steps[start:] {
+		asyncErr := r.runStep(ctx, op, step)
+		if asyncErr != nil {
+			return asyncErr
+		}
+
+		if r.Store != nil {
+			err := r.Store.SaveCheckpoint(ctx, operationId, step.Name)
+			if err != nil {
+				logger.Error("StepRunner: Error saving checkpoint: " + err.Error())
+				return &errors.AsyncError{
+					OriginalError: &errors.RetryError{Message: "Error saving checkpoint."},
+					Message:       err.Error(),
+					ErrorCode:     500,
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *StepRunner) runStep(ctx context.Context, op StepOperation, step Step) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	for _, hook := range r.Hooks {
+		herr := callStepHook(ctx, "BeforeStep", func() *errors.AsyncError { return hook.BeforeStep(ctx, op, step.Name) })
+		if herr != nil {
+			logger.Error("Something went wrong running a BeforeStep hook: " + herr.Error())
+			return herr
+		}
+	}
+
+	logger.Info("StepRunner: Running step " + step.Name)
+	asyncErr := step.Run(ctx)
+
+	for _, hook := range r.Hooks {
+		herr := callStepHook(ctx, "AfterStep", func() *errors.AsyncError { return hook.AfterStep(ctx, op, step.Name, asyncErr) })
+		if herr != nil {
+			logger.Error("Something went wrong running a AfterStep hook: " + herr.Error())
+			if r.CombineErrors != nil {
+				return r.CombineErrors(ctx, asyncErr, herr)
+			}
+			return errors.Join(asyncErr, herr)
+		}
+	}
+
+	return asyncErr
+}
+
+// Calls the step hook, converting a panic into a NonRetryError since running the hook again would
+// panic again.
+func callStepHook(ctx context.Context, name string, hook func() *errors.AsyncError) (asyncErr *errors.AsyncError) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger := ctxlogger.GetLogger(ctx)
+			errorMessage := fmt.Sprintf("Panic in %s hook: %v", name, r)
+			logger.Error(errorMessage + "\n" + string(debug.Stack()))
+			asyncErr = &errors.AsyncError{
+				OriginalError: &errors.NonRetryError{Message: errorMessage},
+				Message:       errorMessage,
+				ErrorCode:     500,
+			}
+		}
+	}()
+
+	return hook()
+}
+
+func stepIndex(steps []Step, name string) int {
+	for i, step := range steps {
+		if step.Name == name {
+			return i
+		}
+	}
+	return -1
+}
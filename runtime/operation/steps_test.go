@@ -0,0 +1,193 @@
+package operation
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/aks-async/runtime/entity"
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestOperation(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Operation Suite")
+}
+
+var _ = Describe("Steps", func() {
+	var (
+		ctx    context.Context
+		op     *testStepOperation
+		store  *testCheckpointStore
+		runner *StepRunner
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		op = &testStepOperation{
+			opReq: &OperationRequest{OperationId: "0"},
+		}
+		store = &testCheckpointStore{checkpoints: map[string]string{}}
+		runner = &StepRunner{Store: store}
+	})
+
+	It("should run all the steps and save the checkpoint", func() {
+		asyncErr := runner.Run(ctx, op)
+		Expect(asyncErr).To(BeNil())
+		Expect(op.ran).To(Equal([]string{"first", "second", "third"}))
+		Expect(store.checkpoints["0"]).To(Equal("third"))
+	})
+
+	It("should resume from the step after the checkpoint", func() {
+		op.failOn = "second"
+		asyncErr := runner.Run(ctx, op)
+		Expect(asyncErr).ToNot(BeNil())
+		Expect(store.checkpoints["0"]).To(Equal("first"))
+
+		op.failOn = ""
+		op.ran = nil
+		asyncErr = runner.Run(ctx, op)
+		Expect(asyncErr).To(BeNil())
+		Expect(op.ran).To(Equal([]string{"second", "third"}))
+	})
+
+	It("should fail if the checkpoint doesn't match any step", func() {
+		store.checkpoints["0"] = "removed"
+		asyncErr := runner.Run(ctx, op)
+		Expect(asyncErr).ToNot(BeNil())
+		var nonRetryErr *asyncErrors.NonRetryError
+		Expect(errors.As(asyncErr, &nonRetryErr)).To(BeTrue())
+		Expect(op.ran).To(BeEmpty())
+	})
+
+	It("should run all the steps if there is no runner in the context", func() {
+		asyncErr := RunSteps(ctx, op)
+		Expect(asyncErr).To(BeNil())
+		Expect(op.ran).To(Equal([]string{"first", "second", "third"}))
+	})
+
+	It("should call the step hooks", func() {
+		hook := &testStepHooks{}
+		ctx = WithStepRunner(ctx, &StepRunner{Hooks: []StepHooks{hook}})
+		asyncErr := RunSteps(ctx, op)
+		Expect(asyncErr).To(BeNil())
+		Expect(hook.before).To(Equal([]string{"first", "second", "third"}))
+		Expect(hook.after).To(Equal([]string{"first", "second", "third"}))
+	})
+
+	It("should turn a panic in a step hook into a NonRetryError", func() {
+		hook := &testStepHooks{panicStep: "second"}
+		ctx = WithStepRunner(ctx, &StepRunner{Hooks: []StepHooks{hook}})
+		asyncErr := RunSteps(ctx, op)
+		var nonRetryErr *asyncErrors.NonRetryError
+		Expect(errors.As(asyncErr, &nonRetryErr)).To(BeTrue())
+		Expect(op.ran).To(Equal([]string{"first"}))
+	})
+
+	It("should join the errors of the step and the AfterStep hook", func() {
+		op.failOn = "first"
+		hookErr := &asyncErrors.AsyncError{OriginalError: &asyncErrors.NonRetryError{Message: "Hook failed."}, Message: "Hook failed."}
+		ctx = WithStepRunner(ctx, &StepRunner{Hooks: []StepHooks{&testStepHooks{afterErr: hookErr}}})
+		asyncErr := RunSteps(ctx, op)
+		var joinedErr *asyncErrors.JoinedError
+		Expect(errors.As(asyncErr, &joinedErr)).To(BeTrue())
+		Expect(joinedErr.Errors).To(HaveLen(2))
+		Expect(errors.Is(asyncErr, hookErr)).To(BeTrue())
+	})
+
+	It("should combine the errors using the runner policy", func() {
+		op.failOn = "first"
+		hookErr := &asyncErrors.AsyncError{OriginalError: &asyncErrors.NonRetryError{Message: "Hook failed."}}
+		ctx = WithStepRunner(ctx, &StepRunner{
+			Hooks: []StepHooks{&testStepHooks{afterErr: hookErr}},
+			CombineErrors: func(ctx context.Context, stepErr *asyncErrors.AsyncError, hookErr *asyncErrors.AsyncError) *asyncErrors.AsyncError {
+				return stepErr
+			},
+		})
+		asyncErr := RunSteps(ctx, op)
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+		Expect(errors.Is(asyncErr, hookErr)).To(BeFalse())
+	})
+})
+
+type testStepOperation struct {
+	opReq  *OperationRequest
+	failOn string
+	ran    []string
+}
+
+func (o *testStepOperation) InitOperation(ctx context.Context, opReq *OperationRequest) (ApiOperation, *asyncErrors.AsyncError) {
+	o.opReq = opReq
+	return o, nil
+}
+
+func (o *testStepOperation) GuardConcurrency(ctx context.Context, e entity.Entity) *asyncErrors.AsyncError {
+	return nil
+}
+
+func (o *testStepOperation) Run(ctx context.Context) *asyncErrors.AsyncError {
+	return RunSteps(ctx, o)
+}
+
+func (o *testStepOperation) GetOperationRequest() *OperationRequest {
+	return o.opReq
+}
+
+func (o *testStepOperation) GetSteps(ctx context.Context) []Step {
+	steps := []Step{}
+	for _, name := range []string{"first", "second", "third"} {
+		stepName := name
+		steps = append(steps, Step{
+			Name: stepName,
+			Run: func(ctx context.Context) *asyncErrors.AsyncError {
+				if o.failOn == stepName {
+					return &asyncErrors.AsyncError{OriginalError: &asyncErrors.RetryError{Message: "Step failed."}}
+				}
+				o.ran = append(o.ran, stepName)
+				return nil
+			},
+		})
+	}
+	return steps
+}
+
+type testCheckpointStore struct {
+	checkpoints map[string]string
+}
+
+func (s *testCheckpointStore) GetCheckpoint(ctx context.Context, operationId string) (string, error) {
+	return s.checkpoints[operationId], nil
+}
+
+func (s *testCheckpointStore) SaveCheckpoint(ctx context.Context, operationId string, step string) error {
+	s.checkpoints[operationId] = step
+	return nil
+}
+
+func (s *testCheckpointStore) DeleteCheckpoint(ctx context.Context, operationId string) error {
+	delete(s.checkpoints, operationId)
+	return nil
+}
+
+type testStepHooks struct {
+	before    []string
+	after     []string
+	afterErr  *asyncErrors.AsyncError
+	panicStep string
+}
+
+func (h *testStepHooks) BeforeStep(ctx context.Context, op ApiOperation, step string) *asyncErrors.AsyncError {
+	if step == h.panicStep {
+		panic("boom")
+	}
+	h.before = append(h.before, step)
+	return nil
+}
+
+func (h *testStepHooks) AfterStep(ctx context.Context, op ApiOperation, step string, asyncError *asyncErrors.AsyncError) *asyncErrors.AsyncError {
+	h.after = append(h.after, step)
+	return h.afterErr
+}
@@ -0,0 +1,329 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Application properties carrying the trace context, propagated to the continuations.
+var TraceContextProperties = []string{"traceparent", "tracestate", "Diagnostic-Id"}
+
+// Default interval between two dispatches of the pending entries.
+const DefaultDispatchInterval = 10 * time.Second
+
+// Default time the sent entries are kept, so a redelivered source message doesn't enqueue its
+// continuations again.
+const DefaultRetention = time.Hour
+
+// OutboxEntry is a message waiting to be sent.
+type OutboxEntry struct {
+	// Id of the entry, which is also used as the MessageID so Service Bus duplicate detection
+	// can drop the copies sent if an entry is dispatched more than once.
+	Id                string
+	SourceOperationId string
+	Message           *azservicebus.Message
+	CreatedAt         time.Time
+	// Queue the message is sent to, sent using the ServiceBusClient of the Outbox. Empty to send it
+	// with the Sender of the Outbox.
+	Queue string
+}
+
+// Store persists the entries until they are sent. Adding an entry that already exists must not
+// fail, since the same message can be delivered more than once.
+type Store interface {
+	Add(ctx context.Context, entries []*OutboxEntry) error
+	Pending(ctx context.Context, limit int) ([]*OutboxEntry, error)
+	MarkSent(ctx context.Context, id string) error
+	// Deletes the entries sent more than retention ago. Returns the number of entries deleted.
+	Prune(ctx context.Context, retention time.Duration) (int, error)
+}
+
+var _ Store = &InMemoryStore{}
+
+// InMemoryStore keeps the entries in memory. Useful for testing, since the entries won't survive
+// a restart of the worker.
+type InMemoryStore struct {
+	entries []*OutboxEntry
+	// Time each entry was sent, zero while pending.
+	sent map[string]time.Time
+	mu   sync.Mutex
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		entries: make([]*OutboxEntry, 0),
+		sent:    make(map[string]time.Time),
+	}
+}
+
+func (s *InMemoryStore) Add(ctx context.Context, entries []*OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range entries {
+		if _, exists := s.sent[entry.Id]; exists {
+			continue
+		}
+		s.sent[entry.Id] = time.Time{}
+		s.entries = append(s.entries, entry)
+	}
+	return nil
+}
+
+func (s *InMemoryStore) Pending(ctx context.Context, limit int) ([]*OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := []*OutboxEntry{}
+	for _, entry := range s.entries {
+		if limit > 0 && len(pending) == limit {
+			break
+		}
+		if s.sent[entry.Id].IsZero() {
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+func (s *InMemoryStore) MarkSent(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sent[id]; exists {
+		s.sent[id] = time.Now()
+	}
+	return nil
+}
+
+func (s *InMemoryStore) Prune(ctx context.Context, retention time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sentBefore := time.Now().Add(-retention)
+	remaining := make([]*OutboxEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		sentAt := s.sent[entry.Id]
+		if !sentAt.IsZero() && sentAt.Before(sentBefore) {
+			delete(s.sent, entry.Id)
+			continue
+		}
+		remaining = append(remaining, entry)
+	}
+
+	pruned := len(s.entries) - len(remaining)
+	s.entries = remaining
+	return pruned, nil
+}
+
+// The Outbox stores the continuation requests of an operation before its message is completed,
+// and sends them afterwards. Entries that couldn't be sent are retried by the background
+// dispatcher started with Start, which also prunes the sent entries.
+type Outbox struct {
+	Store      Store
+	Sender     sb.SenderInterface
+	Marshaller shuttle.Marshaller
+	// Time the sent entries are kept before being pruned. Defaults to DefaultRetention.
+	Retention time.Duration
+	// Creates the senders of the entries sent to another queue, e.g. the replies of the operations.
+	// Entries with a Queue can't be sent without it.
+	ServiceBusClient sb.ServiceBusClientInterface
+
+	senders map[string]sb.SenderInterface
+	mu      sync.Mutex
+}
+
+func NewOutbox(store Store, sender sb.SenderInterface, marshaller shuttle.Marshaller) *Outbox {
+	if marshaller == nil {
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+	}
+
+	return &Outbox{
+		Store:      store,
+		Sender:     sender,
+		Marshaller: marshaller,
+		Retention:  DefaultRetention,
+	}
+}
+
+// Enqueue stores the continuations of the source operation. The EntityId and EntityType of the
+// source are used for the continuations that don't set them, without modifying the given
+// requests, and the correlation id and trace context of the source message are propagated.
+func (o *Outbox) Enqueue(ctx context.Context, source *azservicebus.ReceivedMessage, sourceRequest *operation.OperationRequest, continuations []*operation.OperationRequest) ([]*OutboxEntry, error) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	entries := make([]*OutboxEntry, 0, len(continuations))
+	for i, continuation := range continuations {
+		continuation = proto.Clone(continuation).(*operation.OperationRequest)
+		if continuation.EntityId == "" {
+			continuation.EntityId = sourceRequest.EntityId
+			continuation.EntityType = sourceRequest.EntityType
+		}
+
+		message, err := o.Marshaller.Marshal(continuation)
+		if err != nil {
+			logger.Error("Outbox: Error marshalling continuation: " + err.Error())
+			return nil, err
+		}
+
+		id := fmt.Sprintf("%s-continuation-%d", sourceRequest.OperationId, i)
+		message.MessageID = &id
+		propagate(source, message)
+
+		entries = append(entries, &OutboxEntry{
+			Id:                id,
+			SourceOperationId: sourceRequest.OperationId,
+			Message:           message,
+			CreatedAt:         time.Now(),
+		})
+	}
+
+	err := o.Store.Add(ctx, entries)
+	if err != nil {
+		logger.Error("Outbox: Error storing continuations: " + err.Error())
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Dispatch sends the entries and marks them as sent, stopping at the first error.
+func (o *Outbox) Dispatch(ctx context.Context, entries []*OutboxEntry) error {
+	logger := ctxlogger.GetLogger(ctx)
+
+	for _, entry := range entries {
+		logger.Info("Outbox: Sending entry " + entry.Id)
+		sender, err := o.getSender(ctx, entry.Queue)
+		if err != nil {
+			logger.Error("Outbox: Error creating sender: " + err.Error())
+			return err
+		}
+
+		err = sender.SendMessage(ctx, entry.Message)
+		if err != nil {
+			logger.Error("Outbox: Error sending entry: " + err.Error())
+			return err
+		}
+
+		err = o.Store.MarkSent(ctx, entry.Id)
+		if err != nil {
+			logger.Error("Outbox: Error marking entry as sent: " + err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *Outbox) getSender(ctx context.Context, queue string) (sb.SenderInterface, error) {
+	if queue == "" {
+		return o.Sender, nil
+	}
+	if o.ServiceBusClient == nil {
+		return nil, &MissingClientError{Queue: queue}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.senders == nil {
+		o.senders = make(map[string]sb.SenderInterface)
+	}
+	if sender, ok := o.senders[queue]; ok {
+		return sender, nil
+	}
+
+	sender, err := o.ServiceBusClient.NewServiceBusSender(ctx, queue, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.senders[queue] = sender
+	return sender, nil
+}
+
+type MissingClientError struct {
+	Queue string
+}
+
+func (e *MissingClientError) Error() string {
+	return fmt.Sprintf("No ServiceBusClient to send the entries to queue %s.", e.Queue)
+}
+
+// DispatchPending sends up to limit pending entries. A limit of 0 sends all of them.
+func (o *Outbox) DispatchPending(ctx context.Context, limit int) error {
+	entries, err := o.Store.Pending(ctx, limit)
+	if err != nil {
+		return err
+	}
+	return o.Dispatch(ctx, entries)
+}
+
+// Prune deletes the entries sent more than the retention ago.
+func (o *Outbox) Prune(ctx context.Context) (int, error) {
+	retention := o.Retention
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	return o.Store.Prune(ctx, retention)
+}
+
+// Start dispatches the pending entries and prunes the sent ones every interval until the
+// context is cancelled.
+func (o *Outbox) Start(ctx context.Context, interval time.Duration) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if interval <= 0 {
+		interval = DefaultDispatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := o.DispatchPending(ctx, 0)
+			if err != nil {
+				logger.Error("Outbox: Error dispatching pending entries: " + err.Error())
+			}
+
+			_, err = o.Prune(ctx)
+			if err != nil {
+				logger.Error("Outbox: Error pruning sent entries: " + err.Error())
+			}
+		}
+	}
+}
+
+func propagate(source *azservicebus.ReceivedMessage, message *azservicebus.Message) {
+	if source == nil {
+		return
+	}
+
+	if source.CorrelationID != nil {
+		correlationId := *source.CorrelationID
+		message.CorrelationID = &correlationId
+	} else if source.MessageID != "" {
+		correlationId := source.MessageID
+		message.CorrelationID = &correlationId
+	}
+
+	for _, property := range TraceContextProperties {
+		if value, ok := source.ApplicationProperties[property]; ok {
+			if message.ApplicationProperties == nil {
+				message.ApplicationProperties = map[string]any{}
+			}
+			message.ApplicationProperties[property] = value
+		}
+	}
+}
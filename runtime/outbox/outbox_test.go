@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestOutbox(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Outbox Suite")
+}
+
+var _ = Describe("Outbox", func() {
+	var (
+		ctx           context.Context
+		store         *InMemoryStore
+		receiver      sb.ReceiverInterface
+		marshaller    shuttle.Marshaller
+		ob            *Outbox
+		source        *azservicebus.ReceivedMessage
+		sourceRequest *operation.OperationRequest
+		continuations []*operation.OperationRequest
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client := sb.NewFakeServiceBusClient()
+		sender, _ := client.NewServiceBusSender(ctx, "operations", nil)
+		receiver, _ = client.NewServiceBusReceiver(ctx, "operations", nil)
+		store = NewInMemoryStore()
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+		ob = NewOutbox(store, sender, marshaller)
+
+		correlationId := "correlation"
+		source = &azservicebus.ReceivedMessage{
+			MessageID:     "message",
+			CorrelationID: &correlationId,
+			ApplicationProperties: map[string]any{
+				"traceparent": "00-trace-span-01",
+				"other":       "not propagated",
+			},
+		}
+		sourceRequest = &operation.OperationRequest{
+			OperationName: "CreateCluster",
+			OperationId:   "0",
+			EntityId:      "cluster",
+			EntityType:    "Cluster",
+		}
+		continuations = []*operation.OperationRequest{
+			{OperationName: "ConfigureCluster", OperationId: "1"},
+			{OperationName: "ValidateCluster", OperationId: "2", EntityId: "other", EntityType: "Other"},
+		}
+	})
+
+	It("should store the continuations with the propagated values", func() {
+		entries, err := ob.Enqueue(ctx, source, sourceRequest, continuations)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+
+		Expect(*entries[0].Message.MessageID).To(Equal("0-continuation-0"))
+		Expect(*entries[0].Message.CorrelationID).To(Equal("correlation"))
+		Expect(entries[0].Message.ApplicationProperties).To(HaveKeyWithValue("traceparent", "00-trace-span-01"))
+		Expect(entries[0].Message.ApplicationProperties).ToNot(HaveKey("other"))
+
+		var body operation.OperationRequest
+		Expect(marshaller.Unmarshal(entries[0].Message, &body)).To(Succeed())
+		Expect(body.EntityId).To(Equal("cluster"))
+		Expect(body.EntityType).To(Equal("Cluster"))
+		Expect(marshaller.Unmarshal(entries[1].Message, &body)).To(Succeed())
+		Expect(body.EntityId).To(Equal("other"))
+
+		// The requests of the operation are left as they are.
+		Expect(continuations[0].EntityId).To(BeEmpty())
+		Expect(continuations[0].EntityType).To(BeEmpty())
+
+		pending, err := store.Pending(ctx, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(2))
+	})
+
+	It("should not duplicate entries when the source is redelivered", func() {
+		_, err := ob.Enqueue(ctx, source, sourceRequest, continuations)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ob.Enqueue(ctx, source, sourceRequest, continuations)
+		Expect(err).ToNot(HaveOccurred())
+
+		pending, err := store.Pending(ctx, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(2))
+	})
+
+	It("should send the entries and mark them as sent", func() {
+		entries, err := ob.Enqueue(ctx, source, sourceRequest, continuations)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ob.Dispatch(ctx, entries)).To(Succeed())
+
+		messages, err := receiver.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(2))
+
+		pending, err := store.Pending(ctx, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("should send the entries with a queue using the client", func() {
+		client := sb.NewFakeServiceBusClient()
+		replies, _ := client.NewServiceBusReceiver(ctx, "replies", nil)
+		entries := []*OutboxEntry{{Id: "0-reply", SourceOperationId: "0", Message: &azservicebus.Message{Body: []byte("result")}, Queue: "replies"}}
+		Expect(store.Add(ctx, entries)).To(Succeed())
+
+		var missingErr *MissingClientError
+		Expect(errors.As(ob.Dispatch(ctx, entries), &missingErr)).To(BeTrue())
+
+		ob.ServiceBusClient = client
+		Expect(ob.Dispatch(ctx, entries)).To(Succeed())
+		messages, err := replies.ReceiveMessage(ctx, 10, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+		Expect(messages[0].Body).To(Equal([]byte("result")))
+	})
+
+	It("should send the pending entries", func() {
+		_, err := ob.Enqueue(ctx, source, sourceRequest, continuations)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ob.DispatchPending(ctx, 1)).To(Succeed())
+
+		pending, err := store.Pending(ctx, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+	})
+
+	It("should prune the entries sent before the retention", func() {
+		entries, err := ob.Enqueue(ctx, source, sourceRequest, continuations)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ob.Dispatch(ctx, entries[:1])).To(Succeed())
+
+		pruned, err := ob.Prune(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(0))
+
+		ob.Retention = time.Nanosecond
+		time.Sleep(time.Millisecond)
+		pruned, err = ob.Prune(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(1))
+
+		// Only the pending entry is left.
+		pending, err := store.Pending(ctx, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+		Expect(pending[0].Id).To(Equal("0-continuation-1"))
+	})
+})
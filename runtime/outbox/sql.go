@@ -0,0 +1,127 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/aks-async/database"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+var _ Store = &SqlStore{}
+
+// SqlStore keeps the entries in a SQL Server table with the following schema:
+//
+//	CREATE TABLE OutboxEntries (
+//		Id NVARCHAR(255) NOT NULL PRIMARY KEY,
+//		SourceOperationId NVARCHAR(255) NOT NULL,
+//		Message NVARCHAR(MAX) NOT NULL,
+//		CreatedAt DATETIME2 NOT NULL,
+//		SentAt DATETIME2 NULL,
+//		Queue NVARCHAR(255) NOT NULL
+//	)
+//
+// The messages are stored as JSON, so numeric application properties are read back as float64.
+// Sent times and the prune cutoff are computed in UTC with the clock of the worker. The table name
+// is not parametrized in the queries, so it must come from trusted configuration.
+type SqlStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewSqlStore(db *sql.DB, table string) *SqlStore {
+	return &SqlStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func (s *SqlStore) Add(ctx context.Context, entries []*OutboxEntry) error {
+	query := fmt.Sprintf(`MERGE %s WITH (HOLDLOCK) AS target
+USING (SELECT @p1 AS Id) AS source
+ON target.Id = source.Id
+WHEN NOT MATCHED THEN INSERT (Id, SourceOperationId, Message, CreatedAt, Queue) VALUES (@p1, @p2, @p3, @p4, @p5);`, s.table)
+
+	for _, entry := range entries {
+		message, err := json.Marshal(entry.Message)
+		if err != nil {
+			return err
+		}
+
+		_, err = database.ExecDb(ctx, s.db, query, entry.Id, entry.SourceOperationId, string(message), entry.CreatedAt, entry.Queue)
+
+		// The entry already exists.
+		var noRowsErr *database.NoRowsAffectedError
+		if err != nil && !errors.As(err, &noRowsErr) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SqlStore) Pending(ctx context.Context, limit int) ([]*OutboxEntry, error) {
+	top := ""
+	if limit > 0 {
+		top = fmt.Sprintf("TOP (%d) ", limit)
+	}
+	query := fmt.Sprintf("SELECT %sId, SourceOperationId, Message, CreatedAt, Queue FROM %s WHERE SentAt IS NULL ORDER BY CreatedAt", top, s.table)
+	rows, err := database.QueryDb(ctx, s.db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []*OutboxEntry{}
+	for rows.Next() {
+		entry := &OutboxEntry{}
+		var message string
+		err = rows.Scan(&entry.Id, &entry.SourceOperationId, &message, &entry.CreatedAt, &entry.Queue)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Message = &azservicebus.Message{}
+		err = json.Unmarshal([]byte(message), entry.Message)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+func (s *SqlStore) MarkSent(ctx context.Context, id string) error {
+	query := fmt.Sprintf("UPDATE %s SET SentAt = @p2 WHERE Id = @p1", s.table)
+	_, err := database.ExecDb(ctx, s.db, query, id, time.Now().UTC())
+
+	// The entry was already pruned.
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return nil
+	}
+	return err
+}
+
+func (s *SqlStore) Prune(ctx context.Context, retention time.Duration) (int, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE SentAt < @p1", s.table)
+	result, err := database.ExecDb(ctx, s.db, query, time.Now().UTC().Add(-retention))
+
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	pruned, err := result.RowsAffected()
+	return int(pruned), err
+}
@@ -0,0 +1,115 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// Matches the prune cutoff, computed from the retention when the query runs.
+type cutoff struct {
+	before time.Time
+}
+
+func (c cutoff) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && t.Location() == time.UTC && !t.Before(c.before) && t.Before(c.before.Add(time.Minute))
+}
+
+var _ = Describe("SqlStore", func() {
+	var (
+		ctx   context.Context
+		db    *sql.DB
+		mock  sqlmock.Sqlmock
+		store *SqlStore
+		entry *OutboxEntry
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		db, mock, err = sqlmock.New()
+		Expect(err).ToNot(HaveOccurred())
+		store = NewSqlStore(db, "OutboxEntries")
+
+		id := "0-continuation-0"
+		entry = &OutboxEntry{
+			Id:                id,
+			SourceOperationId: "0",
+			Message: &azservicebus.Message{
+				MessageID:             &id,
+				Body:                  []byte("body"),
+				ApplicationProperties: map[string]any{"traceparent": "00-trace-span-01"},
+			},
+			CreatedAt: time.Now(),
+		}
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		db.Close()
+	})
+
+	It("should add the entries, ignoring the existing ones", func() {
+		message, err := json.Marshal(entry.Message)
+		Expect(err).ToNot(HaveOccurred())
+		mock.ExpectExec(regexp.QuoteMeta("MERGE OutboxEntries")).
+			WithArgs(entry.Id, entry.SourceOperationId, string(message), entry.CreatedAt, entry.Queue).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("MERGE OutboxEntries")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		Expect(store.Add(ctx, []*OutboxEntry{entry, entry})).To(Succeed())
+	})
+
+	It("should return the pending entries", func() {
+		message, err := json.Marshal(entry.Message)
+		Expect(err).ToNot(HaveOccurred())
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT TOP (1) Id, SourceOperationId, Message, CreatedAt, Queue FROM OutboxEntries WHERE SentAt IS NULL")).
+			WillReturnRows(sqlmock.NewRows([]string{"Id", "SourceOperationId", "Message", "CreatedAt", "Queue"}).
+				AddRow(entry.Id, entry.SourceOperationId, string(message), entry.CreatedAt, "replies"))
+
+		pending, err := store.Pending(ctx, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(HaveLen(1))
+		Expect(*pending[0].Message.MessageID).To(Equal(entry.Id))
+		Expect(pending[0].Message.Body).To(Equal([]byte("body")))
+		Expect(pending[0].Message.ApplicationProperties).To(HaveKeyWithValue("traceparent", "00-trace-span-01"))
+		Expect(pending[0].Queue).To(Equal("replies"))
+	})
+
+	It("should mark the entries as sent", func() {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE OutboxEntries SET SentAt = @p2 WHERE Id = @p1")).
+			WithArgs(entry.Id, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE OutboxEntries")).
+			WithArgs("pruned", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		Expect(store.MarkSent(ctx, entry.Id)).To(Succeed())
+		Expect(store.MarkSent(ctx, "pruned")).To(Succeed())
+	})
+
+	It("should prune the sent entries", func() {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM OutboxEntries WHERE SentAt < @p1")).
+			WithArgs(cutoff{before: time.Now().UTC().Add(-time.Hour)}).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM OutboxEntries")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		pruned, err := store.Prune(ctx, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(3))
+		pruned, err = store.Prune(ctx, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(0))
+	})
+})
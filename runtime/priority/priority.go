@@ -0,0 +1,129 @@
+package priority
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+// Class of priority of an operation. Each class is routed to its own queue.
+type Class string
+
+const (
+	// Operations requested by customers.
+	High Class = "High"
+	// The default class of operations.
+	Normal Class = "Normal"
+	// Background operations, e.g. reconciliations.
+	Low Class = "Low"
+)
+
+// Application property of the message holding the priority class of the operation.
+const PriorityProperty = "Priority"
+
+// Weights used to drain the lanes of each class if none are given.
+var DefaultWeights = map[Class]int{
+	High:   6,
+	Normal: 3,
+	Low:    1,
+}
+
+// Returns the weight of the class, or 1 if the class has no default weight.
+func DefaultWeight(class Class) int {
+	if weight, ok := DefaultWeights[class]; ok {
+		return weight
+	}
+	return 1
+}
+
+// Marshals the operation request into a message of the given priority class.
+func NewMessage(marshaller shuttle.Marshaller, req *operation.OperationRequest, class Class) (*azservicebus.Message, error) {
+	if marshaller == nil {
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+	}
+
+	message, err := marshaller.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	SetPriority(message, class)
+	return message, nil
+}
+
+// Sets the priority class of the message.
+func SetPriority(message *azservicebus.Message, class Class) {
+	if message.ApplicationProperties == nil {
+		message.ApplicationProperties = map[string]any{}
+	}
+	message.ApplicationProperties[PriorityProperty] = string(class)
+}
+
+// Returns the priority class of the message, or Normal if it has none.
+func GetPriority(properties map[string]any) Class {
+	if class, ok := properties[PriorityProperty].(string); ok && class != "" {
+		return Class(class)
+	}
+	return Normal
+}
+
+type UnknownClassError struct {
+	Class Class
+}
+
+func (e *UnknownClassError) Error() string {
+	return fmt.Sprintf("No sender for priority class %s.", e.Class)
+}
+
+var _ sb.SenderInterface = &RoutingSender{}
+
+// RoutingSender sends each message to the sender of its priority class. Messages whose class
+// has no sender are sent through the sender of the Default class.
+type RoutingSender struct {
+	Senders map[Class]sb.SenderInterface
+	Default Class
+}
+
+func NewRoutingSender(senders map[Class]sb.SenderInterface) *RoutingSender {
+	return &RoutingSender{
+		Senders: senders,
+		Default: Normal,
+	}
+}
+
+func (s *RoutingSender) SendMessage(ctx context.Context, message *azservicebus.Message) error {
+	logger := ctxlogger.GetLogger(ctx)
+
+	class := GetPriority(message.ApplicationProperties)
+	sender, err := s.getSender(class)
+	if err != nil {
+		logger.Error("RoutingSender: " + err.Error())
+		return err
+	}
+
+	return sender.SendMessage(ctx, message)
+}
+
+// Returns the azure sender of the default class.
+func (s *RoutingSender) GetAzureSender() (*azservicebus.Sender, error) {
+	sender, err := s.getSender(s.Default)
+	if err != nil {
+		return nil, err
+	}
+	return sender.GetAzureSender()
+}
+
+func (s *RoutingSender) getSender(class Class) (sb.SenderInterface, error) {
+	if sender, ok := s.Senders[class]; ok && sender != nil {
+		return sender, nil
+	}
+	if sender, ok := s.Senders[s.Default]; ok && sender != nil {
+		return sender, nil
+	}
+	return nil, &UnknownClassError{Class: class}
+}
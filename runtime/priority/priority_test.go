@@ -0,0 +1,73 @@
+package priority
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPriority(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Priority Suite")
+}
+
+var _ = Describe("RoutingSender", func() {
+	var (
+		ctx        context.Context
+		highClient *sb.FakeServiceBusClient
+		lowClient  *sb.FakeServiceBusClient
+		sender     *RoutingSender
+		req        *operation.OperationRequest
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		highClient = sb.NewFakeServiceBusClient()
+		lowClient = sb.NewFakeServiceBusClient()
+		highSender, _ := highClient.NewServiceBusSender(ctx, "high", nil)
+		lowSender, _ := lowClient.NewServiceBusSender(ctx, "low", nil)
+		sender = NewRoutingSender(map[Class]sb.SenderInterface{High: highSender, Low: lowSender})
+		sender.Default = Low
+		req = &operation.OperationRequest{OperationName: "Upgrade", OperationId: "0"}
+	})
+
+	receive := func(client *sb.FakeServiceBusClient) int {
+		receiver, _ := client.NewServiceBusReceiver(ctx, "", nil)
+		messages, _ := receiver.ReceiveMessage(ctx, 10, nil)
+		return len(messages)
+	}
+
+	It("should route the messages by priority class", func() {
+		message, err := NewMessage(&shuttle.DefaultProtoMarshaller{}, req, High)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(GetPriority(message.ApplicationProperties)).To(Equal(High))
+		Expect(sender.SendMessage(ctx, message)).To(Succeed())
+
+		Expect(receive(highClient)).To(Equal(1))
+		Expect(receive(lowClient)).To(Equal(0))
+	})
+
+	It("should route the messages without a sender to the default class", func() {
+		message, err := NewMessage(nil, req, Normal)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sender.SendMessage(ctx, message)).To(Succeed())
+		Expect(receive(lowClient)).To(Equal(1))
+	})
+
+	It("should fail if there is no sender for the class nor the default", func() {
+		sender.Default = Normal
+		message, err := NewMessage(nil, req, Normal)
+		Expect(err).ToNot(HaveOccurred())
+		err = sender.SendMessage(ctx, message)
+		Expect(err).To(Equal(&UnknownClassError{Class: Normal}))
+	})
+
+	It("should default to the normal class", func() {
+		Expect(GetPriority(nil)).To(Equal(Normal))
+	})
+})
@@ -0,0 +1,318 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	ec "github.com/Azure/aks-async/runtime/entity_controller"
+	"github.com/Azure/aks-async/runtime/handlers"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/matcher"
+	"github.com/Azure/aks-async/runtime/priority"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+const (
+	DefaultLanePrefetch        = 1
+	DefaultLaneReceiveInterval = time.Second
+)
+
+// Lane is a queue of operations of one priority class.
+type Lane struct {
+	Class    priority.Class
+	Receiver sb.ReceiverInterface
+	// Relative share of the messages handled from this lane while the other lanes also have
+	// messages waiting. If not set, the default weight of the class is used.
+	Weight int
+}
+
+type LaneProcessorOptions struct {
+	// Maximum number of messages handled at the same time across all the lanes.
+	MaxConcurrency int
+	// Number of messages received ahead of time from each lane. Keep it low, since the lock of
+	// the received messages keeps running while they wait.
+	Prefetch int
+	// Time to wait before receiving again from a lane that failed or had no messages.
+	ReceiveInterval time.Duration
+}
+
+type NoLanesError struct{}
+
+func (e *NoLanesError) Error() string {
+	return "No lanes received."
+}
+
+type InvalidLaneError struct {
+	Class  priority.Class
+	Reason string
+}
+
+func (e *InvalidLaneError) Error() string {
+	return fmt.Sprintf("Invalid lane %s: %s", e.Class, e.Reason)
+}
+
+type laneState struct {
+	Lane
+	settler  shuttle.MessageSettler
+	messages chan *azservicebus.ReceivedMessage
+	current  int
+}
+
+// LaneProcessor drains the lanes with a smooth weighted round robin, so each lane gets its share
+// of the concurrency while the others are busy, and all of it while they are idle.
+type LaneProcessor struct {
+	lanes   []*laneState
+	handler shuttle.HandlerFunc
+	options LaneProcessorOptions
+	ready   chan struct{}
+}
+
+// Creates a processor that handles the messages of all the lanes with the same handler. The
+// settler of each lane is its receiver if it implements shuttle.MessageSettler, or the azure
+// receiver otherwise.
+func NewLaneProcessor(lanes []Lane, handler shuttle.HandlerFunc, options *LaneProcessorOptions) (*LaneProcessor, error) {
+	if len(lanes) == 0 {
+		return nil, &NoLanesError{}
+	}
+	if handler == nil {
+		return nil, errors.New("No handler received.")
+	}
+
+	p := &LaneProcessor{
+		handler: handler,
+		ready:   make(chan struct{}, 1),
+	}
+	if options != nil {
+		p.options = *options
+	}
+	if p.options.MaxConcurrency <= 0 {
+		p.options.MaxConcurrency = 1
+	}
+	if p.options.Prefetch <= 0 {
+		p.options.Prefetch = DefaultLanePrefetch
+	}
+	if p.options.ReceiveInterval <= 0 {
+		p.options.ReceiveInterval = DefaultLaneReceiveInterval
+	}
+
+	classes := make(map[priority.Class]bool, len(lanes))
+	for _, lane := range lanes {
+		if lane.Receiver == nil {
+			return nil, &InvalidLaneError{Class: lane.Class, Reason: "no receiver"}
+		}
+		if classes[lane.Class] {
+			return nil, &InvalidLaneError{Class: lane.Class, Reason: "duplicate class"}
+		}
+		classes[lane.Class] = true
+
+		if lane.Weight <= 0 {
+			lane.Weight = priority.DefaultWeight(lane.Class)
+		}
+
+		settler, ok := lane.Receiver.(shuttle.MessageSettler)
+		if !ok {
+			azReceiver, err := lane.Receiver.GetAzureReceiver()
+			if err != nil {
+				return nil, err
+			}
+			if azReceiver == nil {
+				return nil, &InvalidLaneError{Class: lane.Class, Reason: "receiver can't settle messages"}
+			}
+			settler = azReceiver
+		}
+
+		p.lanes = append(p.lanes, &laneState{
+			Lane:     lane,
+			settler:  settler,
+			messages: make(chan *azservicebus.ReceivedMessage, p.options.Prefetch),
+		})
+	}
+
+	return p, nil
+}
+
+// Processes the lanes until the context is canceled, then waits for the messages being handled
+// and abandons the ones that were received but not handled. The handlers run on a context that
+// isn't canceled when the processor stops, so they can finish and settle their messages.
+func (p *LaneProcessor) Start(ctx context.Context) error {
+	logger := ctxlogger.GetLogger(ctx)
+	handlerCtx := context.WithoutCancel(ctx)
+
+	var receivers sync.WaitGroup
+	for _, lane := range p.lanes {
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			p.receive(ctx, lane)
+		}()
+	}
+
+	var handlers sync.WaitGroup
+	slots := make(chan struct{}, p.options.MaxConcurrency)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		lane, message := p.next(ctx)
+		if message == nil {
+			<-slots
+			break
+		}
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer func() { <-slots }()
+			p.handler(handlerCtx, lane.settler, message)
+		}()
+	}
+
+	logger.Info("LaneProcessor: Stopping, waiting for the messages being handled.")
+	receivers.Wait()
+	handlers.Wait()
+	p.abandonPending(context.WithoutCancel(ctx))
+
+	return ctx.Err()
+}
+
+// Receives messages from the lane until the context is canceled.
+func (p *LaneProcessor) receive(ctx context.Context, lane *laneState) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	for ctx.Err() == nil {
+		messages, err := lane.Receiver.ReceiveMessage(ctx, p.options.Prefetch, nil)
+		if err != nil || len(messages) == 0 {
+			if err != nil && ctx.Err() == nil {
+				logger.Debug(fmt.Sprintf("LaneProcessor: No messages received from lane %s: %s", lane.Class, err.Error()))
+			}
+			select {
+			case <-time.After(p.options.ReceiveInterval):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		for i, message := range messages {
+			select {
+			case lane.messages <- message:
+				p.signal()
+			case <-ctx.Done():
+				p.abandon(context.WithoutCancel(ctx), lane, messages[i:])
+				return
+			}
+		}
+	}
+}
+
+// Returns the next message to handle, waiting until a lane has one. Returns nil if the context
+// is canceled first.
+func (p *LaneProcessor) next(ctx context.Context) (*laneState, *azservicebus.ReceivedMessage) {
+	for {
+		// The processor is the only reader of the lanes, so a lane with messages waiting still
+		// has them once picked.
+		if lane := p.pick(); lane != nil {
+			return lane, <-lane.messages
+		}
+
+		select {
+		case <-p.ready:
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// Smooth weighted round robin among the lanes with messages waiting.
+func (p *LaneProcessor) pick() *laneState {
+	var selected *laneState
+	total := 0
+	for _, lane := range p.lanes {
+		if len(lane.messages) == 0 {
+			continue
+		}
+		lane.current += lane.Weight
+		total += lane.Weight
+		if selected == nil || lane.current > selected.current {
+			selected = lane
+		}
+	}
+	if selected != nil {
+		selected.current -= total
+	}
+	return selected
+}
+
+func (p *LaneProcessor) signal() {
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (p *LaneProcessor) abandonPending(ctx context.Context) {
+	for _, lane := range p.lanes {
+		for len(lane.messages) > 0 {
+			p.abandon(ctx, lane, []*azservicebus.ReceivedMessage{<-lane.messages})
+		}
+	}
+}
+
+func (p *LaneProcessor) abandon(ctx context.Context, lane *laneState, messages []*azservicebus.ReceivedMessage) {
+	logger := ctxlogger.GetLogger(ctx)
+	for _, message := range messages {
+		err := lane.settler.AbandonMessage(ctx, message, nil)
+		if err != nil {
+			logger.Error("LaneProcessor: Error abandoning message: " + err.Error())
+		}
+	}
+}
+
+// Same as CreateProcessor, but processes the operations of multiple priority lanes. The messages
+// are settled by the receiver of their lane. The default handlers only use the receiver of the
+// first lane to receive deferred messages, which they don't enable; use a customHandler with a
+// deferral.DeferredReceiver per lane to defer messages.
+func CreateLaneProcessor(
+	lanes []Lane,
+	matcher *matcher.Matcher,
+	operationContainer oc.OperationContainerClient,
+	entityController ec.EntityController,
+	logger *slog.Logger,
+	customHandler shuttle.HandlerFunc,
+	options *LaneProcessorOptions,
+	marshaller shuttle.Marshaller,
+	hooks []hooks.BaseOperationHooksInterface,
+) (*LaneProcessor, error) {
+
+	if len(lanes) == 0 {
+		return nil, &NoLanesError{}
+	}
+
+	if matcher == nil {
+		return nil, errors.New("No matcher received.")
+	}
+
+	// Reject any registration changes once the processor is running.
+	if matcher.FreezeOnStart {
+		matcher.Freeze()
+	}
+
+	if customHandler == nil {
+		customHandler = handlers.DefaultHandlers(lanes[0].Receiver, matcher, operationContainer, entityController, logger, hooks, marshaller)
+	}
+
+	return NewLaneProcessor(lanes, customHandler, options)
+}
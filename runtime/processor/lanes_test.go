@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/priority"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestProcessor(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Processor Suite")
+}
+
+// Receiver of the fake service bus that can also settle the messages.
+type settlingReceiver struct {
+	sb.ReceiverInterface
+	settler.SampleMessageSettler
+}
+
+var _ = Describe("LaneProcessor", func() {
+	var (
+		ctx     context.Context
+		cancel  context.CancelFunc
+		handled []priority.Class
+		mu      sync.Mutex
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		handled = nil
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	newLane := func(class priority.Class, weight int, count int) Lane {
+		client := sb.NewFakeServiceBusClient()
+		sender, _ := client.NewServiceBusSender(ctx, string(class), nil)
+		for i := 0; i < count; i++ {
+			message, err := priority.NewMessage(nil, &operation.OperationRequest{OperationName: "Upgrade"}, class)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sender.SendMessage(ctx, message)).To(Succeed())
+		}
+		receiver, _ := client.NewServiceBusReceiver(ctx, string(class), nil)
+		return Lane{Class: class, Receiver: &settlingReceiver{ReceiverInterface: receiver}, Weight: weight}
+	}
+
+	// Records the class of the handled messages and stops the processor after the given count.
+	recordingHandler := func(stopAfter int) shuttle.HandlerFunc {
+		return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+			// Gives the lane time to receive its next message.
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, priority.GetPriority(message.ApplicationProperties))
+			if len(handled) == stopAfter {
+				cancel()
+			}
+		}
+	}
+
+	count := func(class priority.Class) int {
+		n := 0
+		for _, c := range handled {
+			if c == class {
+				n++
+			}
+		}
+		return n
+	}
+
+	It("should share the messages by weight while the lanes are busy", func() {
+		lanes := []Lane{newLane(priority.High, 3, 0), newLane(priority.Low, 1, 0)}
+		p, err := NewLaneProcessor(lanes, recordingHandler(0), &LaneProcessorOptions{Prefetch: 10})
+		Expect(err).ToNot(HaveOccurred())
+		for _, lane := range p.lanes {
+			for i := 0; i < 10; i++ {
+				lane.messages <- &azservicebus.ReceivedMessage{}
+			}
+		}
+
+		picked := []priority.Class{}
+		for i := 0; i < 8; i++ {
+			lane, _ := p.next(ctx)
+			picked = append(picked, lane.Class)
+		}
+		Expect(picked).To(Equal([]priority.Class{
+			priority.High, priority.High, priority.Low, priority.High,
+			priority.High, priority.High, priority.Low, priority.High,
+		}))
+	})
+
+	It("should favor the lanes with a higher weight", func() {
+		lanes := []Lane{newLane(priority.High, 3, 20), newLane(priority.Low, 1, 20)}
+		p, err := NewLaneProcessor(lanes, recordingHandler(12), &LaneProcessorOptions{ReceiveInterval: time.Millisecond})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(p.Start(ctx)).To(MatchError(context.Canceled))
+		Expect(count(priority.High)).To(BeNumerically(">", count(priority.Low)))
+	})
+
+	It("should give all the concurrency to a lane while the others are idle", func() {
+		lanes := []Lane{newLane(priority.High, 0, 0), newLane(priority.Low, 0, 4)}
+		p, err := NewLaneProcessor(lanes, recordingHandler(4), &LaneProcessorOptions{ReceiveInterval: time.Millisecond})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(p.Start(ctx)).To(MatchError(context.Canceled))
+		Expect(count(priority.Low)).To(Equal(4))
+	})
+
+	It("should not cancel the handlers when the processor stops", func() {
+		lanes := []Lane{newLane(priority.High, 0, 1)}
+		handlerErr := make(chan error, 1)
+		p, err := NewLaneProcessor(lanes, func(handlerCtx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+			handlerErr <- handlerCtx.Err()
+		}, &LaneProcessorOptions{ReceiveInterval: time.Millisecond})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(p.Start(ctx)).To(MatchError(context.Canceled))
+		Expect(<-handlerErr).ToNot(HaveOccurred())
+	})
+
+	It("should validate the lanes", func() {
+		_, err := NewLaneProcessor(nil, recordingHandler(1), nil)
+		Expect(err).To(Equal(&NoLanesError{}))
+
+		lanes := []Lane{newLane(priority.High, 0, 0), newLane(priority.High, 0, 0)}
+		_, err = NewLaneProcessor(lanes, recordingHandler(1), nil)
+		Expect(err).To(Equal(&InvalidLaneError{Class: priority.High, Reason: "duplicate class"}))
+
+		client := sb.NewFakeServiceBusClient()
+		receiver, _ := client.NewServiceBusReceiver(ctx, "", nil)
+		_, err = NewLaneProcessor([]Lane{{Class: priority.Low, Receiver: receiver}}, recordingHandler(1), nil)
+		Expect(err).To(Equal(&InvalidLaneError{Class: priority.Low, Reason: "receiver can't settle messages"}))
+	})
+})
@@ -0,0 +1,433 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+
+	ec "github.com/Azure/aks-async/runtime/entity_controller"
+	"github.com/Azure/aks-async/runtime/handlers"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/aks-async/runtime/matcher"
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+)
+
+const DefaultDrainTimeout = 30 * time.Second
+
+// Default time to wait for the handlers canceled by the drain to return.
+const DefaultCancelTimeout = 5 * time.Second
+
+// Cause of the cancellation of the operations still running when the drain timeout expires.
+var ErrDrainTimeout = errors.New("Drain timeout expired.")
+
+// Runner is a processor that receives messages until the context is canceled, such as
+// shuttle.Processor or LaneProcessor.
+type Runner interface {
+	Start(ctx context.Context) error
+}
+
+type ManagedProcessorOptions struct {
+	// Time to wait for the messages being handled once the processor stops.
+	DrainTimeout time.Duration
+	// Time to wait for the handlers canceled at the drain timeout to return, before their operations
+	// are set back to PENDING, so a handler failing on the cancellation doesn't overwrite the
+	// status. Defaults to DefaultCancelTimeout.
+	CancelTimeout time.Duration
+	// Signals that stop the processor. Defaults to SIGINT and SIGTERM. Use an empty, non-nil slice
+	// to only stop when the context is canceled.
+	Signals []os.Signal
+}
+
+// DrainStats reports how the messages being handled were drained when the processor stopped.
+type DrainStats struct {
+	// Messages being handled when the processor stopped.
+	InFlight int
+	// Messages whose handler finished before the drain timeout.
+	Completed int
+	// Messages abandoned because they were still being handled at the drain timeout, or were
+	// received while draining.
+	Abandoned int
+	// Operations of the abandoned messages set back to PENDING.
+	MarkedPending int
+	// Errors abandoning messages or updating the operations.
+	Errors   int
+	Duration time.Duration
+}
+
+type MessageAbandonedError struct {
+	MessageId string
+}
+
+func (e *MessageAbandonedError) Error() string {
+	return fmt.Sprintf("Message %s was already abandoned by the drain.", e.MessageId)
+}
+
+type inFlightMessage struct {
+	message *azservicebus.ReceivedMessage
+	settler shuttle.MessageSettler
+	cancel  context.CancelCauseFunc
+	// Set by whoever settles the message first, the handler or the drain.
+	settled atomic.Bool
+}
+
+// Settler used by the handlers, so the drain doesn't abandon a message already settled and
+// the handler can't settle a message the drain abandoned.
+type drainSettler struct {
+	shuttle.MessageSettler
+	inFlight *inFlightMessage
+}
+
+func (s *drainSettler) claim(message *azservicebus.ReceivedMessage) error {
+	if message != s.inFlight.message {
+		return nil
+	}
+	if !s.inFlight.settled.CompareAndSwap(false, true) {
+		return &MessageAbandonedError{MessageId: message.MessageID}
+	}
+	return nil
+}
+
+func (s *drainSettler) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	if err := s.claim(message); err != nil {
+		return err
+	}
+	return s.MessageSettler.AbandonMessage(ctx, message, options)
+}
+
+func (s *drainSettler) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	if err := s.claim(message); err != nil {
+		return err
+	}
+	return s.MessageSettler.CompleteMessage(ctx, message, options)
+}
+
+func (s *drainSettler) DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error {
+	if err := s.claim(message); err != nil {
+		return err
+	}
+	return s.MessageSettler.DeadLetterMessage(ctx, message, options)
+}
+
+func (s *drainSettler) DeferMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions) error {
+	if err := s.claim(message); err != nil {
+		return err
+	}
+	return s.MessageSettler.DeferMessage(ctx, message, options)
+}
+
+// ManagedProcessor runs a processor and drains it gracefully: once stopped, no more messages are
+// received, the handlers being run get DrainTimeout to finish, and the messages still being
+// handled after that are canceled and abandoned, and their operations set back to PENDING once
+// the handlers return, so they can be picked up by another worker. The handlers must be wrapped
+// with Wrap, since they run on a context that isn't canceled when the processor stops.
+type ManagedProcessor struct {
+	Runner  Runner
+	Options ManagedProcessorOptions
+
+	operationContainer oc.OperationContainerClient
+	marshaller         shuttle.Marshaller
+
+	inFlight map[*inFlightMessage]struct{}
+	draining bool
+	// Closed and replaced every time a handler finishes.
+	finished chan struct{}
+	stats    DrainStats
+	mu       sync.Mutex
+}
+
+func NewManagedProcessor(operationContainer oc.OperationContainerClient, marshaller shuttle.Marshaller, options *ManagedProcessorOptions) *ManagedProcessor {
+	if marshaller == nil {
+		marshaller = &shuttle.DefaultProtoMarshaller{}
+	}
+
+	m := &ManagedProcessor{
+		operationContainer: operationContainer,
+		marshaller:         marshaller,
+		inFlight:           make(map[*inFlightMessage]struct{}),
+		finished:           make(chan struct{}),
+	}
+	if options != nil {
+		m.Options = *options
+	}
+	if m.Options.DrainTimeout <= 0 {
+		m.Options.DrainTimeout = DefaultDrainTimeout
+	}
+	if m.Options.CancelTimeout <= 0 {
+		m.Options.CancelTimeout = DefaultCancelTimeout
+	}
+	if m.Options.Signals == nil {
+		m.Options.Signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	return m
+}
+
+// Same as CreateProcessor, but the processor is drained gracefully when stopped.
+func CreateManagedProcessor(
+	serviceBusReceiver sb.ReceiverInterface,
+	matcher *matcher.Matcher,
+	operationContainer oc.OperationContainerClient,
+	entityController ec.EntityController,
+	logger *slog.Logger,
+	customHandler shuttle.HandlerFunc,
+	processorOptions *shuttle.ProcessorOptions,
+	marshaller shuttle.Marshaller,
+	hooks []hooks.BaseOperationHooksInterface,
+	options *ManagedProcessorOptions,
+) (*ManagedProcessor, error) {
+
+	if serviceBusReceiver == nil {
+		return nil, errors.New("No serviceBusReceiver received.")
+	}
+
+	if matcher == nil {
+		return nil, errors.New("No matcher received.")
+	}
+
+	m := NewManagedProcessor(operationContainer, marshaller, options)
+
+	if customHandler == nil {
+		customHandler = handlers.DefaultHandlers(serviceBusReceiver, matcher, operationContainer, entityController, logger, hooks, marshaller)
+	}
+
+	p, err := CreateProcessor(serviceBusReceiver, matcher, operationContainer, entityController, logger, m.Wrap(customHandler), processorOptions, marshaller, hooks)
+	if err != nil {
+		return nil, err
+	}
+	m.Runner = p
+
+	return m, nil
+}
+
+// Returns the number of messages being handled.
+func (m *ManagedProcessor) InFlight() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.inFlight)
+}
+
+// Wraps the handler so its messages are tracked and drained.
+func (m *ManagedProcessor) Wrap(handler shuttle.HandlerFunc) shuttle.HandlerFunc {
+	return func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+		logger := ctxlogger.GetLogger(ctx)
+
+		// The operation must keep running when the processor stops receiving.
+		handlerCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+		defer cancel(nil)
+
+		inFlight := &inFlightMessage{
+			message: message,
+			settler: settler,
+			cancel:  cancel,
+		}
+
+		m.mu.Lock()
+		if m.draining {
+			m.stats.Abandoned++
+			m.mu.Unlock()
+			logger.Info("ManagedProcessor: Abandoning message received while draining.")
+			err := settler.AbandonMessage(handlerCtx, message, nil)
+			if err != nil {
+				logger.Error("ManagedProcessor: Error abandoning message: " + err.Error())
+				m.mu.Lock()
+				m.stats.Errors++
+				m.mu.Unlock()
+			}
+			return
+		}
+		m.inFlight[inFlight] = struct{}{}
+		m.mu.Unlock()
+
+		defer func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			delete(m.inFlight, inFlight)
+			close(m.finished)
+			m.finished = make(chan struct{})
+		}()
+
+		handler(handlerCtx, &drainSettler{MessageSettler: settler, inFlight: inFlight}, message)
+	}
+}
+
+// Runs the processor until the context is canceled, one of the signals is received or the
+// processor fails, then drains it. Returns the drain statistics and the error of the processor,
+// if it failed.
+func (m *ManagedProcessor) Start(ctx context.Context) (*DrainStats, error) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if m.Runner == nil {
+		return nil, errors.New("No runner received.")
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	if len(m.Options.Signals) > 0 {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, m.Options.Signals...)
+		defer signal.Stop(signals)
+		go func() {
+			select {
+			case s := <-signals:
+				logger.Info("ManagedProcessor: Received signal " + s.String() + ", stopping.")
+				stop()
+			case <-runCtx.Done():
+			}
+		}()
+	}
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- m.Runner.Start(runCtx)
+	}()
+
+	var err error
+	select {
+	case err = <-runErr:
+		if err != nil {
+			logger.Error("ManagedProcessor: Processor stopped: " + err.Error())
+		}
+		stop()
+	case <-runCtx.Done():
+	}
+
+	stats := m.drain(context.WithoutCancel(ctx))
+
+	// The processor stops receiving as soon as the context is canceled. Its error is only
+	// reported if it failed on its own.
+	if err != nil && ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// Waits for the messages being handled until the drain timeout, then abandons the rest.
+func (m *ManagedProcessor) drain(ctx context.Context) *DrainStats {
+	logger := ctxlogger.GetLogger(ctx)
+	start := time.Now()
+
+	m.mu.Lock()
+	m.draining = true
+	m.stats.InFlight = len(m.inFlight)
+	inFlightCount := m.stats.InFlight
+	m.mu.Unlock()
+
+	logger.Info(fmt.Sprintf("ManagedProcessor: Draining %d messages.", inFlightCount))
+
+	m.waitUntil(m.Options.DrainTimeout, func() bool {
+		return len(m.inFlight) == 0
+	})
+
+	m.mu.Lock()
+	remaining := make([]*inFlightMessage, 0, len(m.inFlight))
+	for inFlight := range m.inFlight {
+		remaining = append(remaining, inFlight)
+	}
+	m.mu.Unlock()
+
+	abandoned, markedPending, errCount := 0, 0, 0
+	canceled := make([]*inFlightMessage, 0, len(remaining))
+	for _, inFlight := range remaining {
+		if !inFlight.settled.CompareAndSwap(false, true) {
+			continue
+		}
+		inFlight.cancel(ErrDrainTimeout)
+		canceled = append(canceled, inFlight)
+		abandoned++
+
+		err := inFlight.settler.AbandonMessage(ctx, inFlight.message, nil)
+		if err != nil {
+			logger.Error("ManagedProcessor: Error abandoning message: " + err.Error())
+			errCount++
+		}
+	}
+
+	if m.operationContainer != nil && len(canceled) > 0 {
+		// The canceled handlers may still update their operations, e.g. as failed, so they are set
+		// back to PENDING once the handlers return.
+		returned := m.waitUntil(m.Options.CancelTimeout, func() bool {
+			for _, inFlight := range canceled {
+				if _, ok := m.inFlight[inFlight]; ok {
+					return false
+				}
+			}
+			return true
+		})
+		if !returned {
+			logger.Error("ManagedProcessor: Canceled handlers didn't return before the cancel timeout.")
+		}
+
+		for _, inFlight := range canceled {
+			err := m.setPending(ctx, inFlight.message)
+			if err != nil {
+				logger.Error("ManagedProcessor: Error setting operation as Pending: " + err.Error())
+				errCount++
+				continue
+			}
+			markedPending++
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Abandoned += abandoned
+	m.stats.MarkedPending += markedPending
+	m.stats.Errors += errCount
+	m.stats.Completed = m.stats.InFlight - len(remaining)
+	m.stats.Duration = time.Since(start)
+
+	stats := m.stats
+	logger.Info(fmt.Sprintf("ManagedProcessor: Drained, %d completed, %d abandoned, %d marked pending, %d errors in %s.", stats.Completed, stats.Abandoned, stats.MarkedPending, stats.Errors, stats.Duration))
+	return &stats
+}
+
+// Waits until the condition, checked with the lock held every time a handler finishes, is met or the
+// timeout expires. Returns whether the condition was met.
+func (m *ManagedProcessor) waitUntil(timeout time.Duration, condition func() bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		m.mu.Lock()
+		done := condition()
+		finished := m.finished
+		m.mu.Unlock()
+
+		if done {
+			return true
+		}
+
+		select {
+		case <-finished:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+func (m *ManagedProcessor) setPending(ctx context.Context, message *azservicebus.ReceivedMessage) error {
+	var body operation.OperationRequest
+	err := m.marshaller.Unmarshal(message.Message(), &body)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.operationContainer.UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+		OperationId: body.OperationId,
+		Status:      oc.Status_PENDING,
+	})
+	return err
+}
@@ -0,0 +1,198 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	ocMock "github.com/Azure/OperationContainer/api/v1/mock"
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/testutils/settler"
+	"github.com/Azure/aks-async/runtime/testutils/toolkit/convert"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/go-shuttle/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+// Records the abandoned messages.
+type abandonRecorder struct {
+	settler.SampleMessageSettler
+	mu        sync.Mutex
+	abandoned int
+}
+
+func (s *abandonRecorder) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abandoned++
+	return nil
+}
+
+// Runner handling the given messages, then waiting to be stopped.
+type sampleRunner struct {
+	handler  shuttle.HandlerFunc
+	settler  shuttle.MessageSettler
+	messages []*azservicebus.ReceivedMessage
+	err      error
+}
+
+func (r *sampleRunner) Start(ctx context.Context) error {
+	if r.err != nil {
+		return r.err
+	}
+	for _, message := range r.messages {
+		go r.handler(ctx, r.settler, message)
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+var _ = Describe("ManagedProcessor", func() {
+	var (
+		ctx       context.Context
+		cancel    context.CancelFunc
+		ctrl      *gomock.Controller
+		ocClient  *ocMock.MockOperationContainerClient
+		managed   *ManagedProcessor
+		recorder  *abandonRecorder
+		message   *azservicebus.ReceivedMessage
+		started   chan struct{}
+		release   chan struct{}
+		handlerCh chan error
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		ctrl = gomock.NewController(GinkgoT())
+		ocClient = ocMock.NewMockOperationContainerClient(ctrl)
+		managed = NewManagedProcessor(ocClient, nil, &ManagedProcessorOptions{DrainTimeout: 100 * time.Millisecond, Signals: []os.Signal{}})
+		recorder = &abandonRecorder{}
+
+		marshalledMessage, err := (&shuttle.DefaultProtoMarshaller{}).Marshal(&operation.OperationRequest{OperationName: "Upgrade", OperationId: "1"})
+		Expect(err).ToNot(HaveOccurred())
+		message = convert.ConvertToReceivedMessage(marshalledMessage)
+
+		started = make(chan struct{})
+		release = make(chan struct{})
+		handlerCh = make(chan error, 1)
+	})
+
+	AfterEach(func() {
+		cancel()
+		ctrl.Finish()
+	})
+
+	// Handler that waits to be released or canceled, then completes the message.
+	blockingHandler := func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		handlerCh <- settler.CompleteMessage(ctx, message, nil)
+	}
+
+	start := func(handler shuttle.HandlerFunc) (*DrainStats, error) {
+		managed.Runner = &sampleRunner{handler: managed.Wrap(handler), settler: recorder, messages: []*azservicebus.ReceivedMessage{message}}
+		go func() {
+			<-started
+			Expect(managed.InFlight()).To(Equal(1))
+			cancel()
+		}()
+		return managed.Start(ctx)
+	}
+
+	It("should wait for the messages being handled", func() {
+		go func() {
+			<-started
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+		}()
+		stats, err := start(blockingHandler)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.InFlight).To(Equal(1))
+		Expect(stats.Completed).To(Equal(1))
+		Expect(stats.Abandoned).To(Equal(0))
+		Expect(<-handlerCh).To(BeNil())
+		Expect(recorder.abandoned).To(Equal(0))
+	})
+
+	It("should abandon the messages still being handled after the drain timeout", func() {
+		ocClient.EXPECT().UpdateOperationStatus(gomock.Any(), &oc.UpdateOperationStatusRequest{OperationId: "1", Status: oc.Status_PENDING}).Return(nil, nil)
+
+		cause := make(chan error, 1)
+		stats, err := start(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+			blockingHandler(ctx, settler, message)
+			cause <- context.Cause(ctx)
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Completed).To(Equal(0))
+		Expect(stats.Abandoned).To(Equal(1))
+		Expect(stats.MarkedPending).To(Equal(1))
+		Expect(recorder.abandoned).To(Equal(1))
+
+		// The handler can't settle the message anymore.
+		Expect(<-handlerCh).To(Equal(&MessageAbandonedError{}))
+		Expect(<-cause).To(Equal(ErrDrainTimeout))
+	})
+
+	It("should set the operations as pending once the canceled handlers return", func() {
+		gomock.InOrder(
+			ocClient.EXPECT().UpdateOperationStatus(gomock.Any(), &oc.UpdateOperationStatusRequest{OperationId: "1", Status: oc.Status_FAILED}).Return(nil, nil),
+			ocClient.EXPECT().UpdateOperationStatus(gomock.Any(), &oc.UpdateOperationStatusRequest{OperationId: "1", Status: oc.Status_PENDING}).Return(nil, nil),
+		)
+
+		stats, err := start(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+			blockingHandler(ctx, settler, message)
+			// The handler reports the cancellation as a failure after the message was abandoned.
+			time.Sleep(20 * time.Millisecond)
+			_, _ = ocClient.UpdateOperationStatus(context.WithoutCancel(ctx), &oc.UpdateOperationStatusRequest{OperationId: "1", Status: oc.Status_FAILED})
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Abandoned).To(Equal(1))
+		Expect(stats.MarkedPending).To(Equal(1))
+	})
+
+	It("should set the operations as pending if the canceled handlers don't return", func() {
+		managed.Options.CancelTimeout = 10 * time.Millisecond
+		ocClient.EXPECT().UpdateOperationStatus(gomock.Any(), &oc.UpdateOperationStatusRequest{OperationId: "1", Status: oc.Status_PENDING}).Return(nil, nil)
+
+		stuck := make(chan struct{})
+		defer close(stuck)
+		stats, err := start(func(ctx context.Context, settler shuttle.MessageSettler, message *azservicebus.ReceivedMessage) {
+			blockingHandler(ctx, settler, message)
+			<-stuck
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.MarkedPending).To(Equal(1))
+	})
+
+	It("should count the errors setting the operations as pending", func() {
+		ocClient.EXPECT().UpdateOperationStatus(gomock.Any(), gomock.Any()).Return(nil, errors.New("unavailable"))
+
+		stats, err := start(blockingHandler)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Abandoned).To(Equal(1))
+		Expect(stats.MarkedPending).To(Equal(0))
+		Expect(stats.Errors).To(Equal(1))
+		Expect(<-handlerCh).ToNot(BeNil())
+	})
+
+	It("should abandon the messages received while draining", func() {
+		managed.draining = true
+		managed.Wrap(blockingHandler)(ctx, recorder, message)
+		Expect(recorder.abandoned).To(Equal(1))
+	})
+
+	It("should return the error of the processor", func() {
+		managed.Runner = &sampleRunner{err: errors.New("failed to start")}
+		stats, err := managed.Start(ctx)
+		Expect(err).To(MatchError("failed to start"))
+		Expect(stats.InFlight).To(Equal(0))
+	})
+})
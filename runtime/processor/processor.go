@@ -37,6 +37,11 @@ func CreateProcessor(
 		return nil, errors.New("No matcher received.")
 	}
 
+	// Reject any registration changes once the processor is running.
+	if matcher.FreezeOnStart {
+		matcher.Freeze()
+	}
+
 	// Define the default handler chain
 	// Use the default handler if a custom handler is not provided
 	if customHandler == nil {
@@ -51,17 +56,31 @@ func CreateProcessor(
 		}
 	}
 
-	azReceiver, err := serviceBusReceiver.GetAzureReceiver()
+	receiver, err := getProcessorReceiver(serviceBusReceiver)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create the processor using the (potentially custom) handler
 	p := shuttle.NewProcessor(
-		azReceiver,
+		receiver,
 		customHandler,
 		processorOptions,
 	)
 
 	return p, nil
 }
+
+// Receivers wrapping the azure receiver, like the ones of health.Monitor, implement
+// shuttle.Receiver so the processor receives through them.
+func getProcessorReceiver(serviceBusReceiver sb.ReceiverInterface) (shuttle.Receiver, error) {
+	if receiver, ok := serviceBusReceiver.(shuttle.Receiver); ok {
+		return receiver, nil
+	}
+
+	azReceiver, err := serviceBusReceiver.GetAzureReceiver()
+	if err != nil {
+		return nil, err
+	}
+	return azReceiver, nil
+}
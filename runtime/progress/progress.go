@@ -0,0 +1,174 @@
+package progress
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+)
+
+// Default minimum time between two progress updates being persisted.
+const DefaultMinInterval = 5 * time.Second
+
+// Progress is the partial progress reported by a long running operation.
+type Progress struct {
+	OperationId     string
+	OperationName   string
+	PercentComplete int
+	Message         string
+	Timestamp       time.Time
+}
+
+// Sink persists the progress reported by the operations.
+type Sink interface {
+	SaveProgress(ctx context.Context, progress *Progress) error
+}
+
+// SinkFunc allows the use of a simple function as a Sink, e.g. to record the progress as a metric.
+type SinkFunc func(ctx context.Context, progress *Progress) error
+
+func (f SinkFunc) SaveProgress(ctx context.Context, progress *Progress) error {
+	return f(ctx, progress)
+}
+
+// MultiSink forwards the progress to all of its sinks, returning the first error found.
+type MultiSink []Sink
+
+func (m MultiSink) SaveProgress(ctx context.Context, progress *Progress) error {
+	var firstErr error
+	for _, sink := range m {
+		err := sink.SaveProgress(ctx, progress)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// LogSink logs the progress using the logger in the context.
+type LogSink struct{}
+
+func (s *LogSink) SaveProgress(ctx context.Context, progress *Progress) error {
+	logger := ctxlogger.GetLogger(ctx)
+	logger.With(
+		"operation_id", progress.OperationId,
+		"operation_name", progress.OperationName,
+		"percent_complete", progress.PercentComplete,
+		"timestamp", progress.Timestamp.String(),
+	).Info("Progress: " + progress.Message)
+	return nil
+}
+
+// OperationContainerSink refreshes the IN_PROGRESS status of the operation in the
+// OperationContainer every time progress is reported. The OperationContainer API doesn't
+// store the percentage or message yet, so this sink acts as a heartbeat and is usually
+// combined with another sink through a MultiSink.
+type OperationContainerSink struct {
+	OperationContainer oc.OperationContainerClient
+}
+
+func (s *OperationContainerSink) SaveProgress(ctx context.Context, progress *Progress) error {
+	_, err := s.OperationContainer.UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+		OperationId: progress.OperationId,
+		Status:      oc.Status_IN_PROGRESS,
+	})
+	return err
+}
+
+type InvalidPercentError struct {
+	Percent int
+}
+
+func (e *InvalidPercentError) Error() string {
+	return fmt.Sprintf("Percent %d is not between 0 and 100.", e.Percent)
+}
+
+// ProgressReporter is injected into the context passed to ApiOperation.Run, and lets the
+// operation report its progress. Reports are throttled so that only one report every
+// minInterval is persisted, except for the report that completes the operation (100%).
+// A minInterval of 0 disables the throttling.
+type ProgressReporter struct {
+	sink          Sink
+	minInterval   time.Duration
+	operationId   string
+	operationName string
+
+	lastSaved time.Time
+	last      *Progress
+	mu        sync.Mutex
+}
+
+func NewProgressReporter(sink Sink, req *operation.OperationRequest, minInterval time.Duration) *ProgressReporter {
+	reporter := &ProgressReporter{
+		sink:        sink,
+		minInterval: minInterval,
+	}
+	if req != nil {
+		reporter.operationId = req.OperationId
+		reporter.operationName = req.OperationName
+	}
+	return reporter
+}
+
+// Report publishes the percent complete and a status message. Reports received before
+// minInterval has passed since the last persisted report are dropped.
+func (r *ProgressReporter) Report(ctx context.Context, percent int, message string) error {
+	if percent < 0 || percent > 100 {
+		return &InvalidPercentError{Percent: percent}
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	progress := &Progress{
+		OperationId:     r.operationId,
+		OperationName:   r.operationName,
+		PercentComplete: percent,
+		Message:         message,
+		Timestamp:       now,
+	}
+	r.last = progress
+
+	throttled := !r.lastSaved.IsZero() && now.Sub(r.lastSaved) < r.minInterval && percent != 100
+	if throttled || r.sink == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	r.lastSaved = now
+	r.mu.Unlock()
+
+	return r.sink.SaveProgress(ctx, progress)
+}
+
+// Last returns the last progress reported by the operation, even if it was throttled.
+func (r *ProgressReporter) Last() *Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.last
+}
+
+type progressReporterKey struct{}
+
+// WithProgressReporter returns a copy of the context holding the reporter.
+func WithProgressReporter(ctx context.Context, reporter *ProgressReporter) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, reporter)
+}
+
+// GetProgressReporter returns the reporter stored in the context. If there is none, a reporter
+// without a sink is returned so operations can always report their progress.
+func GetProgressReporter(ctx context.Context) *ProgressReporter {
+	if reporter, ok := ctx.Value(progressReporterKey{}).(*ProgressReporter); ok && reporter != nil {
+		return reporter
+	}
+	return NewProgressReporter(nil, nil, 0)
+}
+
+// ReportProgress is a shortcut for GetProgressReporter(ctx).Report(ctx, percent, message).
+// Ex: progress.ReportProgress(ctx, 50, "Upgraded 3 out of 6 node pools.")
+func ReportProgress(ctx context.Context, percent int, message string) error {
+	return GetProgressReporter(ctx).Report(ctx, percent, message)
+}
@@ -0,0 +1,88 @@
+package progress
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestProgress(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Progress Suite")
+}
+
+var _ = Describe("Progress", func() {
+	var (
+		ctx   context.Context
+		req   *operation.OperationRequest
+		saved []*Progress
+		sink  Sink
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		req = &operation.OperationRequest{
+			OperationName: "SampleOperation",
+			OperationId:   "0",
+		}
+		saved = []*Progress{}
+		sink = SinkFunc(func(ctx context.Context, progress *Progress) error {
+			saved = append(saved, progress)
+			return nil
+		})
+	})
+
+	It("should persist the progress with the operation information", func() {
+		reporter := NewProgressReporter(sink, req, 0)
+		err := reporter.Report(ctx, 10, "Starting.")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(saved).To(HaveLen(1))
+		Expect(saved[0].OperationId).To(Equal("0"))
+		Expect(saved[0].OperationName).To(Equal("SampleOperation"))
+		Expect(saved[0].PercentComplete).To(Equal(10))
+		Expect(saved[0].Message).To(Equal("Starting."))
+	})
+
+	It("should throttle reports except the final one", func() {
+		reporter := NewProgressReporter(sink, req, time.Hour)
+		Expect(reporter.Report(ctx, 10, "Starting.")).To(Succeed())
+		Expect(reporter.Report(ctx, 20, "Still going.")).To(Succeed())
+		Expect(saved).To(HaveLen(1))
+		Expect(reporter.Last().PercentComplete).To(Equal(20))
+
+		Expect(reporter.Report(ctx, 100, "Done.")).To(Succeed())
+		Expect(saved).To(HaveLen(2))
+		Expect(saved[1].PercentComplete).To(Equal(100))
+	})
+
+	It("should reject invalid percentages", func() {
+		reporter := NewProgressReporter(sink, req, 0)
+		err := reporter.Report(ctx, 101, "Too much.")
+		var percentErr *InvalidPercentError
+		Expect(errors.As(err, &percentErr)).To(BeTrue())
+		Expect(saved).To(BeEmpty())
+	})
+
+	It("should use the reporter in the context", func() {
+		ctx = WithProgressReporter(ctx, NewProgressReporter(sink, req, 0))
+		Expect(ReportProgress(ctx, 50, "Halfway there.")).To(Succeed())
+		Expect(saved).To(HaveLen(1))
+	})
+
+	It("should not fail if there is no reporter in the context", func() {
+		Expect(ReportProgress(ctx, 50, "Halfway there.")).To(Succeed())
+		Expect(saved).To(BeEmpty())
+	})
+
+	It("should forward the progress to every sink", func() {
+		multiSink := MultiSink{sink, sink, &LogSink{}}
+		reporter := NewProgressReporter(multiSink, req, 0)
+		Expect(reporter.Report(ctx, 50, "Halfway there.")).To(Succeed())
+		Expect(saved).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,208 @@
+package result
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// Application property set in the reply messages so the caller can match the reply
+// with the operation even if the CorrelationId is not available.
+const OperationIdProperty = "OperationId"
+
+// Application properties set in the reply messages with the outcome of the operation. The
+// ErrorProperty is only set in the replies of failed operations.
+const (
+	StatusProperty = "Status"
+	ErrorProperty  = "Error"
+)
+
+// Values of the StatusProperty of the reply messages.
+const (
+	StatusSucceeded = "Succeeded"
+	StatusFailed    = "Failed"
+)
+
+// Store is used to persist the results of the operations so the caller can retrieve them later.
+// The OperationContainer only keeps track of the status of an operation, so the result has to be
+// stored somewhere else, typically a database.
+type Store interface {
+	SaveResult(ctx context.Context, result *operation.OperationResult) error
+	GetResult(ctx context.Context, operationId string) (*operation.OperationResult, error)
+}
+
+type ResultNotFoundError struct {
+	OperationId string
+}
+
+func (e *ResultNotFoundError) Error() string {
+	return fmt.Sprintf("No result found for operation %s.", e.OperationId)
+}
+
+var _ Store = &InMemoryStore{}
+
+// InMemoryStore keeps the results in memory. Useful for testing or single instance workers.
+type InMemoryStore struct {
+	results map[string]*operation.OperationResult
+	mu      sync.RWMutex
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		results: make(map[string]*operation.OperationResult),
+	}
+}
+
+func (s *InMemoryStore) SaveResult(ctx context.Context, result *operation.OperationResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.results[result.OperationId] = result
+	return nil
+}
+
+func (s *InMemoryStore) GetResult(ctx context.Context, operationId string) (*operation.OperationResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result, ok := s.results[operationId]
+	if !ok {
+		return nil, &ResultNotFoundError{OperationId: operationId}
+	}
+	return result, nil
+}
+
+// The Publisher publishes the result of an operation. It persists the result in the Store, if
+// one was provided, and sends a reply message to the ReplyTo queue of the original message, if
+// the caller set one, enabling request/response style async calls.
+type Publisher struct {
+	Store            Store
+	ServiceBusClient sb.ServiceBusClientInterface
+
+	senders map[string]sb.SenderInterface
+	mu      sync.Mutex
+}
+
+func NewPublisher(store Store, serviceBusClient sb.ServiceBusClientInterface) *Publisher {
+	return &Publisher{
+		Store:            store,
+		ServiceBusClient: serviceBusClient,
+		senders:          make(map[string]sb.SenderInterface),
+	}
+}
+
+// Publish saves the result and sends the reply right away. Use SaveResult and Reply to send the
+// reply only once the operation is committed.
+func (p *Publisher) Publish(ctx context.Context, message *azservicebus.ReceivedMessage, result *operation.OperationResult) error {
+	err := p.SaveResult(ctx, result)
+	if err != nil {
+		return err
+	}
+
+	return p.Reply(ctx, message, NewReplyMessage(message, result))
+}
+
+// SaveResult persists the result in the Store, if one was provided.
+func (p *Publisher) SaveResult(ctx context.Context, result *operation.OperationResult) error {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if p.Store == nil {
+		return nil
+	}
+
+	logger.Info("Publisher: Saving result of operation " + result.OperationId)
+	err := p.Store.SaveResult(ctx, result)
+	if err != nil {
+		logger.Error("Publisher: Error saving result: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Reply sends the reply to the ReplyTo queue of the original message. Nothing is sent if the
+// caller didn't set one or the Publisher has no ServiceBusClient.
+func (p *Publisher) Reply(ctx context.Context, message *azservicebus.ReceivedMessage, reply *azservicebus.Message) error {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if p.ServiceBusClient == nil || message.ReplyTo == nil || *message.ReplyTo == "" {
+		return nil
+	}
+
+	sender, err := p.getSender(ctx, *message.ReplyTo)
+	if err != nil {
+		logger.Error("Publisher: Error creating reply sender: " + err.Error())
+		return err
+	}
+
+	logger.Info("Publisher: Sending reply to " + *message.ReplyTo)
+	err = sender.SendMessage(ctx, reply)
+	if err != nil {
+		logger.Error("Publisher: Error sending reply: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (p *Publisher) getSender(ctx context.Context, queue string) (sb.SenderInterface, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.senders == nil {
+		p.senders = make(map[string]sb.SenderInterface)
+	}
+
+	if sender, ok := p.senders[queue]; ok {
+		return sender, nil
+	}
+
+	sender, err := p.ServiceBusClient.NewServiceBusSender(ctx, queue, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.senders[queue] = sender
+	return sender, nil
+}
+
+// Creates the reply message for the original message. The CorrelationID of the reply is set to
+// the MessageID of the original message and the SessionID to its ReplyToSessionID.
+func NewReplyMessage(message *azservicebus.ReceivedMessage, result *operation.OperationResult) *azservicebus.Message {
+	messageId := message.MessageID
+	reply := &azservicebus.Message{
+		Body:          result.Body,
+		CorrelationID: &messageId,
+		SessionID:     message.ReplyToSessionID,
+		ApplicationProperties: map[string]any{
+			OperationIdProperty: result.OperationId,
+			StatusProperty:      StatusSucceeded,
+		},
+	}
+
+	if result.ContentType != "" {
+		contentType := result.ContentType
+		reply.ContentType = &contentType
+	}
+
+	return reply
+}
+
+// Creates the reply message sent when the operation failed for good, so the caller doesn't wait
+// for a reply that will never come.
+func NewFailureReplyMessage(message *azservicebus.ReceivedMessage, operationId string, errorMessage string) *azservicebus.Message {
+	messageId := message.MessageID
+	return &azservicebus.Message{
+		CorrelationID: &messageId,
+		SessionID:     message.ReplyToSessionID,
+		ApplicationProperties: map[string]any{
+			OperationIdProperty: operationId,
+			StatusProperty:      StatusFailed,
+			ErrorProperty:       errorMessage,
+		},
+	}
+}
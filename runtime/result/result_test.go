@@ -0,0 +1,119 @@
+package result
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/aks-async/runtime/operation"
+	sb "github.com/Azure/aks-async/servicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestResult(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Result Suite")
+}
+
+var _ = Describe("Result", func() {
+	var (
+		ctx     context.Context
+		store   *InMemoryStore
+		client  *sb.FakeServiceBusClient
+		res     *operation.OperationResult
+		message *azservicebus.ReceivedMessage
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = NewInMemoryStore()
+		client = sb.NewFakeServiceBusClient()
+		res = &operation.OperationResult{
+			OperationId: "0",
+			Body:        []byte("result"),
+			ContentType: "text/plain",
+		}
+		message = &azservicebus.ReceivedMessage{
+			MessageID: "message-0",
+		}
+	})
+
+	Context("InMemoryStore", func() {
+		It("should save and retrieve a result", func() {
+			err := store.SaveResult(ctx, res)
+			Expect(err).ToNot(HaveOccurred())
+
+			retrieved, err := store.GetResult(ctx, "0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(retrieved).To(Equal(res))
+		})
+
+		It("should fail if the result doesn't exist", func() {
+			retrieved, err := store.GetResult(ctx, "0")
+			Expect(retrieved).To(BeNil())
+			var notFoundErr *ResultNotFoundError
+			Expect(errors.As(err, &notFoundErr)).To(BeTrue())
+		})
+	})
+
+	Context("Publisher", func() {
+		It("should only store the result if there is no ReplyTo", func() {
+			publisher := NewPublisher(store, client)
+			err := publisher.Publish(ctx, message, res)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = store.GetResult(ctx, "0")
+			Expect(err).ToNot(HaveOccurred())
+
+			receiver, _ := client.NewServiceBusReceiver(ctx, "", nil)
+			_, err = receiver.ReceiveMessage(ctx, 1, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should send a reply to the ReplyTo queue", func() {
+			replyTo := "replies"
+			sessionId := "session-0"
+			message.ReplyTo = &replyTo
+			message.ReplyToSessionID = &sessionId
+
+			publisher := NewPublisher(nil, client)
+			err := publisher.Publish(ctx, message, res)
+			Expect(err).ToNot(HaveOccurred())
+
+			receiver, _ := client.NewServiceBusReceiver(ctx, replyTo, nil)
+			replies, err := receiver.ReceiveMessage(ctx, 1, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(replies).To(HaveLen(1))
+			Expect(replies[0].Body).To(Equal(res.Body))
+			Expect(*replies[0].CorrelationID).To(Equal(message.MessageID))
+			Expect(*replies[0].SessionID).To(Equal(sessionId))
+			Expect(*replies[0].ContentType).To(Equal("text/plain"))
+			Expect(replies[0].ApplicationProperties[OperationIdProperty]).To(Equal("0"))
+			Expect(replies[0].ApplicationProperties[StatusProperty]).To(Equal(StatusSucceeded))
+		})
+
+		It("should only send the reply once asked to", func() {
+			replyTo := "replies"
+			message.ReplyTo = &replyTo
+
+			publisher := NewPublisher(store, client)
+			Expect(publisher.SaveResult(ctx, res)).To(Succeed())
+			_, err := store.GetResult(ctx, "0")
+			Expect(err).ToNot(HaveOccurred())
+
+			receiver, _ := client.NewServiceBusReceiver(ctx, replyTo, nil)
+			_, err = receiver.ReceiveMessage(ctx, 1, nil)
+			Expect(err).To(HaveOccurred())
+
+			Expect(publisher.Reply(ctx, message, NewFailureReplyMessage(message, "0", "Operation failed."))).To(Succeed())
+			replies, err := receiver.ReceiveMessage(ctx, 1, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(replies).To(HaveLen(1))
+			Expect(*replies[0].CorrelationID).To(Equal(message.MessageID))
+			Expect(replies[0].ApplicationProperties[StatusProperty]).To(Equal(StatusFailed))
+			Expect(replies[0].ApplicationProperties[ErrorProperty]).To(Equal("Operation failed."))
+		})
+	})
+})
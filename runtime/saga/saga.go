@@ -0,0 +1,396 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+)
+
+// Step is a unit of work of the saga, with the compensation that undoes it.
+type Step struct {
+	Name string
+	// Action runs the step. A RetryError will make the saga continue from this step on the next
+	// delivery of the message, while a NonRetryError will compensate the completed steps.
+	Action func(ctx context.Context) *errors.AsyncError
+	// Compensate undoes the Action. Can be nil if there is nothing to undo.
+	Compensate func(ctx context.Context) *errors.AsyncError
+}
+
+// Creates a step out of initialized operations, running the action operation and, if needed,
+// the compensation operation.
+func NewOperationStep(name string, action operation.ApiOperation, compensation operation.ApiOperation) Step {
+	step := Step{
+		Name:   name,
+		Action: action.Run,
+	}
+	if compensation != nil {
+		step.Compensate = compensation.Run
+	}
+	return step
+}
+
+type Status string
+
+const (
+	StatusRunning            Status = "Running"
+	StatusCompleted          Status = "Completed"
+	StatusCompensating       Status = "Compensating"
+	StatusCompensated        Status = "Compensated"
+	StatusCompensationFailed Status = "CompensationFailed"
+)
+
+// State of a saga, persisted after every step so the saga can continue across message deliveries.
+type State struct {
+	OperationId      string
+	Status           Status
+	CompletedSteps   []string
+	CompensatedSteps []string
+	FailedStep       string
+	Error            string
+	// Time the state was last saved, set by the store.
+	UpdatedAt time.Time
+}
+
+// Finished returns true if the saga completed or finished compensating, so it won't run again.
+func (s *State) Finished() bool {
+	switch s.Status {
+	case StatusCompleted, StatusCompensated, StatusCompensationFailed:
+		return true
+	}
+	return false
+}
+
+// Default time the state of a finished saga is kept, so a redelivered message reports its final
+// status again instead of running the saga from the beginning.
+const DefaultRetention = 24 * time.Hour
+
+// Default interval between two prunes of the finished sagas.
+const DefaultPruneInterval = time.Hour
+
+// Store persists the state of the sagas.
+type Store interface {
+	// GetState returns the state of the saga, or nil if the saga hasn't started yet.
+	GetState(ctx context.Context, operationId string) (*State, error)
+	SaveState(ctx context.Context, state *State) error
+	// Deletes the state of the sagas that finished more than retention ago. Returns the number of
+	// states deleted.
+	Prune(ctx context.Context, retention time.Duration) (int, error)
+}
+
+var _ Store = &InMemoryStore{}
+
+// InMemoryStore keeps the state of the sagas in memory. Useful for testing.
+type InMemoryStore struct {
+	states map[string]State
+	mu     sync.RWMutex
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		states: make(map[string]State),
+	}
+}
+
+func (s *InMemoryStore) GetState(ctx context.Context, operationId string) (*State, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state, ok := s.states[operationId]
+	if !ok {
+		return nil, nil
+	}
+	state.CompletedSteps = slices.Clone(state.CompletedSteps)
+	state.CompensatedSteps = slices.Clone(state.CompensatedSteps)
+	return &state, nil
+}
+
+func (s *InMemoryStore) SaveState(ctx context.Context, state *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *state
+	saved.CompletedSteps = slices.Clone(state.CompletedSteps)
+	saved.CompensatedSteps = slices.Clone(state.CompensatedSteps)
+	saved.UpdatedAt = time.Now()
+	s.states[state.OperationId] = saved
+	return nil
+}
+
+func (s *InMemoryStore) Prune(ctx context.Context, retention time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finishedBefore := time.Now().Add(-retention)
+	pruned := 0
+	for operationId, state := range s.states {
+		if state.Finished() && state.UpdatedAt.Before(finishedBefore) {
+			delete(s.states, operationId)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// Prune deletes the state of the finished sagas every interval until the context is cancelled.
+// The state is kept for the retention, DefaultRetention if it's 0 or less, so it must be longer
+// than the time a message of the saga can be redelivered.
+func Prune(ctx context.Context, store Store, retention time.Duration, interval time.Duration) {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	if interval <= 0 {
+		interval = DefaultPruneInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruned, err := store.Prune(ctx, retention)
+			if err != nil {
+				logger.Error("Saga: Error pruning the finished sagas: " + err.Error())
+				continue
+			}
+			if pruned > 0 {
+				logger.Info(fmt.Sprintf("Saga: Pruned %d finished sagas.", pruned))
+			}
+		}
+	}
+}
+
+// A Saga runs its steps in order and, if one of them fails with a NonRetryError, runs the
+// compensations of the completed steps in reverse order. The state is saved after every step,
+// so the saga can be resumed when the message is redelivered after a RetryError. The state of a
+// finished saga is kept, so a redelivered message only reports its final status again, until it's
+// deleted by Prune.
+//
+// Operations simply create the saga in InitOperation and call it from Run:
+//
+//	func (op *CreateCluster) Run(ctx context.Context) *errors.AsyncError {
+//		return op.saga.Run(ctx, op.opReq)
+//	}
+type Saga struct {
+	Steps []Step
+	Store Store
+	// If set, the final state of the saga is reported to the OperationContainer. Not required if
+	// the OperationContainerHandler is already part of the handler chain.
+	OperationContainer oc.OperationContainerClient
+}
+
+func NewSaga(store Store, operationContainer oc.OperationContainerClient, steps ...Step) *Saga {
+	return &Saga{
+		Steps:              steps,
+		Store:              store,
+		OperationContainer: operationContainer,
+	}
+}
+
+type StepNotFoundError struct {
+	Step string
+}
+
+func (e *StepNotFoundError) Error() string {
+	return fmt.Sprintf("The step %s doesn't exist in the saga.", e.Step)
+}
+
+// Run executes the saga for the operation request, continuing from its saved state.
+func (s *Saga) Run(ctx context.Context, req *operation.OperationRequest) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	state, err := s.Store.GetState(ctx, req.OperationId)
+	if err != nil {
+		logger.Error("Saga: Error getting the saga state: " + err.Error())
+		return storeError(err)
+	}
+	if state == nil {
+		state = &State{
+			OperationId: req.OperationId,
+			Status:      StatusRunning,
+		}
+	}
+
+	// A finished saga reports its status again, since the report may have failed on the previous
+	// delivery.
+	switch state.Status {
+	case StatusCompleted:
+		logger.Info("Saga: Saga already completed.")
+		return s.report(ctx, state, oc.Status_SUCCEEDED, nil)
+	case StatusCompensated, StatusCompensationFailed:
+		logger.Info("Saga: Saga already finished with status " + string(state.Status))
+		return s.report(ctx, state, oc.Status_FAILED, terminalError(state))
+	case StatusRunning:
+		asyncErr := s.runSteps(ctx, state)
+		if asyncErr != nil {
+			return asyncErr
+		}
+		if state.Status == StatusCompleted {
+			return s.report(ctx, state, oc.Status_SUCCEEDED, nil)
+		}
+	}
+
+	return s.compensate(ctx, state)
+}
+
+func (s *Saga) runSteps(ctx context.Context, state *State) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	for _, step := range s.Steps {
+		if slices.Contains(state.CompletedSteps, step.Name) {
+			continue
+		}
+
+		logger.Info("Saga: Running step " + step.Name)
+		asyncErr := step.Action(ctx)
+		if asyncErr != nil {
+			if _, ok := errors.Classify(asyncErr.OriginalError).(*errors.NonRetryError); ok {
+				logger.Error("Saga: Step " + step.Name + " failed, compensating: " + asyncErr.Error())
+				state.Status = StatusCompensating
+				state.FailedStep = step.Name
+				state.Error = asyncErr.Error()
+				return s.save(ctx, state)
+			}
+
+			logger.Error("Saga: Step " + step.Name + " failed, will retry: " + asyncErr.Error())
+			return asyncErr
+		}
+
+		state.CompletedSteps = append(state.CompletedSteps, step.Name)
+		saveErr := s.save(ctx, state)
+		if saveErr != nil {
+			return saveErr
+		}
+	}
+
+	state.Status = StatusCompleted
+	return s.save(ctx, state)
+}
+
+func (s *Saga) compensate(ctx context.Context, state *State) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	for i := len(state.CompletedSteps) - 1; i >= 0; i-- {
+		name := state.CompletedSteps[i]
+		if slices.Contains(state.CompensatedSteps, name) {
+			continue
+		}
+
+		step, found := s.getStep(name)
+		if !found {
+			notFoundErr := &StepNotFoundError{Step: name}
+			logger.Error("Saga: " + notFoundErr.Error())
+			state.Status = StatusCompensationFailed
+			state.Error = notFoundErr.Error()
+			return s.finish(ctx, state)
+		}
+
+		if step.Compensate != nil {
+			logger.Info("Saga: Compensating step " + name)
+			asyncErr := step.Compensate(ctx)
+			if asyncErr != nil {
+				if _, ok := errors.Classify(asyncErr.OriginalError).(*errors.NonRetryError); ok {
+					logger.Error("Saga: Compensation of step " + name + " failed: " + asyncErr.Error())
+					state.Status = StatusCompensationFailed
+					state.Error = asyncErr.Error()
+					return s.finish(ctx, state)
+				}
+
+				logger.Error("Saga: Compensation of step " + name + " failed, will retry: " + asyncErr.Error())
+				return asyncErr
+			}
+		}
+
+		state.CompensatedSteps = append(state.CompensatedSteps, name)
+		saveErr := s.save(ctx, state)
+		if saveErr != nil {
+			return saveErr
+		}
+	}
+
+	state.Status = StatusCompensated
+	return s.finish(ctx, state)
+}
+
+// Saves the terminal state of a failed saga and reports it.
+func (s *Saga) finish(ctx context.Context, state *State) *errors.AsyncError {
+	saveErr := s.save(ctx, state)
+	if saveErr != nil {
+		return saveErr
+	}
+
+	asyncErr := terminalError(state)
+	reportErr := s.report(ctx, state, oc.Status_FAILED, asyncErr)
+	if reportErr != nil {
+		return reportErr
+	}
+	return asyncErr
+}
+
+func (s *Saga) report(ctx context.Context, state *State, status oc.Status, asyncErr *errors.AsyncError) *errors.AsyncError {
+	if s.OperationContainer == nil {
+		return asyncErr
+	}
+
+	logger := ctxlogger.GetLogger(ctx)
+	logger.Info("Saga: Reporting status " + status.String() + " to the OperationContainer.")
+	_, err := s.OperationContainer.UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+		OperationId: state.OperationId,
+		Status:      status,
+	})
+	if err != nil {
+		logger.Error("Saga: Error updating the operation status: " + err.Error())
+		return &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Error reporting the saga status."},
+			Message:       err.Error(),
+			ErrorCode:     500,
+		}
+	}
+
+	return asyncErr
+}
+
+func (s *Saga) save(ctx context.Context, state *State) *errors.AsyncError {
+	err := s.Store.SaveState(ctx, state)
+	if err != nil {
+		ctxlogger.GetLogger(ctx).Error("Saga: Error saving the saga state: " + err.Error())
+		return storeError(err)
+	}
+	return nil
+}
+
+func (s *Saga) getStep(name string) (Step, bool) {
+	for _, step := range s.Steps {
+		if step.Name == name {
+			return step, true
+		}
+	}
+	return Step{}, false
+}
+
+func terminalError(state *State) *errors.AsyncError {
+	message := fmt.Sprintf("Saga %s after step %s failed: %s", state.Status, state.FailedStep, state.Error)
+	return &errors.AsyncError{
+		OriginalError: &errors.NonRetryError{Message: message},
+		Message:       message,
+		ErrorCode:     500,
+	}
+}
+
+func storeError(err error) *errors.AsyncError {
+	return &errors.AsyncError{
+		OriginalError: &errors.RetryError{Message: "Error accessing the saga state."},
+		Message:       err.Error(),
+		ErrorCode:     500,
+	}
+}
@@ -0,0 +1,223 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	ocMock "github.com/Azure/OperationContainer/api/v1/mock"
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSaga(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Saga Suite")
+}
+
+var _ = Describe("Saga", func() {
+	var (
+		ctrl        *gomock.Controller
+		ctx         context.Context
+		req         *operation.OperationRequest
+		store       *InMemoryStore
+		events      []string
+		failures    map[string]error
+		newStep     func(name string) Step
+		threeSteps  func() []Step
+		sampleSaga  *Saga
+		ocClient    *ocMock.MockOperationContainerClient
+		retryErr    error
+		nonRetryErr error
+	)
+
+	BeforeEach(func() {
+		ctrl = gomock.NewController(GinkgoT())
+		ctx = context.Background()
+		req = &operation.OperationRequest{OperationId: "0"}
+		store = NewInMemoryStore()
+		events = []string{}
+		failures = map[string]error{}
+		retryErr = &asyncErrors.RetryError{Message: "retry"}
+		nonRetryErr = &asyncErrors.NonRetryError{Message: "non retry"}
+		ocClient = ocMock.NewMockOperationContainerClient(ctrl)
+
+		newStep = func(name string) Step {
+			run := func(event string) func(context.Context) *asyncErrors.AsyncError {
+				return func(ctx context.Context) *asyncErrors.AsyncError {
+					if err, ok := failures[event]; ok {
+						return &asyncErrors.AsyncError{OriginalError: err}
+					}
+					events = append(events, event)
+					return nil
+				}
+			}
+			return Step{
+				Name:       name,
+				Action:     run(name),
+				Compensate: run("undo-" + name),
+			}
+		}
+		threeSteps = func() []Step {
+			return []Step{newStep("first"), newStep("second"), newStep("third")}
+		}
+		sampleSaga = NewSaga(store, nil, threeSteps()...)
+	})
+
+	AfterEach(func() {
+		ctrl.Finish()
+	})
+
+	It("should run all the steps", func() {
+		asyncErr := sampleSaga.Run(ctx, req)
+		Expect(asyncErr).To(BeNil())
+		Expect(events).To(Equal([]string{"first", "second", "third"}))
+
+		state, err := store.GetState(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Status).To(Equal(StatusCompleted))
+	})
+
+	It("should continue from the failed step after a RetryError", func() {
+		failures["second"] = retryErr
+		asyncErr := sampleSaga.Run(ctx, req)
+		Expect(errors.Is(asyncErr, retryErr)).To(BeTrue())
+		Expect(events).To(Equal([]string{"first"}))
+
+		delete(failures, "second")
+		asyncErr = sampleSaga.Run(ctx, req)
+		Expect(asyncErr).To(BeNil())
+		Expect(events).To(Equal([]string{"first", "second", "third"}))
+	})
+
+	It("should compensate in reverse order after a NonRetryError", func() {
+		failures["third"] = nonRetryErr
+		asyncErr := sampleSaga.Run(ctx, req)
+		Expect(asyncErr).ToNot(BeNil())
+		var terminalErr *asyncErrors.NonRetryError
+		Expect(errors.As(asyncErr, &terminalErr)).To(BeTrue())
+		Expect(events).To(Equal([]string{"first", "second", "undo-second", "undo-first"}))
+
+		state, err := store.GetState(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Status).To(Equal(StatusCompensated))
+		Expect(state.FailedStep).To(Equal("third"))
+	})
+
+	It("should retry a failed compensation on the next delivery", func() {
+		failures["third"] = nonRetryErr
+		failures["undo-first"] = retryErr
+		asyncErr := sampleSaga.Run(ctx, req)
+		Expect(errors.Is(asyncErr, retryErr)).To(BeTrue())
+		Expect(events).To(Equal([]string{"first", "second", "undo-second"}))
+
+		delete(failures, "undo-first")
+		asyncErr = sampleSaga.Run(ctx, req)
+		Expect(asyncErr).ToNot(BeNil())
+		Expect(events).To(Equal([]string{"first", "second", "undo-second", "undo-first"}))
+	})
+
+	It("should stop compensating if a compensation can't be retried", func() {
+		failures["third"] = nonRetryErr
+		failures["undo-second"] = nonRetryErr
+		asyncErr := sampleSaga.Run(ctx, req)
+		Expect(asyncErr).ToNot(BeNil())
+
+		state, err := store.GetState(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Status).To(Equal(StatusCompensationFailed))
+		Expect(events).To(Equal([]string{"first", "second"}))
+	})
+
+	It("should not run again after finishing", func() {
+		failures["second"] = nonRetryErr
+		_ = sampleSaga.Run(ctx, req)
+		events = []string{}
+
+		asyncErr := sampleSaga.Run(ctx, req)
+		Expect(asyncErr).ToNot(BeNil())
+		Expect(events).To(BeEmpty())
+	})
+
+	Context("OperationContainer", func() {
+		BeforeEach(func() {
+			sampleSaga = NewSaga(store, ocClient, threeSteps()...)
+		})
+
+		It("should report the saga as succeeded", func() {
+			ocClient.EXPECT().UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+				OperationId: "0",
+				Status:      oc.Status_SUCCEEDED,
+			}).Return(nil, nil)
+			asyncErr := sampleSaga.Run(ctx, req)
+			Expect(asyncErr).To(BeNil())
+		})
+
+		It("should report the saga as failed after compensating", func() {
+			failures["second"] = nonRetryErr
+			ocClient.EXPECT().UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+				OperationId: "0",
+				Status:      oc.Status_FAILED,
+			}).Return(nil, nil)
+			asyncErr := sampleSaga.Run(ctx, req)
+			Expect(asyncErr).ToNot(BeNil())
+		})
+
+		It("should report the status again if the report failed", func() {
+			ocClient.EXPECT().UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+				OperationId: "0",
+				Status:      oc.Status_SUCCEEDED,
+			}).Return(nil, errors.New("Unavailable."))
+			asyncErr := sampleSaga.Run(ctx, req)
+			Expect(asyncErr).ToNot(BeNil())
+
+			events = []string{}
+			ocClient.EXPECT().UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+				OperationId: "0",
+				Status:      oc.Status_SUCCEEDED,
+			}).Return(nil, nil)
+			asyncErr = sampleSaga.Run(ctx, req)
+			Expect(asyncErr).To(BeNil())
+			Expect(events).To(BeEmpty())
+		})
+
+		It("should report the failed status again on redelivery", func() {
+			failures["second"] = nonRetryErr
+			ocClient.EXPECT().UpdateOperationStatus(ctx, &oc.UpdateOperationStatusRequest{
+				OperationId: "0",
+				Status:      oc.Status_FAILED,
+			}).Return(nil, nil).Times(2)
+			_ = sampleSaga.Run(ctx, req)
+
+			asyncErr := sampleSaga.Run(ctx, req)
+			Expect(asyncErr).ToNot(BeNil())
+			var nonRetryError *asyncErrors.NonRetryError
+			Expect(errors.As(asyncErr, &nonRetryError)).To(BeTrue())
+		})
+	})
+
+	It("should only prune the finished sagas after the retention", func() {
+		Expect(store.SaveState(ctx, &State{OperationId: "completed", Status: StatusCompleted})).To(Succeed())
+		Expect(store.SaveState(ctx, &State{OperationId: "compensated", Status: StatusCompensated})).To(Succeed())
+		Expect(store.SaveState(ctx, &State{OperationId: "running", Status: StatusRunning})).To(Succeed())
+
+		pruned, err := store.Prune(ctx, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(0))
+
+		pruned, err = store.Prune(ctx, -time.Second)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(2))
+		state, err := store.GetState(ctx, "completed")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state).To(BeNil())
+		state, err = store.GetState(ctx, "running")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,117 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/aks-async/database"
+)
+
+var _ Store = &SqlStore{}
+
+// SqlStore keeps the state of the sagas in a SQL Server table with the following schema:
+//
+//	CREATE TABLE SagaStates (
+//		OperationId NVARCHAR(255) NOT NULL PRIMARY KEY,
+//		Status NVARCHAR(32) NOT NULL,
+//		CompletedSteps NVARCHAR(MAX) NOT NULL,
+//		CompensatedSteps NVARCHAR(MAX) NOT NULL,
+//		FailedStep NVARCHAR(255) NOT NULL,
+//		Error NVARCHAR(MAX) NOT NULL,
+//		UpdatedAt DATETIME2 NOT NULL
+//	)
+//
+// The steps are stored as JSON arrays. Update times are computed with the clock of the worker, in
+// UTC. The table name is not parametrized in the queries, so it must come from trusted
+// configuration.
+type SqlStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewSqlStore(db *sql.DB, table string) *SqlStore {
+	return &SqlStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func (s *SqlStore) GetState(ctx context.Context, operationId string) (*State, error) {
+	query := fmt.Sprintf("SELECT Status, CompletedSteps, CompensatedSteps, FailedStep, Error, UpdatedAt FROM %s WHERE OperationId = @p1", s.table)
+	rows, err := database.QueryDb(ctx, s.db, query, operationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	state := &State{OperationId: operationId}
+	var status, completedSteps, compensatedSteps string
+	err = rows.Scan(&status, &completedSteps, &compensatedSteps, &state.FailedStep, &state.Error, &state.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	state.Status = Status(status)
+
+	err = json.Unmarshal([]byte(completedSteps), &state.CompletedSteps)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(compensatedSteps), &state.CompensatedSteps)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, rows.Err()
+}
+
+func (s *SqlStore) SaveState(ctx context.Context, state *State) error {
+	completedSteps, err := marshalSteps(state.CompletedSteps)
+	if err != nil {
+		return err
+	}
+	compensatedSteps, err := marshalSteps(state.CompensatedSteps)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`MERGE %s WITH (HOLDLOCK) AS target
+USING (SELECT @p1 AS OperationId) AS source
+ON target.OperationId = source.OperationId
+WHEN MATCHED THEN UPDATE SET Status = @p2, CompletedSteps = @p3, CompensatedSteps = @p4, FailedStep = @p5, Error = @p6, UpdatedAt = @p7
+WHEN NOT MATCHED THEN INSERT (OperationId, Status, CompletedSteps, CompensatedSteps, FailedStep, Error, UpdatedAt) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7);`, s.table)
+	_, err = database.ExecDb(ctx, s.db, query, state.OperationId, string(state.Status), completedSteps, compensatedSteps, state.FailedStep, state.Error, time.Now().UTC())
+	return err
+}
+
+func (s *SqlStore) Prune(ctx context.Context, retention time.Duration) (int, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE Status IN (@p1, @p2, @p3) AND UpdatedAt < @p4", s.table)
+	result, err := database.ExecDb(ctx, s.db, query, string(StatusCompleted), string(StatusCompensated), string(StatusCompensationFailed), time.Now().UTC().Add(-retention))
+
+	var noRowsErr *database.NoRowsAffectedError
+	if errors.As(err, &noRowsErr) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	pruned, err := result.RowsAffected()
+	return int(pruned), err
+}
+
+// Steps are never stored as null, so they can always be read back as an array.
+func marshalSteps(steps []string) (string, error) {
+	if steps == nil {
+		steps = []string{}
+	}
+	marshalled, err := json.Marshal(steps)
+	return string(marshalled), err
+}
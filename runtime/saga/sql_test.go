@@ -0,0 +1,87 @@
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SqlStore", func() {
+	var (
+		ctx   context.Context
+		db    *sql.DB
+		mock  sqlmock.Sqlmock
+		store *SqlStore
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		db, mock, err = sqlmock.New()
+		Expect(err).ToNot(HaveOccurred())
+		store = NewSqlStore(db, "SagaStates")
+	})
+
+	AfterEach(func() {
+		Expect(mock.ExpectationsWereMet()).To(Succeed())
+		db.Close()
+	})
+
+	It("should return the state of the saga", func() {
+		updatedAt := time.Now().UTC()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT Status, CompletedSteps, CompensatedSteps, FailedStep, Error, UpdatedAt FROM SagaStates WHERE OperationId = @p1")).
+			WithArgs("0").
+			WillReturnRows(sqlmock.NewRows([]string{"Status", "CompletedSteps", "CompensatedSteps", "FailedStep", "Error", "UpdatedAt"}).
+				AddRow(string(StatusCompensating), `["first","second"]`, `["second"]`, "third", "boom", updatedAt))
+
+		state, err := store.GetState(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state).To(Equal(&State{
+			OperationId:      "0",
+			Status:           StatusCompensating,
+			CompletedSteps:   []string{"first", "second"},
+			CompensatedSteps: []string{"second"},
+			FailedStep:       "third",
+			Error:            "boom",
+			UpdatedAt:        updatedAt,
+		}))
+	})
+
+	It("should return nil if the saga hasn't started", func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT Status")).
+			WithArgs("0").
+			WillReturnRows(sqlmock.NewRows([]string{"Status", "CompletedSteps", "CompensatedSteps", "FailedStep", "Error", "UpdatedAt"}))
+
+		state, err := store.GetState(ctx, "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state).To(BeNil())
+	})
+
+	It("should save the state of the saga", func() {
+		mock.ExpectExec(regexp.QuoteMeta("MERGE SagaStates WITH (HOLDLOCK)")).
+			WithArgs("0", string(StatusRunning), `["first"]`, `[]`, "", "", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		Expect(store.SaveState(ctx, &State{OperationId: "0", Status: StatusRunning, CompletedSteps: []string{"first"}})).To(Succeed())
+	})
+
+	It("should prune the finished sagas", func() {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM SagaStates WHERE Status IN (@p1, @p2, @p3) AND UpdatedAt < @p4")).
+			WithArgs(string(StatusCompleted), string(StatusCompensated), string(StatusCompensationFailed), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM SagaStates")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		pruned, err := store.Prune(ctx, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(2))
+		pruned, err = store.Prune(ctx, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pruned).To(Equal(0))
+	})
+})
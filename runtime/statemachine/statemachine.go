@@ -0,0 +1,203 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/Azure/aks-middleware/grpc/server/ctxlogger"
+
+	"github.com/Azure/aks-async/runtime/entity"
+	"github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+// Transition declares the provisioning states an operation moves the entity through.
+type Transition struct {
+	// States the entity must be in for the operation to run. Empty allows any state.
+	From []entity.ProvisioningState
+	// Allows running the operation when there is no entity yet, e.g. a creation.
+	AllowMissingEntity bool
+	// State written before Run. Nothing is written if empty.
+	Transitional entity.ProvisioningState
+	// State written after Run succeeds. Nothing is written if empty.
+	Target entity.ProvisioningState
+	// State written after Run fails with an error that won't be retried. Defaults to Failed.
+	OnFailure entity.ProvisioningState
+}
+
+// StatefulOperation is an optional interface an ApiOperation can implement so the runtime
+// validates and writes the provisioning state of the entity around Run.
+type StatefulOperation interface {
+	GetTransition(context.Context) *Transition
+}
+
+// StatefulEntity is implemented by the entities that have a provisioning state. It's a subset of
+// entity.VersionedEntity.
+type StatefulEntity interface {
+	entity.Entity
+	GetProvisioningState() entity.ProvisioningState
+}
+
+// EntityWriter persists the provisioning state of the entity, typically in a database. The writer
+// should also set the latest operation id of the entity to the OperationId of the request.
+type EntityWriter interface {
+	SetProvisioningState(ctx context.Context, req *operation.OperationRequest, e entity.Entity, state entity.ProvisioningState) error
+}
+
+// EntityWriterFunc allows using a function as an EntityWriter.
+type EntityWriterFunc func(ctx context.Context, req *operation.OperationRequest, e entity.Entity, state entity.ProvisioningState) error
+
+func (f EntityWriterFunc) SetProvisioningState(ctx context.Context, req *operation.OperationRequest, e entity.Entity, state entity.ProvisioningState) error {
+	return f(ctx, req, e, state)
+}
+
+type InvalidTransitionError struct {
+	OperationName string
+	State         entity.ProvisioningState
+	Allowed       []entity.ProvisioningState
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("Operation %s can't run on an entity in state %s. Allowed states: %v.", e.OperationName, e.State, e.Allowed)
+}
+
+type MissingEntityError struct {
+	OperationName string
+}
+
+func (e *MissingEntityError) Error() string {
+	return fmt.Sprintf("Operation %s requires an entity with a provisioning state.", e.OperationName)
+}
+
+type StateMachine struct {
+	Writer EntityWriter
+}
+
+func NewStateMachine(writer EntityWriter) *StateMachine {
+	return &StateMachine{
+		Writer: writer,
+	}
+}
+
+// Runs the operation, validating the state of the entity and writing the transitional state
+// before calling run, and the target or failure state after. Operations that don't implement
+// StatefulOperation are run without any checks.
+func (sm *StateMachine) Run(ctx context.Context, req *operation.OperationRequest, op operation.ApiOperation, e entity.Entity, run func(context.Context) *errors.AsyncError) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	statefulOperation, ok := op.(StatefulOperation)
+	if !ok {
+		return run(ctx)
+	}
+
+	transition := statefulOperation.GetTransition(ctx)
+	if transition == nil {
+		return run(ctx)
+	}
+
+	asyncErr := sm.Validate(ctx, req, transition, e)
+	if asyncErr != nil {
+		return asyncErr
+	}
+
+	if transition.Transitional != "" {
+		asyncErr = sm.write(ctx, req, e, transition.Transitional)
+		if asyncErr != nil {
+			return asyncErr
+		}
+	}
+
+	runErr := run(ctx)
+	if runErr != nil {
+		// Retried operations keep the transitional state, which this operation is allowed to resume.
+		if _, ok := errors.Classify(runErr.OriginalError).(*errors.NonRetryError); !ok {
+			return runErr
+		}
+
+		failureState := transition.OnFailure
+		if failureState == "" {
+			failureState = entity.ProvisioningStateFailed
+		}
+		if writeErr := sm.write(ctx, req, e, failureState); writeErr != nil {
+			logger.Error("StateMachine: Error writing the failure state: " + writeErr.Error())
+		}
+		return runErr
+	}
+
+	if transition.Target != "" {
+		return sm.write(ctx, req, e, transition.Target)
+	}
+	return nil
+}
+
+// Validates that the operation can run on the entity. A redelivered operation is allowed to run
+// on the transitional state it has written itself, and is retried while another operation holds
+// the entity in a transitional state.
+func (sm *StateMachine) Validate(ctx context.Context, req *operation.OperationRequest, transition *Transition, e entity.Entity) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	statefulEntity, ok := e.(StatefulEntity)
+	if !ok {
+		if transition.AllowMissingEntity || len(transition.From) == 0 {
+			return nil
+		}
+		err := &MissingEntityError{OperationName: req.GetOperationName()}
+		logger.Error("StateMachine: " + err.Error())
+		return &errors.AsyncError{
+			OriginalError: &errors.NonRetryError{Message: "Missing entity state."},
+			Message:       err.Error(),
+			ErrorCode:     500,
+		}
+	}
+
+	state := statefulEntity.GetProvisioningState()
+	if len(transition.From) == 0 || slices.Contains(transition.From, state) {
+		return nil
+	}
+	if state == transition.Transitional && statefulEntity.GetLatestOperationID() == req.GetOperationId() {
+		return nil
+	}
+	if state.IsTransitional() && statefulEntity.GetLatestOperationID() != req.GetOperationId() {
+		errorMessage := fmt.Sprintf("Entity is in transitional state %s by operation %s.", state, statefulEntity.GetLatestOperationID())
+		logger.Info("StateMachine: " + errorMessage)
+		return &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Entity is in a transitional state."},
+			Message:       errorMessage,
+			ErrorCode:     409,
+			RetryAfter:    operation.DefaultTransitionalRetryAfter,
+		}
+	}
+
+	err := &InvalidTransitionError{
+		OperationName: req.GetOperationName(),
+		State:         state,
+		Allowed:       transition.From,
+	}
+	logger.Error("StateMachine: " + err.Error())
+	return &errors.AsyncError{
+		OriginalError: &errors.NonRetryError{Message: "Invalid state transition."},
+		Message:       err.Error(),
+		ErrorCode:     409,
+	}
+}
+
+func (sm *StateMachine) write(ctx context.Context, req *operation.OperationRequest, e entity.Entity, state entity.ProvisioningState) *errors.AsyncError {
+	logger := ctxlogger.GetLogger(ctx)
+
+	if sm.Writer == nil {
+		return nil
+	}
+
+	logger.Info(fmt.Sprintf("StateMachine: Setting provisioning state to %s.", state))
+	err := sm.Writer.SetProvisioningState(ctx, req, e, state)
+	if err != nil {
+		logger.Error("StateMachine: Error setting provisioning state: " + err.Error())
+		return &errors.AsyncError{
+			OriginalError: &errors.RetryError{Message: "Error setting provisioning state."},
+			Message:       err.Error(),
+			ErrorCode:     500,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package statemachine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/aks-async/runtime/entity"
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+	sampleOperation "github.com/Azure/aks-async/runtime/testutils/operation"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestStateMachine(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "StateMachine Suite")
+}
+
+var _ = Describe("StateMachine", func() {
+	var (
+		ctx     context.Context
+		req     *operation.OperationRequest
+		op      *testStatefulOperation
+		e       *testEntity
+		written []entity.ProvisioningState
+		sm      *StateMachine
+		ran     bool
+		runErr  *asyncErrors.AsyncError
+		run     func(context.Context) *asyncErrors.AsyncError
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		req = &operation.OperationRequest{OperationId: "1", OperationName: "Update"}
+		op = &testStatefulOperation{transition: &Transition{
+			From:         []entity.ProvisioningState{entity.ProvisioningStateSucceeded, entity.ProvisioningStateFailed},
+			Transitional: entity.ProvisioningStateUpdating,
+			Target:       entity.ProvisioningStateSucceeded,
+		}}
+		e = &testEntity{latestOperationId: "0", state: entity.ProvisioningStateSucceeded}
+		written = []entity.ProvisioningState{}
+		sm = NewStateMachine(EntityWriterFunc(func(ctx context.Context, req *operation.OperationRequest, e entity.Entity, state entity.ProvisioningState) error {
+			written = append(written, state)
+			return nil
+		}))
+		ran = false
+		runErr = nil
+		run = func(ctx context.Context) *asyncErrors.AsyncError {
+			ran = true
+			return runErr
+		}
+	})
+
+	It("should write the transitional and target states", func() {
+		Expect(sm.Run(ctx, req, op, e, run)).To(BeNil())
+		Expect(ran).To(BeTrue())
+		Expect(written).To(Equal([]entity.ProvisioningState{entity.ProvisioningStateUpdating, entity.ProvisioningStateSucceeded}))
+	})
+
+	It("should not run the operation from an invalid state", func() {
+		e.state = entity.ProvisioningStateCanceled
+		asyncErr := sm.Run(ctx, req, op, e, run)
+		Expect(asyncErr).ToNot(BeNil())
+		var nonRetryErr *asyncErrors.NonRetryError
+		Expect(errors.As(asyncErr, &nonRetryErr)).To(BeTrue())
+		Expect(asyncErr.Message).To(ContainSubstring("Canceled"))
+		Expect(ran).To(BeFalse())
+		Expect(written).To(BeEmpty())
+	})
+
+	It("should retry while another operation holds the entity in a transitional state", func() {
+		e.state = entity.ProvisioningStateDeleting
+		asyncErr := sm.Run(ctx, req, op, e, run)
+		Expect(asyncErr).ToNot(BeNil())
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+		Expect(asyncErr.Message).To(ContainSubstring("Deleting"))
+		Expect(ran).To(BeFalse())
+		Expect(written).To(BeEmpty())
+	})
+
+	It("should resume from its own transitional state", func() {
+		e.state = entity.ProvisioningStateUpdating
+		e.latestOperationId = "1"
+		Expect(sm.Run(ctx, req, op, e, run)).To(BeNil())
+		Expect(ran).To(BeTrue())
+	})
+
+	It("should write the failure state if the operation won't be retried", func() {
+		runErr = &asyncErrors.AsyncError{OriginalError: &asyncErrors.NonRetryError{Message: "bad request"}}
+		Expect(sm.Run(ctx, req, op, e, run)).To(Equal(runErr))
+		Expect(written).To(Equal([]entity.ProvisioningState{entity.ProvisioningStateUpdating, entity.ProvisioningStateFailed}))
+	})
+
+	It("should write the failure state if a joined error won't be retried", func() {
+		runErr = asyncErrors.Join(
+			&asyncErrors.AsyncError{OriginalError: &asyncErrors.RetryError{Message: "timeout"}},
+			&asyncErrors.AsyncError{OriginalError: &asyncErrors.NonRetryError{Message: "bad request"}},
+		)
+		Expect(sm.Run(ctx, req, op, e, run)).To(Equal(runErr))
+		Expect(written).To(Equal([]entity.ProvisioningState{entity.ProvisioningStateUpdating, entity.ProvisioningStateFailed}))
+	})
+
+	It("should keep the transitional state if the operation will be retried", func() {
+		runErr = &asyncErrors.AsyncError{OriginalError: &asyncErrors.RetryError{Message: "timeout"}}
+		Expect(sm.Run(ctx, req, op, e, run)).To(Equal(runErr))
+		Expect(written).To(Equal([]entity.ProvisioningState{entity.ProvisioningStateUpdating}))
+	})
+
+	It("should retry if writing the state fails", func() {
+		sm.Writer = EntityWriterFunc(func(ctx context.Context, req *operation.OperationRequest, e entity.Entity, state entity.ProvisioningState) error {
+			return errors.New("database unavailable")
+		})
+		asyncErr := sm.Run(ctx, req, op, e, run)
+		var retryErr *asyncErrors.RetryError
+		Expect(errors.As(asyncErr, &retryErr)).To(BeTrue())
+		Expect(ran).To(BeFalse())
+	})
+
+	It("should require an entity unless allowed", func() {
+		Expect(sm.Run(ctx, req, op, nil, run)).ToNot(BeNil())
+
+		op.transition.AllowMissingEntity = true
+		Expect(sm.Run(ctx, req, op, nil, run)).To(BeNil())
+	})
+
+	It("should run operations without a transition", func() {
+		Expect(sm.Run(ctx, req, &sampleOperation.SampleOperation{}, e, run)).To(BeNil())
+		Expect(ran).To(BeTrue())
+		Expect(written).To(BeEmpty())
+	})
+})
+
+type testStatefulOperation struct {
+	sampleOperation.SampleOperation
+	transition *Transition
+}
+
+func (o *testStatefulOperation) GetTransition(ctx context.Context) *Transition {
+	return o.transition
+}
+
+type testEntity struct {
+	latestOperationId string
+	state             entity.ProvisioningState
+}
+
+func (e *testEntity) GetLatestOperationID() string {
+	return e.latestOperationId
+}
+
+func (e *testEntity) GetProvisioningState() entity.ProvisioningState {
+	return e.state
+}
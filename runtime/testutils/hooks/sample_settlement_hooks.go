@@ -0,0 +1,41 @@
+package hooks
+
+import (
+	"context"
+
+	oc "github.com/Azure/OperationContainer/api/v1"
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/hooks"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+var _ hooks.SettlementHooks = &SampleSettlementHooks{}
+
+// SampleSettlementHooks records the name of each hook called, in order.
+type SampleSettlementHooks struct {
+	Calls []string
+}
+
+func (h *SampleSettlementHooks) BeforeSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action hooks.SettleAction) {
+	h.Calls = append(h.Calls, "BeforeSettle:"+string(action))
+}
+
+func (h *SampleSettlementHooks) AfterSettle(ctx context.Context, message *azservicebus.ReceivedMessage, action hooks.SettleAction, err error) {
+	if err != nil {
+		h.Calls = append(h.Calls, "AfterSettle:"+string(action)+":error")
+		return
+	}
+	h.Calls = append(h.Calls, "AfterSettle:"+string(action))
+}
+
+func (h *SampleSettlementHooks) OnRetryScheduled(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *asyncErrors.AsyncError) {
+	h.Calls = append(h.Calls, "OnRetryScheduled")
+}
+
+func (h *SampleSettlementHooks) OnDeadLetter(ctx context.Context, message *azservicebus.ReceivedMessage, asyncErr *asyncErrors.AsyncError) {
+	h.Calls = append(h.Calls, "OnDeadLetter")
+}
+
+func (h *SampleSettlementHooks) OnTerminal(ctx context.Context, operationId string, status oc.Status, asyncErr *asyncErrors.AsyncError) {
+	h.Calls = append(h.Calls, "OnTerminal:"+status.String())
+}
@@ -0,0 +1,24 @@
+package operation
+
+import (
+	"context"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+var _ operation.ContinuationOperation = &SampleContinuationOperation{}
+
+// SampleContinuationOperation is a SampleOperation that continues with another SampleOperation.
+type SampleContinuationOperation struct {
+	SampleOperation
+}
+
+func (l *SampleContinuationOperation) GetContinuations(ctx context.Context) ([]*operation.OperationRequest, *asyncErrors.AsyncError) {
+	return []*operation.OperationRequest{
+		{
+			OperationName: "SampleOperation",
+			OperationId:   l.opReq.OperationId + "-next",
+		},
+	}, nil
+}
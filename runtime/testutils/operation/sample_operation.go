@@ -37,6 +37,9 @@ func (l *SampleOperation) Run(ctx context.Context) *asyncErrors.AsyncError {
 	if l.opReq.OperationId == "3" {
 		return &asyncErrors.AsyncError{OriginalError: errors.New("Incorrect OperationId")}
 	}
+	if l.opReq.OperationId == "4" {
+		return &asyncErrors.AsyncError{OriginalError: &asyncErrors.NonRetryError{Message: "Invalid OperationId"}}
+	}
 	return nil
 }
 
@@ -0,0 +1,22 @@
+package operation
+
+import (
+	"context"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+	"github.com/Azure/aks-async/runtime/progress"
+)
+
+var _ operation.ApiOperation = &SampleProgressOperation{}
+
+// SampleProgressOperation is a SampleOperation that reports its progress while running.
+type SampleProgressOperation struct {
+	SampleOperation
+}
+
+func (l *SampleProgressOperation) Run(ctx context.Context) *asyncErrors.AsyncError {
+	_ = progress.ReportProgress(ctx, 50, "Halfway there.")
+	_ = progress.ReportProgress(ctx, 100, "Done.")
+	return l.SampleOperation.Run(ctx)
+}
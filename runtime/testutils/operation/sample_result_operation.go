@@ -0,0 +1,23 @@
+package operation
+
+import (
+	"context"
+
+	asyncErrors "github.com/Azure/aks-async/runtime/errors"
+	"github.com/Azure/aks-async/runtime/operation"
+)
+
+var _ operation.ResultOperation = &SampleResultOperation{}
+
+// SampleResultOperation is a SampleOperation that also publishes a result.
+type SampleResultOperation struct {
+	SampleOperation
+}
+
+func (l *SampleResultOperation) GetResult(ctx context.Context) (*operation.OperationResult, *asyncErrors.AsyncError) {
+	return &operation.OperationResult{
+		OperationId: l.opReq.OperationId,
+		Body:        []byte("result"),
+		ContentType: "text/plain",
+	}, nil
+}